@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Signed, short-lived access tokens (JWTs) issued alongside the session
+// token when ACCESS_TOKEN_ALG is set. Services behind the API can check
+// them without a database lookup; the session token works as the refresh
+// token, so revoking a session stops refreshes, though access tokens
+// already issued stay valid until they expire (ACCESS_TOKEN_TTL, 15
+// minutes by default).
+var accessTokens struct {
+	alg        string
+	secret     []byte
+	privateKey *rsa.PrivateKey
+	publicKey  *rsa.PublicKey
+	issuer     string
+	ttl        time.Duration
+}
+
+const (
+	defaultAccessTokenTTL = 15 * time.Minute
+	maxAccessTokenTTL     = time.Hour
+)
+
+// Claims in an access token
+type accessClaims struct {
+	Subject   int    `json:"sub"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
+	Issuer    string `json:"iss"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func accessTokensEnabled() bool {
+	return accessTokens.alg != ""
+}
+
+// Read access token settings, refusing to start with an unusable setup
+func loadAccessTokens() {
+	alg := os.Getenv("ACCESS_TOKEN_ALG")
+	switch alg {
+	case "":
+		return
+	case "HS256":
+		secret := os.Getenv("ACCESS_TOKEN_SECRET")
+		if len(secret) < 32 {
+			log.Fatal("ACCESS_TOKEN_ALG=HS256 requires ACCESS_TOKEN_SECRET of at least 32 bytes")
+		}
+		accessTokens.secret = []byte(secret)
+	case "RS256":
+		file := os.Getenv("ACCESS_TOKEN_PRIVATE_KEY_FILE")
+		if file == "" {
+			log.Fatal("ACCESS_TOKEN_ALG=RS256 requires ACCESS_TOKEN_PRIVATE_KEY_FILE")
+		}
+		key, err := loadRSAPrivateKey(file)
+		if err != nil {
+			log.Fatal("Failed to load ACCESS_TOKEN_PRIVATE_KEY_FILE:", err)
+		}
+		accessTokens.privateKey = key
+		accessTokens.publicKey = &key.PublicKey
+	default:
+		log.Fatalf("Unknown ACCESS_TOKEN_ALG %q (expected HS256 or RS256)", alg)
+	}
+	accessTokens.alg = alg
+
+	accessTokens.issuer = os.Getenv("ACCESS_TOKEN_ISSUER")
+	if accessTokens.issuer == "" {
+		accessTokens.issuer = "sts"
+	}
+	accessTokens.ttl = defaultAccessTokenTTL
+	if v := os.Getenv("ACCESS_TOKEN_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < time.Minute || ttl > maxAccessTokenTTL {
+			log.Fatal("ACCESS_TOKEN_TTL must be a duration between 1m and 1h")
+		}
+		accessTokens.ttl = ttl
+	}
+
+	log.Printf("✓ Access tokens enabled (%s, valid for %s)", alg, accessTokens.ttl)
+}
+
+// PKCS#1 or PKCS#8 RSA private key from a PEM file
+func loadRSAPrivateKey(file string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+// Whether token has the shape of a JWT rather than a session token
+func isAccessToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func signAccessToken(signingInput string) ([]byte, error) {
+	digest := sha256.Sum256([]byte(signingInput))
+	if accessTokens.alg == "RS256" {
+		return rsa.SignPKCS1v15(rand.Reader, accessTokens.privateKey, crypto.SHA256, digest[:])
+	}
+	mac := hmac.New(sha256.New, accessTokens.secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil), nil
+}
+
+// Access token for a session, and when it expires
+func issueAccessToken(user User, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(accessTokens.ttl)
+
+	header, _ := json.Marshal(map[string]string{"alg": accessTokens.alg, "typ": "JWT"})
+	claims, _ := json.Marshal(accessClaims{
+		Subject:   user.ID,
+		Email:     user.Email,
+		Role:      user.UserType,
+		SessionID: sessionID,
+		Issuer:    accessTokens.issuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	})
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sig, err := signAccessToken(input)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), expires.UTC(), nil
+}
+
+// Check an access token's signature, issuer and expiry and return the
+// caller it names
+func verifyAccessToken(token string) (User, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return User{}, "", errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return User{}, "", errors.New("malformed token header")
+	}
+	// Only ever the configured algorithm, so an RS256 public key can't be
+	// passed off as an HS256 secret
+	if header.Alg != accessTokens.alg {
+		return User{}, "", fmt.Errorf("unexpected token algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return User{}, "", errors.New("malformed token signature")
+	}
+
+	input := parts[0] + "." + parts[1]
+	if accessTokens.alg == "RS256" {
+		digest := sha256.Sum256([]byte(input))
+		if rsa.VerifyPKCS1v15(accessTokens.publicKey, crypto.SHA256, digest[:], sig) != nil {
+			return User{}, "", errors.New("invalid token signature")
+		}
+	} else {
+		want, _ := signAccessToken(input)
+		if !hmac.Equal(sig, want) {
+			return User{}, "", errors.New("invalid token signature")
+		}
+	}
+
+	var claims accessClaims
+	raw, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		return User{}, "", errors.New("malformed token claims")
+	}
+	if claims.Issuer != accessTokens.issuer {
+		return User{}, "", errors.New("unexpected token issuer")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return User{}, "", errors.New("token expired")
+	}
+	return User{ID: claims.Subject, Email: claims.Email, UserType: claims.Role}, claims.SessionID, nil
+}
+
+// Add an access token to a login response, when they're enabled
+func attachAccessToken(user *User, sessionID string) error {
+	if !accessTokensEnabled() {
+		return nil
+	}
+	token, expires, err := issueAccessToken(*user, sessionID)
+	if err != nil {
+		return err
+	}
+	user.AccessToken = token
+	user.AccessTokenExpiresAt = &expires
+	return nil
+}
+
+// POST /token/refresh: a new access token for the session in the
+// Authorization header or cookie. Takes the session token, not an access
+// token, so it fails once the session is revoked and picks up role
+// changes.
+func handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !accessTokensEnabled() {
+		http.Error(w, "Access tokens are not enabled", http.StatusNotFound)
+		return
+	}
+
+	token := sessionToken(r)
+	if token == "" || isAccessToken(token) {
+		http.Error(w, "Refresh with the session token", http.StatusUnauthorized)
+		return
+	}
+	user, sessionID, err := lookupSession(token, r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	access, expires, err := issueAccessToken(user, sessionID)
+	if err != nil {
+		log.Printf("Error issuing access token for %s: %v", user.Email, err)
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": access,
+		"expires_at":   expires,
+		"expires_in":   int(time.Until(expires).Seconds()),
+	})
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Announcement struct {
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	Body        string     `json:"body"`
+	Author      string     `json:"author"`
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// Create announcements table
+func createAnnouncementsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS announcements (
+			id SERIAL PRIMARY KEY,
+			title VARCHAR(200) NOT NULL,
+			body TEXT NOT NULL,
+			author VARCHAR(255) NOT NULL,
+			published_at TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS announcements_published_idx ON announcements (published_at) WHERE published_at IS NOT NULL
+	`)
+	if err != nil {
+		log.Fatal("Failed to create announcements table:", err)
+	}
+}
+
+// Base URL customers reach the portal at, for absolute links in feeds
+func publicBaseURL() string {
+	return strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
+}
+
+// Admin: list, create, update or delete announcements
+func handleAnnouncements(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/announcements"), "/")
+
+	// Body of POST and PUT; published toggles published_at
+	var req struct {
+		Title     string `json:"title"`
+		Body      string `json:"body"`
+		Published bool   `json:"published"`
+	}
+
+	switch {
+	case idPart == "" && r.Method == "GET":
+		announcements, err := listAnnouncements(false, 0)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(announcements)
+
+	case idPart == "" && r.Method == "POST":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if req.Title == "" || req.Body == "" {
+			http.Error(w, "Title and body are required", http.StatusBadRequest)
+			return
+		}
+
+		a := Announcement{Title: req.Title, Body: req.Body, Author: user.Email}
+		err := db.QueryRow(`
+			INSERT INTO announcements (title, body, author, published_at) 
+			VALUES ($1, $2, $3, CASE WHEN $4 THEN CURRENT_TIMESTAMP END) 
+			RETURNING id, published_at, updated_at
+		`, a.Title, a.Body, a.Author, req.Published).Scan(&a.ID, &a.PublishedAt, &a.UpdatedAt)
+		if err != nil {
+			http.Error(w, "Failed to create announcement", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ Announcement #%d created by %s", a.ID, user.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+
+	case idPart != "" && r.Method == "PUT":
+		id, err := strconv.Atoi(idPart)
+		if err != nil {
+			http.Error(w, "Invalid announcement ID", http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if req.Title == "" || req.Body == "" {
+			http.Error(w, "Title and body are required", http.StatusBadRequest)
+			return
+		}
+
+		// Republishing keeps the original publication date
+		a := Announcement{ID: id, Title: req.Title, Body: req.Body}
+		err = db.QueryRow(`
+			UPDATE announcements SET title = $1, body = $2, updated_at = CURRENT_TIMESTAMP, 
+				published_at = CASE WHEN $3 THEN COALESCE(published_at, CURRENT_TIMESTAMP) END 
+			WHERE id = $4 
+			RETURNING author, published_at, updated_at
+		`, a.Title, a.Body, req.Published, id).Scan(&a.Author, &a.PublishedAt, &a.UpdatedAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Announcement not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to update announcement", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+
+	case idPart != "" && r.Method == "DELETE":
+		id, err := strconv.Atoi(idPart)
+		if err != nil {
+			http.Error(w, "Invalid announcement ID", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec("DELETE FROM announcements WHERE id = $1", id)
+		if err != nil {
+			http.Error(w, "Failed to delete announcement", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Announcement not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Announcement deleted"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Announcements, newest first; limit 0 means all
+func listAnnouncements(publishedOnly bool, limit int) ([]Announcement, error) {
+	query := "SELECT id, title, body, author, published_at, updated_at FROM announcements"
+	if publishedOnly {
+		query += " WHERE published_at IS NOT NULL"
+	}
+	query += " ORDER BY COALESCE(published_at, updated_at) DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	announcements := []Announcement{}
+	for rows.Next() {
+		var a Announcement
+		if err := rows.Scan(&a.ID, &a.Title, &a.Body, &a.Author, &a.PublishedAt, &a.UpdatedAt); err != nil {
+			continue
+		}
+		announcements = append(announcements, a)
+	}
+	return announcements, rows.Err()
+}
+
+// Public: published announcements as JSON
+func handlePublicAnnouncements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	announcements, err := listAnnouncements(true, 50)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(announcements)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Author    atomAuthor `xml:"author"`
+	Content   atomText   `xml:"content"`
+	Links     []atomLink `xml:"link"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// Public: GET /announcements.atom
+func handleAnnouncementsFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	announcements, err := listAnnouncements(true, 50)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	base := publicBaseURL()
+	feed := atomFeed{
+		Title:   "Support announcements",
+		ID:      "urn:sts:announcements",
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+	}
+	if base != "" {
+		feed.Links = []atomLink{{Href: base + "/announcements.atom", Rel: "self"}, {Href: base + "/"}}
+	}
+
+	for _, a := range announcements {
+		entry := atomEntry{
+			Title:     a.Title,
+			ID:        fmt.Sprintf("urn:sts:announcement:%d", a.ID),
+			Published: a.PublishedAt.UTC().Format(time.RFC3339),
+			Updated:   a.UpdatedAt.UTC().Format(time.RFC3339),
+			Author:    atomAuthor{Name: "Support team"},
+			Content:   atomText{Type: "text", Body: a.Body},
+		}
+		if base != "" {
+			entry.Links = []atomLink{{Href: fmt.Sprintf("%s/#announcement-%d", base, a.ID)}}
+		}
+		if entry.Updated > feed.Updated {
+			feed.Updated = entry.Updated
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		log.Printf("Error writing announcements feed: %v", err)
+	}
+}
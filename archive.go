@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/lib/pq"
+)
+
+// Hot tables moved to archived_* copies when a ticket is archived, in
+// restore (foreign key) order, with the column linking rows to the ticket
+var archivedTables = []struct {
+	name string
+	key  string
+}{
+	{"tickets", "id"},
+	{"messages", "ticket_id"},
+	{"attachments", "ticket_id"},
+	{"ticket_field_values", "ticket_id"},
+	{"ticket_tags", "ticket_id"},
+	{"ticket_assets", "ticket_id"},
+	{"time_entries", "ticket_id"},
+	{"ticket_handoffs", "ticket_id"},
+	{"ticket_charges", "ticket_id"},
+	{"ticket_entitlements", "ticket_id"},
+	{"change_windows", "ticket_id"},
+	{"ticket_tasks", "ticket_id"},
+	{"ticket_status_history", "ticket_id"},
+}
+
+// Tickets archived per job run, so one run doesn't hold locks for long
+const archiveBatchSize = 500
+
+// Months after closing before a ticket is archived (ARCHIVE_AFTER_MONTHS);
+// 0 disables archival
+func archiveAfterMonths() int {
+	n, _ := strconv.Atoi(os.Getenv("ARCHIVE_AFTER_MONTHS"))
+	return n
+}
+
+// S3 storage class for archived attachments (ARCHIVE_STORAGE_CLASS).
+// Glacier Instant Retrieval by default, so attachments of archived
+// tickets can still be downloaded once unarchived without a restore.
+func archiveStorageClass() string {
+	if class := os.Getenv("ARCHIVE_STORAGE_CLASS"); class != "" {
+		return class
+	}
+	return s3.StorageClassGlacierIr
+}
+
+// Create archive tables mirroring the hot tables. Runs after all other
+// migrations so columns added to hot tables are added here too.
+func createArchiveTables() {
+	for _, t := range archivedTables {
+		_, err := db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS archived_%[1]s (LIKE %[1]s);
+			CREATE INDEX IF NOT EXISTS archived_%[1]s_%[2]s_idx ON archived_%[1]s (%[2]s)
+		`, t.name, t.key))
+		if err != nil {
+			log.Fatal("Failed to create archive tables:", err)
+		}
+
+		if err := syncArchiveColumns(t.name); err != nil {
+			log.Fatal("Failed to migrate archive tables:", err)
+		}
+	}
+}
+
+// Column names and types of a table, in table order. Generated columns
+// (search vectors) are left out: they can't be written and are derived
+// again wherever the row lands.
+func tableColumns(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, table string) ([][2]string, error) {
+	rows, err := q.Query(`
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod) 
+		FROM pg_attribute a 
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped AND a.attgenerated = '' 
+		ORDER BY a.attnum
+	`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cols [][2]string
+	for rows.Next() {
+		var c [2]string
+		if err := rows.Scan(&c[0], &c[1]); err != nil {
+			return nil, err
+		}
+		cols = append(cols, c)
+	}
+	return cols, rows.Err()
+}
+
+// Quoted, comma-separated writable columns of a table
+func columnList(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, table string) (string, error) {
+	cols, err := tableColumns(q, table)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = pq.QuoteIdentifier(c[0])
+	}
+	return strings.Join(names, ", "), nil
+}
+
+// Add columns present on the hot table but missing from its archive copy
+func syncArchiveColumns(table string) error {
+	hot, err := tableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	archived, err := tableColumns(db, "archived_"+table)
+	if err != nil {
+		return err
+	}
+
+	have := map[string]bool{}
+	for _, c := range archived {
+		have[c[0]] = true
+	}
+	for _, c := range hot {
+		if have[c[0]] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE archived_%s ADD COLUMN %s %s", table, pq.QuoteIdentifier(c[0]), c[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy rows for the given tickets from one set of tables to the other
+// and delete them from the source. toArchive selects the direction.
+func moveTicketRows(tx *sql.Tx, ids []int, toArchive bool) error {
+	for _, t := range archivedTables {
+		list, err := columnList(tx, t.name)
+		if err != nil {
+			return err
+		}
+
+		from, to := t.name, "archived_"+t.name
+		if !toArchive {
+			from, to = to, from
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE %s = ANY($1)", to, list, list, from, t.key)
+		if _, err := tx.Exec(query, pq.Array(ids)); err != nil {
+			return fmt.Errorf("%s: %w", t.name, err)
+		}
+	}
+
+	// Child rows in the hot tables go with the ticket via ON DELETE
+	// CASCADE; archive tables have no foreign keys, so clear each one
+	if toArchive {
+		_, err := tx.Exec("DELETE FROM tickets WHERE id = ANY($1)", pq.Array(ids))
+		return err
+	}
+	for _, t := range archivedTables {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM archived_%s WHERE %s = ANY($1)", t.name, t.key), pq.Array(ids)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attachment keys for tickets, read from the tickets' current location
+func attachmentKeys(tx *sql.Tx, table string, ids []int) ([]string, error) {
+	rows, err := tx.Query("SELECT s3_key FROM "+table+" WHERE ticket_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Job: move tickets closed more than ARCHIVE_AFTER_MONTHS ago into the
+// archive tables and their attachments to cold storage
+func archiveClosedTickets() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id FROM tickets 
+		WHERE status = 'closed' AND COALESCE(closed_at, created_at) < CURRENT_TIMESTAMP - $1 * INTERVAL '1 month' 
+		ORDER BY id LIMIT $2 
+		FOR UPDATE
+	`, archiveAfterMonths(), archiveBatchSize)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	keys, err := attachmentKeys(tx, "attachments", ids)
+	if err != nil {
+		return err
+	}
+	if err := moveTicketRows(tx, ids, true); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("✓ Archived %d closed tickets", len(ids))
+	setStorageClass(keys, archiveStorageClass())
+	return nil
+}
+
+// Move attachment objects to another storage class by copying each
+// object onto itself. Best effort: failures are logged.
+func setStorageClass(keys []string, class string) {
+	if !attachmentsEnabled || len(keys) == 0 {
+		return
+	}
+	for _, key := range keys {
+		client, bucket := storageFor(key)
+		if client == nil {
+			log.Printf("Failed to move %s to %s: storage location not configured", key, class)
+			continue
+		}
+		_, err := client.CopyObject(&s3.CopyObjectInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(key),
+			CopySource:        aws.String(bucket + "/" + url.PathEscape(key)),
+			StorageClass:      aws.String(class),
+			MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeInvalidObjectState {
+			// Flexible Retrieval and Deep Archive objects must be restored
+			// before they can be copied back
+			requestRestore(client, bucket, key)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to move %s to %s: %v", key, class, err)
+		}
+	}
+}
+
+func requestRestore(client *s3.S3, bucket, key string) {
+	_, err := client.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(7),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(s3.TierStandard)},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to request restore of %s: %v", key, err)
+		return
+	}
+	log.Printf("Restore requested for archived attachment %s", key)
+}
+
+// ID of an archived ticket by reference
+func archivedTicketIDByReference(ref string) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM archived_tickets WHERE reference = $1", ref).Scan(&id)
+	return id, err
+}
+
+// POST /tickets/{id}/unarchive: bring an archived ticket back into the
+// hot tables. Anyone who could read the ticket may restore it.
+func unarchiveTicket(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !fullFeatured() {
+		http.Error(w, "Archival requires PostgreSQL", http.StatusNotImplemented)
+		return
+	}
+
+	user := currentUser(r)
+	ticket, err := scanTicket(db.QueryRow("SELECT "+ticketColumns+" FROM archived_tickets WHERE id = $1", ticketID))
+	if err == sql.ErrNoRows || (err == nil && !authorize(user, actionTicketRead, &ticket)) {
+		http.Error(w, "Archived ticket not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	keys, err := attachmentKeys(tx, "archived_attachments", []int{ticketID})
+	if err == nil {
+		err = moveTicketRows(tx, []int{ticketID}, false)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error unarchiving ticket #%d: %v", ticketID, err)
+		http.Error(w, "Failed to unarchive ticket", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Ticket #%d unarchived by %s", ticketID, user.Email)
+	go setStorageClass(keys, s3.StorageClassStandard)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Ticket unarchived", "reference": ticket.Reference})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A device tickets can be about. Staff manage the registry; owners can
+// see their own devices and the tickets about them.
+type Asset struct {
+	ID           int           `json:"id"`
+	SerialNumber string        `json:"serial_number"`
+	Model        string        `json:"model"`
+	OwnerEmail   string        `json:"owner_email"`
+	CreatedAt    time.Time     `json:"created_at"`
+	Tickets      []AssetTicket `json:"tickets,omitempty"`
+}
+
+// Asset as shown on a ticket
+type AssetRef struct {
+	ID           int    `json:"id"`
+	SerialNumber string `json:"serial_number"`
+	Model        string `json:"model"`
+}
+
+// A ticket in an asset's history, archived ones included
+type AssetTicket struct {
+	ID        int       `json:"id"`
+	Reference string    `json:"reference"`
+	Subject   string    `json:"subject"`
+	Status    string    `json:"status"`
+	Archived  bool      `json:"archived,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Create asset registry tables
+func createAssetTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS assets (
+			id SERIAL PRIMARY KEY,
+			serial_number VARCHAR(100) UNIQUE NOT NULL,
+			model VARCHAR(200) NOT NULL,
+			owner_email VARCHAR(255) NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS assets_owner_idx ON assets (lower(owner_email));
+		CREATE TABLE IF NOT EXISTS ticket_assets (
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			asset_id INTEGER REFERENCES assets(id) ON DELETE CASCADE,
+			PRIMARY KEY (ticket_id, asset_id)
+		);
+		CREATE INDEX IF NOT EXISTS ticket_assets_asset_idx ON ticket_assets (asset_id)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create asset tables:", err)
+	}
+}
+
+func (a *Asset) validate() error {
+	a.SerialNumber = strings.TrimSpace(a.SerialNumber)
+	a.Model = strings.TrimSpace(a.Model)
+	a.OwnerEmail = strings.ToLower(strings.TrimSpace(a.OwnerEmail))
+	switch {
+	case a.SerialNumber == "" || len(a.SerialNumber) > 100:
+		return newServiceError(errInvalid, "serial_number must be 1-100 characters")
+	case a.Model == "" || len(a.Model) > 200:
+		return newServiceError(errInvalid, "model must be 1-200 characters")
+	case len(a.OwnerEmail) > 255:
+		return newServiceError(errInvalid, "owner_email is too long")
+	}
+	return nil
+}
+
+// Assets linked to each of the given tickets
+func ticketAssets(ids []int) (map[int][]AssetRef, error) {
+	rows, err := db.Query(`
+		SELECT ta.ticket_id, a.id, a.serial_number, a.model
+		FROM ticket_assets ta JOIN assets a ON a.id = ta.asset_id
+		WHERE ta.ticket_id = ANY($1)
+		ORDER BY a.serial_number
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := map[int][]AssetRef{}
+	for rows.Next() {
+		var ticketID int
+		var a AssetRef
+		if err := rows.Scan(&ticketID, &a.ID, &a.SerialNumber, &a.Model); err != nil {
+			return nil, err
+		}
+		assets[ticketID] = append(assets[ticketID], a)
+	}
+	return assets, rows.Err()
+}
+
+// Tickets about an asset that user can see, newest first
+func assetHistory(user User, assetID int) ([]AssetTicket, error) {
+	args := []interface{}{assetID}
+	predicate, args := ticketAccessPredicate(user, args)
+
+	rows, err := db.Query(`
+		SELECT id, reference, subject, status, FALSE, created_at FROM tickets
+		WHERE id IN (SELECT ticket_id FROM ticket_assets WHERE asset_id = $1)`+predicate+`
+		UNION ALL
+		SELECT id, reference, subject, status, TRUE, created_at FROM archived_tickets
+		WHERE id IN (SELECT ticket_id FROM archived_ticket_assets WHERE asset_id = $1)`+predicate+`
+		ORDER BY created_at DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tickets := []AssetTicket{}
+	for rows.Next() {
+		var t AssetTicket
+		var reference sql.NullString
+		if err := rows.Scan(&t.ID, &reference, &t.Subject, &t.Status, &t.Archived, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.Reference = reference.String
+		tickets = append(tickets, t)
+	}
+	return tickets, rows.Err()
+}
+
+func scanAsset(row interface{ Scan(...interface{}) error }) (Asset, error) {
+	var a Asset
+	err := row.Scan(&a.ID, &a.SerialNumber, &a.Model, &a.OwnerEmail, &a.CreatedAt)
+	return a, err
+}
+
+// GET/POST /assets, GET/PUT/DELETE /assets/{id}. GET /assets takes
+// ?owner= and ?serial= filters; clients only ever see their own assets.
+func handleAssets(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	staff := authorize(user, permTicketsReplyAll, nil)
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/assets"), "/")
+
+	if idPart == "" {
+		switch r.Method {
+		case "GET":
+			listAssets(w, r, user, staff)
+		case "POST":
+			if !staff {
+				http.Error(w, "Permission denied", http.StatusForbidden)
+				return
+			}
+			saveAsset(w, r, user, 0)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(idPart)
+	if err != nil {
+		http.Error(w, "Invalid asset ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		a, err := scanAsset(db.QueryRow("SELECT id, serial_number, model, owner_email, created_at FROM assets WHERE id = $1", id))
+		if err != nil || (!staff && !strings.EqualFold(a.OwnerEmail, user.Email)) {
+			http.Error(w, "Asset not found", http.StatusNotFound)
+			return
+		}
+		if a.Tickets, err = assetHistory(user, id); err != nil {
+			log.Printf("Error loading history for asset #%d: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+
+	case "PUT":
+		if !staff {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		saveAsset(w, r, user, id)
+
+	case "DELETE":
+		if !staff {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		res, err := db.Exec("DELETE FROM assets WHERE id = $1", id)
+		if err != nil {
+			http.Error(w, "Failed to delete asset", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Asset not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("✓ Asset #%d deleted by %s", id, user.Email)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listAssets(w http.ResponseWriter, r *http.Request, user User, staff bool) {
+	query := "SELECT id, serial_number, model, owner_email, created_at FROM assets WHERE TRUE"
+	var args []interface{}
+
+	owner := r.URL.Query().Get("owner")
+	if !staff {
+		owner = user.Email
+	}
+	if owner != "" {
+		args = append(args, owner)
+		query += " AND lower(owner_email) = lower($" + strconv.Itoa(len(args)) + ")"
+	}
+	if serial := r.URL.Query().Get("serial"); serial != "" {
+		args = append(args, serial)
+		query += " AND serial_number = $" + strconv.Itoa(len(args))
+	}
+
+	rows, err := db.Query(query+" ORDER BY serial_number", args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	assets := []Asset{}
+	for rows.Next() {
+		a, err := scanAsset(rows)
+		if err != nil {
+			continue
+		}
+		assets = append(assets, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assets)
+}
+
+// Create (id 0) or update an asset
+func saveAsset(w http.ResponseWriter, r *http.Request, user User, id int) {
+	var a Asset
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := a.validate(); err != nil {
+		writeServiceError(w, err, "Invalid asset")
+		return
+	}
+
+	var row *sql.Row
+	if id == 0 {
+		row = db.QueryRow(`
+			INSERT INTO assets (serial_number, model, owner_email) VALUES ($1, $2, $3)
+			RETURNING id, serial_number, model, owner_email, created_at
+		`, a.SerialNumber, a.Model, a.OwnerEmail)
+	} else {
+		row = db.QueryRow(`
+			UPDATE assets SET serial_number = $2, model = $3, owner_email = $4 WHERE id = $1
+			RETURNING id, serial_number, model, owner_email, created_at
+		`, id, a.SerialNumber, a.Model, a.OwnerEmail)
+	}
+	saved, err := scanAsset(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "An asset with this serial number already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to save asset", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Asset %s saved by %s", saved.SerialNumber, user.Email)
+	w.Header().Set("Content-Type", "application/json")
+	if id == 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(saved)
+}
+
+// PUT /tickets/{id}/assets: replace the devices a ticket is about with
+// a list of asset IDs
+func updateTicketAssets(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsReplyAll, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	var assetIDs []int
+	if err := json.NewDecoder(r.Body).Decode(&assetIDs); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	tx.Exec("DELETE FROM ticket_assets WHERE ticket_id = $1", ticketID)
+	for _, id := range assetIDs {
+		if _, err := tx.Exec("INSERT INTO ticket_assets (ticket_id, asset_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", ticketID, id); err != nil {
+			http.Error(w, "Unknown asset: "+strconv.Itoa(id), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to save assets", http.StatusInternalServerError)
+		return
+	}
+
+	publish(Event{Type: eventTicketAssetsUpdated, Actor: user.Email, TicketID: ticketID,
+		Data: map[string]interface{}{"assets": assetIDs}})
+
+	presentTicket(user, &ticket)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
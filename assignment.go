@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Returned by the store when a ticket being claimed already has an assignee
+var errAlreadyAssigned = errors.New("ticket already assigned")
+
+// Add the assignee column to tickets
+func migrateTicketAssignment() {
+	_, err := db.Exec(`
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS assigned_to VARCHAR(255);
+		CREATE INDEX IF NOT EXISTS tickets_assigned_idx ON tickets (assigned_to) WHERE status <> 'closed'
+	`)
+	if err != nil {
+		log.Fatal("Failed to migrate ticket assignment:", err)
+	}
+}
+
+// Whether email belongs to a user who can work tickets
+func isAgent(email string) bool {
+	role, err := store.Users().RoleOf(email)
+	if err != nil {
+		return false
+	}
+	return rolePermissions(role)[permTicketsReplyAll]
+}
+
+// Assign new tickets to the in-scope, on-shift agent with the fewest open
+// tickets when AUTO_ASSIGN=least_loaded. Urgent tickets that arrive while
+// nobody is on shift go to the on-call agent either way.
+func subscribeAutoAssign() {
+	leastLoaded := os.Getenv("AUTO_ASSIGN") == "least_loaded"
+
+	subscribe(eventTicketCreated, func(ev Event) {
+		if ev.Ticket == nil || ev.Ticket.AssignedTo != "" {
+			return
+		}
+
+		var assignee string
+		var err error
+		if leastLoaded {
+			if assignee, err = leastLoadedAgent(*ev.Ticket); err != nil {
+				log.Printf("Auto-assign failed for ticket #%d: %v", ev.TicketID, err)
+				return
+			}
+		}
+		onCall := false
+		if assignee == "" {
+			if assignee, err = afterHoursAssignee(*ev.Ticket, time.Now()); err != nil {
+				log.Printf("On-call assignment failed for ticket #%d: %v", ev.TicketID, err)
+				return
+			}
+			onCall = assignee != ""
+		}
+		if assignee == "" {
+			if leastLoaded {
+				log.Printf("Auto-assign: no agent on shift covers ticket #%d", ev.TicketID)
+			}
+			return
+		}
+
+		if err := store.Tickets().Assign(ev.TicketID, assignee); err != nil {
+			log.Printf("Auto-assign failed for ticket #%d: %v", ev.TicketID, err)
+			return
+		}
+
+		data := map[string]interface{}{"assignee": assignee, "auto": true}
+		if onCall {
+			data["on_call"] = true
+			log.Printf("✓ Urgent ticket #%d assigned to on-call agent %s", ev.TicketID, assignee)
+			sendMailAsync(assignee, fmt.Sprintf("[%s] Urgent ticket assigned to you (on call)", ev.Ticket.Reference),
+				fmt.Sprintf("Nobody is on shift, so urgent ticket %s \"%s\" from %s was assigned to you as the on-call agent.\n",
+					ev.Ticket.Reference, ev.Ticket.Subject, ev.Ticket.Email))
+		} else {
+			log.Printf("✓ Ticket #%d auto-assigned to %s", ev.TicketID, assignee)
+		}
+		publish(Event{Type: eventTicketAssigned, Actor: "system", TicketID: ev.TicketID, Data: data})
+	})
+}
+
+// On-shift agent whose scope covers the ticket and who has the fewest
+// open tickets
+func leastLoadedAgent(ticket Ticket) (string, error) {
+	onShift, scheduled, err := onShiftAgents(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	rows, err := db.Query(`
+		SELECT u.id, u.email, u.user_type, COUNT(t.id) 
+		FROM users u 
+		LEFT JOIN tickets t ON t.assigned_to = u.email AND t.status <> 'closed' 
+		WHERE u.active 
+		GROUP BY u.id 
+		ORDER BY COUNT(t.id), u.id
+	`)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, open int
+		var email, role string
+		if err := rows.Scan(&id, &email, &role, &open); err != nil {
+			return "", err
+		}
+		if scheduled && !onShift[strings.ToLower(email)] {
+			continue
+		}
+		if rolePermissions(role)[permTicketsReplyAll] && agentScope(id).covers(ticket) {
+			return email, nil
+		}
+	}
+	return "", rows.Err()
+}
+
+// POST /tickets/{id}/assign: set or clear the assignee
+func assignTicket(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsAssign, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Assignee string `json:"assignee"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Assignee != "" && !isAgent(req.Assignee) {
+		http.Error(w, "Assignee must be an agent", http.StatusBadRequest)
+		return
+	}
+
+	// Agents limited to certain categories or organizations can't be
+	// handed tickets outside them
+	if req.Assignee != "" {
+		if id, err := store.Users().IDByEmail(req.Assignee); err != nil || !agentScope(id).covers(ticket) {
+			http.Error(w, "Ticket is outside the assignee's categories", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := store.Tickets().Assign(ticketID, req.Assignee); err != nil {
+		log.Printf("Error assigning ticket #%d: %v", ticketID, err)
+		http.Error(w, "Failed to assign ticket", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Ticket #%d assigned to %q by %s", ticketID, req.Assignee, user.Email)
+	publish(Event{Type: eventTicketAssigned, Actor: user.Email, TicketID: ticketID,
+		Data: map[string]interface{}{"assignee": req.Assignee}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Ticket assigned", "assigned_to": req.Assignee})
+}
+
+// POST /tickets/{id}/claim: assign the ticket to yourself, only if it's
+// unassigned. Of two agents claiming at once, one gets it and the other a
+// 409 naming who did.
+func claimTicket(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsReplyAll, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+	// Scopes are only kept in Postgres
+	if fullFeatured() && !agentScope(user.ID).covers(ticket) {
+		http.Error(w, "Ticket is outside your categories", http.StatusForbidden)
+		return
+	}
+
+	err = store.Tickets().Claim(ticketID, user.Email)
+	if err == errAlreadyAssigned {
+		ticket, err = findAccessibleTicket(r, ticketID)
+		if err != nil {
+			http.Error(w, "Failed to claim ticket", http.StatusInternalServerError)
+			return
+		}
+		// A retried claim that already went through
+		if strings.EqualFold(ticket.AssignedTo, user.Email) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": "Ticket claimed", "assigned_to": ticket.AssignedTo})
+			return
+		}
+		msg := "Ticket is already assigned"
+		if ticket.AssignedTo != "" {
+			msg += " to " + ticket.AssignedTo
+		}
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error claiming ticket #%d: %v", ticketID, err)
+		http.Error(w, "Failed to claim ticket", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Ticket #%d claimed by %s", ticketID, user.Email)
+	publish(Event{Type: eventTicketAssigned, Actor: user.Email, TicketID: ticketID,
+		Data: map[string]interface{}{"assignee": user.Email, "claimed": true}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Ticket claimed", "assigned_to": user.Email})
+}
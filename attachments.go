@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"path"
+	"strings"
+)
+
+// Tickets and replies carry any number of files, up to maxAttachments
+// each, recorded in the attachments table against their ticket, and
+// against the message too for a reply's. Sharing the table makes quotas,
+// archival, backups and the virus scanner treat them alike. Files are
+// uploaded beforehand through /upload and referenced by key, or for
+// replies uploaded with the reply (multipart). Links are presigned
+// whenever a ticket or message is read, as they expire.
+//
+// Tickets' attachment_url (and attachment_key in requests) predate this
+// and stay for older clients: the link to a ticket's first file.
+
+const maxAttachments = 10
+
+// Returned by stores when a key is already linked to a ticket or message
+var errAttachmentLinked = errors.New("attachment already linked")
+
+// Ticket-level files that aren't quarantined, for filtering tickets
+const hasAttachmentsSQL = `EXISTS (SELECT 1 FROM attachments a 
+	WHERE a.ticket_id = tickets.id AND a.message_id IS NULL AND a.s3_key LIKE 'attachments/%')`
+
+// File attached to a ticket or message
+type Attachment struct {
+	ID       int    `json:"id"`
+	Key      string `json:"-"`
+	Filename string `json:"filename,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// Link attachments to the messages they came with, and index both ways
+// of finding them. message_id has no foreign key, like email_deliveries':
+// partitioned messages can't be referenced by id alone. Message files also
+// carry ticket_id, so they go with their ticket.
+func migrateAttachments() {
+	_, err := db.Exec(`
+		ALTER TABLE attachments ADD COLUMN IF NOT EXISTS message_id INTEGER;
+		ALTER TABLE attachments DROP CONSTRAINT IF EXISTS attachments_message_id_fkey;
+		ALTER TABLE attachments ADD COLUMN IF NOT EXISTS filename VARCHAR(255);
+		CREATE INDEX IF NOT EXISTS attachments_message_idx ON attachments (message_id) WHERE message_id IS NOT NULL;
+		CREATE INDEX IF NOT EXISTS attachments_ticket_idx ON attachments (ticket_id) WHERE message_id IS NULL
+	`)
+	if err != nil {
+		log.Fatal("Failed to migrate attachments table:", err)
+	}
+}
+
+// Check the attachments a user sends with a ticket or reply
+func checkAttachments(user User, attachments []Attachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	if !attachmentsEnabled {
+		return newServiceError(errUnavailable, "Attachments disabled")
+	}
+	if len(attachments) > maxAttachments {
+		return newServiceError(errInvalid, fmt.Sprintf("At most %d attachments", maxAttachments))
+	}
+	seen := map[string]bool{}
+	for _, a := range attachments {
+		// Only the uploader may attach a file
+		uploader, err := store.Tickets().Uploader(a.Key)
+		if err == sql.ErrNoRows || (err == nil && !strings.EqualFold(uploader, user.Email)) {
+			return newServiceError(errInvalid, "Invalid attachment")
+		}
+		if err != nil {
+			return err
+		}
+		if seen[a.Key] {
+			return newServiceError(errInvalid, "Attachment given twice")
+		}
+		seen[a.Key] = true
+		if fullFeatured() && isQuarantined(a.Key) {
+			return newServiceError(errInvalid, "Attachment was blocked by the virus scanner")
+		}
+	}
+	return nil
+}
+
+// Upload the files sent with a multipart reply, once the user is known to
+// be allowed to reply. On failure nothing uploaded is left behind.
+func uploadMessageFiles(user User, ticketID int, files []*multipart.FileHeader, referenced int) ([]Attachment, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if !attachmentsEnabled {
+		return nil, newServiceError(errUnavailable, "Attachments disabled")
+	}
+	if len(files)+referenced > maxAttachments {
+		return nil, newServiceError(errInvalid, fmt.Sprintf("At most %d attachments", maxAttachments))
+	}
+	ticket, err := ticketService.Get(user, ticketID)
+	if err != nil {
+		return nil, err
+	}
+	if !authorize(user, actionTicketReply, &ticket) {
+		return nil, errPermissionDenied
+	}
+
+	var attachments []Attachment
+	for _, fh := range files {
+		key, err := storeUpload(user.Email, ticket.OrgID, fh)
+		if err != nil {
+			discardUploads(attachments)
+			return nil, err
+		}
+		attachments = append(attachments, Attachment{Key: key, Filename: attachmentFilename(fh.Filename)})
+	}
+	return attachments, nil
+}
+
+// Remove files uploaded for a reply that wasn't sent
+func discardUploads(attachments []Attachment) {
+	for _, a := range attachments {
+		deleteAttachmentObject(a.Key)
+	}
+}
+
+// Name to show for an uploaded file: the last path element, on one line
+func attachmentFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return truncateText(singleLine(normalizeText(name)), 255)
+}
+
+// Fill in what a message carries in responses: rendered HTML and download
+// links. Delivery problems are for staff to follow up on.
+func presentMessage(m *Message, staff bool) {
+	m.HTML = renderMarkdown(m.Message)
+	if !staff {
+		m.DeliveryStatus = ""
+	}
+	m.Attachments = presignAttachments(m.Attachments)
+}
+
+// Copies of attachments with fresh download links
+func presignAttachments(attachments []Attachment) []Attachment {
+	if len(attachments) == 0 {
+		return attachments
+	}
+	signed := make([]Attachment, 0, len(attachments))
+	for _, a := range attachments {
+		if attachmentsEnabled {
+			if urlStr, err := presignAttachment(a.Key); err == nil {
+				a.URL = urlStr
+			} else {
+				storageLog.Errorf("Error presigning %s: %v", a.Key, err)
+			}
+		}
+		signed = append(signed, a)
+	}
+	return signed
+}
+
+// Attachments by owner from rows of id, owner (message or ticket) ID,
+// s3_key, filename. Quarantined files have been moved out of attachments/
+// and are left out.
+func scanAttachments(rows *sql.Rows) (map[int][]Attachment, error) {
+	defer rows.Close()
+
+	byOwner := map[int][]Attachment{}
+	for rows.Next() {
+		var a Attachment
+		var ownerID int
+		var filename sql.NullString
+		if err := rows.Scan(&a.ID, &ownerID, &a.Key, &filename); err != nil {
+			return nil, err
+		}
+		a.Filename = filename.String
+		if strings.HasPrefix(a.Key, "attachments/") {
+			byOwner[ownerID] = append(byOwner[ownerID], a)
+		}
+	}
+	return byOwner, rows.Err()
+}
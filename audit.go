@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Create audit events table
+func createAuditEventsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id SERIAL PRIMARY KEY,
+			actor_email VARCHAR(255) NOT NULL,
+			action VARCHAR(50) NOT NULL,
+			ticket_id INTEGER,
+			details JSONB NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS audit_events_ticket_idx ON audit_events (ticket_id, created_at);
+		CREATE INDEX IF NOT EXISTS audit_events_created_idx ON audit_events (created_at)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create audit_events table:", err)
+	}
+}
+
+// Record ticket events in the audit log
+func subscribeAudit() {
+	for _, eventType := range []string{eventTicketCreated, eventTicketClosed, eventTicketAssigned,
+		eventTicketFieldsUpdated, eventTicketTagsUpdated, eventTicketAssetsUpdated, eventTicketRequesterChanged,
+		eventTicketPriorityChanged, eventTicketStatusChanged} {
+		subscribe(eventType, func(ev Event) {
+			recordAudit(ev.Actor, ev.Type, ev.TicketID, ev.Data)
+		})
+	}
+}
+
+// Record who did what to a ticket (ticketID 0 for non-ticket actions)
+func recordAudit(actor, action string, ticketID int, details map[string]interface{}) {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	payload, _ := json.Marshal(details)
+
+	var tid interface{}
+	if ticketID != 0 {
+		tid = ticketID
+	}
+
+	_, err := execOrQueue("audit event "+action, `
+		INSERT INTO audit_events (actor_email, action, ticket_id, details, created_at) 
+		VALUES ($1, $2, $3, $4, $5)
+	`, actor, action, tid, string(payload), time.Now().UTC())
+	if err != nil {
+		log.Printf("Failed to record audit event %s: %v", action, err)
+	}
+}
@@ -0,0 +1,41 @@
+// Package auth carries the authenticated caller through a request's
+// context, so identity can't be injected through request headers.
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+// Authenticated caller of a request
+type Identity struct {
+	UserID    int
+	Email     string
+	UserType  string
+	SessionID string
+}
+
+type contextKey struct{}
+
+// Context carrying id
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// Identity stored by NewContext; ok is false for unauthenticated requests
+func FromContext(ctx context.Context) (id Identity, ok bool) {
+	id, ok = ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
+
+// Headers older versions used to pass identity between middleware and
+// handlers. Nothing reads them any more; they're removed from inbound
+// requests so a stale proxy or client can't smuggle an identity in.
+var legacyHeaders = []string{"X-User-ID", "X-User-Email", "X-User-Type", "X-Session-ID"}
+
+// Remove identity headers supplied by the client
+func StripHeaders(r *http.Request) {
+	for _, h := range legacyHeaders {
+		r.Header.Del(h)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Acknowledgement emailed to the requester when a ticket arrives through
+// a channel. Subject and body take the signature placeholders (except
+// {agent_email}) and {response_time}.
+type AutoResponse struct {
+	Channel string `json:"channel"`
+	Enabled bool   `json:"enabled"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	Preview string `json:"preview,omitempty"`
+}
+
+const (
+	maxAutoResponseSubject = 200
+	maxAutoResponseBody    = 5000
+	maxResponseTimeText    = 200
+)
+
+// Used for a channel until an admin saves its own; off until enabled
+var defaultAutoResponse = AutoResponse{
+	Subject: "[{ticket_reference}] We received your request",
+	Body: "Thanks for contacting us. We received your request \"{ticket_subject}\" " +
+		"and gave it the reference {ticket_reference}.\n\n" +
+		"We usually respond {response_time}. Reply to this email if you have anything to add.",
+}
+
+// Create auto-responder tables
+func createAutoResponseTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS auto_responses (
+			channel VARCHAR(20) PRIMARY KEY,
+			enabled BOOLEAN NOT NULL DEFAULT FALSE,
+			subject TEXT NOT NULL,
+			body TEXT NOT NULL,
+			updated_by VARCHAR(255) NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS category_response_times (
+			category VARCHAR(50) PRIMARY KEY,
+			response_time TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create auto-responder tables:", err)
+	}
+}
+
+func (a AutoResponse) validate() error {
+	switch {
+	case strings.TrimSpace(a.Subject) == "":
+		return newServiceError(errInvalid, "Subject is required")
+	case len(a.Subject) > maxAutoResponseSubject:
+		return newServiceError(errInvalid, "Subject is too long")
+	case strings.TrimSpace(a.Body) == "":
+		return newServiceError(errInvalid, "Body is required")
+	case len(a.Body) > maxAutoResponseBody:
+		return newServiceError(errInvalid, "Body is too long")
+	}
+	for _, m := range placeholderPattern.FindAllStringSubmatch(a.Subject+"\n"+a.Body, -1) {
+		if m[1] == "agent_email" || (m[1] != "response_time" && signaturePlaceholders[m[1]] == nil) {
+			return newServiceError(errInvalid, "Unknown placeholder {"+m[1]+"}")
+		}
+	}
+	return nil
+}
+
+// Subject and body for a ticket
+func (a AutoResponse) render(t Ticket, responseTime string) (subject, body string) {
+	fill := func(text string) string {
+		return expandPlaceholders(strings.ReplaceAll(text, "{response_time}", responseTime), "", t)
+	}
+	return fill(a.Subject), fill(a.Body)
+}
+
+// Saved auto-response for a channel, or the default
+func autoResponseFor(channel string) (AutoResponse, error) {
+	a := defaultAutoResponse
+	a.Channel = channel
+	err := db.QueryRow("SELECT enabled, subject, body FROM auto_responses WHERE channel = $1", channel).
+		Scan(&a.Enabled, &a.Subject, &a.Body)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return a, err
+}
+
+// Expected response time for a category, e.g. "within 4 hours". Without
+// a category override it's the first-response SLA target.
+func responseTimeFor(category string) string {
+	if category != "" {
+		var text string
+		err := db.QueryRow("SELECT response_time FROM category_response_times WHERE category = $1", category).Scan(&text)
+		if err == nil {
+			return text
+		}
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading response time for category %s: %v", category, err)
+		}
+	}
+	return defaultResponseTime()
+}
+
+func defaultResponseTime() string {
+	target := slaFirstResponseTarget()
+	if days := int(target / (24 * time.Hour)); days > 1 && target%(24*time.Hour) == 0 {
+		return fmt.Sprintf("within %d days", days)
+	}
+	if hours := int(target / time.Hour); hours != 1 {
+		return fmt.Sprintf("within %d hours", hours)
+	}
+	return "within an hour"
+}
+
+// Acknowledge new tickets on channels with the auto-responder enabled
+func subscribeAutoResponder() {
+	subscribe(eventTicketCreated, func(ev Event) {
+		t := ev.Ticket
+		if t == nil || t.Email == "" {
+			return
+		}
+		a, err := autoResponseFor(t.Channel)
+		if err != nil {
+			log.Printf("Error loading auto-response for channel %s: %v", t.Channel, err)
+			return
+		}
+		if !a.Enabled {
+			return
+		}
+		subject, body := a.render(*t, responseTimeFor(t.Category))
+		sendMailAsync(t.Email, subject, body+"\n")
+	})
+}
+
+// GET /admin/auto_responses, PUT/DELETE /admin/auto_responses/{channel}
+func handleAutoResponses(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	channel := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/auto_responses"), "/")
+	if channel != "" && !ticketChannels[channel] {
+		http.Error(w, "Unknown channel", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case channel == "" && r.Method == "GET":
+		channels := make([]string, 0, len(ticketChannels))
+		for c := range ticketChannels {
+			channels = append(channels, c)
+		}
+		sort.Strings(channels)
+
+		responses := []AutoResponse{}
+		for _, c := range channels {
+			a, err := autoResponseFor(c)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			_, a.Preview = a.render(sampleTicket, defaultResponseTime())
+			responses = append(responses, a)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(responses)
+
+	case channel != "" && r.Method == "PUT":
+		var a AutoResponse
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := a.validate(); err != nil {
+			writeServiceError(w, err, "Invalid auto-response")
+			return
+		}
+		a.Channel = channel
+
+		_, err := db.Exec(`
+			INSERT INTO auto_responses (channel, enabled, subject, body, updated_by) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (channel) DO UPDATE SET enabled = EXCLUDED.enabled, subject = EXCLUDED.subject,
+				body = EXCLUDED.body, updated_by = EXCLUDED.updated_by, updated_at = CURRENT_TIMESTAMP
+		`, channel, a.Enabled, a.Subject, a.Body, user.Email)
+		if err != nil {
+			http.Error(w, "Failed to save auto-response", http.StatusInternalServerError)
+			return
+		}
+		_, a.Preview = a.render(sampleTicket, defaultResponseTime())
+
+		log.Printf("✓ Auto-response for %s tickets updated by %s (enabled: %t)", channel, user.Email, a.Enabled)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+
+	case channel != "" && r.Method == "DELETE":
+		if _, err := db.Exec("DELETE FROM auto_responses WHERE channel = $1", channel); err != nil {
+			http.Error(w, "Failed to reset auto-response", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET /admin/response_times, PUT/DELETE /admin/response_times/{category}
+func handleResponseTimes(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	category, _ := url.PathUnescape(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/response_times"), "/"))
+
+	switch {
+	case category == "" && r.Method == "GET":
+		rows, err := db.Query("SELECT category, response_time FROM category_response_times ORDER BY category")
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		times := map[string]string{}
+		for rows.Next() {
+			var c, text string
+			if err := rows.Scan(&c, &text); err != nil {
+				continue
+			}
+			times[c] = text
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"default": defaultResponseTime(), "categories": times})
+
+	case category != "" && r.Method == "PUT":
+		var req struct {
+			ResponseTime string `json:"response_time"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		req.ResponseTime = strings.TrimSpace(req.ResponseTime)
+		if req.ResponseTime == "" || len(req.ResponseTime) > maxResponseTimeText || len(category) > 50 {
+			http.Error(w, "response_time must be 1-200 characters, e.g. \"within 4 hours\"", http.StatusBadRequest)
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO category_response_times (category, response_time) VALUES ($1, $2)
+			ON CONFLICT (category) DO UPDATE SET response_time = EXCLUDED.response_time
+		`, category, req.ResponseTime)
+		if err != nil {
+			http.Error(w, "Failed to save response time", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ Response time for %s tickets set to %q by %s", category, req.ResponseTime, user.Email)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"category": category, "response_time": req.ResponseTime})
+
+	case category != "" && r.Method == "DELETE":
+		res, err := db.Exec("DELETE FROM category_response_times WHERE category = $1", category)
+		if err != nil {
+			http.Error(w, "Failed to remove response time", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "No response time for this category", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Tables included in backups, in restore (foreign key) order
+var backupTables = []string{
+	"roles",
+	"users",
+	"agent_signatures",
+	"saved_searches",
+	"notification_preferences",
+	"calendar_feeds",
+	"email_changes",
+	"scim_users",
+	"organizations",
+	"support_contracts",
+	"agent_scopes",
+	"agent_shifts",
+	"on_call_rotation",
+	"organization_quotas",
+	"usage_records",
+	"usage_exports",
+	"ticket_sequences",
+	"tickets",
+	"messages",
+	"attachments",
+	"quarantined_attachments",
+	"email_deliveries",
+	"held_emails",
+	"email_threads",
+	"custom_fields",
+	"ticket_field_values",
+	"tags",
+	"ticket_tags",
+	"assets",
+	"ticket_assets",
+	"time_entries",
+	"ticket_handoffs",
+	"ticket_charges",
+	"ticket_entitlements",
+	"change_windows",
+	"ticket_tasks",
+	"ticket_status_history",
+	"ticket_shares",
+	"notifications",
+	"report_schedules",
+	"auto_responses",
+	"response_templates",
+	"category_response_times",
+	"announcements",
+	"email_suppressions",
+	"stripe_customers",
+	"import_keys",
+	"audit_events",
+	"security_events",
+	"login_attempts",
+	// Archived tickets; their attachment files may be in cold storage
+	// and aren't included with -objects
+	"archived_tickets",
+	"archived_attachments",
+	"archived_messages",
+	"archived_ticket_field_values",
+	"archived_ticket_tags",
+	"archived_ticket_assets",
+	"archived_time_entries",
+	"archived_ticket_handoffs",
+	"archived_ticket_charges",
+	"archived_ticket_entitlements",
+	"archived_change_windows",
+	"archived_ticket_tasks",
+	"archived_ticket_status_history",
+}
+
+type backupManifest struct {
+	CreatedAt time.Time      `json:"created_at"`
+	Tables    map[string]int `json:"tables"`
+	Objects   []string       `json:"objects"`
+	// Whether object contents are in the archive or only listed
+	ObjectsIncluded bool `json:"objects_included"`
+}
+
+// sts backup -o FILE [-objects]
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("o", fmt.Sprintf("sts-backup-%s.tar.gz", time.Now().UTC().Format("20060102-150405")), "archive to write")
+	withObjects := fs.Bool("objects", false, "include attachment files from S3 (otherwise only their keys are listed)")
+	fs.Parse(args)
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	// One repeatable-read snapshot so every table reflects the same instant
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	manifest := backupManifest{CreatedAt: time.Now().UTC(), Tables: map[string]int{}, ObjectsIncluded: *withObjects}
+
+	for _, table := range backupTables {
+		n, err := backupTable(tx, tw, table)
+		if err != nil {
+			return fmt.Errorf("backup %s: %w", table, err)
+		}
+		manifest.Tables[table] = n
+		log.Printf("✓ Backed up %d rows from %s", n, table)
+	}
+
+	rows, err := tx.Query("SELECT s3_key FROM attachments ORDER BY id")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var key string
+		if rows.Scan(&key) == nil {
+			manifest.Objects = append(manifest.Objects, key)
+		}
+	}
+	rows.Close()
+
+	if *withObjects {
+		if s3Client == nil {
+			return fmt.Errorf("S3 is not configured")
+		}
+		for _, key := range manifest.Objects {
+			if err := backupObject(tw, key); err != nil {
+				return fmt.Errorf("backup object %s: %w", key, err)
+			}
+		}
+		log.Printf("✓ Backed up %d attachment files", len(manifest.Objects))
+	}
+
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := writeTarFile(tw, "manifest.json", data); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("✓ Backup written to %s", *out)
+	return nil
+}
+
+// Dump a table as NDJSON into the archive
+func backupTable(tx *sql.Tx, tw *tar.Writer, table string) (int, error) {
+	list, err := columnList(tx, table)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(fmt.Sprintf("SELECT row_to_json(t) FROM (SELECT %s FROM %s) t", list, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var buf strings.Builder
+	count := 0
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return count, err
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	return count, writeTarFile(tw, "tables/"+table+".ndjson", []byte(buf.String()))
+}
+
+func backupObject(tw *tar.Writer, key string) error {
+	client, bucket := storageFor(key)
+	if client == nil {
+		return fmt.Errorf("storage location not configured")
+	}
+	obj, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    "objects/" + key,
+		Mode:    0600,
+		Size:    aws.Int64Value(obj.ContentLength),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, obj.Body)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// sts restore -i FILE [-truncate]
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := fs.String("i", "", "archive to restore")
+	truncate := fs.Bool("truncate", false, "replace existing tickets and other data")
+	fs.Parse(args)
+
+	if *in == "" {
+		return fmt.Errorf("-i is required")
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the schema exists before loading rows into it
+	createTables()
+
+	var existing int
+	db.QueryRow("SELECT COUNT(*) FROM tickets").Scan(&existing)
+	if existing > 0 && !*truncate {
+		return fmt.Errorf("database already has %d tickets; rerun with -truncate to replace them", existing)
+	}
+
+	// Table dumps come first in the archive; objects are uploaded as they stream by
+	tables := map[string][]byte{}
+	var locations map[string]string
+	uploaded := 0
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case strings.HasPrefix(hdr.Name, "tables/"):
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			tables[strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "tables/"), ".ndjson")] = data
+
+		case strings.HasPrefix(hdr.Name, "objects/"):
+			if s3Client == nil {
+				return fmt.Errorf("archive contains attachment files but S3 is not configured")
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			// Files go back to the storage location they were kept in
+			if locations == nil {
+				if locations, err = backupKeyLocations(tables["attachments"]); err != nil {
+					return fmt.Errorf("read attachment storage locations: %w", err)
+				}
+			}
+			key := strings.TrimPrefix(hdr.Name, "objects/")
+			client, bucket := locationStorage(locations[key])
+			if client == nil {
+				return fmt.Errorf("archive has files for storage location %q, which is not configured", locations[key])
+			}
+			_, err = client.PutObject(&s3.PutObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+				Body:   strings.NewReader(string(data)),
+			})
+			if err != nil {
+				return err
+			}
+			uploaded++
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Clear seeded rows (built-in roles, demo users) along with anything
+	// -truncate allowed us to replace
+	if _, err := tx.Exec("TRUNCATE " + strings.Join(backupTables, ", ") + " RESTART IDENTITY CASCADE"); err != nil {
+		return err
+	}
+
+	for _, table := range backupTables {
+		data, ok := tables[table]
+		if !ok {
+			continue
+		}
+		n, err := restoreTable(tx, table, data)
+		if err != nil {
+			return fmt.Errorf("restore %s: %w", table, err)
+		}
+		log.Printf("✓ Restored %d rows into %s", n, table)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("✓ Restore complete (%d attachment files uploaded)", uploaded)
+	return nil
+}
+
+// Load NDJSON rows into a table and move its ID sequence past them
+func restoreTable(tx *sql.Tx, table string, data []byte) (int, error) {
+	list, err := columnList(tx, table)
+	if err != nil {
+		return 0, err
+	}
+	insert := fmt.Sprintf("INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM json_populate_record(NULL::%[1]s, $1)", table, list)
+
+	count := 0
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if _, err := tx.Exec(insert, scanner.Text()); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+
+	var hasID bool
+	tx.QueryRow("SELECT pg_get_serial_sequence($1, 'id') IS NOT NULL", table).Scan(&hasID)
+	if hasID && count > 0 {
+		_, err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), MAX(id)) FROM %[1]s", table))
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Create calendar feed tokens table. Calendar apps can't send an
+// Authorization header, so each agent gets a secret feed URL instead.
+func createCalendarFeedsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS calendar_feeds (
+			user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create calendar_feeds table:", err)
+	}
+}
+
+// POST /me/calendar_token: create or rotate the caller's feed URL
+func handleCalendarToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsReplyAll, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	_, err := db.Exec(`
+		INSERT INTO calendar_feeds (user_id, token_hash) 
+		VALUES ($1, $2) 
+		ON CONFLICT (user_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = CURRENT_TIMESTAMP
+	`, user.ID, hashToken(token))
+	if err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Calendar feed token rotated for %s", user.Email)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": "/me/calendar.ics?token=" + token})
+}
+
+// GET /me/calendar.ics?token=...: SLA deadlines for tickets assigned to the agent
+func handleCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	err := db.QueryRow(`
+		SELECT u.id, u.email, u.user_type FROM calendar_feeds c JOIN users u ON u.id = c.user_id 
+		WHERE c.token_hash = $1 AND u.active
+	`, hashToken(token)).Scan(&user.ID, &user.Email, &user.UserType)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// The feed outlives role and scope changes made after it was issued
+	if !authorize(user, permTicketsReplyAll, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	email := user.Email
+	access, args := ticketAccessPredicate(user, []interface{}{email})
+
+	// First response is due until someone other than the requester replies
+	rows, err := db.Query(`
+		SELECT t.reference, t.subject, t.created_at, 
+			EXISTS (SELECT 1 FROM messages m WHERE m.ticket_id = t.id AND m.sender_email <> t.email AND NOT m.is_description) 
+		FROM tickets t 
+		WHERE t.assigned_to = $1 AND t.status <> 'closed'`+access+`
+		ORDER BY t.created_at
+	`, args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var cal strings.Builder
+	writeICSLine(&cal, "BEGIN:VCALENDAR")
+	writeICSLine(&cal, "VERSION:2.0")
+	writeICSLine(&cal, "PRODID:-//sts//SLA deadlines//EN")
+	writeICSLine(&cal, "X-WR-CALNAME:Support deadlines ("+icsEscape(email)+")")
+
+	stamp := time.Now().UTC()
+	for rows.Next() {
+		var ref, subject string
+		var createdAt time.Time
+		var responded bool
+		if err := rows.Scan(&ref, &subject, &createdAt, &responded); err != nil {
+			continue
+		}
+		if !responded {
+			due := createdAt.Add(slaFirstResponseTarget())
+			writeICSEvent(&cal, ref+"-first-response", "First response due: "+ref+" "+subject,
+				due, due.Add(15*time.Minute), stamp)
+		}
+		due := createdAt.Add(slaResolutionTarget())
+		writeICSEvent(&cal, ref+"-resolution", "Resolution due: "+ref+" "+subject,
+			due, due.Add(15*time.Minute), stamp)
+	}
+	writeICSLine(&cal, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="calendar.ics"`)
+	w.Write([]byte(cal.String()))
+}
+
+func writeICSEvent(b *strings.Builder, uid, summary string, start, end, stamp time.Time) {
+	const icsTime = "20060102T150405Z"
+	writeICSLine(b, "BEGIN:VEVENT")
+	writeICSLine(b, "UID:"+uid+"@sts")
+	writeICSLine(b, "DTSTAMP:"+stamp.Format(icsTime))
+	writeICSLine(b, "DTSTART:"+start.UTC().Format(icsTime))
+	writeICSLine(b, "DTEND:"+end.UTC().Format(icsTime))
+	writeICSLine(b, "SUMMARY:"+icsEscape(summary))
+	writeICSLine(b, "END:VEVENT")
+}
+
+// Write a content line, folded at 75 octets as RFC 5545 requires
+func writeICSLine(b *strings.Builder, line string) {
+	for len(line) > 75 {
+		cut := 75
+		// Don't split a UTF-8 sequence
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line + "\r\n")
+}
+
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
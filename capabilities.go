@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Optional subsystems enabled in this deployment, so the frontend can
+// adapt instead of hard-coding deployment differences
+type Capabilities struct {
+	Attachments   bool     `json:"attachments"`
+	OutboundEmail bool     `json:"outbound_email"`
+	SSOProviders  []string `json:"sso_providers"`
+	Reports       bool     `json:"reports"`
+	Organizations bool     `json:"organizations"`
+	CustomFields  bool     `json:"custom_fields"`
+	Notifications bool     `json:"notifications"`
+	Billing       bool     `json:"billing"`
+	// External context sections available on tickets (billing, CRM, ...)
+	ContextProviders []string `json:"context_providers"`
+	Database         string   `json:"database"`
+}
+
+// Set at startup once S3 has been checked
+var attachmentsEnabled bool
+
+func currentCapabilities() Capabilities {
+	return Capabilities{
+		Attachments:      attachmentsEnabled,
+		OutboundEmail:    mailer != nil,
+		SSOProviders:     ssoProviders(),
+		Reports:          fullFeatured(),
+		Organizations:    fullFeatured(),
+		CustomFields:     fullFeatured(),
+		Notifications:    fullFeatured(),
+		Billing:          stripeEnabled(),
+		ContextProviders: contextProviderNames(),
+		Database:         dbDriver(),
+	}
+}
+
+// Single sign-on methods the portal can offer
+func ssoProviders() []string {
+	if proxyAuthEnabled() {
+		return []string{"proxy"}
+	}
+	return []string{}
+}
+
+// GET /capabilities
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentCapabilities())
+}
+
+// Stand-in for attachment routes when S3 isn't configured
+func attachmentsDisabled(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Attachments disabled", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Tickets with a change window are change requests: planned work
+// scheduled between StartsAt and EndsAt. Staff only.
+type ChangeWindow struct {
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Risk      string    `json:"risk"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+}
+
+// A scheduled change, as listed on the change calendar
+type ScheduledChange struct {
+	TicketID   int       `json:"ticket_id"`
+	Reference  string    `json:"reference"`
+	Subject    string    `json:"subject"`
+	AssignedTo string    `json:"assigned_to,omitempty"`
+	StartsAt   time.Time `json:"starts_at"`
+	EndsAt     time.Time `json:"ends_at"`
+	Risk       string    `json:"risk"`
+}
+
+var changeRisks = []string{"low", "medium", "high"}
+
+// Longest change window that can be scheduled
+const maxChangeWindow = 7 * 24 * time.Hour
+
+// Create change windows table
+func createChangeWindowsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS change_windows (
+			ticket_id INTEGER PRIMARY KEY REFERENCES tickets(id) ON DELETE CASCADE,
+			starts_at TIMESTAMP NOT NULL,
+			ends_at TIMESTAMP NOT NULL,
+			risk VARCHAR(10) NOT NULL,
+			updated_by VARCHAR(255) NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			CHECK (ends_at > starts_at)
+		);
+		CREATE INDEX IF NOT EXISTS change_windows_time_idx ON change_windows (starts_at, ends_at)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create change_windows table:", err)
+	}
+}
+
+func (c *ChangeWindow) validate() error {
+	c.Risk = strings.ToLower(c.Risk)
+	switch {
+	case c.StartsAt.IsZero() || c.EndsAt.IsZero():
+		return fmt.Errorf("starts_at and ends_at are required")
+	case !c.EndsAt.After(c.StartsAt):
+		return fmt.Errorf("ends_at must be after starts_at")
+	case c.EndsAt.Sub(c.StartsAt) > maxChangeWindow:
+		return fmt.Errorf("change windows can be at most 7 days")
+	case !containsString(changeRisks, c.Risk):
+		return fmt.Errorf("risk must be low, medium or high")
+	}
+	c.StartsAt, c.EndsAt = c.StartsAt.UTC(), c.EndsAt.UTC()
+	return nil
+}
+
+// Change windows for each of the given tickets
+func ticketChangeWindows(ids []int) (map[int]*ChangeWindow, error) {
+	rows, err := db.Query(`
+		SELECT ticket_id, starts_at, ends_at, risk, updated_by FROM change_windows WHERE ticket_id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	windows := map[int]*ChangeWindow{}
+	for rows.Next() {
+		var id int
+		var c ChangeWindow
+		if err := rows.Scan(&id, &c.StartsAt, &c.EndsAt, &c.Risk, &c.UpdatedBy); err != nil {
+			return nil, err
+		}
+		windows[id] = &c
+	}
+	return windows, rows.Err()
+}
+
+// Open changes, other than ticketID, whose windows overlap from-to
+func scheduledChanges(from, to time.Time, ticketID int, predicate string, args []interface{}) ([]ScheduledChange, error) {
+	args = append(args, from, to, ticketID)
+	n := len(args)
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT t.id, COALESCE(t.reference, ''), t.subject, COALESCE(t.assigned_to, ''), c.starts_at, c.ends_at, c.risk
+		FROM change_windows c
+		JOIN (SELECT id, reference, subject, assigned_to FROM tickets WHERE status <> 'closed'%s) t ON t.id = c.ticket_id
+		WHERE c.ends_at > $%d AND c.starts_at < $%d AND c.ticket_id <> $%d
+		ORDER BY c.starts_at, t.id
+	`, predicate, n-2, n-1, n), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []ScheduledChange{}
+	for rows.Next() {
+		var c ScheduledChange
+		if err := rows.Scan(&c.TicketID, &c.Reference, &c.Subject, &c.AssignedTo, &c.StartsAt, &c.EndsAt, &c.Risk); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// GET/PUT/DELETE /tickets/{id}/change: schedule a ticket as a change
+// request. PUT refuses windows overlapping other open changes with 409
+// and the conflicts, unless allow_conflicts is set.
+func handleChangeWindow(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if !fullFeatured() {
+		http.Error(w, "Change requests require PostgreSQL", http.StatusNotImplemented)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsReplyAll, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		windows, err := ticketChangeWindows([]int{ticketID})
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		c, ok := windows[ticketID]
+		if !ok {
+			http.Error(w, "Ticket is not a change request", http.StatusNotFound)
+			return
+		}
+		conflicts, err := scheduledChanges(c.StartsAt, c.EndsAt, ticketID, "", nil)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"change": c, "conflicts": conflicts})
+
+	case "PUT":
+		var req struct {
+			ChangeWindow
+			AllowConflicts bool `json:"allow_conflicts"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		c := req.ChangeWindow
+		if err := c.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ticket.Status == "closed" {
+			http.Error(w, "Ticket is closed", http.StatusConflict)
+			return
+		}
+
+		// Conflicts are checked across all changes, not just those in the
+		// caller's scope, since they share the same systems
+		conflicts, err := scheduledChanges(c.StartsAt, c.EndsAt, ticketID, "", nil)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if len(conflicts) > 0 && !req.AllowConflicts {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":     "Change window overlaps other scheduled changes",
+				"conflicts": conflicts,
+			})
+			return
+		}
+
+		c.UpdatedBy = user.Email
+		_, err = db.Exec(`
+			INSERT INTO change_windows (ticket_id, starts_at, ends_at, risk, updated_by) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (ticket_id) DO UPDATE SET starts_at = EXCLUDED.starts_at, ends_at = EXCLUDED.ends_at,
+				risk = EXCLUDED.risk, updated_by = EXCLUDED.updated_by, updated_at = CURRENT_TIMESTAMP
+		`, ticketID, c.StartsAt, c.EndsAt, c.Risk, c.UpdatedBy)
+		if err != nil {
+			http.Error(w, "Failed to schedule change", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ Ticket #%d scheduled as a %s-risk change %s-%s by %s", ticketID, c.Risk,
+			c.StartsAt.Format(time.RFC3339), c.EndsAt.Format(time.RFC3339), user.Email)
+		recordAudit(user.Email, "ticket.change_scheduled", ticketID, map[string]interface{}{
+			"starts_at": c.StartsAt, "ends_at": c.EndsAt, "risk": c.Risk, "conflicts": len(conflicts)})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"change": c, "conflicts": conflicts})
+
+	case "DELETE":
+		res, err := db.Exec("DELETE FROM change_windows WHERE ticket_id = $1", ticketID)
+		if err != nil {
+			http.Error(w, "Failed to unschedule change", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Ticket is not a change request", http.StatusNotFound)
+			return
+		}
+		recordAudit(user.Email, "ticket.change_unscheduled", ticketID, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET /changes?from=...&to=...[&format=ics]: open changes scheduled in
+// a range, 30 days from now by default
+func handleChangeCalendar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsReplyAll, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	from, to, err := parseReportRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from == nil {
+		now := time.Now().UTC()
+		from = &now
+	}
+	if to == nil {
+		end := from.AddDate(0, 0, 30)
+		to = &end
+	}
+
+	var args []interface{}
+	predicate, args := ticketAccessPredicate(user, args)
+
+	changes, err := scheduledChanges(*from, *to, 0, predicate, args)
+	if err != nil {
+		log.Printf("Error loading change calendar: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "ics" {
+		var cal strings.Builder
+		writeICSLine(&cal, "BEGIN:VCALENDAR")
+		writeICSLine(&cal, "VERSION:2.0")
+		writeICSLine(&cal, "PRODID:-//sts//Change calendar//EN")
+		writeICSLine(&cal, "X-WR-CALNAME:Scheduled changes")
+		stamp := time.Now().UTC()
+		for _, c := range changes {
+			writeICSEvent(&cal, c.Reference+"-change", fmt.Sprintf("[%s risk] %s %s", c.Risk, c.Reference, c.Subject),
+				c.StartsAt, c.EndsAt, stamp)
+		}
+		writeICSLine(&cal, "END:VCALENDAR")
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Content-Disposition", `inline; filename="changes.ics"`)
+		w.Write([]byte(cal.String()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "log"
+
+// Channels a ticket can arrive through
+var ticketChannels = map[string]bool{
+	"web":    true,
+	"email":  true,
+	"api":    true,
+	"widget": true,
+	"chat":   true,
+	"sms":    true,
+}
+
+const defaultTicketChannel = "web"
+
+// Add the channel column to tickets
+func migrateTicketChannels() {
+	_, err := db.Exec(`
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS channel VARCHAR(20) NOT NULL DEFAULT 'web';
+		CREATE INDEX IF NOT EXISTS tickets_channel_idx ON tickets (channel)
+	`)
+	if err != nil {
+		log.Fatal("Failed to migrate ticket channels:", err)
+	}
+}
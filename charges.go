@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Billable line items on a ticket. Time is charged at an hourly rate,
+// parts per unit; amounts are in cents of BILLING_CURRENCY.
+const (
+	chargeTime = "time"
+	chargePart = "part"
+)
+
+type Charge struct {
+	ID             int       `json:"id"`
+	TicketID       int       `json:"ticket_id"`
+	Kind           string    `json:"kind"`
+	Description    string    `json:"description"`
+	Minutes        int       `json:"minutes,omitempty"`
+	Quantity       int       `json:"quantity,omitempty"`
+	UnitPriceCents int64     `json:"unit_price_cents"`
+	AmountCents    int64     `json:"amount_cents"`
+	AgentEmail     string    `json:"agent_email"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// One customer's charges for a month. Customers are organizations;
+// requesters outside any organization are billed individually.
+type BillingLine struct {
+	Month      string `json:"month"`
+	Customer   string `json:"customer"`
+	OrgID      *int   `json:"org_id,omitempty"`
+	Tickets    int    `json:"tickets"`
+	Minutes    int64  `json:"minutes"`
+	TimeCents  int64  `json:"time_cents"`
+	PartsCents int64  `json:"parts_cents"`
+	TotalCents int64  `json:"total_cents"`
+	Currency   string `json:"currency"`
+}
+
+// ISO 4217 code amounts are billed in (BILLING_CURRENCY, default USD)
+func billingCurrency() string {
+	if c := os.Getenv("BILLING_CURRENCY"); c != "" {
+		return strings.ToUpper(c)
+	}
+	return "USD"
+}
+
+// Create ticket charges table
+func createChargesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ticket_charges (
+			id SERIAL PRIMARY KEY,
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			kind VARCHAR(10) NOT NULL,
+			description TEXT NOT NULL,
+			minutes INTEGER NOT NULL DEFAULT 0,
+			quantity INTEGER NOT NULL DEFAULT 0,
+			unit_price_cents BIGINT NOT NULL CHECK (unit_price_cents >= 0),
+			amount_cents BIGINT NOT NULL,
+			agent_email VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS ticket_charges_ticket_idx ON ticket_charges (ticket_id);
+		CREATE INDEX IF NOT EXISTS ticket_charges_created_idx ON ticket_charges (created_at)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create ticket_charges table:", err)
+	}
+}
+
+// Check a new charge and work out its amount. Time is rounded to the
+// nearest cent.
+func (c *Charge) price() error {
+	c.Description = strings.TrimSpace(c.Description)
+	if c.Description == "" {
+		return fmt.Errorf("description is required")
+	}
+	if c.UnitPriceCents < 0 {
+		return fmt.Errorf("unit_price_cents can't be negative")
+	}
+
+	switch c.Kind {
+	case chargeTime:
+		if c.Minutes <= 0 {
+			return fmt.Errorf("minutes must be positive")
+		}
+		c.Quantity = 0
+		c.AmountCents = (int64(c.Minutes)*c.UnitPriceCents + 30) / 60
+	case chargePart:
+		if c.Quantity <= 0 {
+			return fmt.Errorf("quantity must be positive")
+		}
+		c.Minutes = 0
+		c.AmountCents = int64(c.Quantity) * c.UnitPriceCents
+	default:
+		return fmt.Errorf("kind must be %q or %q", chargeTime, chargePart)
+	}
+	return nil
+}
+
+// GET/POST /tickets/{id}/charges, DELETE /tickets/{id}/charges/{chargeID}
+func handleCharges(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if !fullFeatured() {
+		http.Error(w, "Charges require PostgreSQL", http.StatusNotImplemented)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsReplyAll, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	if _, err := findAccessibleTicket(r, ticketID); err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	idPart := ""
+	if len(parts) > 3 {
+		idPart = parts[3]
+	}
+
+	switch {
+	case idPart == "" && r.Method == "GET":
+		charges, err := ticketCharges(ticketID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var total int64
+		for _, c := range charges {
+			total += c.AmountCents
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"charges":     charges,
+			"total_cents": total,
+			"currency":    billingCurrency(),
+		})
+
+	case idPart == "" && r.Method == "POST":
+		var c Charge
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := c.price(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		c.TicketID = ticketID
+		c.AgentEmail = user.Email
+		err := db.QueryRow(`
+			INSERT INTO ticket_charges (ticket_id, kind, description, minutes, quantity, unit_price_cents, amount_cents, agent_email)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING id, created_at
+		`, c.TicketID, c.Kind, c.Description, c.Minutes, c.Quantity, c.UnitPriceCents, c.AmountCents, c.AgentEmail).
+			Scan(&c.ID, &c.CreatedAt)
+		if err != nil {
+			http.Error(w, "Failed to add charge", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ Charge of %d cents added to ticket #%d by %s", c.AmountCents, ticketID, user.Email)
+		recordAudit(user.Email, "ticket.charge_added", ticketID,
+			map[string]interface{}{"charge_id": c.ID, "kind": c.Kind, "amount_cents": c.AmountCents})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+
+	case idPart != "" && r.Method == "DELETE":
+		id, err := strconv.Atoi(idPart)
+		if err != nil {
+			http.Error(w, "Invalid charge ID", http.StatusBadRequest)
+			return
+		}
+
+		// Agents can remove their own mistakes; admins any charge
+		var agent string
+		var amount int64
+		err = db.QueryRow("SELECT agent_email, amount_cents FROM ticket_charges WHERE id = $1 AND ticket_id = $2", id, ticketID).
+			Scan(&agent, &amount)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Charge not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if agent != user.Email && !authorize(user, permUsersManage, nil) {
+			http.Error(w, "Only the agent who added a charge or an admin can remove it", http.StatusForbidden)
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM ticket_charges WHERE id = $1", id); err != nil {
+			http.Error(w, "Failed to remove charge", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(user.Email, "ticket.charge_removed", ticketID,
+			map[string]interface{}{"charge_id": id, "amount_cents": amount})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func ticketCharges(ticketID int) ([]Charge, error) {
+	rows, err := db.Query(`
+		SELECT id, ticket_id, kind, description, minutes, quantity, unit_price_cents, amount_cents, agent_email, created_at
+		FROM ticket_charges WHERE ticket_id = $1 ORDER BY created_at, id
+	`, ticketID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	charges := []Charge{}
+	for rows.Next() {
+		var c Charge
+		if err := rows.Scan(&c.ID, &c.TicketID, &c.Kind, &c.Description, &c.Minutes, &c.Quantity,
+			&c.UnitPriceCents, &c.AmountCents, &c.AgentEmail, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		charges = append(charges, c)
+	}
+	return charges, rows.Err()
+}
+
+// Charges made in month on tickets matching predicate (an " AND ..."
+// fragment over ticket columns), per customer. Archived tickets count.
+func billingReport(month time.Time, predicate string, args []interface{}) ([]BillingLine, error) {
+	args = append(args, month, month.AddDate(0, 1, 0))
+	from, to := len(args)-1, len(args)
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT COALESCE(o.name, t.email), t.org_id, COUNT(DISTINCT t.id),
+			COALESCE(SUM(c.minutes), 0),
+			COALESCE(SUM(c.amount_cents) FILTER (WHERE c.kind = 'time'), 0),
+			COALESCE(SUM(c.amount_cents) FILTER (WHERE c.kind = 'part'), 0),
+			COALESCE(SUM(c.amount_cents), 0)
+		FROM (
+			SELECT ticket_id, kind, minutes, amount_cents, created_at FROM ticket_charges
+			UNION ALL
+			SELECT ticket_id, kind, minutes, amount_cents, created_at FROM archived_ticket_charges
+		) c
+		JOIN (
+			SELECT id, email, org_id FROM tickets WHERE TRUE%[1]s
+			UNION ALL
+			SELECT id, email, org_id FROM archived_tickets WHERE TRUE%[1]s
+		) t ON t.id = c.ticket_id
+		LEFT JOIN organizations o ON o.id = t.org_id
+		WHERE c.created_at >= $%[2]d AND c.created_at < $%[3]d
+		GROUP BY COALESCE(o.name, t.email), t.org_id
+		ORDER BY 1
+	`, predicate, from, to), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []BillingLine{}
+	for rows.Next() {
+		l := BillingLine{Currency: billingCurrency(), Month: month.Format("2006-01")}
+		var orgID sql.NullInt64
+		if err := rows.Scan(&l.Customer, &orgID, &l.Tickets, &l.Minutes, &l.TimeCents, &l.PartsCents, &l.TotalCents); err != nil {
+			return nil, err
+		}
+		if orgID.Valid {
+			id := int(orgID.Int64)
+			l.OrgID = &id
+		}
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+func writeBillingCSV(w io.Writer, lines []BillingLine) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"month", "customer", "org_id", "tickets", "minutes", "time_cents", "parts_cents", "total_cents", "currency"})
+	for _, l := range lines {
+		orgID := ""
+		if l.OrgID != nil {
+			orgID = strconv.Itoa(*l.OrgID)
+		}
+		cw.Write([]string{l.Month, l.Customer, orgID, strconv.Itoa(l.Tickets),
+			strconv.FormatInt(l.Minutes, 10), strconv.FormatInt(l.TimeCents, 10),
+			strconv.FormatInt(l.PartsCents, 10), strconv.FormatInt(l.TotalCents, 10), l.Currency})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// GET /reports/billing?month=YYYY-MM[&format=csv]
+func handleBillingReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permReportsView, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	month := monthStart(time.Now())
+	if m := r.URL.Query().Get("month"); m != "" {
+		parsed, err := time.Parse("2006-01", m)
+		if err != nil {
+			http.Error(w, "Invalid month, expected YYYY-MM", http.StatusBadRequest)
+			return
+		}
+		month = parsed
+	}
+
+	var args []interface{}
+	predicate, args := ticketAccessPredicate(user, args)
+
+	lines, err := billingReport(month, predicate, args)
+	if err != nil {
+		log.Printf("Error building billing report: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="billing-%s.csv"`, month.Format("2006-01")))
+		writeBillingCSV(w, lines)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lines)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Proxies (e.g. the ALB subnets) whose forwarding headers we believe
+var trustedProxies []*net.IPNet
+
+// Parse TRUSTED_PROXIES, a comma-separated list of IPs or CIDRs
+func loadTrustedProxies() {
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Warning: Ignoring invalid trusted proxy %q", entry)
+			continue
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	if len(trustedProxies) > 0 {
+		log.Printf("✓ Trusting forwarding headers from %d proxy ranges", len(trustedProxies))
+	}
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Real client IP. Forwarding headers are only honored when the direct peer
+// is a trusted proxy, and the chain is walked right to left so a client
+// can't spoof its address by sending its own X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(remote)
+	if ip == nil || !isTrustedProxy(ip) {
+		return remote
+	}
+
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			// Garbage in the chain; stop at the last address we could verify
+			break
+		}
+		remote = hops[i]
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+
+	return remote
+}
+
+// Addresses from the Forwarded header (RFC 7239), falling back to X-Forwarded-For
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+
+	for _, header := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				hops = append(hops, parseForwardedNode(value))
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// Strip quotes, brackets and port from a Forwarded node, e.g. "[2001:db8::1]:4711"
+func parseForwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
@@ -0,0 +1,27 @@
+package main
+
+import "fmt"
+
+// CLI subcommands
+var commands = map[string]func(args []string) error{
+	"backup":  runBackup,
+	"restore": runRestore,
+	"policy":  runPolicy,
+	"loadgen": runLoadgen,
+}
+
+// Commands that work against either store
+var portableCommands = map[string]bool{
+	"policy": true,
+}
+
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	if !fullFeatured() && !portableCommands[name] {
+		return fmt.Errorf("%s requires DB_DRIVER=postgres", name)
+	}
+	return cmd(args)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source of external information about a ticket's requester (billing,
+// CRM records, ...), shown to agents alongside the ticket
+type ContextProvider interface {
+	// Key of the provider's section in GET /tickets/{id}/context
+	Name() string
+	// Data about the ticket's requester, or nil if the provider has none
+	Lookup(ticket Ticket) (interface{}, error)
+}
+
+// Providers enabled in this deployment, set up at startup
+var contextProviders []ContextProvider
+
+// Enable the built-in providers whose credentials are configured and any
+// HTTP callouts listed in CONTEXT_PROVIDERS
+func loadContextProviders() {
+	if stripeEnabled() {
+		contextProviders = append(contextProviders, stripeContextProvider{})
+	}
+
+	raw := os.Getenv("CONTEXT_PROVIDERS")
+	if raw == "" {
+		return
+	}
+	var configs []httpContextProvider
+	if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+		log.Printf("Warning: invalid CONTEXT_PROVIDERS, ignoring: %v", err)
+		return
+	}
+	for i := range configs {
+		p := &configs[i]
+		if p.ProviderName == "" || p.URL == "" {
+			log.Printf("Warning: context provider %d needs a name and url, skipping", i)
+			continue
+		}
+		p.cache = newContextCache(time.Duration(p.TTLSeconds) * time.Second)
+		contextProviders = append(contextProviders, p)
+		log.Printf("✓ Context provider %s enabled", p.ProviderName)
+	}
+}
+
+// Names of enabled providers, for capabilities
+func contextProviderNames() []string {
+	names := []string{}
+	for _, p := range contextProviders {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// Small TTL cache for provider lookups
+type contextCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]contextCacheEntry
+}
+
+type contextCacheEntry struct {
+	value interface{}
+	at    time.Time
+}
+
+// Default TTL is five minutes
+func newContextCache(ttl time.Duration) *contextCache {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return &contextCache{ttl: ttl, entries: map[string]contextCacheEntry{}}
+}
+
+func (c *contextCache) get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Since(e.at) > c.ttl {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *contextCache) set(key string, value interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[key] = contextCacheEntry{value: value, at: time.Now()}
+}
+
+func (c *contextCache) delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, key)
+}
+
+// Generic HTTP callout, e.g. to an in-house CRM or a Salesforce/HubSpot
+// adapter. The URL may contain {email}, {reference} and {org_id}; the
+// endpoint returns a JSON object, or 404 when it knows nothing.
+type httpContextProvider struct {
+	ProviderName   string            `json:"name"`
+	URL            string            `json:"url"`
+	Headers        map[string]string `json:"headers"`
+	TTLSeconds     int               `json:"ttl_seconds"`
+	TimeoutSeconds int               `json:"timeout_seconds"`
+
+	cache *contextCache
+}
+
+func (p *httpContextProvider) Name() string {
+	return p.ProviderName
+}
+
+func (p *httpContextProvider) Lookup(ticket Ticket) (interface{}, error) {
+	target := strings.NewReplacer(
+		"{email}", url.QueryEscape(ticket.Email),
+		"{reference}", url.QueryEscape(ticket.Reference),
+		"{org_id}", strconv.Itoa(ticket.OrgID),
+	).Replace(p.URL)
+
+	if v, ok := p.cache.get(target); ok {
+		return v, nil
+	}
+
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+
+	timeout := 5 * time.Second
+	if p.TimeoutSeconds > 0 {
+		timeout = time.Duration(p.TimeoutSeconds) * time.Second
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		p.cache.set(target, nil)
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", p.ProviderName, resp.StatusCode)
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&data); err != nil {
+		return nil, fmt.Errorf("%s: invalid response: %v", p.ProviderName, err)
+	}
+	p.cache.set(target, data)
+	return data, nil
+}
+
+// GET /tickets/{id}/context: every provider's data about the requester,
+// for staff only. Providers are queried in parallel; one failing doesn't
+// hide the others.
+func getTicketContext(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	ticket, err := ticketService.Get(user, ticketID)
+	if err != nil {
+		writeServiceError(w, err, "Database error")
+		return
+	}
+	if !canSeeInternal(user) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sections := map[string]interface{}{}
+	errs := map[string]string{}
+	for _, p := range contextProviders {
+		wg.Add(1)
+		go func(p ContextProvider) {
+			defer wg.Done()
+			data, err := p.Lookup(ticket)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Context provider %s failed for ticket #%d: %v", p.Name(), ticketID, err)
+				errs[p.Name()] = "unavailable"
+				return
+			}
+			sections[p.Name()] = data
+		}(p)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"providers": contextProviderNames(),
+		"context":   sections,
+		"errors":    errs,
+	})
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A customer's support contract: an organization's, or an individual
+// requester's. Incidents is nil for unlimited tickets.
+type Contract struct {
+	ID            int       `json:"id"`
+	OrgID         *int      `json:"org_id,omitempty"`
+	Email         string    `json:"email,omitempty"`
+	Tier          string    `json:"tier"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Incidents     *int      `json:"incidents"`
+	IncidentsUsed int       `json:"incidents_used"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Entitlement statuses recorded on tickets
+const (
+	entitlementCovered   = "covered"
+	entitlementLapsed    = "lapsed"
+	entitlementExhausted = "exhausted"
+	entitlementNone      = "none"
+)
+
+// What a ticket was entitled to when it was opened. Staff only.
+type Entitlement struct {
+	Status     string `json:"status"`
+	ContractID int    `json:"contract_id,omitempty"`
+	Tier       string `json:"tier,omitempty"`
+	Warning    string `json:"warning,omitempty"`
+}
+
+// Create contract tables
+func createContractTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS support_contracts (
+			id SERIAL PRIMARY KEY,
+			org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+			email VARCHAR(255),
+			tier VARCHAR(50) NOT NULL,
+			expires_at DATE NOT NULL,
+			incidents INTEGER CHECK (incidents >= 0),
+			incidents_used INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			CHECK ((org_id IS NULL) <> (email IS NULL))
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS support_contracts_org_idx ON support_contracts (org_id) WHERE org_id IS NOT NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS support_contracts_email_idx ON support_contracts (lower(email)) WHERE email IS NOT NULL;
+		CREATE TABLE IF NOT EXISTS ticket_entitlements (
+			ticket_id INTEGER PRIMARY KEY REFERENCES tickets(id) ON DELETE CASCADE,
+			contract_id INTEGER REFERENCES support_contracts(id) ON DELETE SET NULL,
+			status VARCHAR(20) NOT NULL,
+			tier VARCHAR(50) NOT NULL DEFAULT ''
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create contract tables:", err)
+	}
+}
+
+func (e *Entitlement) explain() {
+	switch e.Status {
+	case entitlementLapsed:
+		e.Warning = "The requester's support contract has expired"
+	case entitlementExhausted:
+		e.Warning = "The requester's support contract has no incidents left"
+	case entitlementNone:
+		e.Warning = "The requester has no support contract"
+	}
+}
+
+// Check the requester's contract for a new ticket and record the outcome,
+// using up an incident if the contract counts them. A personal contract
+// takes precedence over the organization's. Tickets are opened either
+// way; agents see the warning on the ticket.
+func recordEntitlement(ticketID int, email string) (Entitlement, error) {
+	e := Entitlement{Status: entitlementNone}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return e, err
+	}
+	defer tx.Rollback()
+
+	var c Contract
+	var incidents sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT id, tier, expires_at, incidents, incidents_used FROM support_contracts
+		WHERE lower(email) = lower($1)
+			OR org_id = (SELECT id FROM organizations WHERE domain = lower(split_part($1, '@', 2)))
+		ORDER BY email IS NULL
+		LIMIT 1
+		FOR UPDATE
+	`, email).Scan(&c.ID, &c.Tier, &c.ExpiresAt, &incidents, &c.IncidentsUsed)
+	if err != nil && err != sql.ErrNoRows {
+		return e, err
+	}
+
+	var contractID interface{}
+	if err == nil {
+		e.ContractID, e.Tier, contractID = c.ID, c.Tier, c.ID
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		switch {
+		case c.ExpiresAt.Before(today):
+			e.Status = entitlementLapsed
+		case incidents.Valid && int64(c.IncidentsUsed) >= incidents.Int64:
+			e.Status = entitlementExhausted
+		default:
+			e.Status = entitlementCovered
+			if _, err := tx.Exec("UPDATE support_contracts SET incidents_used = incidents_used + 1 WHERE id = $1", c.ID); err != nil {
+				return e, err
+			}
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO ticket_entitlements (ticket_id, contract_id, status, tier) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (ticket_id) DO NOTHING
+	`, ticketID, contractID, e.Status, e.Tier)
+	if err != nil {
+		return e, err
+	}
+	if err := tx.Commit(); err != nil {
+		return e, err
+	}
+
+	e.explain()
+	return e, nil
+}
+
+// Entitlements recorded for each of the given tickets
+func ticketEntitlements(ids []int) (map[int]*Entitlement, error) {
+	rows, err := db.Query(`
+		SELECT ticket_id, COALESCE(contract_id, 0), status, tier FROM ticket_entitlements WHERE ticket_id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entitlements := map[int]*Entitlement{}
+	for rows.Next() {
+		var id int
+		var e Entitlement
+		if err := rows.Scan(&id, &e.ContractID, &e.Status, &e.Tier); err != nil {
+			return nil, err
+		}
+		e.explain()
+		entitlements[id] = &e
+	}
+	return entitlements, rows.Err()
+}
+
+func scanContract(row interface{ Scan(...interface{}) error }) (Contract, error) {
+	var c Contract
+	var orgID, incidents sql.NullInt64
+	var email sql.NullString
+	err := row.Scan(&c.ID, &orgID, &email, &c.Tier, &c.ExpiresAt, &incidents, &c.IncidentsUsed, &c.CreatedAt)
+	if orgID.Valid {
+		id := int(orgID.Int64)
+		c.OrgID = &id
+	}
+	if incidents.Valid {
+		n := int(incidents.Int64)
+		c.Incidents = &n
+	}
+	c.Email = email.String
+	return c, err
+}
+
+const contractColumns = "id, org_id, email, tier, expires_at, incidents, incidents_used, created_at"
+
+// GET/POST /admin/contracts, GET/PUT/DELETE /admin/contracts/{id}.
+// PUT replaces tier, expiry and incidents and can reset incidents_used,
+// e.g. on renewal.
+func handleContracts(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/contracts"), "/")
+
+	if idPart == "" {
+		switch r.Method {
+		case "GET":
+			rows, err := db.Query("SELECT " + contractColumns + " FROM support_contracts ORDER BY expires_at, id")
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			contracts := []Contract{}
+			for rows.Next() {
+				c, err := scanContract(rows)
+				if err != nil {
+					continue
+				}
+				contracts = append(contracts, c)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(contracts)
+
+		case "POST":
+			c, ok := decodeContract(w, r)
+			if !ok {
+				return
+			}
+			if (c.OrgID == nil) == (c.Email == "") {
+				http.Error(w, "Give either org_id or email", http.StatusBadRequest)
+				return
+			}
+			var email interface{}
+			if c.Email != "" {
+				email = strings.ToLower(c.Email)
+			}
+
+			saved, err := scanContract(db.QueryRow(`
+				INSERT INTO support_contracts (org_id, email, tier, expires_at, incidents) VALUES ($1, $2, $3, $4, $5)
+				RETURNING `+contractColumns, c.OrgID, email, c.Tier, c.ExpiresAt, c.Incidents))
+			if !contractSaved(w, err) {
+				return
+			}
+
+			log.Printf("✓ Support contract #%d (%s) created by %s", saved.ID, saved.Tier, user.Email)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(saved)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(idPart)
+	if err != nil {
+		http.Error(w, "Invalid contract ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		c, err := scanContract(db.QueryRow("SELECT "+contractColumns+" FROM support_contracts WHERE id = $1", id))
+		if err != nil {
+			http.Error(w, "Contract not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+
+	case "PUT":
+		c, ok := decodeContract(w, r)
+		if !ok {
+			return
+		}
+		saved, err := scanContract(db.QueryRow(`
+			UPDATE support_contracts SET tier = $2, expires_at = $3, incidents = $4, incidents_used = $5
+			WHERE id = $1
+			RETURNING `+contractColumns, id, c.Tier, c.ExpiresAt, c.Incidents, c.IncidentsUsed))
+		if !contractSaved(w, err) {
+			return
+		}
+
+		log.Printf("✓ Support contract #%d updated by %s", id, user.Email)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+
+	case "DELETE":
+		res, err := db.Exec("DELETE FROM support_contracts WHERE id = $1", id)
+		if err != nil {
+			http.Error(w, "Failed to delete contract", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Contract not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func decodeContract(w http.ResponseWriter, r *http.Request) (Contract, bool) {
+	var req struct {
+		Contract
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return req.Contract, false
+	}
+	c := req.Contract
+
+	expires, err := time.Parse("2006-01-02", req.ExpiresAt)
+	if err != nil {
+		http.Error(w, "expires_at must be a date (YYYY-MM-DD)", http.StatusBadRequest)
+		return c, false
+	}
+	c.ExpiresAt = expires
+	c.Tier = strings.TrimSpace(c.Tier)
+	switch {
+	case c.Tier == "" || len(c.Tier) > 50:
+		http.Error(w, "tier must be 1-50 characters", http.StatusBadRequest)
+		return c, false
+	case c.Incidents != nil && *c.Incidents < 0, c.IncidentsUsed < 0:
+		http.Error(w, "Incident counts can't be negative", http.StatusBadRequest)
+		return c, false
+	}
+	return c, true
+}
+
+// Report a failed contract insert or update; true if it succeeded
+func contractSaved(w http.ResponseWriter, err error) bool {
+	if err == sql.ErrNoRows {
+		http.Error(w, "Contract not found", http.StatusNotFound)
+		return false
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "23505":
+			http.Error(w, "This customer already has a contract", http.StatusConflict)
+			return false
+		case "23503":
+			http.Error(w, "Organization not found", http.StatusBadRequest)
+			return false
+		}
+	}
+	if err != nil {
+		http.Error(w, "Failed to save contract", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Add satisfaction rating columns to tickets
+func migrateCSAT() {
+	_, err := db.Exec(`
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS csat_score SMALLINT CHECK (csat_score BETWEEN 1 AND 5);
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS csat_comment TEXT
+	`)
+	if err != nil {
+		log.Fatal("Failed to migrate CSAT columns:", err)
+	}
+}
+
+// POST /tickets/{id}/rating: requester rates a closed ticket 1-5
+func rateTicket(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	if ticket.Email != currentUser(r).Email {
+		http.Error(w, "Only the requester can rate a ticket", http.StatusForbidden)
+		return
+	}
+	if ticket.Status != "closed" {
+		http.Error(w, "Only closed tickets can be rated", http.StatusConflict)
+		return
+	}
+
+	var req struct {
+		Score   int    `json:"score"`
+		Comment string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Score < 1 || req.Score > 5 {
+		http.Error(w, "Score must be between 1 and 5", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.Tickets().Rate(ticketID, req.Score, req.Comment); err != nil {
+		http.Error(w, "Failed to save rating", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Ticket #%d rated %d by %s", ticketID, req.Score, ticket.Email)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Thanks for your feedback"})
+}
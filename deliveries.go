@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Delivery states of a notification email
+const (
+	deliverySent       = "sent"
+	deliveryDelivered  = "delivered"
+	deliveryDelayed    = "delayed"
+	deliveryBounced    = "bounced"
+	deliveryComplained = "complained"
+	deliveryFailed     = "failed"
+	deliverySuppressed = "suppressed"
+)
+
+// Create email deliveries table, linking sent notifications to messages
+func createEmailDeliveriesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS email_deliveries (
+			id SERIAL PRIMARY KEY,
+			provider_id VARCHAR(255),
+			message_id INTEGER,
+			recipient VARCHAR(255) NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			detail TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS email_deliveries_provider_idx ON email_deliveries (provider_id) WHERE provider_id <> '';
+		CREATE INDEX IF NOT EXISTS email_deliveries_message_idx ON email_deliveries (message_id)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create email_deliveries table:", err)
+	}
+}
+
+// Record that a notification for a message was sent (or failed to send)
+func recordDelivery(providerID string, messageID int, recipient, status, detail string) {
+	if !fullFeatured() {
+		return
+	}
+	_, err := db.Exec(`
+		INSERT INTO email_deliveries (provider_id, message_id, recipient, status, detail) 
+		VALUES ($1, $2, $3, $4, $5)
+	`, providerID, messageID, recipient, status, detail)
+	if err != nil {
+		notifyLog.Errorf("Failed to record email delivery for message #%d: %v", messageID, err)
+	}
+}
+
+// Update a delivery from a provider notification
+func updateDelivery(providerID, status, detail string) {
+	res, err := db.Exec(`
+		UPDATE email_deliveries SET status = $2, detail = $3, updated_at = CURRENT_TIMESTAMP 
+		WHERE provider_id = $1
+	`, providerID, status, detail)
+	if err != nil {
+		notifyLog.Errorf("Failed to update email delivery %s: %v", providerID, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 && status != deliveryDelivered {
+		notifyLog.Printf("✓ Email %s marked %s", providerID, status)
+	}
+}
+
+// SNS envelope around SES notifications
+type snsEnvelope struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	Token            string `json:"Token"`
+	SubscribeURL     string `json:"SubscribeURL"`
+	Signature        string `json:"Signature"`
+	SignatureVersion string `json:"SignatureVersion"`
+	SigningCertURL   string `json:"SigningCertURL"`
+}
+
+// SES bounce, complaint or delivery notification
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Mail             struct {
+		MessageID string `json:"messageId"`
+	} `json:"mail"`
+	Bounce struct {
+		BounceType        string `json:"bounceType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplainedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// POST /webhooks/ses?token=...: the original SES endpoint, kept for
+// existing SNS subscriptions. Requires SES_WEBHOOK_TOKEN in addition to
+// the SNS signature checked by /hooks/ses.
+func handleSESWebhook(w http.ResponseWriter, r *http.Request) {
+	want := os.Getenv("SES_WEBHOOK_TOKEN")
+	if want == "" {
+		http.Error(w, "Webhook not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(want)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.URL.Path = "/hooks/ses"
+	handleHook(w, r)
+}
+
+// Verified SES notifications delivered through SNS. SES_SNS_TOPIC_ARN
+// optionally pins the topic.
+func handleSESHook(w http.ResponseWriter, r *http.Request, body []byte) {
+	var env snsEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if topic := os.Getenv("SES_SNS_TOPIC_ARN"); topic != "" && env.TopicArn != topic {
+		http.Error(w, "Unknown topic", http.StatusForbidden)
+		return
+	}
+
+	switch env.Type {
+	case "SubscriptionConfirmation":
+		confirmSNSSubscription(env.SubscribeURL)
+	case "Notification":
+		var n sesNotification
+		if err := json.Unmarshal([]byte(env.Message), &n); err != nil {
+			http.Error(w, "Invalid notification", http.StatusBadRequest)
+			return
+		}
+		handleSESNotification(n)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Confirm an SNS subscription, only following URLs on AWS hosts
+func confirmSNSSubscription(subscribeURL string) {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		notifyLog.Errorf("Refusing SNS subscription URL %q", subscribeURL)
+		return
+	}
+	resp, err := http.Get(u.String())
+	if err != nil {
+		notifyLog.Errorf("SNS subscription confirmation failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	notifyLog.Printf("✓ SNS subscription confirmed")
+}
+
+func handleSESNotification(n sesNotification) {
+	kind := n.NotificationType
+	if kind == "" {
+		kind = n.EventType
+	}
+
+	switch kind {
+	case "Bounce":
+		status := deliveryBounced
+		if n.Bounce.BounceType == "Transient" {
+			status = deliveryDelayed
+		}
+		detail := n.Bounce.BounceType
+		for _, rcpt := range n.Bounce.BouncedRecipients {
+			if rcpt.DiagnosticCode != "" {
+				detail = rcpt.DiagnosticCode
+			}
+			// Only hard bounces mean the address is bad
+			if status == deliveryBounced {
+				suppressAddress(rcpt.EmailAddress, "bounce", rcpt.DiagnosticCode)
+			}
+		}
+		updateDelivery(n.Mail.MessageID, status, detail)
+	case "Complaint":
+		for _, rcpt := range n.Complaint.ComplainedRecipients {
+			suppressAddress(rcpt.EmailAddress, "complaint", "")
+		}
+		updateDelivery(n.Mail.MessageID, deliveryComplained, "")
+	case "Delivery":
+		updateDelivery(n.Mail.MessageID, deliveryDelivered, "")
+	}
+}
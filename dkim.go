@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Headers covered by the signature, in signing order
+var dkimSignedHeaders = []string{"from", "to", "subject", "date", "message-id", "mime-version", "content-type"}
+
+// DKIM signer (rsa-sha256, relaxed/relaxed canonicalization)
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      *rsa.PrivateKey
+}
+
+// Load the DKIM key from DKIM_DOMAIN, DKIM_SELECTOR and
+// DKIM_PRIVATE_KEY_FILE. Returns nil when signing isn't configured.
+func loadDKIMSigner() (*dkimSigner, error) {
+	domain := os.Getenv("DKIM_DOMAIN")
+	selector := os.Getenv("DKIM_SELECTOR")
+	keyFile := os.Getenv("DKIM_PRIVATE_KEY_FILE")
+	if domain == "" && selector == "" && keyFile == "" {
+		return nil, nil
+	}
+	if domain == "" || selector == "" || keyFile == "" {
+		return nil, fmt.Errorf("DKIM_DOMAIN, DKIM_SELECTOR and DKIM_PRIVATE_KEY_FILE must all be set")
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM key found", keyFile)
+	}
+
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var parsed any
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if key, ok = parsed.(*rsa.PrivateKey); !ok {
+				err = fmt.Errorf("%s: only RSA keys are supported", keyFile)
+			}
+		}
+	default:
+		err = fmt.Errorf("%s: unsupported PEM block %q", keyFile, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &dkimSigner{domain: domain, selector: selector, key: key}, nil
+}
+
+// Return msg with a DKIM-Signature header prepended. msg must use CRLF
+// line endings.
+func (d *dkimSigner) Sign(msg []byte) ([]byte, error) {
+	raw := string(msg)
+	headerPart, body, found := strings.Cut(raw, "\r\n\r\n")
+	if !found {
+		return nil, fmt.Errorf("message has no body separator")
+	}
+
+	bodyHash := sha256.Sum256([]byte(dkimRelaxedBody(body)))
+
+	// Last occurrence of each header, per RFC 6376 section 5.4.2
+	headers := map[string]string{}
+	var signed []string
+	for _, h := range dkimHeaderFields(headerPart) {
+		name, _, _ := strings.Cut(h, ":")
+		headers[strings.ToLower(strings.TrimSpace(name))] = h
+	}
+	for _, name := range dkimSignedHeaders {
+		if _, ok := headers[name]; ok {
+			signed = append(signed, name)
+		}
+	}
+
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		d.domain, d.selector, time.Now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	h := sha256.New()
+	for _, name := range signed {
+		h.Write([]byte(dkimRelaxedHeader(headers[name]) + "\r\n"))
+	}
+	h.Write([]byte(dkimRelaxedHeader(sig)))
+
+	b, err := rsa.SignPKCS1v15(rand.Reader, d.key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(sig + base64.StdEncoding.EncodeToString(b) + "\r\n" + raw), nil
+}
+
+// Split a header block into fields, keeping folded continuation lines
+// with the field they belong to
+func dkimHeaderFields(block string) []string {
+	var fields []string
+	for _, line := range strings.Split(block, "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// Relaxed header canonicalization (RFC 6376 section 3.4.2)
+func dkimRelaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Join(strings.Fields(value), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+// Relaxed body canonicalization (RFC 6376 section 3.4.4)
+func dkimRelaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		lines[i] = collapseWhitespace(line)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// Reduce runs of spaces and tabs to a single space
+func collapseWhitespace(s string) string {
+	var b strings.Builder
+	inSpace := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			if !inSpace {
+				b.WriteByte(' ')
+			}
+			inSpace = true
+			continue
+		}
+		inSpace = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Changing a user's email takes a confirmation link from both the old
+// address (it's really them) and the new one (they own it). Once both are
+// clicked the change is applied, along with every reference that makes
+// the user the owner of something: tickets they requested or are
+// assigned, open tasks, assets, contracts and billing links. Messages
+// and history keep the address they were written with.
+const emailChangeTTL = 24 * time.Hour
+
+// Tables and columns holding a user's email as an owner
+var emailOwnerColumns = [][2]string{
+	{"tickets", "email"},
+	{"tickets", "assigned_to"},
+	{"archived_tickets", "email"},
+	{"archived_tickets", "assigned_to"},
+	{"ticket_tasks", "assignee"},
+	{"assets", "owner_email"},
+	{"support_contracts", "email"},
+	{"stripe_customers", "email"},
+}
+
+// Create email changes table
+func createEmailChangesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS email_changes (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			old_email VARCHAR(255) NOT NULL,
+			new_email VARCHAR(255) NOT NULL,
+			old_token_hash VARCHAR(64) UNIQUE NOT NULL,
+			new_token_hash VARCHAR(64) UNIQUE NOT NULL,
+			old_confirmed_at TIMESTAMP,
+			new_confirmed_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP,
+			cancelled_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS email_changes_user_idx ON email_changes (user_id)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create email_changes table:", err)
+	}
+}
+
+func newEmailChangeToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// POST /me/email starts a change and mails both confirmation links;
+// DELETE /me/email cancels a pending one
+func handleEmailChange(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	switch r.Method {
+	case "POST":
+		requestEmailChange(w, r, user)
+
+	case "DELETE":
+		res, err := db.Exec(`
+			UPDATE email_changes SET cancelled_at = CURRENT_TIMESTAMP
+			WHERE user_id = $1 AND completed_at IS NULL AND cancelled_at IS NULL
+		`, user.ID)
+		if err != nil {
+			http.Error(w, "Failed to cancel email change", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "No pending email change", http.StatusNotFound)
+			return
+		}
+		log.Printf("✓ Email change cancelled by %s", user.Email)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func requestEmailChange(w http.ResponseWriter, r *http.Request, user User) {
+	if proxyAuthEnabled() || ldapAuthEnabled() {
+		http.Error(w, "Email addresses are managed by your organization's sign-in", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		NewEmail string `json:"new_email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	newEmail := strings.ToLower(strings.TrimSpace(req.NewEmail))
+	switch {
+	case strings.LastIndex(newEmail, "@") < 1 || len(newEmail) > 255 || strings.ContainsAny(newEmail, " \r\n"):
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	case strings.EqualFold(newEmail, user.Email):
+		http.Error(w, "That is already your email address", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := userByPassword(user.Email, req.Password); err != nil {
+		if err == errInvalidCredentials {
+			recordSecurityEvent(user.ID, securityEventLoginFailed, r, "email change")
+			http.Error(w, "Password is incorrect", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// Checked again when the change is applied
+	if _, err := store.Users().IDByEmail(newEmail); err == nil {
+		http.Error(w, "That email address is already in use", http.StatusConflict)
+		return
+	}
+
+	oldToken, err := newEmailChangeToken()
+	if err != nil {
+		http.Error(w, "Failed to start email change", http.StatusInternalServerError)
+		return
+	}
+	newToken, err := newEmailChangeToken()
+	if err != nil {
+		http.Error(w, "Failed to start email change", http.StatusInternalServerError)
+		return
+	}
+
+	// Starting over replaces any earlier request
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		UPDATE email_changes SET cancelled_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND completed_at IS NULL AND cancelled_at IS NULL
+	`, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to start email change", http.StatusInternalServerError)
+		return
+	}
+	var expiresAt time.Time
+	err = tx.QueryRow(`
+		INSERT INTO email_changes (user_id, old_email, new_email, old_token_hash, new_token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING expires_at
+	`, user.ID, user.Email, newEmail, hashToken(oldToken), hashToken(newToken), time.Now().Add(emailChangeTTL).UTC()).Scan(&expiresAt)
+	if err != nil {
+		http.Error(w, "Failed to start email change", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to start email change", http.StatusInternalServerError)
+		return
+	}
+
+	sendMailAsync(user.Email, "Confirm your support account email change", fmt.Sprintf(`A change of your support account's email address to %s was requested.
+
+To allow it, open this link within 24 hours:
+
+%s/email_change/%s
+
+The change also has to be confirmed from the new address. If you didn't
+ask for this, ignore this email and change your password.
+`, newEmail, publicBaseURL(), oldToken))
+	sendMailAsync(newEmail, "Confirm your new support account email", fmt.Sprintf(`%s asked to use this address for their support account.
+
+To confirm it, open this link within 24 hours:
+
+%s/email_change/%s
+
+If this wasn't you, ignore this email.
+`, user.Email, publicBaseURL(), newToken))
+
+	log.Printf("✓ Email change from %s to %s requested", user.Email, newEmail)
+	recordSecurityEvent(user.ID, securityEventEmailChangeRequested, r, newEmail)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Confirmation links sent to both addresses",
+		"new_email":  newEmail,
+		"expires_at": expiresAt,
+	})
+}
+
+// GET /email_change/{token}: a confirmation link. The second of the two
+// applies the change.
+func handleEmailChangeConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/email_change/")
+	if token == "" || strings.Contains(token, "/") {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var id, userID int
+	var oldEmail, newEmail string
+	var oldConfirmed, newConfirmed bool
+	err = tx.QueryRow(`
+		UPDATE email_changes SET
+			old_confirmed_at = CASE WHEN old_token_hash = $1 THEN COALESCE(old_confirmed_at, CURRENT_TIMESTAMP) ELSE old_confirmed_at END,
+			new_confirmed_at = CASE WHEN new_token_hash = $1 THEN COALESCE(new_confirmed_at, CURRENT_TIMESTAMP) ELSE new_confirmed_at END
+		WHERE (old_token_hash = $1 OR new_token_hash = $1)
+			AND completed_at IS NULL AND cancelled_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING id, user_id, old_email, new_email, old_confirmed_at IS NOT NULL, new_confirmed_at IS NOT NULL
+	`, hashToken(token)).Scan(&id, &userID, &oldEmail, &newEmail, &oldConfirmed, &newConfirmed)
+	if err == sql.ErrNoRows {
+		http.Error(w, "This link has expired or was already used", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if !oldConfirmed || !newConfirmed {
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Confirmed. The change takes effect once the other address confirms too."})
+		return
+	}
+
+	if err := applyEmailChange(tx, userID, oldEmail, newEmail); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			http.Error(w, "That email address is already in use", http.StatusConflict)
+			return
+		}
+		log.Printf("Error changing email from %s to %s: %v", oldEmail, newEmail, err)
+		http.Error(w, "Failed to change email", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE email_changes SET completed_at = CURRENT_TIMESTAMP WHERE id = $1", id); err != nil {
+		http.Error(w, "Failed to change email", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to change email", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Email changed from %s to %s", oldEmail, newEmail)
+	recordAudit(newEmail, "user.email_changed", 0, map[string]interface{}{"user_id": userID, "from": oldEmail, "to": newEmail})
+	recordSecurityEvent(userID, securityEventEmailChanged, r, oldEmail+" → "+newEmail)
+	sendMailAsync(oldEmail, "Your support account email was changed", fmt.Sprintf(`Your support account now uses %s. This address will no longer
+receive updates about your tickets.
+`, newEmail))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email changed", "email": newEmail})
+}
+
+// Move the user and everything they own over to the new address
+func applyEmailChange(tx *sql.Tx, userID int, oldEmail, newEmail string) error {
+	res, err := tx.Exec("UPDATE users SET email = $1 WHERE id = $2 AND email = $3", newEmail, userID, oldEmail)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %d no longer has email %s", userID, oldEmail)
+	}
+	for _, c := range emailOwnerColumns {
+		_, err := tx.Exec(fmt.Sprintf("UPDATE %[1]s SET %[2]s = $1 WHERE lower(%[2]s) = lower($2)", c[0], c[1]), newEmail, oldEmail)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", c[0], c[1], err)
+		}
+	}
+	return nil
+}
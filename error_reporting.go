@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Panics in handlers become 500s that carry the request's ID, which is
+// also sent on every response as X-Request-Id and logged with the stack.
+// Reports go to Sentry when SENTRY_DSN is set and/or as JSON to
+// ERROR_WEBHOOK_URL, at most errorReportsPerMinute a minute so a panic
+// on a hot path can't flood them.
+
+const errorReportsPerMinute = 30
+
+// Per-request details for error reports, filled in as the request
+// passes through the middleware
+type requestInfo struct {
+	id   string
+	user string
+}
+
+type requestInfoKey struct{}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Note the authenticated user for error reports about this request
+func setRequestUser(r *http.Request, email string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.user = email
+	}
+}
+
+// Give the request an ID and turn panics into 500s that are logged and
+// reported
+func recoverPanics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{id: newRequestID()}
+		w.Header().Set("X-Request-Id", info.id)
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// Deliberate aborts are how net/http drops a connection
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			stack := debug.Stack()
+			log.Printf("Panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, info.id, err, stack)
+			reportError(ErrorReport{
+				RequestID: info.id,
+				Error:     fmt.Sprint(err),
+				Stack:     string(stack),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				User:      info.user,
+				IP:        clientIP(r),
+				UserAgent: r.UserAgent(),
+				At:        time.Now().UTC(),
+				frames:    panicFrames(),
+			})
+			http.Error(w, fmt.Sprintf("Internal server error (request %s)", info.id), http.StatusInternalServerError)
+		}()
+		next(w, r)
+	}
+}
+
+// Error as sent to ERROR_WEBHOOK_URL
+type ErrorReport struct {
+	RequestID string    `json:"request_id,omitempty"`
+	Error     string    `json:"error"`
+	Stack     string    `json:"stack"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	User      string    `json:"user,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	At        time.Time `json:"at"`
+
+	frames []runtime.Frame
+}
+
+// Frames of the goroutine that panicked, outermost first, from inside
+// the deferred function that recovered
+func panicFrames() []runtime.Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var stack []runtime.Frame
+	for {
+		f, more := frames.Next()
+		stack = append([]runtime.Frame{f}, stack...)
+		if !more {
+			return stack
+		}
+	}
+}
+
+var errorReporting struct {
+	sync.Mutex
+	sentry      *sentryDSN
+	webhook     string
+	windowStart time.Time
+	sent        int
+}
+
+// Load SENTRY_DSN and ERROR_WEBHOOK_URL
+func loadErrorReporting() {
+	if dsn := os.Getenv("SENTRY_DSN"); dsn != "" {
+		s, err := parseSentryDSN(dsn)
+		if err != nil {
+			log.Fatal("Invalid SENTRY_DSN:", err)
+		}
+		errorReporting.sentry = s
+		log.Printf("✓ Reporting errors to Sentry project %s", s.project)
+	}
+	if hook := os.Getenv("ERROR_WEBHOOK_URL"); hook != "" {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			log.Fatal("ERROR_WEBHOOK_URL must be an http(s) URL")
+		}
+		errorReporting.webhook = hook
+		log.Println("✓ Reporting errors to webhook")
+	}
+}
+
+// Send a report in the background, unless the minute's quota is used up
+func reportError(rep ErrorReport) {
+	errorReporting.Lock()
+	sentry, webhook := errorReporting.sentry, errorReporting.webhook
+	if sentry == nil && webhook == "" {
+		errorReporting.Unlock()
+		return
+	}
+	if time.Since(errorReporting.windowStart) > time.Minute {
+		errorReporting.windowStart = time.Now()
+		errorReporting.sent = 0
+	}
+	errorReporting.sent++
+	over := errorReporting.sent > errorReportsPerMinute
+	errorReporting.Unlock()
+	if over {
+		return
+	}
+
+	go func() {
+		if sentry != nil {
+			if err := sentry.send(rep); err != nil {
+				log.Printf("Failed to report error to Sentry: %v", err)
+			}
+		}
+		if webhook != "" {
+			if err := postErrorReport(webhook, rep); err != nil {
+				log.Printf("Failed to report error to webhook: %v", err)
+			}
+		}
+	}()
+}
+
+func postErrorReport(webhook string, rep ErrorReport) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Sentry project to send events to, from a DSN like
+// https://<key>@o0.ingest.sentry.io/<project>
+type sentryDSN struct {
+	storeURL  string
+	publicKey string
+	project   string
+}
+
+func parseSentryDSN(dsn string) (*sentryDSN, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("expected https://<key>@<host>/<project>")
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	project := path[slash+1:]
+	if project == "" {
+		return nil, fmt.Errorf("no project ID in %s", u.Redacted())
+	}
+	return &sentryDSN{
+		storeURL:  fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:slash], project),
+		publicKey: u.User.Username(),
+		project:   project,
+	}, nil
+}
+
+// Send a report as a Sentry event
+func (s *sentryDSN) send(rep ErrorReport) error {
+	eventID := make([]byte, 16)
+	rand.Read(eventID)
+
+	frames := []map[string]interface{}{}
+	for _, f := range rep.frames {
+		frames = append(frames, map[string]interface{}{
+			"function": f.Function,
+			"abs_path": f.File,
+			"lineno":   f.Line,
+			"in_app":   strings.HasPrefix(f.Function, "main."),
+		})
+	}
+	hostname, _ := os.Hostname()
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(eventID),
+		"timestamp":   rep.At.Format(time.RFC3339),
+		"level":       "error",
+		"platform":    "go",
+		"logger":      "sts",
+		"server_name": hostname,
+		"exception": map[string]interface{}{
+			"values": []map[string]interface{}{{
+				"type":       "panic",
+				"value":      rep.Error,
+				"stacktrace": map[string]interface{}{"frames": frames},
+			}},
+		},
+		"tags": map[string]string{"request_id": rep.RequestID},
+	}
+	if env := os.Getenv("SENTRY_ENVIRONMENT"); env != "" {
+		event["environment"] = env
+	}
+	if rep.Method != "" {
+		event["request"] = map[string]interface{}{
+			"method":  rep.Method,
+			"url":     publicBaseURL() + rep.Path,
+			"headers": map[string]string{"User-Agent": rep.UserAgent},
+		}
+	}
+	if rep.User != "" || rep.IP != "" {
+		event["user"] = map[string]string{"email": rep.User, "ip_address": rep.IP}
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=sts/1.0, sentry_key=%s", s.publicKey))
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry returned %s", resp.Status)
+	}
+	return nil
+}
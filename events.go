@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Event types published on the bus
+const (
+	eventTicketCreated          = "ticket.created"
+	eventTicketClosed           = "ticket.closed"
+	eventTicketAssigned         = "ticket.assigned"
+	eventTicketFieldsUpdated    = "ticket.fields_updated"
+	eventTicketTagsUpdated      = "ticket.tags_updated"
+	eventTicketAssetsUpdated    = "ticket.assets_updated"
+	eventTicketRequesterChanged = "ticket.requester_changed"
+	eventTicketPriorityChanged  = "ticket.priority_changed"
+	eventTicketStatusChanged    = "ticket.status_changed"
+	eventMessageCreated         = "message.created"
+)
+
+// Something that happened, published by handlers and services and
+// consumed by notification, audit and other cross-cutting subsystems
+type Event struct {
+	Type     string                 `json:"type"`
+	Actor    string                 `json:"actor"`
+	TicketID int                    `json:"ticket_id,omitempty"`
+	Ticket   *Ticket                `json:"ticket,omitempty"`
+	Message  *Message               `json:"message,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+	At       time.Time              `json:"at"`
+}
+
+// Transport between publishers and subscribers. The in-memory backend
+// delivers within this process; a durable backend (e.g. a database
+// outbox or queue) can replace it without touching publishers.
+type eventBackend interface {
+	Publish(ev Event) error
+	// Deliver events to handle until the process exits
+	Consume(handle func(Event))
+}
+
+// In-process backend: a buffered channel drained by one goroutine, so
+// subscribers see events in publish order
+type memoryEventBackend struct {
+	ch chan Event
+}
+
+func newMemoryEventBackend() *memoryEventBackend {
+	return &memoryEventBackend{ch: make(chan Event, 1024)}
+}
+
+func (b *memoryEventBackend) Publish(ev Event) error {
+	b.ch <- ev
+	return nil
+}
+
+func (b *memoryEventBackend) Consume(handle func(Event)) {
+	for ev := range b.ch {
+		handle(ev)
+	}
+}
+
+var eventBus = struct {
+	sync.RWMutex
+	backend     eventBackend
+	subscribers map[string][]func(Event)
+}{subscribers: map[string][]func(Event){}}
+
+// Register fn for an event type, or "*" for every event. Subscribers run
+// on the bus goroutine and should hand slow work off themselves.
+func subscribe(eventType string, fn func(Event)) {
+	eventBus.Lock()
+	defer eventBus.Unlock()
+	eventBus.subscribers[eventType] = append(eventBus.subscribers[eventType], fn)
+}
+
+// Publish an event. Before startEventBus, events are delivered inline.
+func publish(ev Event) {
+	if ev.At.IsZero() {
+		ev.At = time.Now().UTC()
+	}
+
+	eventBus.RLock()
+	backend := eventBus.backend
+	eventBus.RUnlock()
+
+	if backend == nil {
+		dispatchEvent(ev)
+		return
+	}
+	if err := backend.Publish(ev); err != nil {
+		log.Printf("Failed to publish %s event: %v", ev.Type, err)
+	}
+}
+
+// Start delivering events through backend
+func startEventBus(backend eventBackend) {
+	eventBus.Lock()
+	eventBus.backend = backend
+	eventBus.Unlock()
+
+	go backend.Consume(dispatchEvent)
+	log.Println("✓ Event bus started")
+}
+
+func dispatchEvent(ev Event) {
+	eventBus.RLock()
+	subs := append(append([]func(Event){}, eventBus.subscribers[ev.Type]...), eventBus.subscribers["*"]...)
+	eventBus.RUnlock()
+
+	for _, fn := range subs {
+		// One misbehaving subscriber shouldn't take down the bus
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					stack := debug.Stack()
+					log.Printf("Event subscriber for %s panicked: %v\n%s", ev.Type, err, stack)
+					reportError(ErrorReport{
+						Error:  fmt.Sprintf("event subscriber for %s: %v", ev.Type, err),
+						Stack:  string(stack),
+						At:     time.Now().UTC(),
+						frames: panicFrames(),
+					})
+				}
+			}()
+			fn(ev)
+		}()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Tables exported nightly and the query for one day of rows. Each query
+// returns a single JSON column so rows can be written as NDJSON directly.
+var exportTables = map[string]string{
+	"tickets": `
+		SELECT row_to_json(t) FROM (
+			SELECT id, reference, email, subject, description, status, channel, category, priority, org_id,
+				assigned_to, closed_by, closed_at, csat_score, created_at 
+			FROM tickets WHERE created_at >= $1 AND created_at < $2 ORDER BY id
+		) t`,
+	"messages": `
+		SELECT row_to_json(m) FROM (
+			SELECT id, ticket_id, sender_email, message, is_description, created_at 
+			FROM messages WHERE created_at >= $1 AND created_at < $2 ORDER BY id
+		) m`,
+	"audit_events": `
+		SELECT row_to_json(a) FROM (
+			SELECT id, actor_email, action, ticket_id, details, created_at 
+			FROM audit_events WHERE created_at >= $1 AND created_at < $2 ORDER BY id
+		) a`,
+}
+
+// How many missed days the export catches up on after downtime
+const exportCatchUpDays = 7
+
+// Create export bookkeeping table
+func createExportRunsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS export_runs (
+			day DATE PRIMARY KEY,
+			exported_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create export_runs table:", err)
+	}
+}
+
+// S3 location for exports; disabled unless EXPORT_S3_PREFIX is set
+func exportDestination() (bucket, prefix string, ok bool) {
+	prefix = strings.Trim(os.Getenv("EXPORT_S3_PREFIX"), "/")
+	bucket = os.Getenv("EXPORT_S3_BUCKET")
+	if bucket == "" {
+		bucket = os.Getenv("S3_BUCKET_NAME")
+	}
+	return bucket, prefix, prefix != "" && bucket != "" && s3Client != nil
+}
+
+// Export every completed day that hasn't been exported yet
+func exportEvents() error {
+	bucket, prefix, ok := exportDestination()
+	if !ok {
+		return nil
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for i := exportCatchUpDays; i >= 1; i-- {
+		day := today.AddDate(0, 0, -i)
+
+		var done bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM export_runs WHERE day = $1)", day).Scan(&done); err != nil {
+			return err
+		}
+		if done {
+			continue
+		}
+
+		for table, query := range exportTables {
+			key := fmt.Sprintf("%s/%s/dt=%s/%s.ndjson", prefix, table, day.Format("2006-01-02"), table)
+			n, err := exportDay(bucket, key, query, day)
+			if err != nil {
+				return fmt.Errorf("export %s for %s: %w", table, day.Format("2006-01-02"), err)
+			}
+			log.Printf("✓ Exported %d %s rows to s3://%s/%s", n, table, bucket, key)
+		}
+
+		if _, err := db.Exec("INSERT INTO export_runs (day) VALUES ($1) ON CONFLICT DO NOTHING", day); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stream one day of rows to S3 as NDJSON without buffering the whole file
+func exportDay(bucket, key, query string, day time.Time) (int, error) {
+	rows, err := db.Query(query, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	pr, pw := io.Pipe()
+	written := make(chan int, 1)
+
+	go func() {
+		count := 0
+		defer func() { written <- count }()
+
+		for rows.Next() {
+			var line []byte
+			if err := rows.Scan(&line); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if !json.Valid(line) {
+				continue
+			}
+			if _, err := pw.Write(append(line, '\n')); err != nil {
+				return
+			}
+			count++
+		}
+		pw.CloseWithError(rows.Err())
+	}()
+
+	uploader := s3manager.NewUploaderWithClient(s3Client)
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        pr,
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	pr.Close()
+	return <-written, err
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Background work that gave up (an email out of retries, a scheduled job
+// that failed) is kept as a failed job so an admin can see why and retry
+// or discard it. Failures with a key (a job's name) collect on one open
+// entry rather than adding a row each time; a later success resolves it.
+
+const (
+	jobFailed    = "failed"
+	jobRetrying  = "retrying"
+	jobSucceeded = "succeeded"
+	jobDiscarded = "discarded"
+)
+
+type JobAttempt struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+	// Who retried it; empty for the automatic attempts
+	By string `json:"by,omitempty"`
+}
+
+type FailedJob struct {
+	ID         int             `json:"id"`
+	Kind       string          `json:"kind"`
+	Key        string          `json:"key,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+	Error      string          `json:"error"`
+	Attempts   []JobAttempt    `json:"attempts"`
+	Status     string          `json:"status"`
+	ResolvedBy string          `json:"resolved_by,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// How each kind of failed job is retried, given its payload
+var jobRetriers = map[string]func(payload json.RawMessage) error{
+	"email": retryFailedEmail,
+	"job":   retryFailedScheduledJob,
+}
+
+// Create the failed jobs table
+func createFailedJobsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS failed_jobs (
+			id SERIAL PRIMARY KEY,
+			kind VARCHAR(50) NOT NULL,
+			key VARCHAR(255) NOT NULL DEFAULT '',
+			payload JSONB NOT NULL,
+			error TEXT NOT NULL,
+			attempts JSONB NOT NULL DEFAULT '[]',
+			status VARCHAR(20) NOT NULL DEFAULT 'failed',
+			resolved_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS failed_jobs_status_idx ON failed_jobs (status, created_at);
+		CREATE UNIQUE INDEX IF NOT EXISTS failed_jobs_open_key_idx ON failed_jobs (kind, key)
+			WHERE key <> '' AND status IN ('failed', 'retrying')
+	`)
+	if err != nil {
+		log.Fatal("Failed to create failed_jobs table:", err)
+	}
+}
+
+// Record background work that gave up after attempts. With a key, the
+// attempts are added to the open entry for it if there is one.
+func recordFailedJob(kind, key string, payload interface{}, attempts []JobAttempt) {
+	if !fullFeatured() || len(attempts) == 0 {
+		return
+	}
+	rawPayload, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to record failed %s job: %v", kind, err)
+		return
+	}
+	rawAttempts, _ := json.Marshal(attempts)
+	lastError := attempts[len(attempts)-1].Error
+
+	if key != "" {
+		res, err := db.Exec(`
+			UPDATE failed_jobs SET payload = $3, error = $4, attempts = attempts || $5::jsonb, updated_at = CURRENT_TIMESTAMP
+			WHERE kind = $1 AND key = $2 AND status = 'failed'
+		`, kind, key, rawPayload, lastError, rawAttempts)
+		if err != nil {
+			log.Printf("Failed to record failed %s job %s: %v", kind, key, err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return
+		}
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO failed_jobs (kind, key, payload, error, attempts) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (kind, key) WHERE key <> '' AND status IN ('failed', 'retrying') DO NOTHING
+	`, kind, key, rawPayload, lastError, rawAttempts)
+	if err != nil {
+		log.Printf("Failed to record failed %s job: %v", kind, err)
+	}
+}
+
+// Mark the open entry for key resolved, once the work has succeeded
+func resolveFailedJob(kind, key string) {
+	if !fullFeatured() {
+		return
+	}
+	res, err := db.Exec(`
+		UPDATE failed_jobs SET status = 'succeeded', resolved_by = 'system', updated_at = CURRENT_TIMESTAMP
+		WHERE kind = $1 AND key = $2 AND status = 'failed'
+	`, kind, key)
+	if err != nil {
+		log.Printf("Failed to resolve failed %s job %s: %v", kind, key, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("✓ Failed %s job %s resolved by a later run", kind, key)
+	}
+}
+
+const failedJobColumns = `id, kind, key, payload, error, attempts, status, COALESCE(resolved_by, ''), created_at, updated_at`
+
+func scanFailedJob(row interface{ Scan(...interface{}) error }) (FailedJob, error) {
+	var j FailedJob
+	var payload, attempts []byte
+	err := row.Scan(&j.ID, &j.Kind, &j.Key, &payload, &j.Error, &attempts, &j.Status, &j.ResolvedBy, &j.CreatedAt, &j.UpdatedAt)
+	if err != nil {
+		return j, err
+	}
+	j.Payload = payload
+	if err := json.Unmarshal(attempts, &j.Attempts); err != nil {
+		return j, err
+	}
+	return j, nil
+}
+
+// Admin: GET /admin/jobs?status=failed[&kind=] lists failed jobs, newest
+// first; POST /admin/jobs/{id}/retry runs one again now and
+// POST /admin/jobs/{id}/discard gives up on it
+func handleFailedJobs(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/jobs"), "/")
+
+	switch {
+	case idPart == "" && r.Method == "GET":
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = jobFailed
+		}
+		if status != jobFailed && status != jobRetrying && status != jobSucceeded && status != jobDiscarded {
+			http.Error(w, "status must be failed, retrying, succeeded or discarded", http.StatusBadRequest)
+			return
+		}
+		page, err := parsePage(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		args := []interface{}{status}
+		where := " WHERE status = $1"
+		if kind := r.URL.Query().Get("kind"); kind != "" {
+			args = append(args, kind)
+			where += fmt.Sprintf(" AND kind = $%d", len(args))
+		}
+
+		var total int
+		if err := db.QueryRow("SELECT COUNT(*) FROM failed_jobs"+where, args...).Scan(&total); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		args = append(args, page.Limit, page.Offset)
+		rows, err := db.Query(fmt.Sprintf("SELECT "+failedJobColumns+" FROM failed_jobs"+where+
+			" ORDER BY updated_at DESC, id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args)), args...)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		jobs := []FailedJob{}
+		for rows.Next() {
+			j, err := scanFailedJob(rows)
+			if err != nil {
+				log.Printf("Error reading failed job: %v", err)
+				continue
+			}
+			jobs = append(jobs, j)
+		}
+
+		setPageHeaders(w, r, page, total)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+
+	case strings.HasSuffix(idPart, "/retry") && r.Method == "POST":
+		id, err := strconv.Atoi(strings.TrimSuffix(idPart, "/retry"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		job, err := retryFailedJob(id, user)
+		if err == sql.ErrNoRows {
+			http.Error(w, "No failed job with that ID", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error retrying failed job %d: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+
+	case strings.HasSuffix(idPart, "/discard") && r.Method == "POST":
+		id, err := strconv.Atoi(strings.TrimSuffix(idPart, "/discard"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		job, err := scanFailedJob(db.QueryRow(`
+			UPDATE failed_jobs SET status = 'discarded', resolved_by = $2, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND status = 'failed'
+			RETURNING `+failedJobColumns, id, user.Email))
+		if err == sql.ErrNoRows {
+			http.Error(w, "No failed job with that ID", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("✓ Failed %s job %d discarded by %s", job.Kind, id, user.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Run a failed job again. It is claimed first, so two admins retrying at
+// once don't both run it. A failure goes back on the list with the new
+// attempt added; the returned job says which happened.
+func retryFailedJob(id int, user User) (FailedJob, error) {
+	var kind string
+	var payload []byte
+	err := db.QueryRow(`
+		UPDATE failed_jobs SET status = 'retrying', updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'failed'
+		RETURNING kind, payload
+	`, id).Scan(&kind, &payload)
+	if err != nil {
+		return FailedJob{}, err
+	}
+
+	retry, ok := jobRetriers[kind]
+	runErr := fmt.Errorf("no way to retry %s jobs", kind)
+	if ok {
+		runErr = retry(payload)
+	}
+
+	if runErr == nil {
+		log.Printf("✓ Failed %s job %d retried by %s", kind, id, user.Email)
+		return scanFailedJob(db.QueryRow(`
+			UPDATE failed_jobs SET status = 'succeeded', resolved_by = $2, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+			RETURNING `+failedJobColumns, id, user.Email))
+	}
+
+	log.Printf("Retry of failed %s job %d by %s failed: %v", kind, id, user.Email, runErr)
+	attempt, _ := json.Marshal([]JobAttempt{{At: time.Now().UTC(), Error: runErr.Error(), By: user.Email}})
+	return scanFailedJob(db.QueryRow(`
+		UPDATE failed_jobs SET status = 'failed', error = $2, attempts = attempts || $3::jsonb, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+failedJobColumns, id, runErr.Error(), attempt))
+}
+
+// Payload of a failed email
+type failedEmail struct {
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	MessageID int    `json:"message_id,omitempty"`
+}
+
+// Send a failed email once, now
+func retryFailedEmail(payload json.RawMessage) error {
+	var m failedEmail
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+	if mailer == nil {
+		return fmt.Errorf("outbound email isn't configured")
+	}
+	if isSuppressed(m.To) {
+		return fmt.Errorf("%s is on the suppression list", m.To)
+	}
+	providerID, err := mailer.Send(m.To, m.Subject, m.Body)
+	if err != nil {
+		return err
+	}
+	notifyLog.Printf("✓ Email sent to %s: %s", m.To, m.Subject)
+	if m.MessageID != 0 {
+		recordDelivery(providerID, m.MessageID, m.To, deliverySent, "")
+	}
+	return nil
+}
+
+// Run a failed scheduled job now, outside its schedule
+func retryFailedScheduledJob(payload json.RawMessage) error {
+	var p struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	for _, job := range scheduledJobs {
+		if job.name != p.Name {
+			continue
+		}
+		ran, err := runExclusive(job.name, func(conn *sql.Conn) error {
+			if err := job.run(); err != nil {
+				return err
+			}
+			return markJobRun(conn, job.name)
+		})
+		if err == nil && !ran {
+			return fmt.Errorf("job %s is running on another instance", job.name)
+		}
+		return err
+	}
+	return fmt.Errorf("no scheduled job named %s", p.Name)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Dev-only fault injection, so the frontend and load tests can exercise
+// error handling. Set FAULT_INJECTION_TOKEN (16+ characters) and send it
+// as X-Fault-Token along with any of:
+//
+//	X-Fault-Latency: 750ms   wait before handling the request (up to 30s)
+//	X-Fault-S3: error        S3 calls fail
+//	X-Fault-DB: error        database calls fail as if it were unreachable
+//
+// The database and S3 clients are shared, so a request asking for their
+// faults runs alone: others wait for it to finish, and background jobs
+// running meanwhile fail too. Never set the token in production.
+
+const maxInjectedLatency = 30 * time.Second
+
+var faults struct {
+	// Held shared by ordinary requests, exclusively by one injecting
+	// S3 or database faults
+	mu sync.RWMutex
+	db atomic.Bool
+	s3 atomic.Bool
+}
+
+var errInjectedFault = errors.New("injected fault")
+
+func faultInjectionEnabled() bool {
+	return len(os.Getenv("FAULT_INJECTION_TOKEN")) >= 16
+}
+
+func logFaultInjection() {
+	if faultInjectionEnabled() {
+		log.Println("Warning: fault injection is enabled (FAULT_INJECTION_TOKEN); do not use in production")
+	}
+}
+
+// Apply the faults a request asks for
+func injectFaults(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		latency := r.Header.Get("X-Fault-Latency")
+		dbFault := r.Header.Get("X-Fault-DB")
+		s3Fault := r.Header.Get("X-Fault-S3")
+		if latency == "" && dbFault == "" && s3Fault == "" {
+			faults.mu.RLock()
+			defer faults.mu.RUnlock()
+			next(w, r)
+			return
+		}
+
+		token := r.Header.Get("X-Fault-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(os.Getenv("FAULT_INJECTION_TOKEN"))) != 1 {
+			http.Error(w, "Invalid fault token", http.StatusForbidden)
+			return
+		}
+		for _, v := range []string{dbFault, s3Fault} {
+			if v != "" && v != "error" {
+				http.Error(w, "X-Fault-DB and X-Fault-S3 only support: error", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if latency != "" {
+			d, err := time.ParseDuration(latency)
+			if err != nil || d < 0 || d > maxInjectedLatency {
+				http.Error(w, fmt.Sprintf("X-Fault-Latency must be a duration up to %s", maxInjectedLatency), http.StatusBadRequest)
+				return
+			}
+			time.Sleep(d)
+		}
+
+		if dbFault == "" && s3Fault == "" {
+			faults.mu.RLock()
+			defer faults.mu.RUnlock()
+			next(w, r)
+			return
+		}
+
+		faults.mu.Lock()
+		defer faults.mu.Unlock()
+		faults.db.Store(dbFault != "")
+		faults.s3.Store(s3Fault != "")
+		defer faults.db.Store(false)
+		defer faults.s3.Store(false)
+
+		log.Printf("Injecting faults into %s %s (db=%t s3=%t)", r.Method, r.URL.Path, dbFault != "", s3Fault != "")
+		next(w, r)
+	}
+}
+
+// Fail S3 calls, including presigning, while a request asks for it
+func addS3FaultHandler(handlers *request.Handlers) {
+	handlers.Validate.PushFront(func(r *request.Request) {
+		if faults.s3.Load() {
+			r.Error = awserr.New("InjectedFault", errInjectedFault.Error(), nil)
+			r.Retryable = aws.Bool(false)
+		}
+	})
+}
+
+// Name to open a database driver under: the driver itself, or a wrapper
+// that can fail on demand when fault injection is enabled
+func sqlDriverName(name string) string {
+	if !faultInjectionEnabled() {
+		return name
+	}
+	wrapped := name + "+faults"
+	faultDrivers.Do(func() {
+		for _, n := range []string{"postgres", "sqlite3"} {
+			if probe, err := sql.Open(n, ""); err == nil {
+				sql.Register(n+"+faults", faultDriver{probe.Driver()})
+				probe.Close()
+			}
+		}
+	})
+	return wrapped
+}
+
+var faultDrivers sync.Once
+
+// What an unreachable database looks like to the caller
+func injectedDBError() error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: errInjectedFault}
+}
+
+type faultDriver struct {
+	driver.Driver
+}
+
+func (d faultDriver) Open(name string) (driver.Conn, error) {
+	if faults.db.Load() {
+		return nil, injectedDBError()
+	}
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return faultConn{conn}, nil
+}
+
+// Connection that fails every statement while a database fault is
+// injected. Statements prepared earlier aren't affected; the store
+// doesn't keep any.
+type faultConn struct {
+	driver.Conn
+}
+
+func (c faultConn) Prepare(query string) (driver.Stmt, error) {
+	if faults.db.Load() {
+		return nil, injectedDBError()
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c faultConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if faults.db.Load() {
+		return nil, injectedDBError()
+	}
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c faultConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if faults.db.Load() {
+		return nil, injectedDBError()
+	}
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c faultConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if faults.db.Load() {
+		return nil, injectedDBError()
+	}
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c faultConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if faults.db.Load() {
+		return nil, injectedDBError()
+	}
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c faultConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
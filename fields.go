@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Field visibility
+const (
+	visibilityPublic   = "public"
+	visibilityInternal = "internal"
+)
+
+// Custom ticket field definition
+type CustomField struct {
+	Key        string `json:"key"`
+	Label      string `json:"label"`
+	Visibility string `json:"visibility"`
+}
+
+// Tag definition
+type Tag struct {
+	Name       string `json:"name"`
+	Visibility string `json:"visibility"`
+}
+
+// Create custom field and tag tables
+func createFieldTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS custom_fields (
+			key VARCHAR(50) PRIMARY KEY,
+			label VARCHAR(200) NOT NULL,
+			visibility VARCHAR(20) NOT NULL DEFAULT 'internal'
+		);
+		CREATE TABLE IF NOT EXISTS ticket_field_values (
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			field_key VARCHAR(50) REFERENCES custom_fields(key) ON DELETE CASCADE,
+			value TEXT NOT NULL,
+			PRIMARY KEY (ticket_id, field_key)
+		);
+		CREATE TABLE IF NOT EXISTS tags (
+			name VARCHAR(50) PRIMARY KEY,
+			visibility VARCHAR(20) NOT NULL DEFAULT 'internal'
+		);
+		CREATE TABLE IF NOT EXISTS ticket_tags (
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			tag VARCHAR(50) REFERENCES tags(name) ON DELETE CASCADE,
+			PRIMARY KEY (ticket_id, tag)
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create custom field tables:", err)
+	}
+}
+
+// Staff see internal fields; requesters only see public ones
+func canSeeInternal(user User) bool {
+	return authorize(user, permTicketsReadAll, nil)
+}
+
+// Attach custom field values and tags to tickets, dropping internal-only
+// ones for callers who can't see them. Every endpoint that returns
+// tickets goes through here so visibility is enforced uniformly.
+func presentTickets(user User, tickets []Ticket) {
+	if len(tickets) == 0 {
+		return
+	}
+
+	ids := make([]int, len(tickets))
+	index := make(map[int]*Ticket, len(tickets))
+	for i := range tickets {
+		ids[i] = tickets[i].ID
+		index[tickets[i].ID] = &tickets[i]
+	}
+
+	internal := canSeeInternal(user)
+
+	setResponseTargets(tickets)
+
+	if attachments, err := store.Tickets().Attachments(ids); err == nil {
+		for id, list := range attachments {
+			index[id].Attachments = presignAttachments(list)
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT v.ticket_id, v.field_key, v.value 
+		FROM ticket_field_values v 
+		JOIN custom_fields f ON f.key = v.field_key 
+		WHERE v.ticket_id = ANY($1) AND (f.visibility = 'public' OR $2)
+	`, pq.Array(ids), internal)
+	if err == nil {
+		for rows.Next() {
+			var id int
+			var key, value string
+			if rows.Scan(&id, &key, &value) != nil {
+				continue
+			}
+			t := index[id]
+			if t.CustomFields == nil {
+				t.CustomFields = make(map[string]string)
+			}
+			t.CustomFields[key] = value
+		}
+		rows.Close()
+	}
+
+	rows, err = db.Query(`
+		SELECT tt.ticket_id, tt.tag 
+		FROM ticket_tags tt 
+		JOIN tags t ON t.name = tt.tag 
+		WHERE tt.ticket_id = ANY($1) AND (t.visibility = 'public' OR $2) 
+		ORDER BY tt.tag
+	`, pq.Array(ids), internal)
+	if err == nil {
+		for rows.Next() {
+			var id int
+			var tag string
+			if rows.Scan(&id, &tag) != nil {
+				continue
+			}
+			index[id].Tags = append(index[id].Tags, tag)
+		}
+		rows.Close()
+	}
+
+	if assets, err := ticketAssets(ids); err == nil {
+		for id, refs := range assets {
+			index[id].Assets = refs
+		}
+	}
+
+	if internal {
+		if entitlements, err := ticketEntitlements(ids); err == nil {
+			for id, e := range entitlements {
+				index[id].Entitlement = e
+			}
+		}
+		if windows, err := ticketChangeWindows(ids); err == nil {
+			for id, c := range windows {
+				index[id].Change = c
+			}
+		}
+		if progress, err := ticketTaskProgress(ids); err == nil {
+			for id, p := range progress {
+				index[id].Tasks = p
+			}
+		}
+	}
+
+	// Built-in internal fields
+	if !internal {
+		for i := range tickets {
+			tickets[i].OrgID = 0
+			tickets[i].Category = ""
+			tickets[i].Entitlement = nil
+			tickets[i].Change = nil
+			tickets[i].Tasks = nil
+		}
+	}
+}
+
+// Single-ticket variant of presentTickets
+func presentTicket(user User, ticket *Ticket) {
+	tickets := []Ticket{*ticket}
+	presentTickets(user, tickets)
+	*ticket = tickets[0]
+}
+
+// Either *sql.DB or *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Store custom field values, rejecting fields the user can't write
+func saveCustomFields(q queryer, user User, ticketID int, values map[string]string) error {
+	internal := canSeeInternal(user)
+	for key, value := range values {
+		var visibility string
+		if err := q.QueryRow("SELECT visibility FROM custom_fields WHERE key = $1", key).Scan(&visibility); err != nil {
+			return errUnknownField
+		}
+		if visibility != visibilityPublic && !internal {
+			return errUnknownField
+		}
+
+		_, err := q.Exec(`
+			INSERT INTO ticket_field_values (ticket_id, field_key, value) 
+			VALUES ($1, $2, $3) 
+			ON CONFLICT (ticket_id, field_key) DO UPDATE SET value = EXCLUDED.value
+		`, ticketID, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fieldError string
+
+func (e fieldError) Error() string { return string(e) }
+
+const errUnknownField = fieldError("unknown custom field")
+
+// PUT /tickets/{id}/fields: set custom field values
+func updateTicketFields(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, actionTicketReply, &ticket) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	var values map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := saveCustomFields(db, user, ticketID, values); err != nil {
+		if err == errUnknownField {
+			http.Error(w, "Unknown custom field", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to save fields", http.StatusInternalServerError)
+		return
+	}
+
+	publish(Event{Type: eventTicketFieldsUpdated, Actor: user.Email, TicketID: ticketID,
+		Data: map[string]interface{}{"fields": values}})
+	presentTicket(user, &ticket)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
+
+// PUT /tickets/{id}/tags: replace the ticket's tags (staff only)
+func updateTicketTags(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsReplyAll, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	var tags []string
+	if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	tx.Exec("DELETE FROM ticket_tags WHERE ticket_id = $1", ticketID)
+	for _, tag := range tags {
+		if _, err := tx.Exec("INSERT INTO ticket_tags (ticket_id, tag) VALUES ($1, $2) ON CONFLICT DO NOTHING", ticketID, tag); err != nil {
+			http.Error(w, "Unknown tag: "+tag, http.StatusBadRequest)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to save tags", http.StatusInternalServerError)
+		return
+	}
+
+	publish(Event{Type: eventTicketTagsUpdated, Actor: user.Email, TicketID: ticketID,
+		Data: map[string]interface{}{"tags": tags}})
+
+	presentTicket(user, &ticket)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
+
+// Admin: list or define custom fields
+func handleCustomFields(w http.ResponseWriter, r *http.Request) {
+	if !authorize(currentUser(r), permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		rows, err := db.Query("SELECT key, label, visibility FROM custom_fields ORDER BY key")
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		fields := []CustomField{}
+		for rows.Next() {
+			var f CustomField
+			if err := rows.Scan(&f.Key, &f.Label, &f.Visibility); err != nil {
+				continue
+			}
+			fields = append(fields, f)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fields)
+
+	case "POST":
+		var f CustomField
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		f.Key = strings.TrimSpace(f.Key)
+		if f.Key == "" || f.Label == "" || !validVisibility(f.Visibility) {
+			http.Error(w, "Key, label and visibility (public or internal) are required", http.StatusBadRequest)
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO custom_fields (key, label, visibility) 
+			VALUES ($1, $2, $3) 
+			ON CONFLICT (key) DO UPDATE SET label = EXCLUDED.label, visibility = EXCLUDED.visibility
+		`, f.Key, f.Label, f.Visibility)
+		if err != nil {
+			http.Error(w, "Failed to save field", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Admin: list or define tags
+func handleTags(w http.ResponseWriter, r *http.Request) {
+	if !authorize(currentUser(r), permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		rows, err := db.Query("SELECT name, visibility FROM tags ORDER BY name")
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		tags := []Tag{}
+		for rows.Next() {
+			var t Tag
+			if err := rows.Scan(&t.Name, &t.Visibility); err != nil {
+				continue
+			}
+			tags = append(tags, t)
+		}
+		sortCollated(tags, func(i int) string { return tags[i].Name })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tags)
+
+	case "POST":
+		var t Tag
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		t.Name = strings.TrimSpace(t.Name)
+		if t.Name == "" || !validVisibility(t.Visibility) {
+			http.Error(w, "Name and visibility (public or internal) are required", http.StatusBadRequest)
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO tags (name, visibility) 
+			VALUES ($1, $2) 
+			ON CONFLICT (name) DO UPDATE SET visibility = EXCLUDED.visibility
+		`, t.Name, t.Visibility)
+		if err != nil {
+			http.Error(w, "Failed to save tag", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func validVisibility(v string) bool {
+	return v == visibilityPublic || v == visibilityInternal
+}
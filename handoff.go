@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A reassignment with a note for the new assignee, e.g. at a shift change
+// or when a supervisor takes a ticket over. Notes are staff-only.
+type Handoff struct {
+	ID           int       `json:"id"`
+	TicketID     int       `json:"ticket_id"`
+	FromAssignee string    `json:"from_assignee"`
+	ToAssignee   string    `json:"to_assignee"`
+	HandedOffBy  string    `json:"handed_off_by"`
+	Note         string    `json:"note"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const maxHandoffNoteLength = 5000
+
+// Create ticket handoffs table
+func createHandoffsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ticket_handoffs (
+			id SERIAL PRIMARY KEY,
+			ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+			from_assignee VARCHAR(255) NOT NULL DEFAULT '',
+			to_assignee VARCHAR(255) NOT NULL,
+			handed_off_by VARCHAR(255) NOT NULL,
+			note TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS ticket_handoffs_ticket_idx ON ticket_handoffs (ticket_id, created_at)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create ticket_handoffs table:", err)
+	}
+}
+
+// GET /tickets/{id}/handoff: the ticket's handoffs, oldest first
+// POST /tickets/{id}/handoff: reassign with a note. Supervisors
+// (tickets.assign) can hand off or take over any ticket they can see;
+// the current assignee can hand off their own.
+func handleHandoff(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if !fullFeatured() {
+		http.Error(w, "Handoffs require PostgreSQL", http.StatusNotImplemented)
+		return
+	}
+
+	user := currentUser(r)
+	if !canSeeInternal(user) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		listHandoffs(w, ticketID)
+	case "POST":
+		handOffTicket(w, r, user, ticket)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listHandoffs(w http.ResponseWriter, ticketID int) {
+	rows, err := db.Query(`
+		SELECT id, ticket_id, from_assignee, to_assignee, handed_off_by, note, created_at
+		FROM ticket_handoffs WHERE ticket_id = $1 ORDER BY created_at, id
+	`, ticketID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	handoffs := []Handoff{}
+	for rows.Next() {
+		var h Handoff
+		if err := rows.Scan(&h.ID, &h.TicketID, &h.FromAssignee, &h.ToAssignee, &h.HandedOffBy, &h.Note, &h.CreatedAt); err != nil {
+			continue
+		}
+		handoffs = append(handoffs, h)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handoffs)
+}
+
+func handOffTicket(w http.ResponseWriter, r *http.Request, user User, ticket Ticket) {
+	supervisor := authorize(user, permTicketsAssign, nil)
+	if !supervisor && !strings.EqualFold(ticket.AssignedTo, user.Email) {
+		http.Error(w, "Only the assignee or a supervisor can hand off this ticket", http.StatusForbidden)
+		return
+	}
+	if ticket.Status == "closed" {
+		http.Error(w, "Ticket is closed", http.StatusConflict)
+		return
+	}
+
+	var req struct {
+		Assignee string `json:"assignee"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Assignee = strings.TrimSpace(req.Assignee)
+	req.Note = strings.TrimSpace(req.Note)
+
+	switch {
+	case req.Note == "":
+		http.Error(w, "A handoff note is required", http.StatusBadRequest)
+		return
+	case len(req.Note) > maxHandoffNoteLength:
+		http.Error(w, "Handoff note is too long", http.StatusBadRequest)
+		return
+	case req.Assignee == "":
+		http.Error(w, "Assignee is required", http.StatusBadRequest)
+		return
+	case strings.EqualFold(req.Assignee, ticket.AssignedTo):
+		http.Error(w, "Ticket is already assigned to "+req.Assignee, http.StatusConflict)
+		return
+	case !isAgent(req.Assignee):
+		http.Error(w, "Assignee must be an agent", http.StatusBadRequest)
+		return
+	}
+	if id, err := store.Users().IDByEmail(req.Assignee); err != nil || !agentScope(id).covers(ticket) {
+		http.Error(w, "Ticket is outside the assignee's categories", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Guard against a concurrent reassignment: the handoff is from the
+	// assignee the caller saw
+	res, err := tx.Exec("UPDATE tickets SET assigned_to = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2 AND COALESCE(assigned_to, '') = $3",
+		req.Assignee, ticket.ID, ticket.AssignedTo)
+	if err != nil {
+		log.Printf("Error handing off ticket #%d: %v", ticket.ID, err)
+		http.Error(w, "Failed to hand off ticket", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Ticket was reassigned in the meantime", http.StatusConflict)
+		return
+	}
+
+	h := Handoff{TicketID: ticket.ID, FromAssignee: ticket.AssignedTo, ToAssignee: req.Assignee,
+		HandedOffBy: user.Email, Note: req.Note}
+	err = tx.QueryRow(`
+		INSERT INTO ticket_handoffs (ticket_id, from_assignee, to_assignee, handed_off_by, note)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at
+	`, h.TicketID, h.FromAssignee, h.ToAssignee, h.HandedOffBy, h.Note).Scan(&h.ID, &h.CreatedAt)
+	if err != nil {
+		log.Printf("Error recording handoff for ticket #%d: %v", ticket.ID, err)
+		http.Error(w, "Failed to hand off ticket", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to hand off ticket", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Ticket #%d handed off from %q to %s by %s", ticket.ID, h.FromAssignee, h.ToAssignee, user.Email)
+	publish(Event{Type: eventTicketAssigned, Actor: user.Email, TicketID: ticket.ID,
+		Data: map[string]interface{}{"assignee": h.ToAssignee, "handoff": h.ID, "from": h.FromAssignee}})
+
+	if !strings.EqualFold(h.ToAssignee, user.Email) {
+		sendMailAsync(h.ToAssignee, fmt.Sprintf("[%s] Handed off to you", ticket.Reference),
+			fmt.Sprintf("%s handed off ticket %s \"%s\" to you.\n\nHandoff note:\n\n%s\n",
+				user.Email, ticket.Reference, ticket.Subject, h.Note))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h)
+}
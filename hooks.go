@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Inbound integrations share one receiver at /hooks/{provider}: the
+// provider's verifier authenticates the raw request, then the handler
+// registered for it parses and acts on the payload
+var webhookVerifiers = map[string]func(r *http.Request, body []byte) error{
+	"slack":   verifySlackSignature,
+	"twilio":  verifyTwilioSignature,
+	"ses":     verifySNSSignature,
+	"stripe":  verifyStripeSignature,
+	"scanner": verifyScannerSignature,
+}
+
+var webhookHandlers = map[string]func(w http.ResponseWriter, r *http.Request, body []byte){}
+
+// ID of a single delivery, used as its replay nonce. Providers that
+// retry reuse the ID, so retries of a processed delivery are dropped too.
+var webhookDeliveryIDs = map[string]func(r *http.Request, body []byte) string{
+	"slack":   slackDeliveryID,
+	"twilio":  twilioDeliveryID,
+	"ses":     snsDeliveryID,
+	"stripe":  stripeDeliveryID,
+	"scanner": scannerDeliveryID,
+}
+
+// Returned by verifiers when the provider's secret isn't configured
+var errWebhookNotConfigured = errors.New("webhook not configured")
+
+// Oldest signed timestamp accepted, to limit replays
+const webhookTolerance = 5 * time.Minute
+
+// How long delivery IDs are remembered. Timestamps older than this are
+// rejected, so a delivery can't be replayed after its nonce expires.
+const webhookReplayWindow = 72 * time.Hour
+
+// Register the handler for a provider's verified webhooks
+func registerWebhookHandler(provider string, fn func(w http.ResponseWriter, r *http.Request, body []byte)) {
+	if webhookVerifiers[provider] == nil || webhookDeliveryIDs[provider] == nil {
+		log.Fatalf("No webhook verifier for %s", provider)
+	}
+	webhookHandlers[provider] = fn
+}
+
+// POST /hooks/{provider}
+func handleHook(w http.ResponseWriter, r *http.Request) {
+	provider := strings.Trim(strings.TrimPrefix(r.URL.Path, "/hooks/"), "/")
+	handler, ok := webhookHandlers[provider]
+	if !ok {
+		http.Error(w, "Unknown integration", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := webhookVerifiers[provider](r, body); err != nil {
+		if err == errWebhookNotConfigured {
+			http.Error(w, "Webhook not configured", http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("Rejected %s webhook from %s: %v", provider, clientIP(r), err)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	id := webhookDeliveryIDs[provider](r, body)
+	if id == "" {
+		http.Error(w, "Missing delivery ID", http.StatusBadRequest)
+		return
+	}
+	fresh, err := claimNonce("hook:"+provider, id, webhookReplayWindow)
+	if err != nil {
+		log.Printf("Error checking %s webhook nonce: %v", provider, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !fresh {
+		// Acknowledge so the provider stops retrying, but don't process again
+		log.Printf("Ignored replayed %s webhook %s from %s", provider, id, clientIP(r))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	handler(rec, r, body)
+	if rec.status >= 500 {
+		// Let the provider's retry through
+		releaseNonce("hook:"+provider, id)
+	}
+}
+
+// Captures the status a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Lets http.ResponseController reach the connection underneath
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Slack doesn't send a delivery ID; the signature covers the timestamp
+// and body, so it is unique per delivery
+func slackDeliveryID(r *http.Request, body []byte) string {
+	return r.Header.Get("X-Slack-Signature")
+}
+
+// Twilio signs no timestamp, so the message or call SID is the only
+// replay protection, and lasts for webhookReplayWindow
+func twilioDeliveryID(r *http.Request, body []byte) string {
+	if token := r.Header.Get("I-Twilio-Idempotency-Token"); token != "" {
+		return token
+	}
+	params, _ := url.ParseQuery(string(body))
+	for _, k := range []string{"MessageSid", "SmsSid", "CallSid"} {
+		if sid := params.Get(k); sid != "" {
+			return sid
+		}
+	}
+	return r.Header.Get("X-Twilio-Signature")
+}
+
+func snsDeliveryID(r *http.Request, body []byte) string {
+	var env snsEnvelope
+	json.Unmarshal(body, &env)
+	return env.MessageID
+}
+
+// Stripe event ID, stable across retries of the same event
+func stripeDeliveryID(r *http.Request, body []byte) string {
+	var event struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(body, &event)
+	return event.ID
+}
+
+// Slack: v0 HMAC-SHA256 of "v0:{timestamp}:{body}" with SLACK_SIGNING_SECRET
+func verifySlackSignature(r *http.Request, body []byte) error {
+	secret := os.Getenv("SLACK_SIGNING_SECRET")
+	if secret == "" {
+		return errWebhookNotConfigured
+	}
+
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	if err := checkWebhookTimestamp(ts); err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// Twilio: base64 HMAC-SHA1 with TWILIO_AUTH_TOKEN over the public URL
+// followed by the sorted form parameters
+func verifyTwilioSignature(r *http.Request, body []byte) error {
+	token := os.Getenv("TWILIO_AUTH_TOKEN")
+	if token == "" || publicBaseURL() == "" {
+		return errWebhookNotConfigured
+	}
+
+	params, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write([]byte(publicBaseURL() + r.URL.RequestURI()))
+	for _, k := range keys {
+		for _, v := range params[k] {
+			mac.Write([]byte(k + v))
+		}
+	}
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get("X-Twilio-Signature"))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// Stripe: "t=...,v1=..." header, HMAC-SHA256 of "{t}.{body}" with
+// STRIPE_WEBHOOK_SECRET; any v1 entry may match during secret rotation
+func verifyStripeSignature(r *http.Request, body []byte) error {
+	secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if secret == "" {
+		return errWebhookNotConfigured
+	}
+
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	if err := checkWebhookTimestamp(ts); err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.%s", ts, body)
+	want := hex.EncodeToString(mac.Sum(nil))
+	for _, sig := range sigs {
+		if hmac.Equal([]byte(want), []byte(sig)) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+// Reject missing or stale Unix timestamps
+func checkWebhookTimestamp(ts string) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("missing timestamp")
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > webhookTolerance || d < -webhookTolerance {
+		return errors.New("timestamp outside tolerance")
+	}
+	return nil
+}
+
+// SNS signing certificates are served from sns.{region}.amazonaws.com
+var snsCertHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var snsCerts = struct {
+	sync.Mutex
+	byURL map[string]*x509.Certificate
+}{byURL: map[string]*x509.Certificate{}}
+
+// SNS: RSA signature over the message's canonical fields, checked
+// against the AWS certificate named in the message
+func verifySNSSignature(r *http.Request, body []byte) error {
+	var env snsEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return err
+	}
+
+	var fields []string
+	switch env.Type {
+	case "Notification":
+		fields = []string{"Message", env.Message, "MessageId", env.MessageID}
+		if env.Subject != "" {
+			fields = append(fields, "Subject", env.Subject)
+		}
+		fields = append(fields, "Timestamp", env.Timestamp, "TopicArn", env.TopicArn, "Type", env.Type)
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		fields = []string{"Message", env.Message, "MessageId", env.MessageID, "SubscribeURL", env.SubscribeURL,
+			"Timestamp", env.Timestamp, "Token", env.Token, "TopicArn", env.TopicArn, "Type", env.Type}
+	default:
+		return fmt.Errorf("unknown SNS message type %q", env.Type)
+	}
+
+	algo := x509.SHA1WithRSA
+	if env.SignatureVersion == "2" {
+		algo = x509.SHA256WithRSA
+	} else if env.SignatureVersion != "1" {
+		return fmt.Errorf("unsupported signature version %q", env.SignatureVersion)
+	}
+
+	cert, err := snsSigningCert(env.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignature(algo, []byte(strings.Join(fields, "\n")+"\n"), sig); err != nil {
+		return err
+	}
+
+	// SNS retries keep the original timestamp for hours, so the window
+	// here is the replay window rather than webhookTolerance
+	sent, err := time.Parse(time.RFC3339, env.Timestamp)
+	if err != nil {
+		return errors.New("missing timestamp")
+	}
+	if d := time.Since(sent); d > webhookReplayWindow || d < -webhookTolerance {
+		return errors.New("timestamp outside replay window")
+	}
+	return nil
+}
+
+// Fetch and cache an SNS signing certificate, only from AWS hosts
+func snsSigningCert(certURL string) (*x509.Certificate, error) {
+	u, err := url.Parse(certURL)
+	if err != nil || u.Scheme != "https" || !snsCertHost.MatchString(u.Hostname()) || !strings.HasSuffix(u.Path, ".pem") {
+		return nil, fmt.Errorf("untrusted signing certificate URL %q", certURL)
+	}
+
+	snsCerts.Lock()
+	cert := snsCerts.byURL[certURL]
+	snsCerts.Unlock()
+	if cert != nil {
+		return cert, nil
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing certificate is not PEM")
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	snsCerts.Lock()
+	snsCerts.byURL[certURL] = cert
+	snsCerts.Unlock()
+	return cert, nil
+}
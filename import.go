@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Lines committed together; a batch resumes from the last commit
+const importChunkSize = 100
+
+// One NDJSON line of an import. Users are keyed by email, tickets by
+// reference or external_id, messages by external_id.
+type importRecord struct {
+	Type       string `json:"type"`
+	ExternalID string `json:"external_id"`
+
+	// Users
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	UserType string `json:"user_type"`
+
+	// Tickets (Email is the requester)
+	Reference   string     `json:"reference"`
+	Subject     string     `json:"subject"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`
+	Channel     string     `json:"channel"`
+	AssignedTo  string     `json:"assigned_to"`
+	Category    string     `json:"category"`
+	ClosedBy    string     `json:"closed_by"`
+	ClosedAt    *time.Time `json:"closed_at"`
+	CreatedAt   *time.Time `json:"created_at"`
+
+	// Messages
+	TicketReference  string `json:"ticket_reference"`
+	TicketExternalID string `json:"ticket_external_id"`
+	SenderEmail      string `json:"sender_email"`
+	Message          string `json:"message"`
+}
+
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type importBatch struct {
+	ID        string        `json:"batch_id"`
+	CreatedBy string        `json:"created_by"`
+	LinesDone int           `json:"lines_done"`
+	Created   int           `json:"created"`
+	Updated   int           `json:"updated"`
+	Failed    int           `json:"failed"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Errors    []importError `json:"errors,omitempty"`
+}
+
+// Create import bookkeeping tables
+func createImportTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS import_batches (
+			id VARCHAR(36) PRIMARY KEY,
+			created_by VARCHAR(255) NOT NULL,
+			lines_done INTEGER NOT NULL DEFAULT 0,
+			created INTEGER NOT NULL DEFAULT 0,
+			updated INTEGER NOT NULL DEFAULT 0,
+			failed INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS import_errors (
+			id SERIAL PRIMARY KEY,
+			batch_id VARCHAR(36) NOT NULL REFERENCES import_batches(id) ON DELETE CASCADE,
+			line INTEGER NOT NULL,
+			message TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS import_keys (
+			kind VARCHAR(20) NOT NULL,
+			external_id VARCHAR(255) NOT NULL,
+			local_id INTEGER NOT NULL,
+			PRIMARY KEY (kind, external_id)
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create import tables:", err)
+	}
+}
+
+// POST /admin/import[?batch=ID][&offset=N][&dry_run=true] with an NDJSON
+// body, GET /admin/import/{batch_id} for a batch report
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/import"), "/")
+
+	switch {
+	case idPart == "" && r.Method == "POST":
+		runImport(w, r, user)
+	case idPart != "" && r.Method == "GET":
+		batch, err := loadImportBatch(idPart)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Import batch not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batch)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func loadImportBatch(id string) (importBatch, error) {
+	var b importBatch
+	err := db.QueryRow(`
+		SELECT id, created_by, lines_done, created, updated, failed, created_at, updated_at 
+		FROM import_batches WHERE id = $1
+	`, id).Scan(&b.ID, &b.CreatedBy, &b.LinesDone, &b.Created, &b.Updated, &b.Failed, &b.CreatedAt, &b.UpdatedAt)
+	if err != nil {
+		return b, err
+	}
+
+	rows, err := db.Query("SELECT line, message FROM import_errors WHERE batch_id = $1 ORDER BY line LIMIT 1000", id)
+	if err != nil {
+		return b, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e importError
+		if err := rows.Scan(&e.Line, &e.Error); err != nil {
+			return b, err
+		}
+		b.Errors = append(b.Errors, e)
+	}
+	return b, rows.Err()
+}
+
+// Import the request body. Lines are numbered across the whole batch;
+// offset says which batch line the body starts at, and lines the batch
+// already committed are skipped, so a client can resend from its last
+// known position after a failure.
+func runImport(w http.ResponseWriter, r *http.Request, user User) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	batch := importBatch{ID: r.URL.Query().Get("batch")}
+	if batch.ID != "" {
+		var err error
+		if batch, err = loadImportBatch(batch.ID); err == sql.ErrNoRows {
+			http.Error(w, "Import batch not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	} else if !dryRun {
+		batch.ID = uuid.New().String()
+		if _, err := db.Exec("INSERT INTO import_batches (id, created_by) VALUES ($1, $2)", batch.ID, user.Email); err != nil {
+			http.Error(w, "Failed to create import batch", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	offset := batch.LinesDone
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		if n > batch.LinesDone {
+			http.Error(w, fmt.Sprintf("Offset is past the last imported line (%d)", batch.LinesDone), http.StatusConflict)
+			return
+		}
+		offset = n
+	}
+
+	roles, err := store.Users().Roles()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	report := struct {
+		BatchID   string        `json:"batch_id,omitempty"`
+		DryRun    bool          `json:"dry_run"`
+		LinesDone int           `json:"lines_done"`
+		Skipped   int           `json:"skipped"`
+		Created   int           `json:"created"`
+		Updated   int           `json:"updated"`
+		Failed    int           `json:"failed"`
+		Errors    []importError `json:"errors"`
+	}{BatchID: batch.ID, DryRun: dryRun, LinesDone: batch.LinesDone, Errors: []importError{}}
+
+	var tx *sql.Tx
+	var chunk struct{ lines, created, updated, failed int }
+	var chunkErrors []importError
+
+	// Commit the current chunk together with the batch's progress
+	flush := func() error {
+		if tx == nil {
+			return nil
+		}
+		defer func() { tx = nil }()
+		if dryRun {
+			return tx.Rollback()
+		}
+
+		_, err := tx.Exec(`
+			UPDATE import_batches SET lines_done = lines_done + $2, created = created + $3, updated = updated + $4, 
+				failed = failed + $5, updated_at = CURRENT_TIMESTAMP 
+			WHERE id = $1
+		`, batch.ID, chunk.lines, chunk.created, chunk.updated, chunk.failed)
+		for _, e := range chunkErrors {
+			if err != nil {
+				break
+			}
+			_, err = tx.Exec("INSERT INTO import_errors (batch_id, line, message) VALUES ($1, $2, $3)", batch.ID, e.Line, e.Error)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		report.LinesDone += chunk.lines
+		report.Created += chunk.created
+		report.Updated += chunk.updated
+		report.Failed += chunk.failed
+		report.Errors = append(report.Errors, chunkErrors...)
+		chunk.lines, chunk.created, chunk.updated, chunk.failed = 0, 0, 0, 0
+		chunkErrors = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, 64<<20))
+	scanner.Buffer(make([]byte, 1024*1024), 8*1024*1024)
+	line := offset
+	for scanner.Scan() {
+		line++
+		if line <= batch.LinesDone {
+			report.Skipped++
+			continue
+		}
+		text := strings.TrimSpace(scanner.Text())
+
+		if tx == nil {
+			if tx, err = db.Begin(); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		chunk.lines++
+		created, err := importLine(tx, roles, text)
+		switch {
+		case err != nil:
+			chunk.failed++
+			chunkErrors = append(chunkErrors, importError{Line: line, Error: err.Error()})
+		case created:
+			chunk.created++
+		default:
+			chunk.updated++
+		}
+
+		// A dry run stays in one transaction so later lines can see
+		// rows created by earlier ones
+		if chunk.lines >= importChunkSize && !dryRun {
+			if err := flush(); err != nil {
+				log.Printf("Import batch %s failed at line %d: %v", batch.ID, line, err)
+				http.Error(w, "Failed to save import progress", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if tx != nil {
+			tx.Rollback()
+		}
+		http.Error(w, "Failed to read import body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		// Nothing was written, so report what the whole body would do
+		report.LinesDone += chunk.lines
+		report.Created += chunk.created
+		report.Updated += chunk.updated
+		report.Failed += chunk.failed
+		report.Errors = append(report.Errors, chunkErrors...)
+	}
+	if err := flush(); err != nil {
+		log.Printf("Import batch %s failed at line %d: %v", batch.ID, line, err)
+		http.Error(w, "Failed to save import progress", http.StatusInternalServerError)
+		return
+	}
+
+	if !dryRun {
+		log.Printf("✓ Import batch %s by %s: %d created, %d updated, %d failed",
+			batch.ID, user.Email, report.Created, report.Updated, report.Failed)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Validate and upsert one line inside a savepoint, so a bad line
+// doesn't abort the rest of its chunk. Returns whether a row was created.
+func importLine(tx *sql.Tx, roles map[string]map[string]bool, text string) (bool, error) {
+	var rec importRecord
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rec); err != nil {
+		return false, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	if _, err := tx.Exec("SAVEPOINT import_line"); err != nil {
+		return false, err
+	}
+
+	var created bool
+	var err error
+	switch rec.Type {
+	case "user":
+		created, err = importUser(tx, roles, rec)
+	case "ticket":
+		created, err = importTicket(tx, rec)
+	case "message":
+		created, err = importMessage(tx, rec)
+	default:
+		err = fmt.Errorf("unknown type %q (expected user, ticket or message)", rec.Type)
+	}
+
+	if err != nil {
+		tx.Exec("ROLLBACK TO SAVEPOINT import_line")
+		return false, err
+	}
+	_, err = tx.Exec("RELEASE SAVEPOINT import_line")
+	return created, err
+}
+
+func importUser(tx *sql.Tx, roles map[string]map[string]bool, rec importRecord) (bool, error) {
+	if !strings.Contains(rec.Email, "@") {
+		return false, fmt.Errorf("email is required")
+	}
+	if _, ok := roles[rec.UserType]; !ok {
+		return false, fmt.Errorf("unknown user_type %q", rec.UserType)
+	}
+
+	// Imported users without a password can't log in until it is reset
+	password := rec.Password
+	if password == "" {
+		buf := make([]byte, 24)
+		rand.Read(buf)
+		password = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return false, err
+	}
+
+	var created bool
+	err = tx.QueryRow(`
+		INSERT INTO users (email, password, user_type) 
+		VALUES ($1, $2, $3) 
+		ON CONFLICT (email) DO UPDATE SET user_type = EXCLUDED.user_type, 
+			password = CASE WHEN $4 THEN EXCLUDED.password ELSE users.password END 
+		RETURNING xmax = 0
+	`, rec.Email, hash, rec.UserType, rec.Password != "").Scan(&created)
+	return created, err
+}
+
+func importTicket(tx *sql.Tx, rec importRecord) (bool, error) {
+	if rec.Reference == "" && rec.ExternalID == "" {
+		return false, fmt.Errorf("reference or external_id is required")
+	}
+	if !strings.Contains(rec.Email, "@") {
+		return false, fmt.Errorf("email is required")
+	}
+	rec.Subject = normalizeText(rec.Subject)
+	rec.Description = normalizeText(rec.Description)
+	if rec.Subject == "" || utf8.RuneCountInString(rec.Subject) > maxSubjectLength {
+		return false, fmt.Errorf("subject is required and at most %d characters", maxSubjectLength)
+	}
+	if rec.Description == "" {
+		return false, fmt.Errorf("description is required")
+	}
+	if rec.Status == "" {
+		rec.Status = "open"
+	}
+	if !validStatus(rec.Status) {
+		return false, fmt.Errorf("unknown status %q", rec.Status)
+	}
+	if rec.Channel == "" {
+		rec.Channel = defaultTicketChannel
+	}
+	if !ticketChannels[rec.Channel] {
+		return false, fmt.Errorf("unknown channel %q", rec.Channel)
+	}
+
+	var id int
+	var err error
+	if rec.Reference != "" {
+		err = tx.QueryRow("SELECT id FROM tickets WHERE reference = $1", rec.Reference).Scan(&id)
+	} else {
+		err = tx.QueryRow("SELECT local_id FROM import_keys WHERE kind = 'ticket' AND external_id = $1", rec.ExternalID).Scan(&id)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	orgID := orgIDForEmail(rec.Email)
+	nullable := func(s string) sql.NullString { return sql.NullString{String: s, Valid: s != ""} }
+
+	if id != 0 {
+		res, err := tx.Exec(`
+			UPDATE tickets SET email = $2, subject = $3, description = $4, status = $5, channel = $6, 
+				assigned_to = $7, category = $8, closed_by = $9, closed_at = $10, org_id = $11 
+			WHERE id = $1
+		`, id, rec.Email, rec.Subject, rec.Description, rec.Status, rec.Channel,
+			nullable(rec.AssignedTo), nullable(rec.Category), nullable(rec.ClosedBy), rec.ClosedAt, orgID)
+		if err != nil {
+			return false, err
+		}
+		// A stale external_id mapping (ticket deleted or archived) falls through to insert
+		if n, _ := res.RowsAffected(); n > 0 {
+			_, err = tx.Exec("UPDATE messages SET sender_email = $2, message = $3 WHERE ticket_id = $1 AND is_description",
+				id, rec.Email, rec.Description)
+			if err == nil && rec.ExternalID != "" {
+				err = saveImportKey(tx, "ticket", rec.ExternalID, id)
+			}
+			return false, err
+		}
+	}
+
+	ref := rec.Reference
+	if ref == "" {
+		if ref, err = nextTicketReference(tx, int(orgID.Int64)); err != nil {
+			return false, err
+		}
+	} else if err := reserveTicketReference(tx, ref); err != nil {
+		return false, err
+	}
+
+	var createdAt time.Time
+	err = tx.QueryRow(`
+		INSERT INTO tickets (reference, email, requester_id, subject, description, status, channel, assigned_to, category, 
+			closed_by, closed_at, org_id, created_at, updated_at) 
+		VALUES ($1, $2, (SELECT id FROM users WHERE email = $2), $3, $4, $5, $6, $7, $8, $9, $10, $11, COALESCE($12, CURRENT_TIMESTAMP), 
+			GREATEST(COALESCE($12, CURRENT_TIMESTAMP), $10)) 
+		RETURNING id, created_at
+	`, ref, rec.Email, rec.Subject, rec.Description, rec.Status, rec.Channel, nullable(rec.AssignedTo),
+		nullable(rec.Category), nullable(rec.ClosedBy), rec.ClosedAt, orgID, rec.CreatedAt).Scan(&id, &createdAt)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO messages (ticket_id, sender_email, message, is_description, created_at) 
+		VALUES ($1, $2, $3, TRUE, $4)
+	`, id, rec.Email, rec.Description, createdAt)
+	if err != nil {
+		return false, err
+	}
+
+	if rec.ExternalID != "" {
+		if err := saveImportKey(tx, "ticket", rec.ExternalID, id); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+var ticketReferencePattern = regexp.MustCompile(`^(.+)-(\d{4})-(\d+)$`)
+
+// Move the reference counter past an imported reference in our own
+// format, so later tickets don't collide with it
+func reserveTicketReference(tx *sql.Tx, ref string) error {
+	m := ticketReferencePattern.FindStringSubmatch(ref)
+	if m == nil {
+		return nil
+	}
+	// The prefix may be followed by an organization's ID
+	prefix, orgID := ticketRefPrefix(), 0
+	if m[1] != prefix {
+		id, ok := strings.CutPrefix(m[1], prefix+"-")
+		var err error
+		if orgID, err = strconv.Atoi(id); !ok || err != nil || orgID <= 0 {
+			return nil
+		}
+	}
+	year, _ := strconv.Atoi(m[2])
+	n, _ := strconv.Atoi(m[3])
+	_, err := tx.Exec(`
+		INSERT INTO ticket_sequences (prefix, org_id, year, last_value) 
+		VALUES ($1, $2, $3, $4) 
+		ON CONFLICT (prefix, org_id, year) DO UPDATE SET last_value = GREATEST(ticket_sequences.last_value, EXCLUDED.last_value)
+	`, prefix, orgID, year, n)
+	return err
+}
+
+func importMessage(tx *sql.Tx, rec importRecord) (bool, error) {
+	if rec.ExternalID == "" {
+		return false, fmt.Errorf("external_id is required")
+	}
+	if !strings.Contains(rec.SenderEmail, "@") {
+		return false, fmt.Errorf("sender_email is required")
+	}
+	rec.Message = normalizeText(rec.Message)
+	if rec.Message == "" {
+		return false, fmt.Errorf("message is required")
+	}
+
+	var ticketID int
+	var err error
+	switch {
+	case rec.TicketReference != "":
+		err = tx.QueryRow("SELECT id FROM tickets WHERE reference = $1", rec.TicketReference).Scan(&ticketID)
+	case rec.TicketExternalID != "":
+		err = tx.QueryRow("SELECT local_id FROM import_keys WHERE kind = 'ticket' AND external_id = $1", rec.TicketExternalID).Scan(&ticketID)
+	default:
+		return false, fmt.Errorf("ticket_reference or ticket_external_id is required")
+	}
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("ticket not found")
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var id int
+	err = tx.QueryRow("SELECT local_id FROM import_keys WHERE kind = 'message' AND external_id = $1", rec.ExternalID).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if id != 0 {
+		res, err := tx.Exec("UPDATE messages SET ticket_id = $2, sender_email = $3, message = $4 WHERE id = $1",
+			id, ticketID, rec.SenderEmail, rec.Message)
+		if err != nil {
+			return false, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return false, nil
+		}
+	}
+
+	var createdAt time.Time
+	err = tx.QueryRow(`
+		INSERT INTO messages (ticket_id, sender_email, message, created_at) 
+		VALUES ($1, $2, $3, COALESCE($4, CURRENT_TIMESTAMP)) 
+		RETURNING id, created_at
+	`, ticketID, rec.SenderEmail, rec.Message, rec.CreatedAt).Scan(&id, &createdAt)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("UPDATE tickets SET updated_at = GREATEST(updated_at, $2) WHERE id = $1", ticketID, createdAt)
+	if err != nil {
+		return false, err
+	}
+	return true, saveImportKey(tx, "message", rec.ExternalID, id)
+}
+
+// Remember which row an external ID was imported as
+func saveImportKey(tx *sql.Tx, kind, externalID string, localID int) error {
+	_, err := tx.Exec(`
+		INSERT INTO import_keys (kind, external_id, local_id) 
+		VALUES ($1, $2, $3) 
+		ON CONFLICT (kind, external_id) DO UPDATE SET local_id = EXCLUDED.local_id
+	`, kind, externalID, localID)
+	return err
+}
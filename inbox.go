@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In-app notification kinds
+const (
+	notificationAssigned = "assigned"
+	notificationMention  = "mention"
+	notificationReply    = "reply"
+	// A new ticket matched one of the agent's saved searches
+	notificationSavedSearch = "saved_search"
+)
+
+type Notification struct {
+	ID        int        `json:"id"`
+	Kind      string     `json:"kind"`
+	TicketID  int        `json:"ticket_id"`
+	Actor     string     `json:"actor"`
+	Summary   string     `json:"summary"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Create in-app notifications table
+func createNotificationsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS notifications (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			kind VARCHAR(20) NOT NULL,
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			actor VARCHAR(255) NOT NULL DEFAULT '',
+			summary TEXT NOT NULL,
+			read_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications (user_id, created_at DESC)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create notifications table:", err)
+	}
+}
+
+// @-mentions of a user by email address, e.g. "@jane@example.com"
+var mentionPattern = regexp.MustCompile(`@([A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,})`)
+
+// Record assignments, mentions and replies in each recipient's inbox
+func subscribeInAppNotifications() {
+	subscribe(eventTicketAssigned, func(ev Event) {
+		assignee, _ := ev.Data["assignee"].(string)
+		if assignee == "" || assignee == ev.Actor {
+			return
+		}
+		ticket, err := ticketForNotification(ev.TicketID)
+		if err != nil {
+			return
+		}
+		summary := fmt.Sprintf("%s was assigned to you", ticket.Reference)
+		if _, ok := ev.Data["handoff"]; ok {
+			summary = fmt.Sprintf("%s handed off %s to you", ev.Actor, ticket.Reference)
+		}
+		notifyUser(assignee, notificationAssigned, ticket, ev.Actor, summary)
+	})
+
+	subscribe(eventMessageCreated, func(ev Event) {
+		t := ev.Ticket
+		if t == nil || ev.Message == nil {
+			return
+		}
+
+		notified := map[string]bool{strings.ToLower(ev.Actor): true}
+
+		// Mentions take precedence so nobody gets two entries for one message
+		for _, m := range mentionPattern.FindAllStringSubmatch(ev.Message.Message, -1) {
+			email := strings.ToLower(m[1])
+			if notified[email] {
+				continue
+			}
+			notified[email] = true
+			notifyUser(email, notificationMention, *t, ev.Actor,
+				fmt.Sprintf("%s mentioned you on %s", ev.Actor, t.Reference))
+		}
+
+		for _, email := range []string{t.Email, t.AssignedTo} {
+			if email == "" || notified[strings.ToLower(email)] {
+				continue
+			}
+			notified[strings.ToLower(email)] = true
+			notifyUser(email, notificationReply, *t, ev.Actor,
+				fmt.Sprintf("%s replied on %s", ev.Actor, t.Reference))
+		}
+	})
+}
+
+// Ticket lookup for event subscribers, which act outside any user's access scope
+func ticketForNotification(id int) (Ticket, error) {
+	return scanTicket(db.QueryRow("SELECT "+ticketColumns+" FROM tickets WHERE id = $1", id))
+}
+
+// Add a notification for the user with email, if they exist and can see the ticket
+func notifyUser(email, kind string, ticket Ticket, actor, summary string) {
+	var u User
+	err := db.QueryRow("SELECT id, email, user_type FROM users WHERE lower(email) = lower($1)", email).
+		Scan(&u.ID, &u.Email, &u.UserType)
+	if err != nil {
+		return
+	}
+	// A mention must not leak tickets to users who can't read them
+	if !authorize(u, actionTicketRead, &ticket) {
+		return
+	}
+
+	_, err = execOrQueue(kind+" notification", `
+		INSERT INTO notifications (user_id, kind, ticket_id, actor, summary, created_at) 
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, u.ID, kind, ticket.ID, actor, summary, time.Now().UTC())
+	if err != nil {
+		notifyLog.Errorf("Failed to record %s notification for %s: %v", kind, email, err)
+	}
+}
+
+// GET /me/notifications[?unread=true], POST /me/notifications/{id}/read,
+// POST /me/notifications/read_all
+func handleNotifications(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/notifications"), "/")
+
+	switch {
+	case idPart == "" && r.Method == "GET":
+		listNotifications(w, r, user)
+
+	case idPart == "read_all" && r.Method == "POST":
+		queued, err := execOrQueue("read marker", "UPDATE notifications SET read_at = $2 WHERE user_id = $1 AND read_at IS NULL", user.ID, time.Now().UTC())
+		if err != nil {
+			http.Error(w, "Failed to update notifications", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if queued {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"message": "All notifications marked read"})
+
+	case strings.HasSuffix(idPart, "/read") && r.Method == "POST":
+		id, err := strconv.Atoi(strings.TrimSuffix(idPart, "/read"))
+		if err != nil {
+			http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+			return
+		}
+		const markRead = `
+			UPDATE notifications SET read_at = COALESCE(read_at, $3) 
+			WHERE id = $1 AND user_id = $2
+		`
+		now := time.Now().UTC()
+		res, err := db.Exec(markRead, id, user.ID, now)
+		if err != nil && isTransientDBError(err) {
+			// Whether it exists has to wait until the database is back too
+			if err := queueWrite("read marker", markRead, id, user.ID, now); err != nil {
+				http.Error(w, "Failed to update notification", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Notification will be marked read"})
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to update notification", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Notification not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Notification marked read"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Latest 50 notifications plus the unread count for the bell badge
+func listNotifications(w http.ResponseWriter, r *http.Request, user User) {
+	query := "SELECT id, kind, COALESCE(ticket_id, 0), actor, summary, read_at, created_at FROM notifications WHERE user_id = $1"
+	if r.URL.Query().Get("unread") == "true" {
+		query += " AND read_at IS NULL"
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT 50"
+
+	rows, err := db.Query(query, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Kind, &n.TicketID, &n.Actor, &n.Summary, &n.ReadAt, &n.CreatedAt); err != nil {
+			continue
+		}
+		list = append(list, n)
+	}
+
+	var unread int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL", user.ID).Scan(&unread)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"notifications": list,
+		"unread_count":  unread,
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+// Scheduled background job
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	run      func() error
+}
+
+var scheduledJobs []scheduledJob
+
+// How often each replica checks whether a job is due. Jobs are checked at
+// startup and then on this tick rather than once per interval, so a daily
+// job still runs when replicas restart more often than daily; job_runs
+// decides when one is due.
+const schedulerTick = time.Minute
+
+// Register a job to run once per interval across all replicas
+func scheduleJob(name string, interval time.Duration, run func() error) {
+	scheduledJobs = append(scheduledJobs, scheduledJob{name: name, interval: interval, run: run})
+}
+
+// Start a ticker for every registered job
+func startScheduler() {
+	for _, job := range scheduledJobs {
+		go func(job scheduledJob) {
+			tick := schedulerTick
+			if job.interval < tick {
+				tick = job.interval
+			}
+			ticker := time.NewTicker(tick)
+			defer ticker.Stop()
+			// After a failure, wait out the interval before trying again
+			var retryAt time.Time
+			for {
+				if time.Now().After(retryAt) && !runScheduledJob(job) {
+					retryAt = time.Now().Add(job.interval)
+				}
+				<-ticker.C
+			}
+		}(job)
+	}
+
+	if len(scheduledJobs) > 0 {
+		log.Printf("✓ Scheduler started with %d jobs", len(scheduledJobs))
+	}
+}
+
+// Run a job if this replica holds its lock and it hasn't run, on any
+// replica, within its interval; false if it failed
+func runScheduledJob(job scheduledJob) bool {
+	ran, err := runExclusive(job.name, func(conn *sql.Conn) error {
+		ctx := context.Background()
+
+		var recent bool
+		err := conn.QueryRowContext(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM job_runs
+				WHERE name = $1 AND last_run_at > CURRENT_TIMESTAMP - $2 * INTERVAL '1 second'
+			)
+		`, job.name, job.interval.Seconds()).Scan(&recent)
+		if err != nil {
+			return err
+		}
+		if recent {
+			return nil
+		}
+
+		if err := job.run(); err != nil {
+			return err
+		}
+		return markJobRun(conn, job.name)
+	})
+
+	if err != nil {
+		log.Printf("Job %s failed: %v", job.name, err)
+		recordFailedJob("job", job.name, map[string]string{"name": job.name},
+			[]JobAttempt{{At: time.Now().UTC(), Error: err.Error()}})
+		return false
+	}
+	if !ran {
+		log.Printf("Job %s skipped: lock held by another instance", job.name)
+	} else {
+		resolveFailedJob("job", job.name)
+	}
+	return true
+}
+
+// Note a successful run so replicas don't repeat it this interval
+func markJobRun(conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(context.Background(), `
+		INSERT INTO job_runs (name, last_run_at)
+		VALUES ($1, CURRENT_TIMESTAMP)
+		ON CONFLICT (name) DO UPDATE SET last_run_at = EXCLUDED.last_run_at
+	`, name)
+	return err
+}
+
+// Run fn while holding a Postgres advisory lock for name. Advisory locks
+// belong to a database session, so the lock is taken on a dedicated
+// connection that is handed to fn. Returns false if another session
+// holds the lock.
+func runExclusive(name string, fn func(conn *sql.Conn) error) (bool, error) {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	key := advisoryLockKey(name)
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+		return false, err
+	}
+	if !acquired {
+		return false, nil
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", key)
+
+	return true, fn(conn)
+}
+
+// Map a lock name to the bigint key space used by advisory locks
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("sts:" + name))
+	return int64(h.Sum64())
+}
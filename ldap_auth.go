@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Password login checked against an LDAP directory (OpenLDAP, Active
+// Directory). With AUTH_MODE=ldap, POST /login finds the user with a
+// service account search, binds as them with the password given, and
+// sets their role from their directory groups on every login. Users are
+// created on first login and can't sign in with a local password.
+var ldapAuth struct {
+	url            string
+	startTLS       bool
+	tlsConfig      *tls.Config
+	bindDN         string
+	bindPassword   string
+	baseDN         string
+	userFilter     string
+	emailAttribute string
+	groupAttribute string
+	groupRoles     []ldapGroupRole
+	defaultRole    string
+}
+
+// Directory group whose members get a role
+type ldapGroupRole struct {
+	groupDN string
+	role    string
+}
+
+const ldapTimeout = 10 * time.Second
+
+var (
+	errLDAPInvalidCredentials = errors.New("invalid credentials")
+	errLDAPUnavailable        = errors.New("directory unavailable")
+)
+
+func ldapAuthEnabled() bool {
+	return os.Getenv("AUTH_MODE") == "ldap"
+}
+
+// Read LDAP settings, refusing to start with an unusable setup
+func loadLDAPAuth() {
+	if !ldapAuthEnabled() {
+		return
+	}
+
+	ldapAuth.url = os.Getenv("LDAP_URL")
+	ldapAuth.baseDN = os.Getenv("LDAP_BASE_DN")
+	if ldapAuth.url == "" || ldapAuth.baseDN == "" {
+		log.Fatal("AUTH_MODE=ldap requires LDAP_URL and LDAP_BASE_DN")
+	}
+	ldapAuth.startTLS = os.Getenv("LDAP_START_TLS") == "true"
+	if strings.HasPrefix(ldapAuth.url, "ldap://") && !ldapAuth.startTLS {
+		log.Println("Warning: LDAP_URL is ldap:// without LDAP_START_TLS; passwords are sent in the clear")
+	}
+
+	ldapAuth.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if file := os.Getenv("LDAP_CA_FILE"); file != "" {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatal("Failed to read LDAP_CA_FILE:", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatal("LDAP_CA_FILE has no certificates")
+		}
+		ldapAuth.tlsConfig.RootCAs = pool
+	}
+
+	ldapAuth.bindDN = os.Getenv("LDAP_BIND_DN")
+	ldapAuth.bindPassword = os.Getenv("LDAP_BIND_PASSWORD")
+	ldapAuth.userFilter = os.Getenv("LDAP_USER_FILTER")
+	if ldapAuth.userFilter == "" {
+		ldapAuth.userFilter = "(mail=%s)"
+	}
+	if !strings.Contains(ldapAuth.userFilter, "%s") {
+		log.Fatalf("LDAP_USER_FILTER must contain %%s for the login name")
+	}
+	ldapAuth.emailAttribute = os.Getenv("LDAP_EMAIL_ATTRIBUTE")
+	if ldapAuth.emailAttribute == "" {
+		ldapAuth.emailAttribute = "mail"
+	}
+	ldapAuth.groupAttribute = os.Getenv("LDAP_GROUP_ATTRIBUTE")
+	if ldapAuth.groupAttribute == "" {
+		ldapAuth.groupAttribute = "memberOf"
+	}
+	ldapAuth.defaultRole = os.Getenv("LDAP_DEFAULT_ROLE")
+	if ldapAuth.defaultRole == "" {
+		ldapAuth.defaultRole = "client"
+	}
+
+	// LDAP_GROUP_ROLES is "groupDN=role;groupDN=role", first match wins.
+	// DNs contain = themselves, so the role follows the last one.
+	for _, entry := range strings.Split(os.Getenv("LDAP_GROUP_ROLES"), ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 1 || i == len(entry)-1 {
+			log.Fatalf("LDAP_GROUP_ROLES entry %q is not groupDN=role", entry)
+		}
+		ldapAuth.groupRoles = append(ldapAuth.groupRoles, ldapGroupRole{
+			groupDN: strings.TrimSpace(entry[:i]),
+			role:    strings.TrimSpace(entry[i+1:]),
+		})
+	}
+
+	log.Printf("✓ LDAP authentication enabled (%s, %d group mappings)", ldapAuth.url, len(ldapAuth.groupRoles))
+}
+
+func ldapConnect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(ldapAuth.url, ldap.DialWithTLSConfig(ldapAuth.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if ldapAuth.startTLS {
+		if err := conn.StartTLS(ldapAuth.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Role for a user in these groups: the first configured mapping they
+// match, or the default role
+func ldapRole(groups []string) string {
+	for _, gr := range ldapAuth.groupRoles {
+		for _, g := range groups {
+			if strings.EqualFold(g, gr.groupDN) {
+				return gr.role
+			}
+		}
+	}
+	return ldapAuth.defaultRole
+}
+
+// Check login and password against the directory and return the
+// matching user, created or updated to the role their groups give
+func ldapUser(login, password string) (User, error) {
+	login = strings.TrimSpace(login)
+	// An empty password is an unauthenticated bind, which servers accept
+	if login == "" || password == "" {
+		return User{}, errLDAPInvalidCredentials
+	}
+
+	conn, err := ldapConnect()
+	if err != nil {
+		log.Printf("Error connecting to LDAP server: %v", err)
+		return User{}, errLDAPUnavailable
+	}
+	defer conn.Close()
+
+	if ldapAuth.bindDN != "" {
+		if err := conn.Bind(ldapAuth.bindDN, ldapAuth.bindPassword); err != nil {
+			log.Printf("Error binding LDAP service account: %v", err)
+			return User{}, errLDAPUnavailable
+		}
+	}
+
+	filter := strings.ReplaceAll(ldapAuth.userFilter, "%s", ldap.EscapeFilter(login))
+	res, err := conn.Search(ldap.NewSearchRequest(
+		ldapAuth.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		filter, []string{ldapAuth.emailAttribute, ldapAuth.groupAttribute}, nil,
+	))
+	if err != nil {
+		log.Printf("Error searching LDAP for %s: %v", login, err)
+		return User{}, errLDAPUnavailable
+	}
+	if len(res.Entries) != 1 {
+		// Unknown or ambiguous; either way there's no one to bind as
+		return User{}, errLDAPInvalidCredentials
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return User{}, errLDAPInvalidCredentials
+		}
+		log.Printf("Error binding LDAP user %s: %v", entry.DN, err)
+		return User{}, errLDAPUnavailable
+	}
+
+	email := strings.ToLower(strings.TrimSpace(entry.GetAttributeValue(ldapAuth.emailAttribute)))
+	if email == "" && strings.Contains(login, "@") {
+		email = strings.ToLower(login)
+	}
+	if strings.LastIndex(email, "@") < 1 {
+		log.Printf("LDAP user %s has no %s attribute", entry.DN, ldapAuth.emailAttribute)
+		return User{}, fmt.Errorf("%s has no email address", entry.DN)
+	}
+
+	// The local password is never used; the directory checks passwords
+	unusable, err := randomPasswordHash()
+	if err != nil {
+		return User{}, err
+	}
+	role := ldapRole(entry.GetAttributeValues(ldapAuth.groupAttribute))
+	user, created, err := store.Users().Provision(email, unusable, role)
+	if err != nil {
+		return User{}, err
+	}
+	if created {
+		log.Printf("✓ Provisioned %s (%s) from LDAP", user.Email, user.UserType)
+	} else if user.UserType != role {
+		// The directory is the source of truth for roles
+		if err := store.Users().SetRole(user.ID, role); err != nil {
+			return User{}, err
+		}
+		log.Printf("✓ Role for %s changed from %s to %s by LDAP groups", user.Email, user.UserType, role)
+		user.UserType = role
+	}
+	return user, nil
+}
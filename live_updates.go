@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Live ticket updates over WebSocket. A client opens /ws with its usual
+// session (the cookie, or the Authorization header outside browsers) and
+// sends {"type": "subscribe", "ticket_id": N} for each ticket it has
+// open, or "unsubscribe" when it's done with one. New messages and
+// status changes on those tickets are pushed as they are published.
+// Pushes come from this instance's event bus, so with several instances
+// behind a load balancer the bus needs a shared backend.
+
+const (
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// Clients only send small subscribe requests
+	wsMaxMessage = 4096
+	// Tickets one connection may follow at once
+	wsMaxSubscriptions = 50
+	// Pings also recheck the session the socket was opened with
+	wsPingInterval = 30 * time.Second
+	wsReadTimeout  = 2*wsPingInterval + 15*time.Second
+	wsWriteTimeout = 10 * time.Second
+	// Frames queued for a client; one that falls further behind is dropped
+	// and expected to reconnect
+	wsSendBuffer = 64
+)
+
+// Frame opcodes (RFC 6455 section 5.2)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// Close codes
+const (
+	wsCloseNormal          = 1000
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseInvalidPayload  = 1007
+	wsClosePolicyViolation = 1008
+	wsCloseTooBig          = 1009
+)
+
+// A reason to close the connection with a code
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e wsCloseError) Error() string {
+	return fmt.Sprintf("websocket close %d: %s", e.code, e.reason)
+}
+
+type wsFrame struct {
+	op      byte
+	payload []byte
+}
+
+func wsCloseFrame(code int, reason string) wsFrame {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return wsFrame{op: wsOpClose, payload: append(payload, reason...)}
+}
+
+// Update pushed to subscribers of a ticket
+type LiveUpdate struct {
+	Type     string    `json:"type"`
+	TicketID int       `json:"ticket_id"`
+	Actor    string    `json:"actor"`
+	Message  *Message  `json:"message,omitempty"`
+	Status   string    `json:"status,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+type wsClient struct {
+	user User
+	// Credential the socket was opened with, rechecked on each ping;
+	// empty for proxy identities
+	token string
+	conn  net.Conn
+	send  chan wsFrame
+	done  chan struct{}
+	once  sync.Once
+	// Subscribed tickets, guarded by liveHub
+	tickets map[int]bool
+}
+
+// Something following tickets: a WebSocket, or an event stream of one
+// ticket's messages
+type liveSubscriber interface {
+	liveUser() User
+	// Hand over an update without blocking the event bus
+	deliver(update LiveUpdate, payload []byte)
+	// Called once the subscriber has lost access to the ticket and been
+	// removed from it
+	revoke(ticketID int)
+}
+
+// Subscribers by the tickets they follow
+var liveHub = struct {
+	sync.RWMutex
+	subscribers map[int]map[liveSubscriber]bool
+}{subscribers: map[int]map[liveSubscriber]bool{}}
+
+// Start or stop following a ticket; the caller holds liveHub's lock
+func followLocked(s liveSubscriber, ticketID int) {
+	if liveHub.subscribers[ticketID] == nil {
+		liveHub.subscribers[ticketID] = map[liveSubscriber]bool{}
+	}
+	liveHub.subscribers[ticketID][s] = true
+}
+
+func unfollowLocked(s liveSubscriber, ticketID int) {
+	if subs := liveHub.subscribers[ticketID]; subs != nil {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(liveHub.subscribers, ticketID)
+		}
+	}
+}
+
+// Push ticket messages and status changes to subscribers
+func subscribeLiveUpdates() {
+	subscribe(eventMessageCreated, pushLiveUpdate)
+	subscribe(eventTicketStatusChanged, pushLiveUpdate)
+	subscribe(eventTicketClosed, pushLiveUpdate)
+	subscribe(eventTicketRequesterChanged, func(ev Event) {
+		// The previous requester can no longer read the ticket; staff
+		// access doesn't depend on the requester
+		liveHub.Lock()
+		var dropped []liveSubscriber
+		for s := range liveHub.subscribers[ev.TicketID] {
+			if !canSeeInternal(s.liveUser()) {
+				dropped = append(dropped, s)
+			}
+		}
+		for _, s := range dropped {
+			unfollowLocked(s, ev.TicketID)
+		}
+		liveHub.Unlock()
+		for _, s := range dropped {
+			s.revoke(ev.TicketID)
+		}
+	})
+}
+
+func pushLiveUpdate(ev Event) {
+	update := LiveUpdate{Type: ev.Type, TicketID: ev.TicketID, Actor: ev.Actor, At: ev.At}
+	switch ev.Type {
+	case eventMessageCreated:
+		if ev.Message == nil {
+			return
+		}
+		m := *ev.Message
+		presentMessage(&m, false)
+		update.Message = &m
+	case eventTicketClosed:
+		update.Type, update.Status = eventTicketStatusChanged, "closed"
+	case eventTicketStatusChanged:
+		update.Status, _ = ev.Data["to"].(string)
+	}
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return
+	}
+
+	// A subscriber that's too far behind is dropped, which takes the lock
+	liveHub.RLock()
+	var subs []liveSubscriber
+	for s := range liveHub.subscribers[ev.TicketID] {
+		subs = append(subs, s)
+	}
+	liveHub.RUnlock()
+	for _, s := range subs {
+		s.deliver(update, payload)
+	}
+}
+
+// GET /ws: upgrade to a WebSocket carrying live updates
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	// Browsers send the session cookie with cross-site handshakes and CORS
+	// doesn't apply, so the origin is checked here
+	if !wsOriginAllowed(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		httpLog.Errorf("Error upgrading to WebSocket: %v", err)
+		http.Error(w, "WebSocket upgrade failed", http.StatusInternalServerError)
+		return
+	}
+	accept := sha1.Sum([]byte(key + wsAcceptGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(accept[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &wsClient{
+		user:    currentUser(r),
+		token:   sessionToken(r),
+		conn:    conn,
+		send:    make(chan wsFrame, wsSendBuffer),
+		done:    make(chan struct{}),
+		tickets: map[int]bool{},
+	}
+	httpLog.Debugf("WebSocket opened by %s", c.user.Email)
+	go c.writeLoop()
+	err = c.readLoop(rw.Reader)
+	if ce, ok := err.(wsCloseError); ok {
+		c.finish(wsCloseFrame(ce.code, ce.reason))
+	} else {
+		c.finish(wsCloseFrame(wsCloseNormal, ""))
+	}
+	httpLog.Debugf("WebSocket of %s closed: %v", c.user.Email, err)
+}
+
+// Whether a comma-separated header lists token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Same-origin pages, the CORS credential origins, and clients that
+// aren't browsers (no Origin) may connect
+func wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || containsString(corsCredentialOrigins(), origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Read frames until the client closes or breaks the protocol, handling
+// control frames and subscribe requests as they arrive
+func (c *wsClient) readLoop(br *bufio.Reader) error {
+	var message []byte
+	var messageOp byte
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		fin, op, payload, err := readWSFrame(br)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case wsOpPing:
+			c.queue(wsFrame{op: wsOpPong, payload: payload})
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			return io.EOF
+		case wsOpContinuation:
+			if messageOp == 0 {
+				return wsCloseError{wsCloseProtocolError, "unexpected continuation frame"}
+			}
+			message = append(message, payload...)
+		case wsOpText, wsOpBinary:
+			if messageOp != 0 {
+				return wsCloseError{wsCloseProtocolError, "expected continuation frame"}
+			}
+			messageOp, message = op, payload
+		default:
+			return wsCloseError{wsCloseProtocolError, "unknown opcode"}
+		}
+		if len(message) > wsMaxMessage {
+			return wsCloseError{wsCloseTooBig, "message too big"}
+		}
+		if !fin {
+			continue
+		}
+
+		if messageOp == wsOpBinary {
+			return wsCloseError{wsCloseUnsupportedData, "only text messages are accepted"}
+		}
+		if !utf8.Valid(message) {
+			return wsCloseError{wsCloseInvalidPayload, "message is not UTF-8"}
+		}
+		c.handleRequest(message)
+		message, messageOp = nil, 0
+	}
+}
+
+// One frame from the client. Client frames must be masked.
+func readWSFrame(br *bufio.Reader) (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(br, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0F
+	if head[0]&0x70 != 0 {
+		return fin, op, nil, wsCloseError{wsCloseProtocolError, "reserved bits set"}
+	}
+	if head[1]&0x80 == 0 {
+		return fin, op, nil, wsCloseError{wsCloseProtocolError, "client frames must be masked"}
+	}
+
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(br, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(br, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (n > 125 || !fin) {
+		return fin, op, nil, wsCloseError{wsCloseProtocolError, "invalid control frame"}
+	}
+	if n > wsMaxMessage {
+		return fin, op, nil, wsCloseError{wsCloseTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// Subscribe or unsubscribe, as asked in a client message
+func (c *wsClient) handleRequest(message []byte) {
+	var req struct {
+		Type     string `json:"type"`
+		TicketID int    `json:"ticket_id"`
+	}
+	if err := json.Unmarshal(message, &req); err != nil {
+		c.reply(map[string]interface{}{"type": "error", "error": "Invalid request"})
+		return
+	}
+
+	switch req.Type {
+	case "subscribe":
+		ticket, err := ticketService.Get(c.user, req.TicketID)
+		if err != nil || !authorize(c.user, actionTicketRead, &ticket) {
+			c.reply(map[string]interface{}{"type": "error", "ticket_id": req.TicketID, "error": "Ticket not found"})
+			return
+		}
+		liveHub.Lock()
+		full := len(c.tickets) >= wsMaxSubscriptions && !c.tickets[req.TicketID]
+		if !full {
+			followLocked(c, req.TicketID)
+			c.tickets[req.TicketID] = true
+		}
+		liveHub.Unlock()
+		if full {
+			c.reply(map[string]interface{}{"type": "error", "ticket_id": req.TicketID,
+				"error": fmt.Sprintf("At most %d tickets can be followed at once", wsMaxSubscriptions)})
+			return
+		}
+		c.reply(map[string]interface{}{"type": "subscribed", "ticket_id": req.TicketID})
+
+	case "unsubscribe":
+		liveHub.Lock()
+		c.unsubscribeLocked(req.TicketID)
+		liveHub.Unlock()
+		c.reply(map[string]interface{}{"type": "unsubscribed", "ticket_id": req.TicketID})
+
+	default:
+		c.reply(map[string]interface{}{"type": "error", "error": "type must be subscribe or unsubscribe"})
+	}
+}
+
+// Stop following a ticket; the caller holds liveHub's lock
+func (c *wsClient) unsubscribeLocked(ticketID int) {
+	delete(c.tickets, ticketID)
+	unfollowLocked(c, ticketID)
+}
+
+func (c *wsClient) liveUser() User {
+	return c.user
+}
+
+func (c *wsClient) deliver(_ LiveUpdate, payload []byte) {
+	c.push(payload)
+}
+
+func (c *wsClient) revoke(ticketID int) {
+	liveHub.Lock()
+	delete(c.tickets, ticketID)
+	liveHub.Unlock()
+	c.reply(map[string]interface{}{"type": "unsubscribed", "ticket_id": ticketID})
+}
+
+func (c *wsClient) reply(v interface{}) {
+	payload, err := json.Marshal(v)
+	if err == nil {
+		c.push(payload)
+	}
+}
+
+// Queue a text message without blocking the event bus
+func (c *wsClient) push(payload []byte) {
+	if !c.queue(wsFrame{op: wsOpText, payload: payload}) {
+		httpLog.Warnf("Dropping WebSocket of %s: %d updates behind", c.user.Email, wsSendBuffer)
+		c.finish(wsCloseFrame(wsClosePolicyViolation, "too far behind"))
+	}
+}
+
+func (c *wsClient) queue(f wsFrame) bool {
+	select {
+	case c.send <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// Unsubscribe everything and have the writer send the close frame and
+// hang up
+func (c *wsClient) finish(closing wsFrame) {
+	c.once.Do(func() {
+		liveHub.Lock()
+		for id := range c.tickets {
+			c.unsubscribeLocked(id)
+		}
+		liveHub.Unlock()
+		c.queue(closing)
+		close(c.done)
+	})
+}
+
+// Write queued frames and pings until the connection is finished
+func (c *wsClient) writeLoop() {
+	defer c.conn.Close()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case f := <-c.send:
+			if c.write(f) != nil || f.op == wsOpClose {
+				return
+			}
+		case <-ping.C:
+			if !credentialStillValid(c.token) {
+				c.write(wsCloseFrame(wsClosePolicyViolation, "session ended"))
+				return
+			}
+			if c.write(wsFrame{op: wsOpPing}) != nil {
+				return
+			}
+		case <-c.done:
+			// Flush what's queued, ending with the close frame
+			for {
+				select {
+				case f := <-c.send:
+					if c.write(f) != nil || f.op == wsOpClose {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *wsClient) write(f wsFrame) error {
+	head := []byte{0x80 | f.op}
+	switch n := len(f.payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xFFFF:
+		head = binary.BigEndian.AppendUint16(append(head, 126), uint16(n))
+	default:
+		head = binary.BigEndian.AppendUint64(append(head, 127), uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(append(head, f.payload...))
+	return err
+}
+
+// Whether the session or access token a long-lived connection was opened
+// with still holds. A database error keeps the connection; only a revoked
+// or expired credential ends it. Proxy identities have no token.
+func credentialStillValid(token string) bool {
+	if token == "" {
+		return true
+	}
+	if accessTokensEnabled() && isAccessToken(token) {
+		_, _, err := verifyAccessToken(token)
+		return err == nil
+	}
+	_, _, err := store.Users().SessionUser(hashToken(token))
+	return err != sql.ErrNoRows
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Synthetic data for benchmarking pagination, search and index changes.
+// Everything generated lives under loadgenDomain, so it's easy to tell
+// apart from (and delete before) real data.
+const loadgenDomain = "loadgen.example"
+
+const loadgenBatchSize = 1000
+
+var loadgenProblems = []string{
+	"Cannot log in to", "Error when opening", "Slow response from", "Question about",
+	"Unable to export", "Missing data in", "Refund request for", "Password reset for",
+	"Timeout while loading", "Feature request:", "Wrong totals in", "Access denied to",
+}
+
+var loadgenSubjects = []string{
+	"the dashboard", "invoice #%d", "the mobile app", "monthly report", "API key", "billing page",
+	"user settings", "team workspace", "CSV import", "order %d", "the Zürich office account",
+	"Überweisung %d", "café locations", "東京 branch", "notifications 🔔",
+}
+
+var loadgenSentences = []string{
+	"Hi, since this morning we keep getting an error when we try this.",
+	"It worked fine last week and nothing changed on our side.",
+	"Could you have a look as soon as possible? Several people are blocked.",
+	"I've attached a screenshot of what we see.",
+	"Thanks for getting back to me so quickly.",
+	"We tried clearing the cache and a different browser, same result.",
+	"Can you confirm whether this is a known issue?",
+	"I've checked the logs and the request is reaching us fine.",
+	"Could you try again now? We deployed a fix a few minutes ago.",
+	"That did the trick, everything works again.",
+	"Please send us the exact time it happened and your account ID.",
+	"Merci beaucoup, c'est réglé de notre côté.",
+	"Danke, das Problem tritt weiterhin auf.",
+}
+
+var loadgenCategories = []string{"billing", "technical", "account", "general"}
+
+// sts loadgen -tickets N -messages-per-ticket N [-users N] [-agents N] [-days N] [-seed N]
+func runLoadgen(args []string) error {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	tickets := fs.Int("tickets", 1000, "tickets to create")
+	perTicket := fs.Int("messages-per-ticket", 5, "average replies per ticket, besides the description")
+	users := fs.Int("users", 0, "requesters to spread tickets across (default: one per 20 tickets)")
+	agents := fs.Int("agents", 20, "agents to assign tickets to")
+	orgs := fs.Int("orgs", 50, "organizations requesters belong to")
+	days := fs.Int("days", 365, "spread ticket creation over this many days")
+	seed := fs.Uint64("seed", 1, "random seed; the same seed generates the same data")
+	password := fs.String("password", "", "password for generated users (default: random, so they can't log in)")
+	force := fs.Bool("force", false, "generate into a database that has real tickets")
+	fs.Parse(args)
+
+	if *tickets <= 0 || *perTicket < 0 || *agents <= 0 || *orgs <= 0 || *days <= 0 {
+		return fmt.Errorf("-tickets, -agents, -orgs and -days must be positive")
+	}
+	if *users <= 0 {
+		*users = max(1, *tickets/20)
+	}
+
+	// Make sure the schema exists before loading rows into it
+	createTables()
+
+	var existing int
+	db.QueryRow("SELECT COUNT(*) FROM tickets WHERE email NOT LIKE $1", "%"+loadgenDomain).Scan(&existing)
+	if existing > 0 && !*force {
+		return fmt.Errorf("database has %d tickets that weren't generated; rerun with -force to add to them", existing)
+	}
+
+	if *password == "" {
+		buf := make([]byte, 24)
+		rand.Read(buf)
+		*password = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	hash, err := hashPassword(*password)
+	if err != nil {
+		return err
+	}
+
+	rng := mrand.New(mrand.NewPCG(*seed, *seed))
+	ctx := context.Background()
+	start := time.Now()
+
+	orgIDs, err := loadgenOrgs(ctx, *orgs)
+	if err != nil {
+		return fmt.Errorf("organizations: %w", err)
+	}
+	clients, err := loadgenUsers(ctx, hash, "client", *users, func(i int) string {
+		return fmt.Sprintf("user-%05d@org%03d.%s", i, i%*orgs, loadgenDomain)
+	})
+	if err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+	agentEmails, err := loadgenUsers(ctx, hash, "agent", *agents, func(i int) string {
+		return fmt.Sprintf("agent-%03d@%s", i, loadgenDomain)
+	})
+	if err != nil {
+		return fmt.Errorf("agents: %w", err)
+	}
+	log.Printf("✓ %d organizations, %d requesters and %d agents ready", len(orgIDs), len(clients), len(agentEmails))
+
+	g := loadgen{
+		rng:       rng,
+		clients:   clients,
+		agents:    agentEmails,
+		orgIDs:    orgIDs,
+		perTicket: *perTicket,
+		now:       time.Now().UTC(),
+		span:      time.Duration(*days) * 24 * time.Hour,
+	}
+
+	var messages int
+	for done := 0; done < *tickets; done += loadgenBatchSize {
+		n, err := g.batch(ctx, min(loadgenBatchSize, *tickets-done))
+		if err != nil {
+			return err
+		}
+		messages += n
+		log.Printf("✓ Generated %d/%d tickets", min(done+loadgenBatchSize, *tickets), *tickets)
+	}
+
+	if _, err := db.Exec("ANALYZE tickets; ANALYZE messages"); err != nil {
+		return err
+	}
+	log.Printf("✓ Generated %d tickets and %d messages in %s", *tickets, messages, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// Create orgN.loadgen.example organizations, returning their IDs by index
+func loadgenOrgs(ctx context.Context, n int) ([]int, error) {
+	domains := make([]string, n)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("org%03d.%s", i, loadgenDomain)
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO organizations (name, domain)
+		SELECT 'Loadgen ' || d, d FROM unnest($1::text[]) AS d
+		ON CONFLICT (domain) DO NOTHING
+	`, pq.Array(domains))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, domain FROM organizations WHERE domain = ANY($1)", pq.Array(domains))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byDomain := map[string]int{}
+	for rows.Next() {
+		var id int
+		var domain string
+		if err := rows.Scan(&id, &domain); err != nil {
+			return nil, err
+		}
+		byDomain[domain] = id
+	}
+	ids := make([]int, n)
+	for i, d := range domains {
+		ids[i] = byDomain[d]
+	}
+	return ids, rows.Err()
+}
+
+type loadgenUser struct {
+	id    int
+	email string
+}
+
+// Create n users of one type, leaving existing ones alone
+func loadgenUsers(ctx context.Context, hash, userType string, n int, email func(i int) string) ([]loadgenUser, error) {
+	emails := make([]string, n)
+	for i := range emails {
+		emails[i] = email(i)
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO users (email, password, user_type)
+		SELECT e, $2, $3 FROM unnest($1::text[]) AS e
+		ON CONFLICT (email) DO NOTHING
+	`, pq.Array(emails), hash, userType)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, email FROM users WHERE email = ANY($1) ORDER BY email", pq.Array(emails))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []loadgenUser
+	for rows.Next() {
+		var u loadgenUser
+		if err := rows.Scan(&u.id, &u.email); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+type loadgen struct {
+	rng       *mrand.Rand
+	clients   []loadgenUser
+	agents    []loadgenUser
+	orgIDs    []int
+	perTicket int
+	now       time.Time
+	span      time.Duration
+}
+
+type loadgenTicket struct {
+	id        int
+	reference string
+	requester loadgenUser
+	orgID     int
+	agent     string
+	subject   string
+	body      string
+	channel   string
+	category  string
+	priority  string
+	closed    bool
+	createdAt time.Time
+	closedAt  time.Time
+	csat      int
+}
+
+// Generate and load one batch of tickets with their messages in a
+// transaction, returning how many messages were created
+func (g *loadgen) batch(ctx context.Context, n int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	tickets := make([]loadgenTicket, n)
+	for i := range tickets {
+		tickets[i] = g.ticket()
+	}
+	// Older tickets get lower IDs and references, as they would have
+	sort.Slice(tickets, func(i, j int) bool { return tickets[i].createdAt.Before(tickets[j].createdAt) })
+
+	if err := reserveTicketIDs(ctx, tx, tickets); err != nil {
+		return 0, err
+	}
+	if err := reserveLoadgenReferences(ctx, tx, tickets); err != nil {
+		return 0, err
+	}
+	if messagesPartitioned() {
+		if err := ensureMessagePartitions(ctx, tx, tickets[0].createdAt); err != nil {
+			return 0, err
+		}
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("tickets", "id", "reference", "email", "requester_id",
+		"subject", "description", "status", "channel", "assigned_to", "org_id", "category", "priority",
+		"closed_by", "closed_at", "csat_score", "created_at"))
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range tickets {
+		status, closedBy, closedAt, csat := "open", interface{}(nil), interface{}(nil), interface{}(nil)
+		if t.closed {
+			status, closedBy, closedAt = "closed", t.agent, t.closedAt
+			if t.csat > 0 {
+				csat = t.csat
+			}
+		}
+		agent, org := interface{}(nil), interface{}(nil)
+		if t.agent != "" {
+			agent = t.agent
+		}
+		if t.orgID != 0 {
+			org = t.orgID
+		}
+		_, err := stmt.ExecContext(ctx, t.id, t.reference, t.requester.email, t.requester.id, t.subject, t.body,
+			status, t.channel, agent, org, t.category, t.priority, closedBy, closedAt, csat, t.createdAt)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	stmt.Close()
+
+	stmt, err = tx.PrepareContext(ctx, pq.CopyIn("messages", "ticket_id", "sender_email", "message", "is_description", "created_at"))
+	if err != nil {
+		return 0, err
+	}
+	var messages int
+	for _, t := range tickets {
+		if _, err := stmt.ExecContext(ctx, t.id, t.requester.email, t.body, true, t.createdAt); err != nil {
+			return 0, err
+		}
+		messages++
+		for _, m := range g.replies(t) {
+			if _, err := stmt.ExecContext(ctx, t.id, m.sender, m.body, false, m.at); err != nil {
+				return 0, err
+			}
+			messages++
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	stmt.Close()
+
+	return messages, tx.Commit()
+}
+
+func (g *loadgen) ticket() loadgenTicket {
+	// Skew towards recent tickets, like a growing customer base
+	age := time.Duration(float64(g.span) * g.rng.Float64() * g.rng.Float64())
+	created := g.now.Add(-age).Truncate(time.Second)
+	requester := g.clients[g.rng.IntN(len(g.clients))]
+	domain := requester.email[strings.IndexByte(requester.email, '@')+1:]
+
+	t := loadgenTicket{
+		requester: requester,
+		subject:   g.subject(),
+		body:      g.text(2 + g.rng.IntN(4)),
+		channel:   g.channel(),
+		category:  loadgenCategories[g.rng.IntN(len(loadgenCategories))],
+		priority:  g.priority(),
+		createdAt: created,
+	}
+	var org int
+	if _, err := fmt.Sscanf(domain, "org%d.", &org); err == nil && org < len(g.orgIDs) {
+		t.orgID = g.orgIDs[org]
+	}
+
+	// Most tickets older than a couple of weeks are closed; newer ones
+	// are often still open and unassigned
+	closeChance := 0.3
+	if age > 14*24*time.Hour {
+		closeChance = 0.95
+	}
+	if g.rng.Float64() < closeChance {
+		t.closed = true
+		t.agent = g.agents[g.rng.IntN(len(g.agents))].email
+		t.closedAt = created.Add(time.Duration(1+g.rng.IntN(7*24)) * time.Hour)
+		if t.closedAt.After(g.now) {
+			t.closedAt = g.now
+		}
+		if g.rng.Float64() < 0.4 {
+			t.csat = 1 + g.rng.IntN(5)
+		}
+	} else if g.rng.Float64() < 0.6 {
+		t.agent = g.agents[g.rng.IntN(len(g.agents))].email
+	}
+	return t
+}
+
+func (g *loadgen) subject() string {
+	s := loadgenSubjects[g.rng.IntN(len(loadgenSubjects))]
+	if strings.Contains(s, "%d") {
+		s = fmt.Sprintf(s, 1000+g.rng.IntN(90000))
+	}
+	return loadgenProblems[g.rng.IntN(len(loadgenProblems))] + " " + s
+}
+
+func (g *loadgen) text(sentences int) string {
+	parts := make([]string, sentences)
+	for i := range parts {
+		parts[i] = loadgenSentences[g.rng.IntN(len(loadgenSentences))]
+	}
+	return strings.Join(parts, " ")
+}
+
+// Mostly web and email, like real traffic
+func (g *loadgen) channel() string {
+	switch r := g.rng.IntN(100); {
+	case r < 45:
+		return "web"
+	case r < 80:
+		return "email"
+	case r < 88:
+		return "widget"
+	case r < 94:
+		return "api"
+	case r < 98:
+		return "chat"
+	default:
+		return "sms"
+	}
+}
+
+func (g *loadgen) priority() string {
+	switch r := g.rng.IntN(100); {
+	case r < 15:
+		return "low"
+	case r < 75:
+		return "normal"
+	case r < 95:
+		return "high"
+	default:
+		return "urgent"
+	}
+}
+
+type loadgenMessage struct {
+	sender string
+	body   string
+	at     time.Time
+}
+
+// Replies alternating between requester and agent, between 0 and twice
+// the requested average per ticket
+func (g *loadgen) replies(t loadgenTicket) []loadgenMessage {
+	n := 0
+	if g.perTicket > 0 {
+		n = g.rng.IntN(2*g.perTicket + 1)
+	}
+	end := g.now
+	if t.closed {
+		end = t.closedAt
+	}
+	if t.agent == "" {
+		n = min(n, 1)
+	}
+
+	// Spread replies over the ticket's lifetime
+	window := max(end.Sub(t.createdAt), time.Minute)
+	offsets := make([]time.Duration, n)
+	for i := range offsets {
+		offsets[i] = time.Duration(g.rng.Int64N(int64(window))).Truncate(time.Second)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	msgs := make([]loadgenMessage, n)
+	for i, off := range offsets {
+		sender := t.requester.email
+		if i%2 == 0 && t.agent != "" {
+			sender = t.agent
+		}
+		msgs[i] = loadgenMessage{sender: sender, body: g.text(1 + g.rng.IntN(3)), at: t.createdAt.Add(off)}
+	}
+	return msgs
+}
+
+// Take IDs for a batch of tickets from the tickets sequence, so their
+// messages can be loaded alongside them
+func reserveTicketIDs(ctx context.Context, tx *sql.Tx, tickets []loadgenTicket) error {
+	rows, err := tx.QueryContext(ctx, "SELECT nextval(pg_get_serial_sequence('tickets', 'id')) FROM generate_series(1, $1)", len(tickets))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for i := 0; rows.Next(); i++ {
+		if err := rows.Scan(&tickets[i].id); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Number tickets from the reference counter of their organization and
+// creation year, reserving a block per counter in one go. Tickets must be
+// sorted by creation time.
+func reserveLoadgenReferences(ctx context.Context, tx *sql.Tx, tickets []loadgenTicket) error {
+	type counter struct{ orgID, year int }
+	var order []counter
+	members := map[counter][]int{}
+	for i, t := range tickets {
+		c := counter{t.orgID, t.createdAt.Year()}
+		if members[c] == nil {
+			order = append(order, c)
+		}
+		members[c] = append(members[c], i)
+	}
+
+	prefix := ticketRefPrefix()
+	for _, c := range order {
+		block := members[c]
+		var last int
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO ticket_sequences (prefix, org_id, year, last_value)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (prefix, org_id, year) DO UPDATE SET last_value = ticket_sequences.last_value + EXCLUDED.last_value
+			RETURNING last_value
+		`, prefix, c.orgID, c.year, len(block)).Scan(&last)
+		if err != nil {
+			return err
+		}
+		for k, i := range block {
+			tickets[i].reference = formatTicketReference(prefix, c.orgID, c.year, last-len(block)+k+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Log levels. LOG_LEVEL sets the level for every subsystem; overrides
+// for a single subsystem come from LOG_LEVEL_<SUBSYSTEM> (e.g.
+// LOG_LEVEL_NOTIFICATIONS=debug) and can be changed at runtime through
+// /admin/log_levels. Runtime changes apply to this instance only and
+// last until it restarts. Lines logged outside a subsystem are always
+// written.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q (expected %s)", s, strings.Join(logLevelNames, ", "))
+}
+
+// Logger for one part of the system
+type subsystemLog string
+
+const (
+	httpLog    subsystemLog = "http"
+	dbLog      subsystemLog = "db"
+	storageLog subsystemLog = "storage"
+	notifyLog  subsystemLog = "notifications"
+)
+
+var logSubsystems = []subsystemLog{httpLog, dbLog, storageLog, notifyLog}
+
+var logLevels = struct {
+	sync.RWMutex
+	level     logLevel
+	overrides map[subsystemLog]logLevel
+}{level: levelInfo, overrides: map[subsystemLog]logLevel{}}
+
+// Load LOG_LEVEL and the per-subsystem overrides
+func loadLogLevels() {
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		level, err := parseLogLevel(v)
+		if err != nil {
+			log.Fatal("Invalid LOG_LEVEL:", err)
+		}
+		logLevels.level = level
+	}
+	for _, s := range logSubsystems {
+		name := "LOG_LEVEL_" + strings.ToUpper(string(s))
+		if v := os.Getenv(name); v != "" {
+			level, err := parseLogLevel(v)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", name, err)
+			}
+			logLevels.overrides[s] = level
+		}
+	}
+	if logLevels.level != levelInfo || len(logLevels.overrides) > 0 {
+		log.Printf("✓ Log levels: %s", describeLogLevels())
+	}
+}
+
+// Level in effect for the subsystem
+func (s subsystemLog) level() logLevel {
+	logLevels.RLock()
+	defer logLevels.RUnlock()
+	if level, ok := logLevels.overrides[s]; ok {
+		return level
+	}
+	return logLevels.level
+}
+
+func (s subsystemLog) enabled(level logLevel) bool {
+	return level >= s.level()
+}
+
+// Debug lines name their subsystem, since they're only on for some
+func (s subsystemLog) Debugf(format string, args ...interface{}) {
+	if s.enabled(levelDebug) {
+		log.Printf("[%s] "+format, append([]interface{}{s}, args...)...)
+	}
+}
+
+func (s subsystemLog) Printf(format string, args ...interface{}) {
+	if s.enabled(levelInfo) {
+		log.Printf(format, args...)
+	}
+}
+
+func (s subsystemLog) Warnf(format string, args ...interface{}) {
+	if s.enabled(levelWarn) {
+		log.Printf("Warning: "+format, args...)
+	}
+}
+
+func (s subsystemLog) Errorf(format string, args ...interface{}) {
+	if s.enabled(levelError) {
+		log.Printf(format, args...)
+	}
+}
+
+// Current levels, e.g. "info (notifications=debug)"
+func describeLogLevels() string {
+	levels := currentLogLevels()
+	var overrides []string
+	for name, level := range levels.Subsystems {
+		if level != levels.Level {
+			overrides = append(overrides, name+"="+level)
+		}
+	}
+	sort.Strings(overrides)
+	if len(overrides) == 0 {
+		return levels.Level
+	}
+	return fmt.Sprintf("%s (%s)", levels.Level, strings.Join(overrides, ", "))
+}
+
+type LogLevels struct {
+	Level string `json:"level"`
+	// Level in effect for each subsystem
+	Subsystems map[string]string `json:"subsystems"`
+}
+
+func currentLogLevels() LogLevels {
+	logLevels.RLock()
+	levels := LogLevels{Level: logLevels.level.String(), Subsystems: map[string]string{}}
+	logLevels.RUnlock()
+	for _, s := range logSubsystems {
+		levels.Subsystems[string(s)] = s.level().String()
+	}
+	return levels
+}
+
+// Log each request with its status and duration at debug level
+func logRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !httpLog.enabled(levelDebug) {
+			next(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		httpLog.Debugf("%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// Log each S3 call at debug level
+func addS3LogHandler(handlers *request.Handlers) {
+	handlers.Complete.PushBack(func(r *request.Request) {
+		if !storageLog.enabled(levelDebug) {
+			return
+		}
+		took := time.Since(r.Time).Round(time.Millisecond)
+		if r.Error != nil {
+			storageLog.Debugf("S3 %s failed after %s: %v", r.Operation.Name, took, r.Error)
+			return
+		}
+		status := 0
+		if r.HTTPResponse != nil {
+			status = r.HTTPResponse.StatusCode
+		}
+		storageLog.Debugf("S3 %s %d %s", r.Operation.Name, status, took)
+	})
+}
+
+// Admin: GET the log levels; PUT {"level": ..., "subsystems": {...}} to
+// change them, where an empty subsystem level drops its override
+func handleLogLevels(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	switch r.Method {
+	case "GET":
+		// Current levels are written below
+
+	case "PUT":
+		var req struct {
+			Level      string            `json:"level"`
+			Subsystems map[string]string `json:"subsystems"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// Validate everything before changing anything
+		var level *logLevel
+		if req.Level != "" {
+			l, err := parseLogLevel(req.Level)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			level = &l
+		}
+		overrides := map[subsystemLog]*logLevel{}
+		for name, v := range req.Subsystems {
+			s := subsystemLog(name)
+			if !containsSubsystem(s) {
+				http.Error(w, fmt.Sprintf("Unknown subsystem %q", name), http.StatusBadRequest)
+				return
+			}
+			if v == "" {
+				overrides[s] = nil
+				continue
+			}
+			l, err := parseLogLevel(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			overrides[s] = &l
+		}
+
+		logLevels.Lock()
+		if level != nil {
+			logLevels.level = *level
+		}
+		for s, l := range overrides {
+			if l == nil {
+				delete(logLevels.overrides, s)
+			} else {
+				logLevels.overrides[s] = *l
+			}
+		}
+		logLevels.Unlock()
+		log.Printf("✓ Log levels set to %s by %s", describeLogLevels(), user.Email)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentLogLevels())
+}
+
+func containsSubsystem(s subsystemLog) bool {
+	for _, known := range logSubsystems {
+		if s == known {
+			return true
+		}
+	}
+	return false
+}
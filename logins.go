@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every login attempt, successful or not and whether or not the email
+// belongs to anyone, for investigating credential stuffing and account
+// takeovers. Per-user security events only cover known accounts.
+type LoginAttempt struct {
+	ID        int       `json:"id"`
+	Email     string    `json:"email"`
+	UserID    *int      `json:"user_id,omitempty"`
+	Method    string    `json:"method"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Login outcomes and failure reasons
+const (
+	loginSuccess = "success"
+	loginFailure = "failure"
+
+	loginReasonInvalidCredentials = "invalid_credentials"
+	loginReasonUnavailable        = "unavailable"
+	loginReasonError              = "error"
+	loginReasonRateLimited        = "rate_limited"
+)
+
+const (
+	defaultLoginAttemptsLimit = 100
+	maxLoginAttemptsLimit     = 1000
+)
+
+// Create login attempts table
+func createLoginAttemptsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS login_attempts (
+			id SERIAL PRIMARY KEY,
+			email VARCHAR(255) NOT NULL,
+			user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			method VARCHAR(20) NOT NULL,
+			outcome VARCHAR(20) NOT NULL,
+			reason VARCHAR(50) NOT NULL DEFAULT '',
+			ip VARCHAR(45) NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS login_attempts_created_idx ON login_attempts (created_at DESC);
+		CREATE INDEX IF NOT EXISTS login_attempts_email_idx ON login_attempts (email, created_at DESC);
+		CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, created_at DESC)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create login_attempts table:", err)
+	}
+}
+
+// Record a login attempt and log it as one key=value line. userID is 0
+// when the email isn't a known account.
+func recordLoginAttempt(r *http.Request, email string, userID int, method, outcome, reason string) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	email = truncateText(email, 255)
+	log.Printf("login_attempt method=%s outcome=%s reason=%q email=%q ip=%s user_agent=%q",
+		method, outcome, reason, email, clientIP(r), r.UserAgent())
+
+	if !fullFeatured() {
+		return
+	}
+	var uid sql.NullInt64
+	if userID != 0 {
+		uid = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	_, err := db.Exec(`
+		INSERT INTO login_attempts (email, user_id, method, outcome, reason, ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, email, uid, method, outcome, reason, clientIP(r), r.UserAgent())
+	if err != nil {
+		log.Printf("Failed to record login attempt for %s: %v", email, err)
+	}
+}
+
+// GET /admin/security/logins: login attempts, newest first. Filters are
+// email, ip, outcome, since and until (RFC 3339) and limit (at most 1000).
+func handleLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	where := "WHERE TRUE"
+	args := []interface{}{}
+	if email := strings.ToLower(strings.TrimSpace(q.Get("email"))); email != "" {
+		args = append(args, email)
+		where += fmt.Sprintf(" AND email = $%d", len(args))
+	}
+	if ip := strings.TrimSpace(q.Get("ip")); ip != "" {
+		args = append(args, ip)
+		where += fmt.Sprintf(" AND ip = $%d", len(args))
+	}
+	if outcome := q.Get("outcome"); outcome != "" {
+		if outcome != loginSuccess && outcome != loginFailure {
+			http.Error(w, "outcome must be success or failure", http.StatusBadRequest)
+			return
+		}
+		args = append(args, outcome)
+		where += fmt.Sprintf(" AND outcome = $%d", len(args))
+	}
+	for _, bound := range []struct{ param, op string }{{"since", ">="}, {"until", "<"}} {
+		v := q.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid "+bound.param+", expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+		args = append(args, t.UTC())
+		where += fmt.Sprintf(" AND created_at %s $%d", bound.op, len(args))
+	}
+
+	limit := defaultLoginAttemptsLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLoginAttemptsLimit {
+			http.Error(w, "limit must be 1-1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	args = append(args, limit)
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT id, email, user_id, method, outcome, reason, ip, user_agent, created_at
+		FROM login_attempts %s
+		ORDER BY created_at DESC, id DESC
+		LIMIT $%d
+	`, where, len(args)), args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var a LoginAttempt
+		var uid sql.NullInt64
+		if err := rows.Scan(&a.ID, &a.Email, &uid, &a.Method, &a.Outcome, &a.Reason, &a.IP, &a.UserAgent, &a.CreatedAt); err != nil {
+			continue
+		}
+		if uid.Valid {
+			id := int(uid.Int64)
+			a.UserID = &id
+		}
+		attempts = append(attempts, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attempts)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+// Outbound email transport. Send returns the provider's message ID,
+// used to match later bounce and delivery notifications.
+type mailTransport interface {
+	Send(to, subject, body string) (string, error)
+}
+
+// nil when outbound email isn't configured
+var mailer mailTransport
+
+// SES transport
+type sesTransport struct {
+	client *ses.SES
+	from   string
+}
+
+func (t *sesTransport) Send(to, subject, body string) (string, error) {
+	out, err := t.client.SendEmail(&ses.SendEmailInput{
+		Source:      aws.String(t.from),
+		Destination: &ses.Destination{ToAddresses: []*string{aws.String(to)}},
+		Message: &ses.Message{
+			Subject: &ses.Content{Data: aws.String(subject), Charset: aws.String("UTF-8")},
+			Body: &ses.Body{
+				Text: &ses.Content{Data: aws.String(body), Charset: aws.String("UTF-8")},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.MessageId), nil
+}
+
+// Set up outbound email from MAIL_FROM, sending through SES unless
+// MAIL_TRANSPORT=smtp
+func initMail(sess *session.Session) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		notifyLog.Warnf("MAIL_FROM not set, outbound email disabled")
+		return
+	}
+
+	switch os.Getenv("MAIL_TRANSPORT") {
+	case "smtp":
+		t, err := newSMTPTransport(from)
+		if err != nil {
+			notifyLog.Warnf("SMTP transport disabled: %v", err)
+			return
+		}
+		mailer = headerSafeTransport{t}
+		notifyLog.Printf("✓ Outbound email via SMTP (%s) initialized", t.addr)
+		if t.dkim != nil {
+			notifyLog.Printf("✓ DKIM signing enabled for %s (selector %s)", t.dkim.domain, t.dkim.selector)
+		}
+	case "", "ses":
+		if sess == nil {
+			notifyLog.Warnf("AWS session unavailable, outbound email disabled")
+			return
+		}
+		mailer = headerSafeTransport{&sesTransport{client: ses.New(sess), from: from}}
+		notifyLog.Printf("✓ Outbound email via SES initialized")
+	default:
+		notifyLog.Warnf("unknown MAIL_TRANSPORT %q, outbound email disabled", os.Getenv("MAIL_TRANSPORT"))
+	}
+}
+
+// Send an email in the background; failures are logged
+func sendMailAsync(to, subject, body string) {
+	sendMailTracked(to, subject, body, 0)
+}
+
+// Queue an email about a ticket message for the mail workers, which
+// record the delivery so bounces can be traced back to the message
+// (messageID 0 for mail not tied to a message)
+func sendMailTracked(to, subject, body string, messageID int) {
+	if mailer == nil {
+		return
+	}
+	queueMail(outboundMail{to: to, subject: subject, body: body, messageID: messageID})
+}
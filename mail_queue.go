@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Outbound email is sent by a small pool of workers (MAIL_WORKERS, 2 by
+// default) from a bounded queue (MAIL_QUEUE_SIZE, 1000 by default), so
+// requests never wait on the mail server. Sends that fail for a reason
+// that may pass (a dropped connection, throttling, a 4xx reply) are
+// retried with backoff up to mailMaxAttempts times; rejections are not.
+// Mail that still isn't sent is kept as a failed job (see failed_jobs.go).
+
+const (
+	defaultMailWorkers   = 2
+	defaultMailQueueSize = 1000
+	mailMaxAttempts      = 5
+	mailRetryBase        = 30 * time.Second
+	mailRetryMax         = 15 * time.Minute
+)
+
+type outboundMail struct {
+	to        string
+	subject   string
+	body      string
+	messageID int
+	attempt   int
+	history   []JobAttempt
+}
+
+var mailQueue struct {
+	once sync.Once
+	ch   chan outboundMail
+}
+
+func mailWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("MAIL_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMailWorkers
+}
+
+func mailQueueSize() int {
+	if n, err := strconv.Atoi(os.Getenv("MAIL_QUEUE_SIZE")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMailQueueSize
+}
+
+// Hand an email to the mail workers, starting them on first use
+func queueMail(m outboundMail) {
+	mailQueue.once.Do(func() {
+		mailQueue.ch = make(chan outboundMail, mailQueueSize())
+		for i := 0; i < mailWorkers(); i++ {
+			go mailWorker()
+		}
+	})
+
+	select {
+	case mailQueue.ch <- m:
+		notifyLog.Debugf("Queued %q for %s (attempt %d)", m.subject, m.to, m.attempt+1)
+	default:
+		notifyLog.Errorf("Mail queue full, not emailing %s: %s", m.to, m.subject)
+		if m.messageID != 0 {
+			recordDelivery("", m.messageID, m.to, deliveryFailed, "mail queue full")
+		}
+	}
+}
+
+func mailWorker() {
+	for m := range mailQueue.ch {
+		deliverMail(m)
+	}
+}
+
+func deliverMail(m outboundMail) {
+	// Sending to bounced or complaining addresses hurts sender reputation
+	if isSuppressed(m.to) {
+		notifyLog.Printf("Not emailing %s: address is suppressed", m.to)
+		if m.messageID != 0 {
+			recordDelivery("", m.messageID, m.to, deliverySuppressed, "")
+		}
+		return
+	}
+
+	notifyLog.Debugf("Sending %q to %s (%d bytes, message #%d)", m.subject, m.to, len(m.body), m.messageID)
+	providerID, err := mailer.Send(m.to, m.subject, m.body)
+	if err != nil {
+		m.attempt++
+		m.history = append(m.history, JobAttempt{At: time.Now().UTC(), Error: err.Error()})
+		if m.attempt < mailMaxAttempts && !isPermanentMailError(err) {
+			wait := min(mailRetryBase<<(m.attempt-1), mailRetryMax)
+			notifyLog.Warnf("Failed to send email to %s, retrying in %s: %v", m.to, wait, err)
+			// Waiting outside the queue keeps the workers free
+			time.AfterFunc(wait, func() { queueMail(m) })
+			return
+		}
+		notifyLog.Errorf("Failed to send email to %s after %d attempts: %v", m.to, m.attempt, err)
+		if m.messageID != 0 {
+			recordDelivery("", m.messageID, m.to, deliveryFailed, err.Error())
+		}
+		recordFailedJob("email", "", failedEmail{To: m.to, Subject: m.subject, Body: m.body, MessageID: m.messageID}, m.history)
+		return
+	}
+	notifyLog.Printf("✓ Email sent to %s: %s", m.to, m.subject)
+	if m.messageID != 0 {
+		recordDelivery(providerID, m.messageID, m.to, deliverySent, "")
+	}
+}
+
+// SES errors that retrying the same message won't fix
+var permanentSESErrors = map[string]bool{
+	"MessageRejected":                    true,
+	"MailFromDomainNotVerifiedException": true,
+	"ConfigurationSetDoesNotExist":       true,
+	"InvalidParameterValue":              true,
+}
+
+// Whether the mail server or provider refused the message for good, as
+// opposed to failing to take it right now
+func isPermanentMailError(err error) bool {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 500
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return permanentSESErrors[awsErr.Code()]
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Notification emails are rendered from text templates whose first line
+// is the subject and the rest, after a blank line, the body. Any of them
+// can be replaced by a file named after it in MAIL_TEMPLATE_DIR, e.g.
+// reply.tmpl. Templates see a mailData.
+var defaultMailTemplates = map[string]string{
+	"reply": `[{{.Ticket.Reference}}] New reply to your ticket
+
+{{.Actor}} replied to your ticket "{{.Ticket.Subject}}":
+
+{{.Message}}
+`,
+	"closed": `[{{.Ticket.Reference}}] Your ticket was closed
+
+Your ticket "{{.Ticket.Subject}}" was closed by our support team.
+
+If you still need help, reply to the ticket to let us know.`,
+	"new_ticket": `[{{.Ticket.Reference}}] New ticket: {{.Ticket.Subject}}
+
+{{.Ticket.Email}} opened a new {{.Ticket.Priority}} priority ticket{{with .Ticket.Category}} in {{.}}{{end}}:
+
+{{.Ticket.Subject}}
+
+{{.Ticket.Description}}
+{{with .PortalURL}}
+{{.}}
+{{end}}`,
+}
+
+type mailData struct {
+	Ticket Ticket
+	// Who acted: the replying agent, or who closed or opened the ticket
+	Actor string
+	// The reply, for reply notifications
+	Message   string
+	PortalURL string
+}
+
+type mailTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+var mailTemplates, builtinMailTemplates = map[string]mailTemplate{}, map[string]mailTemplate{}
+
+// Parse the built-in templates and any replacements in MAIL_TEMPLATE_DIR
+func loadMailTemplates() {
+	dir := os.Getenv("MAIL_TEMPLATE_DIR")
+	for name, text := range defaultMailTemplates {
+		builtin, err := parseMailTemplate(name, text)
+		if err != nil {
+			log.Fatalf("Invalid built-in %s mail template: %v", name, err)
+		}
+		builtinMailTemplates[name] = builtin
+
+		source := "built-in"
+		if dir != "" {
+			path := filepath.Join(dir, name+".tmpl")
+			if raw, err := os.ReadFile(path); err == nil {
+				text, source = string(raw), path
+			} else if !os.IsNotExist(err) {
+				log.Fatalf("Failed to read mail template %s: %v", path, err)
+			}
+		}
+
+		t, err := parseMailTemplate(name, text)
+		if err != nil {
+			log.Fatalf("Invalid %s mail template (%s): %v", name, source, err)
+		}
+		// Catch references to missing fields now rather than on the
+		// first notification
+		if _, _, err := t.render(mailData{Ticket: sampleTicket}); err != nil {
+			log.Fatalf("Invalid %s mail template (%s): %v", name, source, err)
+		}
+		mailTemplates[name] = t
+		if source != "built-in" {
+			notifyLog.Printf("✓ Mail template %s loaded from %s", name, source)
+		}
+	}
+}
+
+func parseMailTemplate(name, text string) (mailTemplate, error) {
+	subject, body, ok := strings.Cut(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if !ok || strings.TrimSpace(subject) == "" {
+		return mailTemplate{}, fmt.Errorf("first line must be the subject")
+	}
+	var t mailTemplate
+	var err error
+	if t.subject, err = template.New(name + " subject").Parse(subject); err != nil {
+		return t, err
+	}
+	if t.body, err = template.New(name).Parse(strings.TrimPrefix(body, "\n")); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+func (t mailTemplate) render(data mailData) (subject, body string, err error) {
+	var b bytes.Buffer
+	if err := t.subject.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	subject = strings.TrimSpace(b.String())
+	b.Reset()
+	if err := t.body.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	return subject, b.String(), nil
+}
+
+// Render a notification email, falling back to the built-in template if
+// a replacement fails on this data
+func renderMail(name string, data mailData) (subject, body string) {
+	if data.PortalURL == "" {
+		data.PortalURL = publicBaseURL()
+	}
+	subject, body, err := mailTemplates[name].render(data)
+	if err != nil {
+		notifyLog.Errorf("Error rendering %s mail template, using the built-in one: %v", name, err)
+		// Built-in templates are checked against sample data at startup
+		subject, body, _ = builtinMailTemplates[name].render(data)
+	}
+	return subject, body
+}
@@ -3,16 +3,20 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"sts/auth"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -21,47 +25,156 @@ import (
 )
 
 type User struct {
-	ID       int    `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"-"`
-	UserType string `json:"user_type"`
-	Token    string `json:"token"`
+	ID          int      `json:"id"`
+	Email       string   `json:"email"`
+	Password    string   `json:"-"`
+	UserType    string   `json:"user_type"`
+	Permissions []string `json:"permissions,omitempty"`
+	Token       string   `json:"token"`
+	// Set when access tokens are enabled (see access_tokens.go)
+	AccessToken          string     `json:"access_token,omitempty"`
+	AccessTokenExpiresAt *time.Time `json:"access_token_expires_at,omitempty"`
 }
 
 type Ticket struct {
-	ID            int       `json:"id"`
-	Email         string    `json:"email"`
-	Subject       string    `json:"subject"`
-	Description   string    `json:"description"`
-	Status        string    `json:"status"`
-	AttachmentURL string    `json:"attachment_url,omitempty"`
-	ClosedBy      string    `json:"closed_by,omitempty"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID            int               `json:"id"`
+	Reference     string            `json:"reference"`
+	Email         string            `json:"email"`
+	RequesterID   int               `json:"requester_id,omitempty"`
+	Subject       string            `json:"subject"`
+	Description   string            `json:"description"`
+	Status        string            `json:"status"`
+	Channel       string            `json:"channel"`
+	AttachmentURL string            `json:"attachment_url,omitempty"`
+	AttachmentKey string            `json:"attachment_key,omitempty"`
+	ClosedBy      string            `json:"closed_by,omitempty"`
+	AssignedTo    string            `json:"assigned_to,omitempty"`
+	OrgID         int               `json:"org_id,omitempty"`
+	Category      string            `json:"category,omitempty"`
+	Priority      string            `json:"priority"`
+	CustomFields  map[string]string `json:"custom_fields,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Assets        []AssetRef        `json:"assets,omitempty"`
+	Entitlement   *Entitlement      `json:"entitlement,omitempty"`
+	Change        *ChangeWindow     `json:"change,omitempty"`
+	Tasks         *TaskProgress     `json:"tasks,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+
+	// Files uploaded through /upload, given when creating the ticket, and
+	// the ticket's files as presentTickets lists them
+	AttachmentKeys []string     `json:"attachment_keys,omitempty"`
+	Attachments    []Attachment `json:"attachments,omitempty"`
+
+	// Response-time targets, filled in by presentTickets
+	FirstResponseDueAt *time.Time `json:"first_response_due_at,omitempty"`
+	FirstRespondedAt   *time.Time `json:"first_responded_at,omitempty"`
+	ResolutionDueAt    *time.Time `json:"resolution_due_at,omitempty"`
 }
 
 type Message struct {
-	ID          int       `json:"id"`
-	TicketID    int       `json:"ticket_id"`
-	SenderEmail string    `json:"sender_email"`
-	Message     string    `json:"message"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID             int          `json:"id"`
+	TicketID       int          `json:"ticket_id"`
+	SenderEmail    string       `json:"sender_email"`
+	Message        string       `json:"message"`
+	IsDescription  bool         `json:"is_description"`
+	HTML           string       `json:"html,omitempty"`
+	DeliveryStatus string       `json:"delivery_status,omitempty"`
+	Attachments    []Attachment `json:"attachments,omitempty"`
+	CreatedAt      time.Time    `json:"created_at"`
 }
 
 var db *sql.DB
 var s3Client *s3.S3
-var activeTokens = make(map[string]User)
 
 func main() {
+	log.SetOutput(logSanitizer{os.Stderr})
+	loadLogLevels()
+	loadErrorReporting()
+	loadTrustedProxies()
+	loadProxyAuth()
+	loadLDAPAuth()
+	loadAccessTokens()
+	logFaultInjection()
+	loadTicketWorkflow()
+
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("AWS_REGION")),
 	})
 	if err != nil {
-		log.Printf("Warning: Failed to create AWS session: %v", err)
+		storageLog.Warnf("Failed to create AWS session: %v", err)
 	} else {
-		s3Client = s3.New(sess)
-		log.Println("✓ AWS S3 initialized")
+		s3Client = newS3Client(sess)
+		storageLog.Printf("✓ AWS S3 initialized")
+	}
+	loadStorageLocations()
+	initMail(sess)
+	loadMailTemplates()
+	loadContextProviders()
+
+	connectStore()
+	defer db.Close()
+	ticketService = TicketService{store}
+
+	subscribeAudit()
+	subscribeTicketNotifications()
+	subscribeLiveUpdates()
+	if fullFeatured() {
+		subscribeAutoAssign()
+		subscribeInAppNotifications()
+		subscribeSavedSearches()
+		subscribeAutoResponder()
 	}
+	startEventBus(newMemoryEventBackend())
+	checkS3()
 
+	// CLI subcommands, e.g. `sts backup`
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	if err := store.Migrate(); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+	go rehashPlaintextPasswords()
+
+	// Background jobs
+	if fullFeatured() {
+		scheduleJob("report-emails", time.Hour, sendDueReportEmails)
+		scheduleJob("event-export", time.Hour, exportEvents)
+		scheduleJob("held-emails", 5*time.Minute, sendHeldEmails)
+		scheduleJob("request-nonces", time.Hour, purgeExpiredNonces)
+		scheduleJob("usage-metering", time.Hour, recordUsage)
+		scheduleJob("message-partitions", 24*time.Hour, maintainMessagePartitions)
+		if archiveAfterMonths() > 0 {
+			scheduleJob("archive-tickets", 24*time.Hour, archiveClosedTickets)
+		}
+		startScheduler()
+		startAPIUsageFlusher()
+	}
+
+	// Routes
+	registerWebhookHandler("stripe", handleStripeHook)
+	if fullFeatured() {
+		registerWebhookHandler("ses", handleSESHook)
+		registerWebhookHandler("scanner", handleScanResult)
+	}
+	registerRoutes()
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	log.Printf("✓ Server starting on port %s", port)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
+
+// Connect to Postgres
+func connectDB() {
 	dbHost := os.Getenv("DB_HOST")
 	dbUser := os.Getenv("DB_USER")
 	dbPass := os.Getenv("DB_PASSWORD")
@@ -70,39 +183,47 @@ func main() {
 	connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=require",
 		dbHost, dbUser, dbPass, dbName)
 
-	db, err = sql.Open("postgres", connStr)
+	var err error
+	db, err = sql.Open(sqlDriverName("postgres"), connStr)
 	if err != nil {
 		log.Fatal("Database connection error:", err)
 	}
-	defer db.Close()
 
-	if err = db.Ping(); err != nil {
+	if err = retryStartup("database", db.Ping); err != nil {
 		log.Fatal("Database ping error:", err)
 	}
-	log.Println("✓ Connected to RDS database")
-
-	createTables()
-	// Routes
-	http.HandleFunc("/health", handleHealth)
-	http.HandleFunc("/login", cors(handleLogin))
-	http.HandleFunc("/upload", cors(authenticate(handleUpload)))
-	http.HandleFunc("/tickets", cors(authenticate(handleTickets)))
-	http.HandleFunc("/tickets/", cors(authenticate(handleTicketActions)))
+	dbLog.Printf("✓ Connected to RDS database")
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+// Origins allowed to send credentials (the session cookie) cross-origin,
+// from CORS_CREDENTIAL_ORIGINS, e.g. the portal's own origin when it's
+// served from a different host than the API. Cookies are SameSite=Lax,
+// so the portal and API must still be on the same site.
+func corsCredentialOrigins() []string {
+	var origins []string
+	for _, o := range strings.Split(os.Getenv("CORS_CREDENTIAL_ORIGINS"), ",") {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
+		}
 	}
-
-	log.Printf("✓ Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	return origins
 }
 
 func cors(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && containsString(corsCredentialOrigins(), origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token, X-API-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "Link, X-Total-Count, X-Request-Id")
+		if faultInjectionEnabled() {
+			w.Header().Add("Access-Control-Allow-Headers", "X-Fault-Token, X-Fault-Latency, X-Fault-DB, X-Fault-S3")
+		}
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -112,31 +233,54 @@ func cors(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}
 }
+
 // Authentication
 func authenticate(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
-		if token == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+		auth.StripHeaders(r)
+
+		var user User
+		var sessionID string
+		err := errors.New("no credentials")
+		if token := sessionToken(r); token != "" {
+			if accessTokensEnabled() && isAccessToken(token) {
+				user, sessionID, err = verifyAccessToken(token)
+			} else {
+				user, sessionID, err = lookupSession(token, r)
+			}
 		}
-
-		user, exists := activeTokens[token]
-		if !exists {
+		// Behind an SSO proxy, API calls may carry only the proxy's identity
+		if err != nil && proxyAuthEnabled() {
+			user, err = proxyUser(r)
+		}
+		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		r.Header.Set("X-User-Email", user.Email)
-		r.Header.Set("X-User-Type", user.UserType)
-
-		next(w, r)
+		ctx := auth.NewContext(r.Context(), auth.Identity{
+			UserID:    user.ID,
+			Email:     user.Email,
+			UserType:  user.UserType,
+			SessionID: sessionID,
+		})
+		setRequestUser(r, user.Email)
+		next(w, r.WithContext(ctx))
 	}
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := map[string]interface{}{"status": "healthy"}
+	// Writes waiting out a database outage
+	if pending, dropped := writeQueueStats(); pending > 0 || dropped > 0 {
+		health["queued_writes"] = pending
+		health["dropped_writes"] = dropped
+		if pending > 0 {
+			health["status"] = "degraded"
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	json.NewEncoder(w).Encode(health)
 }
 
 // Create database tables
@@ -154,6 +298,8 @@ func createTables() {
 		log.Fatal("Failed to create users table:", err)
 	}
 
+	createRolesTable()
+
 	// Insert demo users
 	db.Exec(`
 		INSERT INTO users (email, password, user_type) 
@@ -163,6 +309,10 @@ func createTables() {
 		ON CONFLICT (email) DO NOTHING
 	`)
 
+	createSessionsTable()
+	createSecurityEventsTable()
+	createLoginAttemptsTable()
+
 	// Tickets table
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS tickets (
@@ -194,6 +344,109 @@ func createTables() {
 		log.Fatal("Failed to create messages table:", err)
 	}
 
+	// Attachments table
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS attachments (
+			id SERIAL PRIMARY KEY,
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			s3_key TEXT UNIQUE NOT NULL,
+			uploaded_by VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create attachments table:", err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE tickets ADD COLUMN IF NOT EXISTS closed_at TIMESTAMP`)
+	if err != nil {
+		log.Fatal("Failed to migrate tickets table:", err)
+	}
+
+	// The ticket description is the first message of every thread. Once
+	// messages is partitioned the index can't be unique (see partitions.go).
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_description BOOLEAN NOT NULL DEFAULT FALSE`)
+	if err == nil && !messagesPartitioned() {
+		_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS messages_description_idx ON messages (ticket_id) WHERE is_description`)
+	}
+	if err != nil {
+		log.Fatal("Failed to migrate messages table:", err)
+	}
+
+	// Backfill description messages for tickets created before this existed
+	res, err := db.Exec(`
+		INSERT INTO messages (ticket_id, sender_email, message, is_description, created_at)
+		SELECT t.id, t.email, t.description, TRUE, t.created_at FROM tickets t
+		WHERE NOT EXISTS (SELECT 1 FROM messages m WHERE m.ticket_id = t.id AND m.is_description)
+	`)
+	if err != nil {
+		log.Fatal("Failed to backfill description messages:", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("✓ Backfilled %d description messages", n)
+	}
+
+	migrateTicketReferences()
+	createOrganizationTables()
+	createFieldTables()
+	createAssetTables()
+	createContractTables()
+	createChangeWindowsTable()
+	createTasksTable()
+	createTicketSharesTable()
+	createSCIMTables()
+	createEmailChangesTable()
+	createRegistrationsTable()
+	migrateTicketChannels()
+	migrateTicketAssignment()
+	migrateTicketRequester()
+	migrateTicketPriority()
+	migrateTicketSorting()
+	migrateAttachments()
+	createStorageLocationColumns()
+	createStatusHistoryTable()
+	migrateCSAT()
+	createTimeEntriesTable()
+	createChargesTable()
+	createHandoffsTable()
+	createShiftTables()
+	createReportSchedulesTable()
+	createAuditEventsTable()
+	createExportRunsTable()
+	createCalendarFeedsTable()
+	createAnnouncementsTable()
+	createEmailDeliveriesTable()
+	createEmailThreadsTable()
+	createSuppressionsTable()
+	createQuotaTables()
+	createQuarantineTable()
+	createSignaturesTable()
+	createAutoResponseTables()
+	createResponseTemplatesTable()
+	createUsageTables()
+	createRequestNoncesTable()
+	createNotificationsTable()
+	createSavedSearchesTable()
+	createNotificationPreferencesTables()
+	createImportTables()
+	createStripeCustomersTable()
+	migratePartitionedMessages()
+	migrateSearch()
+	createArchiveTables()
+
+	createFailedJobsTable()
+
+	// Job runs table (scheduler bookkeeping)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS job_runs (
+			name VARCHAR(100) PRIMARY KEY,
+			last_run_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create job_runs table:", err)
+	}
+
 	log.Println("✓ Database tables ready")
 }
 
@@ -204,9 +457,17 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if proxyAuthEnabled() {
+		http.Error(w, "Password login is disabled; sign in through your organization's SSO", http.StatusForbidden)
+		return
+	}
+
 	var creds struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// Set the session as an HttpOnly cookie rather than returning
+		// the token
+		Cookie bool `json:"cookie"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
@@ -215,23 +476,62 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var user User
-	err := db.QueryRow(`
-		SELECT id, email, user_type 
-		FROM users 
-		WHERE email = $1 AND password = $2
-	`, creds.Email, creds.Password).Scan(&user.ID, &user.Email, &user.UserType)
-
+	var err error
+	method := "password"
+	if ldapAuthEnabled() {
+		method = "ldap"
+		user, err = ldapUser(creds.Email, creds.Password)
+	} else {
+		user, err = userByPassword(creds.Email, creds.Password)
+	}
+	if err == errLDAPUnavailable {
+		recordLoginAttempt(r, creds.Email, 0, method, loginFailure, loginReasonUnavailable)
+		http.Error(w, "Sign-in is temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
-		log.Printf("Login failed for %s", creds.Email)
+		reason := loginReasonInvalidCredentials
+		if err != errInvalidCredentials && err != errLDAPInvalidCredentials {
+			log.Printf("Error checking credentials for %s: %v", creds.Email, err)
+			reason = loginReasonError
+		}
+		userID, err := store.Users().IDByEmail(strings.TrimSpace(creds.Email))
+		if err == nil {
+			recordSecurityEvent(userID, securityEventLoginFailed, r, "")
+		}
+		recordLoginAttempt(r, creds.Email, userID, method, loginFailure, reason)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
+	user.Permissions = permissionList(user.UserType)
+	knownDevice := isKnownDevice(user.ID, r)
+
 	// Generate token
-	user.Token = fmt.Sprintf("%s-%d-%s", user.Email, time.Now().Unix(), uuid.New().String()[:8])
-	activeTokens[user.Token] = user
+	var sessionID string
+	user.Token, sessionID, err = createSession(user, r)
+	if err == nil {
+		err = attachAccessToken(&user, sessionID)
+	}
+	if err != nil {
+		log.Printf("Error creating session for %s: %v", user.Email, err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
 
-	log.Printf("✓ User logged in: %s (%s)", user.Email, user.UserType)
+	log.Printf("✓ User logged in: %s (%s) from %s", user.Email, user.UserType, clientIP(r))
+	recordLoginAttempt(r, user.Email, user.ID, method, loginSuccess, "")
+	if creds.Cookie {
+		setSessionCookie(w, user.Token)
+		user.Token = ""
+	}
+
+	if knownDevice {
+		recordSecurityEvent(user.ID, securityEventLogin, r, "")
+	} else {
+		recordSecurityEvent(user.ID, securityEventNewDeviceLogin, r, describeDevice(r.UserAgent()))
+		notifySecurityEvent(user.Email, securityEventNewDeviceLogin, r)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
@@ -244,7 +544,7 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userEmail := r.Header.Get("X-User-Email")
+	userEmail := currentUser(r).Email
 
 	err := r.ParseMultipartForm(5 << 20)
 	if err != nil {
@@ -252,53 +552,115 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	_, header, err := r.FormFile("file")
 	if err != nil {
 		http.Error(w, "Failed to get file", http.StatusBadRequest)
 		return
 	}
+
+	key, err := storeUpload(userEmail, storageOrgID(userEmail), header)
+	if err != nil {
+		writeServiceError(w, err, "Failed to upload file")
+		return
+	}
+
+	urlStr, err := presignAttachment(key)
+	if err != nil {
+		http.Error(w, "Failed to generate URL", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": urlStr, "key": key})
+}
+
+// Upload a file to S3 under the uploader's namespace, in the storage
+// location of the organization it's for, and count it toward their storage
+// quota; returns the object key
+func storeUpload(userEmail string, orgID int, header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", err
+	}
 	defer file.Close()
 
-	// Generate unique filename
-	ext := filepath.Ext(header.Filename)
-	filename := fmt.Sprintf("%s-%d-%s%s", userEmail, time.Now().Unix(), uuid.New().String()[:8], ext)
+	// Generate unique filename; only the extension comes from the client
+	ext := keyExtension(header.Filename)
+	filename := fmt.Sprintf("%s-%d-%s%s", keyEmail(userEmail), time.Now().Unix(), uuid.New().String()[:8], ext)
 
 	// Read file content
 	fileBytes, err := io.ReadAll(file)
 	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusInternalServerError)
-		return
+		return "", err
+	}
+
+	if fullFeatured() {
+		if err := checkStorageQuota(userEmail, int64(len(fileBytes))); err != nil {
+			return "", err
+		}
 	}
 
 	// Upload to S3
-	bucketName := os.Getenv("S3_BUCKET_NAME")
-	_, err = s3Client.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String("attachments/" + filename),
+	location := orgStorageLocation(orgID)
+	client, bucket := locationStorage(location)
+	if client == nil {
+		storageLog.Errorf("Storage location %q of organization %d is not configured", location, orgID)
+		return "", newServiceError(errUnavailable, "Attachment storage unavailable")
+	}
+	key := "attachments/" + filename
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 		Body:   strings.NewReader(string(fileBytes)),
 	})
-
 	if err != nil {
-		log.Printf("S3 upload error: %v", err)
-		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
-		return
+		storageLog.Errorf("S3 upload error: %v", err)
+		return "", err
+	}
+
+	// An unrecorded upload couldn't be attached by anyone
+	if err := recordUpload(key, userEmail, location, int64(len(fileBytes))); err != nil {
+		storageLog.Errorf("Error recording upload %s: %v", key, err)
+		deleteAttachmentObject(key)
+		return "", err
 	}
 
-	// Generate presigned URL
-	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String("attachments/" + filename),
+	storageLog.Printf("✓ File uploaded: %s", filename)
+	return key, nil
+}
+
+// Generate presigned download URL for an attachment
+func presignAttachment(key string) (string, error) {
+	client, bucket := storageFor(key)
+	if client == nil {
+		return "", fmt.Errorf("storage location of %s is not configured", key)
+	}
+	req, _ := client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(7 * 24 * time.Hour)
+}
+
+// Remove an uploaded attachment that never got linked to a ticket
+func deleteAttachmentObject(key string) {
+	client, bucket := storageFor(key)
+	if client == nil {
+		storageLog.Errorf("Failed to delete orphaned attachment %s: storage location not configured", key)
+		return
+	}
+	_, err := client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 	})
-	urlStr, err := req.Presign(7 * 24 * time.Hour)
 	if err != nil {
-		http.Error(w, "Failed to generate URL", http.StatusInternalServerError)
+		storageLog.Errorf("Failed to delete orphaned attachment %s: %v", key, err)
 		return
 	}
-
-	log.Printf("✓ File uploaded: %s", filename)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"url": urlStr})
+	if fullFeatured() {
+		db.Exec("DELETE FROM attachments WHERE s3_key = $1 AND ticket_id IS NULL", key)
+	}
+	storageLog.Printf("✓ Orphaned attachment removed: %s", key)
 }
 
 // Tickets handler
@@ -315,91 +677,133 @@ func handleTickets(w http.ResponseWriter, r *http.Request) {
 
 // Get tickets
 func getTickets(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.Header.Get("X-User-Email")
-	userType := r.Header.Get("X-User-Type")
-
-	var rows *sql.Rows
-	var err error
-
-	if userType == "agent" {
-		rows, err = db.Query(`
-			SELECT id, email, subject, description, status, attachment_url, closed_by, created_at 
-			FROM tickets 
-			ORDER BY created_at DESC
-		`)
-	} else {
-		rows, err = db.Query(`
-			SELECT id, email, subject, description, status, attachment_url, closed_by, created_at 
-			FROM tickets 
-			WHERE email = $1 
-			ORDER BY created_at DESC
-		`, userEmail)
+	user := currentUser(r)
+
+	filter := TicketFilter{
+		Reference: r.URL.Query().Get("ref"),
+		Channel:   r.URL.Query().Get("channel"),
+		Query:     r.URL.Query().Get("q"),
+		Priority:  r.URL.Query().Get("priority"),
+		Status:    r.URL.Query().Get("status"),
+		Email:     strings.ToLower(strings.TrimSpace(r.URL.Query().Get("email"))),
+	}
+	sort, err := parseTicketSort(r.URL.Query().Get("sort"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Sort = sort
+	if filter.Priority != "" && !validPriority(filter.Priority) {
+		http.Error(w, "Invalid priority", http.StatusBadRequest)
+		return
 	}
+	if filter.Status != "" && !validStatus(filter.Status) {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	if v := r.URL.Query().Get("has_attachment"); v != "" {
+		has, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "has_attachment must be true or false", http.StatusBadRequest)
+			return
+		}
+		filter.HasAttachment = &has
+	}
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.From, filter.To = from, to
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Page = page
 
+	tickets, total, err := store.Tickets().List(user, filter)
 	if err != nil {
 		log.Printf("Error fetching tickets: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	tickets := []Ticket{}
-	for rows.Next() {
-		var t Ticket
-		var attachmentURL, closedBy sql.NullString
-		if err := rows.Scan(&t.ID, &t.Email, &t.Subject, &t.Description, &t.Status, &attachmentURL, &closedBy, &t.CreatedAt); err != nil {
+	presentTickets(user, tickets)
+
+	setPageHeaders(w, r, page, total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tickets)
+}
+
+// Days asked for with the from and to query parameters (YYYY-MM-DD, both
+// inclusive), as a half-open range; zero for a bound that isn't given
+func parseDateRange(r *http.Request) (from, to time.Time, err error) {
+	for _, bound := range []struct {
+		param string
+		t     *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		v := r.URL.Query().Get(bound.param)
+		if v == "" {
 			continue
 		}
-		if attachmentURL.Valid {
-			t.AttachmentURL = attachmentURL.String
+		day, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return from, to, fmt.Errorf("Invalid %s, expected YYYY-MM-DD", bound.param)
 		}
-		if closedBy.Valid {
-			t.ClosedBy = closedBy.String
-		}
-		tickets = append(tickets, t)
+		*bound.t = day
+	}
+	if !to.IsZero() {
+		to = to.AddDate(0, 0, 1)
 	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, fmt.Errorf("Invalid range, from is after to")
+	}
+	return from, to, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(tickets)
+// Columns selected for a Ticket, in scanTicket order
+const ticketColumns = `id, reference, email, requester_id, subject, description, status, channel, attachment_url, closed_by, assigned_to, org_id, category, priority, created_at, updated_at`
+
+// Scan a row selected with ticketColumns, and any columns selected after
+// them into extra
+func scanTicket(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Ticket, error) {
+	var t Ticket
+	var attachmentURL, closedBy, assignedTo, category sql.NullString
+	var requesterID, orgID sql.NullInt64
+	dest := []interface{}{&t.ID, &t.Reference, &t.Email, &requesterID, &t.Subject, &t.Description, &t.Status, &t.Channel,
+		&attachmentURL, &closedBy, &assignedTo, &orgID, &category, &t.Priority, &t.CreatedAt, &t.UpdatedAt}
+	err := row.Scan(append(dest, extra...)...)
+	t.RequesterID = int(requesterID.Int64)
+	t.AttachmentURL = attachmentURL.String
+	t.ClosedBy = closedBy.String
+	t.AssignedTo = assignedTo.String
+	t.OrgID = int(orgID.Int64)
+	t.Category = category.String
+	return t, err
+}
+
+// Load a ticket the caller is allowed to see
+func findAccessibleTicket(r *http.Request, ticketID int) (Ticket, error) {
+	return store.Tickets().Find(currentUser(r), ticketID)
 }
 
 // Create ticket
 func createTicket(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.Header.Get("X-User-Email")
-	userType := r.Header.Get("X-User-Type")
-
-	if userType != "client" {
-		http.Error(w, "Only clients can create tickets", http.StatusForbidden)
-		return
-	}
-
 	var ticket Ticket
 	if err := json.NewDecoder(r.Body).Decode(&ticket); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	ticket.Email = userEmail
-
-	if ticket.Subject == "" || ticket.Description == "" {
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
-		return
-	}
-
-	err := db.QueryRow(`
-		INSERT INTO tickets (email, subject, description, status, attachment_url) 
-		VALUES ($1, $2, $3, 'open', $4) 
-		RETURNING id, created_at
-	`, ticket.Email, ticket.Subject, ticket.Description, sql.NullString{String: ticket.AttachmentURL, Valid: ticket.AttachmentURL != ""}).Scan(&ticket.ID, &ticket.CreatedAt)
-
-	if err != nil {
-		log.Printf("Error creating ticket: %v", err)
-		http.Error(w, "Failed to create ticket", http.StatusInternalServerError)
+	user := currentUser(r)
+	if err := ticketService.Create(user, &ticket); err != nil {
+		log.Printf("Error creating ticket for %s from %s: %v", user.Email, clientIP(r), err)
+		writeServiceError(w, err, "Failed to create ticket")
 		return
 	}
 
-	ticket.Status = "open"
-	log.Printf("✓ Ticket #%d created by %s", ticket.ID, ticket.Email)
+	presentTicket(user, &ticket)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ticket)
@@ -413,10 +817,17 @@ func handleTicketActions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Tickets can be addressed by ID or by reference
 	ticketID, err := strconv.Atoi(parts[1])
 	if err != nil {
-		http.Error(w, "Invalid ticket ID", http.StatusBadRequest)
-		return
+		ticketID, err = store.Tickets().IDByReference(parts[1])
+		if err != nil && len(parts) == 3 && parts[2] == "unarchive" && fullFeatured() {
+			ticketID, err = archivedTicketIDByReference(parts[1])
+		}
+		if err != nil {
+			http.Error(w, "Ticket not found", http.StatusNotFound)
+			return
+		}
 	}
 
 	if len(parts) == 2 && r.Method == "GET" {
@@ -427,7 +838,47 @@ func handleTicketActions(w http.ResponseWriter, r *http.Request) {
 		case "close":
 			closeTicket(w, r, ticketID)
 		case "messages":
-			handleMessages(w, r, ticketID)
+			if len(parts) == 4 && parts[3] == "stream" {
+				streamMessages(w, r, ticketID)
+			} else {
+				handleMessages(w, r, ticketID)
+			}
+		case "fields":
+			updateTicketFields(w, r, ticketID)
+		case "tags":
+			updateTicketTags(w, r, ticketID)
+		case "assets":
+			updateTicketAssets(w, r, ticketID)
+		case "change":
+			handleChangeWindow(w, r, ticketID)
+		case "tasks":
+			handleTasks(w, r, ticketID)
+		case "share":
+			handleTicketShare(w, r, ticketID)
+		case "assign":
+			assignTicket(w, r, ticketID)
+		case "claim":
+			claimTicket(w, r, ticketID)
+		case "requester":
+			changeRequester(w, r, ticketID)
+		case "priority":
+			changePriority(w, r, ticketID)
+		case "status":
+			handleTicketStatus(w, r, ticketID)
+		case "handoff":
+			handleHandoff(w, r, ticketID)
+		case "rating":
+			rateTicket(w, r, ticketID)
+		case "time":
+			handleTimeEntries(w, r, ticketID)
+		case "charges":
+			handleCharges(w, r, ticketID)
+		case "export.pdf":
+			exportTicketPDF(w, r, ticketID)
+		case "unarchive":
+			unarchiveTicket(w, r, ticketID)
+		case "context":
+			getTicketContext(w, r, ticketID)
 		default:
 			http.Error(w, "Invalid action", http.StatusBadRequest)
 		}
@@ -438,39 +889,14 @@ func handleTicketActions(w http.ResponseWriter, r *http.Request) {
 
 // Get single ticket detail
 func getTicketDetail(w http.ResponseWriter, r *http.Request, ticketID int) {
-	userEmail := r.Header.Get("X-User-Email")
-	userType := r.Header.Get("X-User-Type")
-
-	var ticket Ticket
-	var attachmentURL, closedBy sql.NullString
-
-	query := `SELECT id, email, subject, description, status, attachment_url, closed_by, created_at 
-			  FROM tickets WHERE id = $1`
-	
-	var args []interface{}
-	args = append(args, ticketID)
-
-	if userType == "client" {
-		query += " AND email = $2"
-		args = append(args, userEmail)
-	}
-
-	err := db.QueryRow(query, args...).Scan(
-		&ticket.ID, &ticket.Email, &ticket.Subject, &ticket.Description,
-		&ticket.Status, &attachmentURL, &closedBy, &ticket.CreatedAt,
-	)
-
+	user := currentUser(r)
+	ticket, err := ticketService.Get(user, ticketID)
 	if err != nil {
-		http.Error(w, "Ticket not found", http.StatusNotFound)
+		writeServiceError(w, err, "Database error")
 		return
 	}
 
-	if attachmentURL.Valid {
-		ticket.AttachmentURL = attachmentURL.String
-	}
-	if closedBy.Valid {
-		ticket.ClosedBy = closedBy.String
-	}
+	presentTicket(user, &ticket)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ticket)
@@ -483,33 +909,14 @@ func closeTicket(w http.ResponseWriter, r *http.Request, ticketID int) {
 		return
 	}
 
-	userEmail := r.Header.Get("X-User-Email")
-	userType := r.Header.Get("X-User-Type")
-
-	// Check if ticket exists
-	var ticketEmail string
-	query := "SELECT email FROM tickets WHERE id = $1"
-	err := db.QueryRow(query, ticketID).Scan(&ticketEmail)
-	if err != nil {
-		http.Error(w, "Ticket not found", http.StatusNotFound)
-		return
-	}
-
-	if userType == "client" && ticketEmail != userEmail {
-		http.Error(w, "Permission denied", http.StatusForbidden)
-		return
-	}
-
-	// Close ticket
-	_, err = db.Exec("UPDATE tickets SET status = 'closed', closed_by = $1 WHERE id = $2", userEmail, ticketID)
-	if err != nil {
-		log.Printf("Error closing ticket #%d: %v", ticketID, err)
-		http.Error(w, "Failed to close ticket", http.StatusInternalServerError)
+	if _, err := ticketService.Close(currentUser(r), ticketID); err != nil {
+		if _, ok := err.(*serviceError); !ok {
+			log.Printf("Error closing ticket #%d: %v", ticketID, err)
+		}
+		writeServiceError(w, err, "Failed to close ticket")
 		return
 	}
 
-	log.Printf("✓ Ticket #%d closed by %s", ticketID, userEmail)
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Ticket closed successfully"})
 }
@@ -528,93 +935,112 @@ func handleMessages(w http.ResponseWriter, r *http.Request, ticketID int) {
 
 // Get messages for a ticket
 func getMessages(w http.ResponseWriter, r *http.Request, ticketID int) {
-	userEmail := r.Header.Get("X-User-Email")
-	userType := r.Header.Get("X-User-Type")
-
-	// Check if user has access to this ticket
-	var ticketEmail string
-	err := db.QueryRow("SELECT email FROM tickets WHERE id = $1", ticketID).Scan(&ticketEmail)
+	user := currentUser(r)
+	ticket, err := ticketService.Get(user, ticketID)
 	if err != nil {
-		http.Error(w, "Ticket not found", http.StatusNotFound)
+		writeServiceError(w, err, "Database error")
 		return
 	}
 
-	if userType == "client" && ticketEmail != userEmail {
+	if !authorize(user, actionTicketRead, &ticket) {
 		http.Error(w, "Permission denied", http.StatusForbidden)
 		return
 	}
 
-	rows, err := db.Query(`
-		SELECT id, ticket_id, sender_email, message, created_at 
-		FROM messages 
-		WHERE ticket_id = $1 
-		ORDER BY created_at ASC
-	`, ticketID)
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	messages, total, err := store.Messages().ListPage(ticketID, page)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	messages := []Message{}
-	for rows.Next() {
-		var m Message
-		if err := rows.Scan(&m.ID, &m.TicketID, &m.SenderEmail, &m.Message, &m.CreatedAt); err != nil {
-			continue
-		}
-		messages = append(messages, m)
+	for i := range messages {
+		presentMessage(&messages[i], canSeeInternal(user))
 	}
 
+	setPageHeaders(w, r, page, total)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(messages)
 }
 
 // Create message (reply)
 func createMessage(w http.ResponseWriter, r *http.Request, ticketID int) {
-	userEmail := r.Header.Get("X-User-Email")
-	userType := r.Header.Get("X-User-Type")
-
-	var ticketEmail string
-	err := db.QueryRow("SELECT email FROM tickets WHERE id = $1", ticketID).Scan(&ticketEmail)
-	if err != nil {
-		http.Error(w, "Ticket not found", http.StatusNotFound)
-		return
+	var req struct {
+		Message string `json:"message"`
+		// Defaults to true; false leaves the agent's signature off
+		Signature *bool `json:"signature"`
+		// A response template to send instead of message
+		Template  int               `json:"template"`
+		Variables map[string]string `json:"variables"`
+		// Files uploaded beforehand through /upload
+		AttachmentKeys []string `json:"attachment_keys"`
 	}
 
-	if userType == "client" && ticketEmail != userEmail {
-		http.Error(w, "Permission denied", http.StatusForbidden)
+	// Replies with files are multipart: message, signature and
+	// attachment_key as form values alongside the files
+	var files []*multipart.FileHeader
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(5 << 20); err != nil {
+			http.Error(w, "Invalid form", http.StatusBadRequest)
+			return
+		}
+		req.Message = r.FormValue("message")
+		if v := r.FormValue("signature"); v != "" {
+			withSignature, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "signature must be true or false", http.StatusBadRequest)
+				return
+			}
+			req.Signature = &withSignature
+		}
+		req.AttachmentKeys = r.MultipartForm.Value["attachment_key"]
+		files = r.MultipartForm.File["file"]
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	var msg Message
-	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+	user := currentUser(r)
+	if req.Template != 0 {
+		if req.Message != "" {
+			http.Error(w, "Give either message or template", http.StatusBadRequest)
+			return
+		}
+		body, err := templateReply(user, req.Template, req.Variables)
+		if err != nil {
+			writeServiceError(w, err, "Failed to send message")
+			return
+		}
+		req.Message = body
 	}
 
-	if msg.Message == "" {
-		http.Error(w, "Message cannot be empty", http.StatusBadRequest)
+	attachments, err := uploadMessageFiles(user, ticketID, files, len(req.AttachmentKeys))
+	if err != nil {
+		writeServiceError(w, err, "Failed to upload file")
 		return
 	}
+	uploaded := attachments
+	for _, key := range req.AttachmentKeys {
+		attachments = append(attachments, Attachment{Key: key})
+	}
 
-	err = db.QueryRow(`
-		INSERT INTO messages (ticket_id, sender_email, message) 
-		VALUES ($1, $2, $3) 
-		RETURNING id, created_at
-	`, ticketID, userEmail, msg.Message).Scan(&msg.ID, &msg.CreatedAt)
-
+	withSignature := req.Signature == nil || *req.Signature
+	msg, err := ticketService.Reply(user, ticketID, req.Message, withSignature, attachments)
 	if err != nil {
-		log.Printf("Error creating message: %v", err)
-		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		if _, ok := err.(*serviceError); !ok {
+			log.Printf("Error creating message: %v", err)
+		}
+		discardUploads(uploaded)
+		writeServiceError(w, err, "Failed to send message")
 		return
 	}
 
-	msg.TicketID = ticketID
-	msg.SenderEmail = userEmail
-
-	log.Printf("✓ Message added to ticket #%d by %s", ticketID, userEmail)
-
+	presentMessage(&msg, canSeeInternal(user))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(msg)
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Tests and benchmarks run against the memory store with its demo users
+func TestMain(m *testing.M) {
+	os.Setenv("DB_DRIVER", "memory")
+	connectStore()
+	if err := store.Migrate(); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+	ticketService = TicketService{store}
+	os.Exit(m.Run())
+}
+
+// Session token for a demo user
+func testSession(tb testing.TB, email string) string {
+	tb.Helper()
+	user, _, err := store.Users().PasswordHash(email)
+	if err != nil {
+		tb.Fatalf("user %s: %v", email, err)
+	}
+	token, _, err := createSession(user, httptest.NewRequest("POST", "/login", nil))
+	if err != nil {
+		tb.Fatalf("session for %s: %v", email, err)
+	}
+	return token
+}
+
+// A new client with n tickets, each answered replies times by the demo
+// agent; returns the client and their tickets' IDs
+func seedTickets(tb testing.TB, email string, n, replies int) (User, []int) {
+	tb.Helper()
+	user, created, err := store.Users().Provision(email, "password123", "client")
+	if err != nil || !created {
+		tb.Fatalf("client %s: created %v, %v", email, created, err)
+	}
+	ids := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		ticket := Ticket{Email: email, Subject: fmt.Sprintf("Ticket %d", i+1), Description: "Something broke", Priority: "medium"}
+		if err := store.Tickets().Create(&ticket, user); err != nil {
+			tb.Fatalf("ticket: %v", err)
+		}
+		for j := 0; j < replies; j++ {
+			msg := Message{TicketID: ticket.ID, SenderEmail: "agent@demo.com", Message: fmt.Sprintf("Reply %d", j+1)}
+			if err := store.Messages().Create(&msg); err != nil {
+				tb.Fatalf("reply: %v", err)
+			}
+		}
+		ids = append(ids, ticket.ID)
+	}
+	return user, ids
+}
+
+// Hot paths, for the regression gate in scripts/bench-gate.sh. The data is
+// seeded once per process, as each benchmark function runs several times.
+var benchData struct {
+	sync.Once
+	clientToken string
+	agentToken  string
+	ticketID    int
+}
+
+func benchSetup(b *testing.B) {
+	benchData.Do(func() {
+		seedTickets(b, "bench@example.com", 500, 0)
+		_, thread := seedTickets(b, "bench-thread@example.com", 1, 200)
+		benchData.clientToken = testSession(b, "bench@example.com")
+		benchData.agentToken = testSession(b, "agent@demo.com")
+		benchData.ticketID = thread[0]
+	})
+}
+
+// Serve b.N authenticated GETs of path
+func benchHandler(b *testing.B, path, token string, handler http.HandlerFunc) {
+	h := authenticate(handler)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+// A page of a client's 500 tickets
+func BenchmarkGetTickets(b *testing.B) {
+	benchSetup(b)
+	benchHandler(b, "/tickets?limit=50&offset=200", benchData.clientToken, getTickets)
+}
+
+// A page of a 201-message thread, read by an agent
+func BenchmarkGetMessages(b *testing.B) {
+	benchSetup(b)
+	path := fmt.Sprintf("/tickets/%d/messages?limit=50&offset=100", benchData.ticketID)
+	benchHandler(b, path, benchData.agentToken, func(w http.ResponseWriter, r *http.Request) {
+		getMessages(w, r, benchData.ticketID)
+	})
+}
+
+// Session lookup alone, in front of a handler that does nothing
+func BenchmarkAuthenticate(b *testing.B) {
+	benchSetup(b)
+	benchHandler(b, "/me", benchData.agentToken, func(w http.ResponseWriter, r *http.Request) {})
+}
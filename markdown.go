@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Messages are stored as the text the sender wrote and rendered to HTML
+// for display with a small Markdown subset: paragraphs, line breaks,
+// bullet and numbered lists, fenced code, `code`, **bold**, *italic*,
+// _italic_, # headings and [links](https://...). Everything is escaped
+// before formatting is applied, so no HTML from the message survives.
+
+var (
+	mdBullet   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdNumbered = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdHeading  = regexp.MustCompile(`^(#{1,3})\s+(.*)$`)
+	mdCode     = regexp.MustCompile("`([^`]+)`")
+	mdLink     = regexp.MustCompile(`\[([^\]]+)\]\(((?:https?://|mailto:)[^\s)]+)\)`)
+	mdBold     = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdItalic   = regexp.MustCompile(`\*([^*\s][^*]*)\*`)
+	mdUnder    = regexp.MustCompile(`(^|[\s(])_([^_]+)_($|[\s).,!?:;])`)
+	mdToken    = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// Render message text to safe HTML
+func renderMarkdown(text string) string {
+	var out strings.Builder
+	var para []string
+	list := ""
+
+	flushPara := func() {
+		if len(para) > 0 {
+			out.WriteString("<p>" + strings.Join(para, "<br>") + "</p>")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			out.WriteString("<" + tag + ">")
+			list = tag
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			flushPara()
+			closeList()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>")
+			continue
+		}
+
+		if m := mdBullet.FindStringSubmatch(line); m != nil && line != "-- " {
+			flushPara()
+			openList("ul")
+			out.WriteString("<li>" + renderInline(m[1]) + "</li>")
+			continue
+		}
+		if m := mdNumbered.FindStringSubmatch(line); m != nil {
+			flushPara()
+			openList("ol")
+			out.WriteString("<li>" + renderInline(m[1]) + "</li>")
+			continue
+		}
+		closeList()
+
+		if strings.TrimSpace(line) == "" {
+			flushPara()
+			continue
+		}
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			flushPara()
+			tag := fmt.Sprintf("h%d", len(m[1])+2)
+			out.WriteString("<" + tag + ">" + renderInline(m[2]) + "</" + tag + ">")
+			continue
+		}
+		para = append(para, renderInline(line))
+	}
+	flushPara()
+	closeList()
+
+	return out.String()
+}
+
+// Inline formatting for one escaped line; code spans are set aside first
+// so their contents aren't formatted
+func renderInline(line string) string {
+	s := html.EscapeString(line)
+
+	var code []string
+	s = mdCode.ReplaceAllStringFunc(s, func(m string) string {
+		code = append(code, "<code>"+m[1:len(m)-1]+"</code>")
+		return fmt.Sprintf("\x00%d\x00", len(code)-1)
+	})
+
+	s = mdLink.ReplaceAllString(s, `<a href="$2" target="_blank" rel="noopener noreferrer">$1</a>`)
+	s = mdBold.ReplaceAllString(s, "<strong>$1</strong>")
+	s = mdItalic.ReplaceAllString(s, "<em>$1</em>")
+	s = mdUnder.ReplaceAllString(s, "$1<em>$2</em>$3")
+
+	return mdToken.ReplaceAllStringFunc(s, func(m string) string {
+		var n int
+		fmt.Sscanf(m[1:len(m)-1], "%d", &n)
+		return code[n]
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Server-sent events for one ticket, for networks that block WebSockets.
+// GET /tickets/{id}/messages/stream carries the same updates /ws pushes
+// for that ticket. Each message event has the message ID as its event ID,
+// so a client reconnecting with Last-Event-ID (EventSource does this by
+// itself) first gets the messages it missed. Comment lines keep proxies
+// from timing out an idle stream.
+
+const (
+	sseHeartbeatInterval = 15 * time.Second
+	// Reconnect delay suggested to clients
+	sseRetry = 3 * time.Second
+	// Updates queued for a stream; one that falls further behind is ended,
+	// and catches up on reconnecting
+	sseBuffer = 64
+)
+
+type messageStream struct {
+	user    User
+	updates chan LiveUpdate
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (s *messageStream) liveUser() User {
+	return s.user
+}
+
+func (s *messageStream) deliver(update LiveUpdate, _ []byte) {
+	select {
+	case s.updates <- update:
+	default:
+		httpLog.Warnf("Ending message stream of %s: %d updates behind", s.user.Email, sseBuffer)
+		s.end()
+	}
+}
+
+func (s *messageStream) revoke(int) {
+	s.end()
+}
+
+func (s *messageStream) end() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// GET /tickets/{id}/messages/stream: new messages and status changes of
+// a ticket as server-sent events
+func streamMessages(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := currentUser(r)
+	ticket, err := ticketService.Get(user, ticketID)
+	if err != nil {
+		writeServiceError(w, err, "Database error")
+		return
+	}
+	if !authorize(user, actionTicketRead, &ticket) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	// Clients that reconnect by hand can pass the ID as a parameter
+	lastID := 0
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+	if v != "" {
+		if lastID, err = strconv.Atoi(v); err != nil || lastID < 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Follow the ticket before reading missed messages, so nothing
+	// published in between is lost; duplicates are skipped by ID below
+	s := &messageStream{user: user, updates: make(chan LiveUpdate, sseBuffer), done: make(chan struct{})}
+	liveHub.Lock()
+	followLocked(s, ticketID)
+	liveHub.Unlock()
+	defer func() {
+		liveHub.Lock()
+		unfollowLocked(s, ticketID)
+		liveHub.Unlock()
+	}()
+
+	var missed []Message
+	if lastID > 0 {
+		messages, err := store.Messages().List(ticketID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		for _, m := range messages {
+			if m.ID > lastID {
+				missed = append(missed, m)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	sw := newStreamWriter(w)
+	fmt.Fprintf(sw, "retry: %d\n\n", sseRetry.Milliseconds())
+	writeSSE(sw, "", "ready", map[string]interface{}{"ticket_id": ticketID, "status": ticket.Status})
+	for _, m := range missed {
+		presentMessage(&m, false)
+		writeSSE(sw, strconv.Itoa(m.ID), eventMessageCreated,
+			LiveUpdate{Type: eventMessageCreated, TicketID: ticketID, Actor: m.SenderEmail, Message: &m, At: m.CreatedAt})
+		lastID = m.ID
+	}
+	if sw.Flush() != nil {
+		return
+	}
+	httpLog.Debugf("Message stream of ticket #%d opened by %s", ticketID, user.Email)
+
+	token := sessionToken(r)
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case update := <-s.updates:
+			id := ""
+			if update.Message != nil {
+				if update.Message.ID <= lastID {
+					continue
+				}
+				lastID = update.Message.ID
+				id = strconv.Itoa(lastID)
+			}
+			writeSSE(sw, id, update.Type, update)
+		case <-heartbeat.C:
+			if !credentialStillValid(token) {
+				return
+			}
+			fmt.Fprint(sw, ": heartbeat\n\n")
+		}
+		if sw.Flush() != nil {
+			return
+		}
+	}
+}
+
+// Write one event; an empty id leaves the client's last event ID as it is
+func writeSSE(sw *streamWriter, id, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if id != "" {
+		fmt.Fprintf(sw, "id: %s\n", id)
+	}
+	fmt.Fprintf(sw, "event: %s\ndata: %s\n\n", event, data)
+}
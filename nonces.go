@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// Single-use request nonces, so a captured signed request can't be
+// processed twice. Postgres deployments share them across replicas;
+// SQLite runs a single process and keeps them in memory.
+func createRequestNoncesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS request_nonces (
+			scope VARCHAR(50) NOT NULL,
+			nonce CHAR(64) NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (scope, nonce)
+		);
+		CREATE INDEX IF NOT EXISTS request_nonces_expires_idx ON request_nonces (expires_at)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create request_nonces table:", err)
+	}
+}
+
+var localNonces = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: map[string]time.Time{}}
+
+// Nonces are stored hashed so arbitrary-length IDs fit the column
+func nonceKey(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// Record nonce as used within scope for ttl. Returns false if it was
+// already used and hasn't expired.
+func claimNonce(scope, nonce string, ttl time.Duration) (bool, error) {
+	key := nonceKey(nonce)
+
+	if !fullFeatured() {
+		localNonces.Lock()
+		defer localNonces.Unlock()
+
+		now := time.Now()
+		id := scope + ":" + key
+		if exp, ok := localNonces.expires[id]; ok && exp.After(now) {
+			return false, nil
+		}
+		if len(localNonces.expires) > 10000 {
+			for k, exp := range localNonces.expires {
+				if !exp.After(now) {
+					delete(localNonces.expires, k)
+				}
+			}
+		}
+		localNonces.expires[id] = now.Add(ttl)
+		return true, nil
+	}
+
+	res, err := db.Exec(`
+		INSERT INTO request_nonces (scope, nonce, expires_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP + $3 * INTERVAL '1 second')
+		ON CONFLICT (scope, nonce) DO UPDATE SET expires_at = EXCLUDED.expires_at
+		WHERE request_nonces.expires_at <= CURRENT_TIMESTAMP
+	`, scope, key, ttl.Seconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Forget a claimed nonce, e.g. when processing failed and the sender
+// should be allowed to retry
+func releaseNonce(scope, nonce string) {
+	key := nonceKey(nonce)
+
+	if !fullFeatured() {
+		localNonces.Lock()
+		delete(localNonces.expires, scope+":"+key)
+		localNonces.Unlock()
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM request_nonces WHERE scope = $1 AND nonce = $2", scope, key); err != nil {
+		log.Printf("Error releasing nonce: %v", err)
+	}
+}
+
+// Scheduled job: drop expired nonces
+func purgeExpiredNonces() error {
+	res, err := db.Exec("DELETE FROM request_nonces WHERE expires_at <= CURRENT_TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("✓ Purged %d expired request nonces", n)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// Email requesters when staff act on their tickets, respecting their
+// working hours and do-not-disturb settings, and agents when a ticket
+// is opened
+func subscribeTicketNotifications() {
+	subscribe(eventTicketCreated, func(ev Event) {
+		t := ev.Ticket
+		if t == nil {
+			return
+		}
+		recipients, err := newTicketRecipients(*t)
+		if err != nil {
+			notifyLog.Errorf("Error finding agents to notify of ticket #%d: %v", ev.TicketID, err)
+			return
+		}
+		subject, body := renderMail("new_ticket", mailData{Ticket: *t, Actor: ev.Actor})
+		for _, to := range recipients {
+			if to != ev.Actor {
+				sendNotification(to, subject, body, 0)
+			}
+		}
+	})
+
+	subscribe(eventTicketClosed, func(ev Event) {
+		t := ev.Ticket
+		if t == nil || t.Email == ev.Actor {
+			return
+		}
+		subject, body := renderMail("closed", mailData{Ticket: *t, Actor: ev.Actor})
+		sendNotification(t.Email, subject, appendSignature(body, ev.Actor, *t)+"\n", 0)
+	})
+
+	subscribe(eventMessageCreated, func(ev Event) {
+		t := ev.Ticket
+		if t == nil || ev.Message == nil || t.Email == ev.Actor {
+			return
+		}
+		subject, body := replyNotification(ev.Actor, *t, ev.Message.Message)
+		sendNotification(t.Email, subject, body, ev.Message.ID)
+	})
+}
+
+// Who hears about new tickets: the addresses in NEW_TICKET_NOTIFY (e.g.
+// a team list), nobody if it's "none", or by default every agent whose
+// scope covers the ticket
+func newTicketRecipients(t Ticket) ([]string, error) {
+	switch v := strings.TrimSpace(os.Getenv("NEW_TICKET_NOTIFY")); v {
+	case "":
+	case "none":
+		return nil, nil
+	default:
+		var recipients []string
+		for _, to := range strings.Split(v, ",") {
+			if to = strings.TrimSpace(to); to != "" {
+				recipients = append(recipients, to)
+			}
+		}
+		return recipients, nil
+	}
+
+	roles, err := store.Users().Roles()
+	if err != nil {
+		return nil, err
+	}
+	var agentRoles []string
+	for role, perms := range roles {
+		if perms[permTicketsReplyAll] {
+			agentRoles = append(agentRoles, role)
+		}
+	}
+	sort.Strings(agentRoles)
+
+	agents, err := store.Users().WithRoles(agentRoles)
+	if err != nil {
+		return nil, err
+	}
+	var recipients []string
+	for _, a := range agents {
+		// Scopes are only kept in Postgres
+		if fullFeatured() && !agentScope(a.ID).covers(t) {
+			continue
+		}
+		recipients = append(recipients, a.Email)
+	}
+	return recipients, nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+type Organization struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Domain string `json:"domain"`
+
+	// Where new attachments are stored; empty for the default bucket
+	StorageLocation string `json:"storage_location,omitempty"`
+}
+
+// Agent visibility limits. Empty lists mean no limit on that dimension,
+// so an agent without scopes is a global agent.
+type AgentScope struct {
+	Organizations []int    `json:"organizations"`
+	Categories    []string `json:"categories"`
+
+	// Set when the scope couldn't be loaded; it then covers nothing
+	unknown bool
+}
+
+// Create organization tables and link tickets to organizations
+func createOrganizationTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS organizations (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(200) NOT NULL,
+			domain VARCHAR(255) UNIQUE NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS agent_scopes (
+			user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			org_ids INTEGER[] NOT NULL DEFAULT '{}',
+			categories TEXT[] NOT NULL DEFAULT '{}'
+		);
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS org_id INTEGER REFERENCES organizations(id);
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS category VARCHAR(50);
+		CREATE INDEX IF NOT EXISTS tickets_org_idx ON tickets (org_id)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create organization tables:", err)
+	}
+}
+
+// Organization owning an email address, by domain
+func orgIDForEmail(email string) sql.NullInt64 {
+	var id sql.NullInt64
+	_, domain, ok := strings.Cut(strings.ToLower(email), "@")
+	if !ok {
+		return id
+	}
+	db.QueryRow("SELECT id FROM organizations WHERE domain = $1", domain).Scan(&id)
+	return id
+}
+
+// Load an agent's scope. An agent without a row is a global agent, and
+// so is every agent where scopes aren't kept (anything but Postgres).
+func loadAgentScope(userID int) (AgentScope, error) {
+	scope := AgentScope{Organizations: []int{}, Categories: []string{}}
+	if !fullFeatured() {
+		return scope, nil
+	}
+	var orgIDs pq.Int64Array
+	err := db.QueryRow("SELECT org_ids, categories FROM agent_scopes WHERE user_id = $1", userID).
+		Scan(&orgIDs, pq.Array(&scope.Categories))
+	if err == sql.ErrNoRows {
+		return scope, nil
+	}
+	if err != nil {
+		return scope, err
+	}
+	for _, id := range orgIDs {
+		scope.Organizations = append(scope.Organizations, int(id))
+	}
+	return scope, nil
+}
+
+// Agent's scope for access checks. Failing to load it must not make the
+// agent global, so the scope then covers nothing.
+func agentScope(userID int) AgentScope {
+	scope, err := loadAgentScope(userID)
+	if err != nil {
+		log.Printf("Error loading scope of user %d: %v", userID, err)
+		return AgentScope{Organizations: []int{}, Categories: []string{}, unknown: true}
+	}
+	return scope
+}
+
+// Whether a ticket falls within the scope's organizations and categories
+func (s AgentScope) covers(t Ticket) bool {
+	if s.unknown {
+		return false
+	}
+	if len(s.Organizations) > 0 {
+		found := false
+		for _, id := range s.Organizations {
+			found = found || id == t.OrgID
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(s.Categories) > 0 {
+		found := false
+		for _, c := range s.Categories {
+			found = found || c == t.Category
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// SQL predicate restricting tickets to those the user may see.
+// Appends its placeholders to args and returns the " AND ..." fragment.
+func ticketAccessPredicate(user User, args []interface{}) (string, []interface{}) {
+	if !authorize(user, permTicketsReadAll, nil) {
+		// Tickets belong to the requester's account; the email only
+		// decides for tickets filed before they had one
+		args = append(args, user.ID, user.Email)
+		predicate := fmt.Sprintf(" AND (requester_id = $%d OR (requester_id IS NULL AND email = $%d)", len(args)-1, len(args))
+		if orgID := orgIDForEmail(user.Email); orgID.Valid && authorize(user, permTicketsReadOrg, nil) {
+			args = append(args, orgID.Int64)
+			predicate += fmt.Sprintf(" OR org_id = $%d", len(args))
+		}
+		return predicate + ")", args
+	}
+
+	predicate := ""
+	scope := agentScope(user.ID)
+	if scope.unknown {
+		return " AND FALSE", args
+	}
+	if len(scope.Organizations) > 0 {
+		args = append(args, pq.Array(scope.Organizations))
+		predicate += fmt.Sprintf(" AND org_id = ANY($%d)", len(args))
+	}
+	if len(scope.Categories) > 0 {
+		args = append(args, pq.Array(scope.Categories))
+		predicate += fmt.Sprintf(" AND category = ANY($%d)", len(args))
+	}
+	return predicate, args
+}
+
+// Admin: list or create organizations
+func handleOrganizations(w http.ResponseWriter, r *http.Request) {
+	if !authorize(currentUser(r), permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		rows, err := db.Query("SELECT id, name, domain, COALESCE(storage_location, '') FROM organizations ORDER BY name")
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		orgs := []Organization{}
+		for rows.Next() {
+			var o Organization
+			if err := rows.Scan(&o.ID, &o.Name, &o.Domain, &o.StorageLocation); err != nil {
+				continue
+			}
+			orgs = append(orgs, o)
+		}
+		sortCollated(orgs, func(i int) string { return orgs[i].Name })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(orgs)
+
+	case "POST":
+		var org Organization
+		if err := json.NewDecoder(r.Body).Decode(&org); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		org.Name = normalizeText(strings.TrimSpace(org.Name))
+		org.Domain = strings.ToLower(strings.TrimSpace(org.Domain))
+		if org.Name == "" || org.Domain == "" {
+			http.Error(w, "Missing required fields", http.StatusBadRequest)
+			return
+		}
+		org.StorageLocation = strings.ToLower(strings.TrimSpace(org.StorageLocation))
+		if org.StorageLocation != defaultStorageLocation && storageLocations[org.StorageLocation] == nil {
+			http.Error(w, fmt.Sprintf("Unknown storage location %q", org.StorageLocation), http.StatusBadRequest)
+			return
+		}
+
+		err := db.QueryRow(`
+			INSERT INTO organizations (name, domain, storage_location) VALUES ($1, $2, NULLIF($3, '')) RETURNING id
+		`, org.Name, org.Domain, org.StorageLocation).Scan(&org.ID)
+		if err != nil {
+			http.Error(w, "Failed to create organization", http.StatusConflict)
+			return
+		}
+
+		// Link existing tickets from this domain
+		db.Exec(`
+			UPDATE tickets SET org_id = $1 
+			WHERE org_id IS NULL AND lower(split_part(email, '@', 2)) = $2
+		`, org.ID, org.Domain)
+
+		log.Printf("✓ Organization %s (%s) created", org.Name, org.Domain)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(org)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Admin: /admin/users/{id}/scope and /admin/users/{id}/role
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if !authorize(currentUser(r), permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 4 {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	switch parts[3] {
+	case "scope":
+		handleUserScope(w, r, userID)
+	case "role":
+		handleUserRole(w, r, userID)
+	default:
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+	}
+}
+
+// PUT /admin/users/{id}/role: change a user's role, e.g. to org_admin
+func handleUserRole(w http.ResponseWriter, r *http.Request, userID int) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if rolePermissions(req.Role) == nil {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRow("SELECT user_type FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE users SET user_type = $1 WHERE id = $2", req.Role, userID); err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+	if ok, err := usersManageable(tx); err != nil || !ok {
+		http.Error(w, "No active user would be left with "+permUsersManage, http.StatusConflict)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	actor := currentUser(r).Email
+	log.Printf("✓ Role for user %d set to %s by %s", userID, req.Role, actor)
+	recordAudit(actor, "user.role_changed", 0, map[string]interface{}{"user_id": userID, "from": previous, "to": req.Role})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Role updated", "role": req.Role})
+}
+
+// GET/PUT /admin/users/{id}/scope: view or replace an agent's scope
+func handleUserScope(w http.ResponseWriter, r *http.Request, userID int) {
+	switch r.Method {
+	case "GET":
+		scope, err := loadAgentScope(userID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scope)
+
+	case "PUT":
+		var scope AgentScope
+		if err := json.NewDecoder(r.Body).Decode(&scope); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if scope.Organizations == nil {
+			scope.Organizations = []int{}
+		}
+		if scope.Categories == nil {
+			scope.Categories = []string{}
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO agent_scopes (user_id, org_ids, categories) 
+			VALUES ($1, $2, $3) 
+			ON CONFLICT (user_id) DO UPDATE SET org_ids = EXCLUDED.org_ids, categories = EXCLUDED.categories
+		`, userID, pq.Array(scope.Organizations), pq.Array(scope.Categories))
+		if err != nil {
+			http.Error(w, "Failed to update scope", http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("✓ Scope for user %d updated by %s", userID, currentUser(r).Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scope)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
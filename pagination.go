@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Ticket and message lists are paged with limit and offset. Responses
+// carry the number of matching items in X-Total-Count and links to the
+// neighbouring pages in Link (RFC 8288).
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Items per page when the request doesn't say (PAGE_SIZE)
+func pageSize() int {
+	if n, err := strconv.Atoi(os.Getenv("PAGE_SIZE")); err == nil && n > 0 {
+		return min(n, maxPageSize)
+	}
+	return defaultPageSize
+}
+
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// Page asked for with the limit and offset query parameters
+func parsePage(r *http.Request) (Page, error) {
+	page := Page{Limit: pageSize()}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return page, fmt.Errorf("limit must be 1-%d", maxPageSize)
+		}
+		page.Limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return page, fmt.Errorf("offset must be 0 or more")
+		}
+		page.Offset = n
+	}
+	return page, nil
+}
+
+// The page's share of items already loaded in full
+func pageSlice[T any](items []T, page Page) []T {
+	if page.Offset >= len(items) {
+		return items[:0]
+	}
+	return items[page.Offset:min(page.Offset+page.Limit, len(items))]
+}
+
+// Set X-Total-Count and Link headers for a page out of total items
+func setPageHeaders(w http.ResponseWriter, r *http.Request, page Page, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	link := func(offset int, rel string) string {
+		q := r.URL.Query()
+		q.Set("limit", strconv.Itoa(page.Limit))
+		q.Set("offset", strconv.Itoa(offset))
+		u := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+	}
+
+	last := 0
+	if total > 0 {
+		last = (total - 1) / page.Limit * page.Limit
+	}
+	links := []string{link(0, "first")}
+	if page.Offset > 0 {
+		links = append(links, link(max(0, min(page.Offset-page.Limit, last)), "prev"))
+	}
+	if page.Offset+page.Limit < total {
+		links = append(links, link(page.Offset+page.Limit, "next"))
+	}
+	links = append(links, link(last, "last"))
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    Page
+		wantErr bool
+	}{
+		{"", Page{Limit: defaultPageSize}, false},
+		{"limit=1", Page{Limit: 1}, false},
+		{"limit=500", Page{Limit: maxPageSize}, false},
+		{"limit=501", Page{}, true},
+		{"limit=0", Page{}, true},
+		{"limit=-1", Page{}, true},
+		{"limit=ten", Page{}, true},
+		{"offset=0", Page{Limit: defaultPageSize}, false},
+		{"offset=1000000", Page{Limit: defaultPageSize, Offset: 1000000}, false},
+		{"offset=-1", Page{}, true},
+		{"limit=20&offset=40", Page{Limit: 20, Offset: 40}, false},
+	}
+	for _, tt := range tests {
+		page, err := parsePage(httptest.NewRequest("GET", "/tickets?"+tt.query, nil))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", tt.query, page)
+			}
+			continue
+		}
+		if err != nil || page != tt.want {
+			t.Errorf("%q: got %+v, %v, want %+v", tt.query, page, err, tt.want)
+		}
+	}
+}
+
+func TestPageSlice(t *testing.T) {
+	items := []int{0, 1, 2, 3, 4, 5, 6}
+	tests := []struct {
+		page Page
+		want []int
+	}{
+		{Page{Limit: 3}, []int{0, 1, 2}},
+		{Page{Limit: 3, Offset: 3}, []int{3, 4, 5}},
+		{Page{Limit: 3, Offset: 6}, []int{6}},
+		{Page{Limit: 3, Offset: 7}, []int{}},
+		{Page{Limit: 3, Offset: 100}, []int{}},
+		{Page{Limit: maxPageSize}, items},
+	}
+	for _, tt := range tests {
+		if got := pageSlice(items, tt.page); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.page, got, tt.want)
+		}
+	}
+}
+
+func TestSetPageHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		page  Page
+		total int
+		links []string
+	}{
+		{"first page", Page{Limit: 10}, 25, []string{
+			`</tickets?limit=10&offset=0&status=open>; rel="first"`,
+			`</tickets?limit=10&offset=10&status=open>; rel="next"`,
+			`</tickets?limit=10&offset=20&status=open>; rel="last"`,
+		}},
+		{"middle page", Page{Limit: 10, Offset: 10}, 25, []string{
+			`</tickets?limit=10&offset=0&status=open>; rel="first"`,
+			`</tickets?limit=10&offset=0&status=open>; rel="prev"`,
+			`</tickets?limit=10&offset=20&status=open>; rel="next"`,
+			`</tickets?limit=10&offset=20&status=open>; rel="last"`,
+		}},
+		{"last page", Page{Limit: 10, Offset: 20}, 25, []string{
+			`</tickets?limit=10&offset=0&status=open>; rel="first"`,
+			`</tickets?limit=10&offset=10&status=open>; rel="prev"`,
+			`</tickets?limit=10&offset=20&status=open>; rel="last"`,
+		}},
+		{"past the end", Page{Limit: 10, Offset: 100}, 25, []string{
+			`</tickets?limit=10&offset=0&status=open>; rel="first"`,
+			`</tickets?limit=10&offset=20&status=open>; rel="prev"`,
+			`</tickets?limit=10&offset=20&status=open>; rel="last"`,
+		}},
+		{"exactly full pages", Page{Limit: 10, Offset: 10}, 20, []string{
+			`</tickets?limit=10&offset=0&status=open>; rel="first"`,
+			`</tickets?limit=10&offset=0&status=open>; rel="prev"`,
+			`</tickets?limit=10&offset=10&status=open>; rel="last"`,
+		}},
+		{"nothing matches", Page{Limit: 10}, 0, []string{
+			`</tickets?limit=10&offset=0&status=open>; rel="first"`,
+			`</tickets?limit=10&offset=0&status=open>; rel="last"`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/tickets?status=open&offset=3", nil)
+			w := httptest.NewRecorder()
+			setPageHeaders(w, r, tt.page, tt.total)
+
+			if got, want := w.Header().Get("X-Total-Count"), strconv.Itoa(tt.total); got != want {
+				t.Errorf("X-Total-Count: got %s, want %s", got, want)
+			}
+			if got := strings.Split(w.Header().Get("Link"), ", "); !reflect.DeepEqual(got, tt.links) {
+				t.Errorf("Link:\ngot  %q\nwant %q", got, tt.links)
+			}
+		})
+	}
+}
+
+// Lists through the handlers report the total and return just the page
+func TestListPages(t *testing.T) {
+	_, ids := seedTickets(t, "pages@example.com", 25, 11)
+	token := testSession(t, "pages@example.com")
+
+	tests := []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+		total   int
+		items   int
+	}{
+		{"tickets, first page", "/tickets?limit=10", getTickets, 25, 10},
+		{"tickets, last page", "/tickets?limit=10&offset=20", getTickets, 25, 5},
+		{"tickets, past the end", "/tickets?limit=10&offset=30", getTickets, 25, 0},
+		{"tickets, default size", "/tickets", getTickets, 25, 25},
+		// The description and 11 replies
+		{"messages, middle page", "/tickets/1/messages?limit=5&offset=5", func(w http.ResponseWriter, r *http.Request) {
+			getMessages(w, r, ids[0])
+		}, 12, 5},
+		{"messages, last page", "/tickets/1/messages?limit=5&offset=10", func(w http.ResponseWriter, r *http.Request) {
+			getMessages(w, r, ids[0])
+		}, 12, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			authenticate(tt.handler)(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d: %s", w.Code, w.Body)
+			}
+			if got, want := w.Header().Get("X-Total-Count"), fmt.Sprint(tt.total); got != want {
+				t.Errorf("X-Total-Count: got %s, want %s", got, want)
+			}
+			var items []json.RawMessage
+			if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != tt.items {
+				t.Errorf("got %d items, want %d", len(items), tt.items)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Months of message partitions created ahead of the current month
+const messagePartitionsAhead = 3
+
+// Whether messages has been converted to a partitioned table
+func messagesPartitioned() bool {
+	var partitioned bool
+	db.QueryRow("SELECT relkind = 'p' FROM pg_class WHERE oid = 'messages'::regclass").Scan(&partitioned)
+	return partitioned
+}
+
+// Create monthly messages partitions from the month containing from
+// through messagePartitionsAhead months past the current one
+func ensureMessagePartitions(ctx context.Context, q interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}, from time.Time) error {
+	month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+	now := time.Now().UTC()
+	last := time.Date(now.Year(), now.Month()+messagePartitionsAhead, 1, 0, 0, 0, 0, time.UTC)
+
+	for ; !month.After(last); month = month.AddDate(0, 1, 0) {
+		next := month.AddDate(0, 1, 0)
+		_, err := q.ExecContext(ctx, fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS messages_y%04dm%02d PARTITION OF messages FOR VALUES FROM ('%s') TO ('%s')",
+			month.Year(), month.Month(), month.Format("2006-01-02"), next.Format("2006-01-02")))
+		if err != nil {
+			return fmt.Errorf("partition for %s: %w", month.Format("2006-01"), err)
+		}
+	}
+	return nil
+}
+
+// Convert messages into a table partitioned by month of created_at.
+// Runs once; the old table is copied and dropped in one transaction,
+// so messages are unavailable while it runs on a large install.
+func migratePartitionedMessages() {
+	if messagesPartitioned() {
+		// Don't leave new messages to the default partition until the
+		// maintenance job first runs
+		_, err := runExclusive("message-partitions", func(conn *sql.Conn) error {
+			return maintainMessagePartitions()
+		})
+		if err != nil {
+			log.Printf("Error creating message partitions: %v", err)
+		}
+		return
+	}
+
+	_, err := runExclusive("migrate-partitioned-messages", func(conn *sql.Conn) error {
+		ctx := context.Background()
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// Another replica may have finished while we waited
+		var partitioned bool
+		tx.QueryRowContext(ctx, "SELECT relkind = 'p' FROM pg_class WHERE oid = 'messages'::regclass").Scan(&partitioned)
+		if partitioned {
+			return nil
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			LOCK TABLE messages IN ACCESS EXCLUSIVE MODE;
+			UPDATE messages m SET created_at = COALESCE((SELECT t.created_at FROM tickets t WHERE t.id = m.ticket_id), CURRENT_TIMESTAMP) 
+				WHERE created_at IS NULL;
+			ALTER TABLE messages RENAME TO messages_unpartitioned;
+			CREATE TABLE messages (LIKE messages_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (created_at);
+			ALTER TABLE messages ALTER COLUMN created_at SET NOT NULL;
+			CREATE TABLE messages_default PARTITION OF messages DEFAULT
+		`)
+		if err != nil {
+			return err
+		}
+
+		var first sql.NullTime
+		tx.QueryRowContext(ctx, "SELECT MIN(created_at) FROM messages_unpartitioned").Scan(&first)
+		if !first.Valid {
+			first.Time = time.Now()
+		}
+		if err := ensureMessagePartitions(ctx, tx, first.Time); err != nil {
+			return err
+		}
+
+		// Foreign keys to messages(id) can't survive: a partitioned table's
+		// unique keys must include created_at
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO messages SELECT * FROM messages_unpartitioned;
+			ALTER SEQUENCE messages_id_seq OWNED BY messages.id;
+			ALTER TABLE email_deliveries DROP CONSTRAINT IF EXISTS email_deliveries_message_id_fkey;
+			ALTER TABLE held_emails DROP CONSTRAINT IF EXISTS held_emails_message_id_fkey;
+			ALTER TABLE attachments DROP CONSTRAINT IF EXISTS attachments_message_id_fkey;
+			DROP TABLE messages_unpartitioned;
+			ALTER TABLE messages ADD PRIMARY KEY (id, created_at);
+			ALTER TABLE messages ADD FOREIGN KEY (ticket_id) REFERENCES tickets(id) ON DELETE CASCADE;
+			CREATE INDEX messages_ticket_idx ON messages (ticket_id, created_at);
+			CREATE INDEX messages_description_idx ON messages (ticket_id) WHERE is_description
+		`)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Println("✓ Messages table partitioned by month")
+		return nil
+	})
+	if err != nil {
+		log.Fatal("Failed to partition messages table:", err)
+	}
+}
+
+// Job: keep partitions ready for the coming months so new messages
+// never land in the default partition, and give any that did (e.g. while
+// the job wasn't running) a partition of their own
+func maintainMessagePartitions() error {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	months := map[time.Time]bool{}
+	for i := 0; i <= messagePartitionsAhead; i++ {
+		months[time.Date(now.Year(), now.Month()+time.Month(i), 1, 0, 0, 0, 0, time.UTC)] = true
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT date_trunc('month', created_at) FROM messages_default")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var month time.Time
+		if err := rows.Scan(&month); err != nil {
+			return err
+		}
+		months[time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for month := range months {
+		if err := createMessagePartition(ctx, month); err != nil {
+			return fmt.Errorf("partition for %s: %w", month.Format("2006-01"), err)
+		}
+	}
+	return nil
+}
+
+// Create the partition for a month unless it exists. Messages of that
+// month in the default partition would make creating it fail, so they're
+// moved into the new table before it's attached.
+func createMessagePartition(ctx context.Context, month time.Time) error {
+	name := fmt.Sprintf("messages_y%04dm%02d", month.Year(), month.Month())
+	next := month.AddDate(0, 1, 0)
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Hold off new messages for the month until the partition takes them
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		LOCK TABLE messages_default IN ACCESS EXCLUSIVE MODE;
+		CREATE TABLE %s (LIKE messages INCLUDING DEFAULTS)
+	`, name))
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		WITH moved AS (
+			DELETE FROM messages_default WHERE created_at >= $1 AND created_at < $2 RETURNING *
+		)
+		INSERT INTO %s SELECT * FROM moved
+	`, name), month, next)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE messages ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')",
+		name, month.Format("2006-01-02"), next.Format("2006-01-02")))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if moved, _ := res.RowsAffected(); moved > 0 {
+		log.Printf("✓ Moved %d messages from the default partition to %s", moved, name)
+	}
+	return nil
+}
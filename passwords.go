@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Local passwords are stored as bcrypt hashes. Rows from before hashing
+// hold the password itself; they still work and are rehashed the first
+// time their owner logs in.
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores anything after 72 bytes
+	maxPasswordLength = 72
+)
+
+// Passwords too common to allow whatever their length
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "12345678": true, "123456789": true,
+	"1234567890": true, "qwertyuiop": true, "iloveyou": true, "letmein1": true, "welcome1": true,
+	"sunshine1": true, "football1": true, "baseball1": true, "abc12345": true, "trustno1": true,
+}
+
+// Reject passwords that are short, common, based on the email address or
+// made of a single kind of character
+func checkPasswordStrength(password, email string) error {
+	switch {
+	case len(password) < minPasswordLength:
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	case len(password) > maxPasswordLength:
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+	case commonPasswords[strings.ToLower(password)]:
+		return fmt.Errorf("password is too common")
+	}
+	if local, _, _ := strings.Cut(strings.ToLower(email), "@"); len(local) >= 4 && strings.Contains(strings.ToLower(password), local) {
+		return fmt.Errorf("password must not contain your email address")
+	}
+
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	kinds := 0
+	for _, has := range []bool{lower, upper, digit, other} {
+		if has {
+			kinds++
+		}
+	}
+	if kinds < 2 {
+		return fmt.Errorf("password must mix letters with digits, capitals or symbols")
+	}
+	return nil
+}
+
+// Compared against when there's no such user, so an unknown email takes
+// as long to reject as a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Hash of a random password no one knows, for users who sign in some
+// other way (SSO, LDAP) and mustn't be able to use a local password
+func randomPasswordHash() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hashPassword(base64.RawURLEncoding.EncodeToString(buf))
+}
+
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// Whether password matches the stored value. Plaintext rows are compared
+// by digest so the comparison doesn't depend on where they differ.
+func checkPassword(stored, password string) bool {
+	if isPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	a := sha256.Sum256([]byte(stored))
+	b := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// Active user with this email and password. Whatever the reason, a
+// failure is errInvalidCredentials and takes about as long.
+func userByPassword(email, password string) (User, error) {
+	user, stored, err := store.Users().PasswordHash(strings.TrimSpace(email))
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return User{}, errInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if !checkPassword(stored, password) {
+		return User{}, errInvalidCredentials
+	}
+
+	if !isPasswordHash(stored) {
+		if hash, err := hashPassword(password); err == nil {
+			if err := store.Users().ReplacePassword(user.ID, stored, hash); err != nil {
+				log.Printf("Error rehashing password for %s: %v", user.Email, err)
+			}
+		}
+	}
+	return user, nil
+}
+
+// Hash any passwords still stored as plaintext. Runs at startup in the
+// background; until it reaches a row, logins still check it as before.
+func rehashPlaintextPasswords() {
+	plaintext, err := store.Users().PlaintextPasswords()
+	if err != nil {
+		log.Printf("Error finding plaintext passwords: %v", err)
+		return
+	}
+	if len(plaintext) == 0 {
+		return
+	}
+
+	log.Printf("Hashing %d plaintext passwords", len(plaintext))
+	hashed := 0
+	for userID, password := range plaintext {
+		hash, err := hashPassword(password)
+		if err != nil {
+			// Longer than bcrypt allows; leave it for a password change
+			log.Printf("Error hashing password for user %d: %v", userID, err)
+			continue
+		}
+		if err := store.Users().ReplacePassword(userID, password, hash); err != nil {
+			log.Printf("Error storing password hash for user %d: %v", userID, err)
+			continue
+		}
+		hashed++
+	}
+	log.Printf("✓ Hashed %d plaintext passwords", hashed)
+}
+
+// POST /me/password: change the caller's password. The current password
+// is required, and every other session is signed out, so whoever else
+// had the old password loses access.
+func handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if proxyAuthEnabled() || ldapAuthEnabled() {
+		http.Error(w, "Passwords are managed by your organization's sign-in", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	user := currentUser(r)
+	if err := checkPasswordStrength(req.NewPassword, user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		http.Error(w, "New password must be different", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := userByPassword(user.Email, req.CurrentPassword); err != nil {
+		if err == errInvalidCredentials {
+			recordSecurityEvent(user.ID, securityEventLoginFailed, r, "password change")
+			http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	if err := store.Users().SetPasswordHash(user.ID, hash); err != nil {
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	n, err := store.Users().RevokeOtherSessions(user.ID, currentSessionID(r))
+	if err != nil {
+		log.Printf("Error revoking sessions for %s after password change: %v", user.Email, err)
+	}
+
+	log.Printf("✓ Password changed by %s (%d other sessions revoked)", user.Email, n)
+	recordSecurityEvent(user.ID, securityEventPasswordChanged, r, "")
+	notifySecurityEvent(user.Email, securityEventPasswordChanged, r)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Password changed", "revoked": n})
+}
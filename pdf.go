@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// GET /tickets/{id}/export.pdf: printable copy of a ticket and its thread
+func exportTicketPDF(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	ticket, err := ticketService.Get(user, ticketID)
+	if err != nil {
+		writeServiceError(w, err, "Database error")
+		return
+	}
+	if !authorize(user, actionTicketRead, &ticket) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	presentTicket(user, &ticket)
+
+	messages, err := store.Messages().List(ticketID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	pdf := renderTicketPDF(ticket, messages)
+	if err := pdf.Error(); err != nil {
+		log.Printf("Error rendering PDF for ticket #%d: %v", ticketID, err)
+		http.Error(w, "Failed to render PDF", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, ticket.Reference))
+	if err := pdf.Output(w); err != nil {
+		log.Printf("Error writing PDF for ticket #%d: %v", ticketID, err)
+	}
+}
+
+// Lay out ticket metadata followed by the message thread
+func renderTicketPDF(ticket Ticket, messages []Message) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle(ticket.Reference+" "+ticket.Subject, true)
+	pdf.SetMargins(20, 20, 20)
+	pdf.SetAutoPageBreak(true, 20)
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-15)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.SetTextColor(120, 120, 120)
+		pdf.CellFormat(0, 10, fmt.Sprintf("%s - page %d", ticket.Reference, pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	// Core fonts are cp1252
+	tr := pdfText
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.MultiCell(0, 8, tr(ticket.Reference+": "+ticket.Subject), "", "L", false)
+	pdf.Ln(4)
+
+	fields := [][2]string{
+		{"Status", ticket.Status},
+		{"Requester", ticket.Email},
+		{"Channel", ticket.Channel},
+		{"Created", ticket.CreatedAt.UTC().Format("2006-01-02 15:04 MST")},
+	}
+	if ticket.Category != "" {
+		fields = append(fields, [2]string{"Category", ticket.Category})
+	}
+	if ticket.AssignedTo != "" {
+		fields = append(fields, [2]string{"Assigned to", ticket.AssignedTo})
+	}
+	if ticket.ClosedBy != "" {
+		fields = append(fields, [2]string{"Closed by", ticket.ClosedBy})
+	}
+	if len(ticket.Tags) > 0 {
+		fields = append(fields, [2]string{"Tags", strings.Join(ticket.Tags, ", ")})
+	}
+	keys := make([]string, 0, len(ticket.CustomFields))
+	for k := range ticket.CustomFields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fields = append(fields, [2]string{k, ticket.CustomFields[k]})
+	}
+
+	for _, f := range fields {
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.CellFormat(35, 6, tr(f[0]), "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.MultiCell(0, 6, tr(f[1]), "", "L", false)
+	}
+
+	pdf.Ln(4)
+	pdf.SetFont("Helvetica", "B", 12)
+	pdf.CellFormat(0, 8, "Conversation", "B", 1, "L", false, 0, "")
+	pdf.Ln(2)
+
+	for _, m := range messages {
+		heading := m.SenderEmail + " - " + m.CreatedAt.UTC().Format(time.RFC1123)
+		if m.IsDescription {
+			heading += " (original request)"
+		}
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.SetFillColor(240, 240, 240)
+		pdf.MultiCell(0, 6, tr(heading), "", "L", true)
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.MultiCell(0, 5, tr(m.Message), "", "L", false)
+		pdf.Ln(4)
+	}
+
+	pdf.SetFont("Helvetica", "I", 8)
+	pdf.SetTextColor(120, 120, 120)
+	pdf.MultiCell(0, 5, "Exported "+time.Now().UTC().Format(time.RFC1123), "", "L", false)
+
+	return pdf
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"sts/auth"
+
+	"github.com/lib/pq"
+)
+
+// Permissions. Ticket actions come in _all/_org/_own variants: _all grants
+// the action on any ticket, _org on tickets from the user's organization,
+// _own only on tickets the user requested.
+const (
+	permTicketsCreate   = "tickets.create"
+	permTicketsReadAll  = "tickets.read_all"
+	permTicketsReadOrg  = "tickets.read_org"
+	permTicketsReadOwn  = "tickets.read_own"
+	permTicketsReplyAll = "tickets.reply_all"
+	permTicketsReplyOrg = "tickets.reply_org"
+	permTicketsReplyOwn = "tickets.reply_own"
+	permTicketsCloseAll = "tickets.close_all"
+	permTicketsCloseOwn = "tickets.close_own"
+	permTicketsAssign   = "tickets.assign"
+	permUsersManage     = "users.manage"
+	permReportsView     = "reports.view"
+)
+
+// Ticket actions checked against a ticket resource
+const (
+	actionTicketRead  = "tickets.read"
+	actionTicketReply = "tickets.reply"
+	actionTicketClose = "tickets.close"
+)
+
+// Built-in roles, seeded once; deployments can edit them or add their
+// own rows (e.g. a read-only supervisor) without code changes
+var defaultRoles = map[string][]string{
+	"client": {permTicketsCreate, permTicketsReadOwn, permTicketsReplyOwn, permTicketsCloseOwn},
+	"agent":  {permTicketsReadAll, permTicketsReplyAll, permTicketsCloseAll, permTicketsAssign},
+	"admin": {permTicketsReadAll, permTicketsReplyAll, permTicketsCloseAll, permTicketsAssign,
+		permUsersManage, permReportsView},
+	"supervisor": {permTicketsReadAll, permReportsView},
+	// Customer-side admin who sees every ticket filed from their company
+	"org_admin": {permTicketsCreate, permTicketsReadOrg, permTicketsReplyOrg, permTicketsCloseOwn},
+}
+
+// Permission sets of the built-in roles, for stores without a roles table
+func builtinRoles() map[string]map[string]bool {
+	roles := make(map[string]map[string]bool, len(defaultRoles))
+	for name, perms := range defaultRoles {
+		set := make(map[string]bool, len(perms))
+		for _, p := range perms {
+			set[p] = true
+		}
+		roles[name] = set
+	}
+	return roles
+}
+
+// Create roles table and seed built-in roles
+func createRolesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS roles (
+			name VARCHAR(50) PRIMARY KEY,
+			permissions TEXT[] NOT NULL DEFAULT '{}'
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create roles table:", err)
+	}
+
+	for name, perms := range defaultRoles {
+		db.Exec(`
+			INSERT INTO roles (name, permissions) 
+			VALUES ($1, $2) 
+			ON CONFLICT (name) DO NOTHING
+		`, name, pq.Array(perms))
+	}
+}
+
+// Role permissions cached briefly so every request doesn't hit the roles table
+var roleCache = struct {
+	sync.Mutex
+	perms    map[string]map[string]bool
+	loadedAt time.Time
+}{}
+
+const roleCacheTTL = time.Minute
+
+// Permission set for a role
+func rolePermissions(role string) map[string]bool {
+	roleCache.Lock()
+	defer roleCache.Unlock()
+
+	if roleCache.perms == nil || time.Since(roleCache.loadedAt) > roleCacheTTL {
+		perms, err := store.Users().Roles()
+		if err != nil {
+			log.Printf("Error loading roles: %v", err)
+			if roleCache.perms == nil {
+				return nil
+			}
+		} else {
+			roleCache.perms = perms
+			roleCache.loadedAt = time.Now()
+		}
+	}
+
+	return roleCache.perms[role]
+}
+
+// Sorted permission list for a role, for API responses
+func permissionList(role string) []string {
+	perms := []string{}
+	for p := range rolePermissions(role) {
+		perms = append(perms, p)
+	}
+	sort.Strings(perms)
+	return perms
+}
+
+// Central authorization check. perm is either a plain permission
+// (e.g. users.manage) or a ticket action (e.g. tickets.read) checked
+// against the ticket given as resource.
+func authorize(user User, perm string, resource interface{}) bool {
+	perms := rolePermissions(user.UserType)
+	if perms[perm] {
+		return true
+	}
+
+	if ticket, ok := resource.(*Ticket); ok && ticket != nil {
+		if perms[perm+"_all"] {
+			return true
+		}
+		if perms[perm+"_own"] && ownsTicket(user, *ticket) {
+			return true
+		}
+		if perms[perm+"_org"] && ticket.OrgID != 0 && int64(ticket.OrgID) == orgIDForEmail(user.Email).Int64 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// User attached to the request by authenticate
+func currentUser(r *http.Request) User {
+	id, _ := auth.FromContext(r.Context())
+	return User{
+		ID:       id.UserID,
+		Email:    id.Email,
+		UserType: id.UserType,
+	}
+}
+
+// Session the request was authenticated with
+func currentSessionID(r *http.Request) string {
+	id, _ := auth.FromContext(r.Context())
+	return id.SessionID
+}
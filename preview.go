@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Reply text as it will be stored: staff get placeholders filled in and
+// their signature appended
+func composeReply(user User, t Ticket, body string, withSignature bool) string {
+	if !canSeeInternal(user) {
+		return body
+	}
+	body = expandPlaceholders(body, user.Email, t)
+	if withSignature {
+		body = appendSignature(body, user.Email, t)
+	}
+	return body
+}
+
+// Email sent to the requester about a new reply
+func replyNotification(actor string, t Ticket, message string) (subject, body string) {
+	return renderMail("reply", mailData{Ticket: t, Actor: actor, Message: message})
+}
+
+// Stand-in ticket for previews composed outside a ticket
+var sampleTicket = Ticket{Reference: "STS-2024-00123", Subject: "Example ticket", Email: "customer@example.com"}
+
+type Preview struct {
+	Message string        `json:"message"`
+	HTML    string        `json:"html"`
+	Email   *PreviewEmail `json:"email,omitempty"`
+}
+
+type PreviewEmail struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// POST /preview: render a draft reply exactly as it would be stored,
+// displayed and emailed, without saving it
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		TicketID  int               `json:"ticket_id"`
+		Message   string            `json:"message"`
+		Signature *bool             `json:"signature"`
+		Template  int               `json:"template"`
+		Variables map[string]string `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	user := currentUser(r)
+	if req.Template != 0 {
+		body, err := templateReply(user, req.Template, req.Variables)
+		if err != nil {
+			writeServiceError(w, err, "Failed to render template")
+			return
+		}
+		req.Message = body
+	}
+	ticket := sampleTicket
+	if req.TicketID != 0 {
+		t, err := ticketService.Get(user, req.TicketID)
+		if err != nil {
+			writeServiceError(w, err, "Database error")
+			return
+		}
+		if !authorize(user, actionTicketReply, &t) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		ticket = t
+	}
+
+	withSignature := req.Signature == nil || *req.Signature
+	var p Preview
+	p.Message = composeReply(user, ticket, req.Message, withSignature)
+	p.HTML = renderMarkdown(p.Message)
+
+	// Mirrors subscribeTicketNotifications: requesters aren't emailed
+	// about their own replies
+	if ticket.Email != user.Email {
+		p.Email = &PreviewEmail{To: ticket.Email}
+		p.Email.Subject, p.Email.Body = replyNotification(user.Email, ticket, p.Message)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
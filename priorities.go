@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Ticket priorities, most urgent last
+var ticketPriorities = []string{"low", "normal", "high", "urgent"}
+
+const defaultTicketPriority = "normal"
+
+func validPriority(p string) bool {
+	return containsString(ticketPriorities, p)
+}
+
+// ORDER BY expression putting the most urgent tickets first
+const priorityOrder = `CASE priority WHEN 'urgent' THEN 0 WHEN 'high' THEN 1 WHEN 'normal' THEN 2 ELSE 3 END`
+
+// Add the priority column to tickets
+func migrateTicketPriority() {
+	_, err := db.Exec(`
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS priority VARCHAR(10) NOT NULL DEFAULT 'normal'
+			CHECK (priority IN ('low', 'normal', 'high', 'urgent'));
+		CREATE INDEX IF NOT EXISTS tickets_priority_idx ON tickets (priority)
+	`)
+	if err != nil {
+		log.Fatal("Failed to migrate ticket priority:", err)
+	}
+}
+
+// POST /tickets/{id}/priority: change a ticket's priority
+func changePriority(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsAssign, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Priority string `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !validPriority(req.Priority) {
+		http.Error(w, "Priority must be low, normal, high or urgent", http.StatusBadRequest)
+		return
+	}
+
+	if req.Priority != ticket.Priority {
+		if err := store.Tickets().SetPriority(ticketID, req.Priority); err != nil {
+			log.Printf("Error changing priority of ticket #%d: %v", ticketID, err)
+			http.Error(w, "Failed to change priority", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ Ticket #%d priority changed from %s to %s by %s", ticketID, ticket.Priority, req.Priority, user.Email)
+		publish(Event{Type: eventTicketPriorityChanged, Actor: user.Email, TicketID: ticketID,
+			Data: map[string]interface{}{"from": ticket.Priority, "to": req.Priority}})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Priority updated", "priority": req.Priority})
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication delegated to a reverse proxy (ALB OIDC, oauth2-proxy,
+// ...). With AUTH_MODE=proxy the proxy passes a signed JWT identifying
+// the user in AUTH_PROXY_HEADER; users are created on first sight and
+// password login is disabled.
+var proxyAuth struct {
+	header        string
+	jwksURL       string
+	albARN        string
+	albRegion     string
+	issuer        string
+	audience      string
+	emailClaim    string
+	defaultRole   string
+	allowedDomain []string
+}
+
+func proxyAuthEnabled() bool {
+	return os.Getenv("AUTH_MODE") == "proxy"
+}
+
+// Read proxy auth settings, refusing to start with an unverifiable setup
+func loadProxyAuth() {
+	if !proxyAuthEnabled() {
+		return
+	}
+
+	proxyAuth.jwksURL = os.Getenv("AUTH_PROXY_JWKS_URL")
+	proxyAuth.albARN = os.Getenv("AUTH_PROXY_ALB_ARN")
+	proxyAuth.header = os.Getenv("AUTH_PROXY_HEADER")
+	proxyAuth.issuer = os.Getenv("AUTH_PROXY_ISSUER")
+	proxyAuth.audience = os.Getenv("AUTH_PROXY_AUDIENCE")
+
+	switch {
+	case proxyAuth.jwksURL != "":
+		if proxyAuth.header == "" {
+			log.Fatal("AUTH_MODE=proxy with AUTH_PROXY_JWKS_URL requires AUTH_PROXY_HEADER")
+		}
+		// An identity provider's keys sign tokens for all its apps
+		if proxyAuth.issuer == "" || proxyAuth.audience == "" {
+			log.Fatal("AUTH_MODE=proxy with AUTH_PROXY_JWKS_URL requires AUTH_PROXY_ISSUER and AUTH_PROXY_AUDIENCE")
+		}
+	case proxyAuth.albARN != "":
+		// ARNs look like arn:aws:elasticloadbalancing:REGION:ACCOUNT:loadbalancer/...
+		if parts := strings.Split(proxyAuth.albARN, ":"); len(parts) > 3 {
+			proxyAuth.albRegion = parts[3]
+		}
+		if proxyAuth.albRegion == "" {
+			log.Fatal("AUTH_PROXY_ALB_ARN is not a load balancer ARN")
+		}
+		if proxyAuth.header == "" {
+			proxyAuth.header = "X-Amzn-Oidc-Data"
+		}
+	default:
+		log.Fatal("AUTH_MODE=proxy requires AUTH_PROXY_JWKS_URL or AUTH_PROXY_ALB_ARN")
+	}
+
+	proxyAuth.emailClaim = os.Getenv("AUTH_PROXY_EMAIL_CLAIM")
+	if proxyAuth.emailClaim == "" {
+		proxyAuth.emailClaim = "email"
+	}
+	proxyAuth.defaultRole = os.Getenv("AUTH_PROXY_DEFAULT_ROLE")
+	if proxyAuth.defaultRole == "" {
+		proxyAuth.defaultRole = "client"
+	}
+	for _, d := range strings.Split(os.Getenv("AUTH_PROXY_ALLOWED_DOMAINS"), ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			proxyAuth.allowedDomain = append(proxyAuth.allowedDomain, d)
+		}
+	}
+
+	if len(trustedProxies) == 0 {
+		log.Println("Warning: AUTH_MODE=proxy without TRUSTED_PROXIES; identity headers are accepted from any peer")
+	}
+	log.Printf("✓ Proxy authentication enabled (header %s)", proxyAuth.header)
+}
+
+// User identified by the proxy's signed header, created if new
+func proxyUser(r *http.Request) (User, error) {
+	if len(trustedProxies) > 0 {
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(remote); err != nil || ip == nil || !isTrustedProxy(ip) {
+			return User{}, errors.New("request did not come through a trusted proxy")
+		}
+	}
+
+	token := strings.TrimPrefix(r.Header.Get(proxyAuth.header), "Bearer ")
+	if token == "" {
+		return User{}, errors.New("missing identity header")
+	}
+
+	claims, err := verifyProxyJWT(token)
+	if err != nil {
+		return User{}, err
+	}
+
+	email, _ := claims[proxyAuth.emailClaim].(string)
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return User{}, fmt.Errorf("token has no %s claim", proxyAuth.emailClaim)
+	}
+	if len(proxyAuth.allowedDomain) > 0 && !containsString(proxyAuth.allowedDomain, email[at+1:]) {
+		return User{}, fmt.Errorf("%s is not in an allowed domain", email)
+	}
+
+	// Nearly every request is from a user seen before; only new ones cost
+	// a password hash and an insert
+	if user, _, err := store.Users().PasswordHash(email); err == nil {
+		return user, nil
+	} else if err != sql.ErrNoRows {
+		return User{}, err
+	}
+
+	// Provisioned users can't log in with a password, only through the proxy
+	password, err := randomPasswordHash()
+	if err != nil {
+		return User{}, err
+	}
+	user, created, err := store.Users().Provision(email, password, proxyAuth.defaultRole)
+	if err != nil {
+		return User{}, err
+	}
+	if created {
+		log.Printf("✓ Provisioned %s (%s) from proxy identity", user.Email, user.UserType)
+	}
+	return user, nil
+}
+
+// POST /login/proxy: exchange the proxy identity for a session, so the
+// portal can use bearer tokens like a password login
+func handleProxyLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !proxyAuthEnabled() {
+		http.Error(w, "Proxy authentication is not enabled", http.StatusNotFound)
+		return
+	}
+
+	// The body is optional; cookie works as for POST /login
+	var req struct {
+		Cookie bool `json:"cookie"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	user, err := proxyUser(r)
+	if err != nil {
+		log.Printf("Proxy login failed from %s: %v", clientIP(r), err)
+		recordLoginAttempt(r, "", 0, "proxy", loginFailure, loginReasonInvalidCredentials)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user.Permissions = permissionList(user.UserType)
+	knownDevice := isKnownDevice(user.ID, r)
+
+	var sessionID string
+	user.Token, sessionID, err = createSession(user, r)
+	if err == nil {
+		err = attachAccessToken(&user, sessionID)
+	}
+	if err != nil {
+		log.Printf("Error creating session for %s: %v", user.Email, err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ User logged in via proxy: %s (%s) from %s", user.Email, user.UserType, clientIP(r))
+	recordLoginAttempt(r, user.Email, user.ID, "proxy", loginSuccess, "")
+	if req.Cookie {
+		setSessionCookie(w, user.Token)
+		user.Token = ""
+	}
+	if knownDevice {
+		recordSecurityEvent(user.ID, securityEventLogin, r, "proxy")
+	} else {
+		recordSecurityEvent(user.ID, securityEventNewDeviceLogin, r, describeDevice(r.UserAgent()))
+		notifySecurityEvent(user.Email, securityEventNewDeviceLogin, r)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// Decode base64url, tolerating the padding ALB adds
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Verify a JWT's signature and standard claims, returning its claims
+func verifyProxyJWT(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg    string `json:"alg"`
+		Kid    string `json:"kid"`
+		Signer string `json:"signer"`
+	}
+	raw, err := decodeSegment(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+
+	var key crypto.PublicKey
+	if proxyAuth.albARN != "" && proxyAuth.jwksURL == "" {
+		if header.Signer != proxyAuth.albARN {
+			return nil, fmt.Errorf("token signed by unexpected load balancer %q", header.Signer)
+		}
+		key, err = albPublicKey(header.Kid)
+	} else {
+		key, err = jwksPublicKey(header.Kid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch header.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("invalid token signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	raw, err = decodeSegment(parts[1])
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		return nil, errors.New("malformed token claims")
+	}
+
+	const leeway = 60
+	now := float64(time.Now().Unix())
+	exp, ok := claims["exp"].(float64)
+	if !ok || now > exp+leeway {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf-leeway {
+		return nil, errors.New("token not yet valid")
+	}
+	if proxyAuth.issuer != "" && claims["iss"] != proxyAuth.issuer {
+		return nil, errors.New("unexpected token issuer")
+	}
+	if proxyAuth.audience != "" && !audienceMatches(claims["aud"], proxyAuth.audience) {
+		return nil, errors.New("unexpected token audience")
+	}
+	return claims, nil
+}
+
+// aud may be a string or a list of strings
+func audienceMatches(aud interface{}, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, a := range v {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var proxyKeys = struct {
+	sync.Mutex
+	byKid     map[string]crypto.PublicKey
+	fetchedAt time.Time
+}{byKid: map[string]crypto.PublicKey{}}
+
+// ALB publishes each signing key as PEM under its key ID
+func albPublicKey(kid string) (crypto.PublicKey, error) {
+	if kid == "" || strings.ContainsAny(kid, "/?#") {
+		return nil, errors.New("invalid key ID")
+	}
+
+	proxyKeys.Lock()
+	key := proxyKeys.byKid[kid]
+	proxyKeys.Unlock()
+	if key != nil {
+		return key, nil
+	}
+
+	data, err := fetchKeyDocument(fmt.Sprintf("https://public-keys.auth.elb.%s.amazonaws.com/%s", proxyAuth.albRegion, url.PathEscape(kid)))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("ALB key is not PEM")
+	}
+	key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyKeys.Lock()
+	proxyKeys.byKid[kid] = key
+	proxyKeys.Unlock()
+	return key, nil
+}
+
+// Key from the JWKS document, refetched (at most once a minute) when an
+// unknown key ID appears after the identity provider rotates keys
+func jwksPublicKey(kid string) (crypto.PublicKey, error) {
+	proxyKeys.Lock()
+	defer proxyKeys.Unlock()
+
+	if key, ok := proxyKeys.byKid[kid]; ok {
+		return key, nil
+	}
+	if time.Since(proxyKeys.fetchedAt) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	proxyKeys.fetchedAt = time.Now()
+
+	data, err := fetchKeyDocument(proxyAuth.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range doc.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := decodeSegment(k.N)
+			e, err2 := decodeSegment(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := decodeSegment(k.X)
+			y, err2 := decodeSegment(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	proxyKeys.byKid = keys
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func fetchKeyDocument(u string) ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Infected uploads are moved under this prefix, which is never presigned,
+// so existing download links stop working
+const quarantinePrefix = "quarantine/"
+
+type QuarantinedAttachment struct {
+	ID            int       `json:"id"`
+	Key           string    `json:"key"`
+	QuarantineKey string    `json:"quarantine_key"`
+	TicketID      *int      `json:"ticket_id"`
+	UploadedBy    string    `json:"uploaded_by"`
+	Findings      string    `json:"findings"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// Create quarantine table
+func createQuarantineTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS quarantined_attachments (
+			id SERIAL PRIMARY KEY,
+			s3_key TEXT UNIQUE NOT NULL,
+			quarantine_key TEXT NOT NULL,
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE SET NULL,
+			uploaded_by VARCHAR(255) NOT NULL,
+			findings TEXT NOT NULL DEFAULT '',
+			quarantined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create quarantined_attachments table:", err)
+	}
+}
+
+// Scanner: hex HMAC-SHA256 of "{timestamp}.{body}" with
+// SCANNER_WEBHOOK_SECRET in X-Scanner-Signature, timestamp in
+// X-Scanner-Timestamp. Fits a ClamAV/bucketAV or GuardDuty forwarder.
+func verifyScannerSignature(r *http.Request, body []byte) error {
+	secret := os.Getenv("SCANNER_WEBHOOK_SECRET")
+	if secret == "" {
+		return errWebhookNotConfigured
+	}
+
+	ts := r.Header.Get("X-Scanner-Timestamp")
+	if err := checkWebhookTimestamp(ts); err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.%s", ts, body)
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get("X-Scanner-Signature"))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+type scanResult struct {
+	ScanID   string   `json:"scan_id"`
+	Key      string   `json:"key"`
+	Result   string   `json:"result"` // clean, infected or error
+	Findings []string `json:"findings"`
+}
+
+func scannerDeliveryID(r *http.Request, body []byte) string {
+	var res scanResult
+	json.Unmarshal(body, &res)
+	if res.ScanID != "" {
+		return res.ScanID
+	}
+	return r.Header.Get("X-Scanner-Signature")
+}
+
+// Verified scan results; infected attachments are quarantined
+func handleScanResult(w http.ResponseWriter, r *http.Request, body []byte) {
+	var res scanResult
+	if err := json.Unmarshal(body, &res); err != nil || res.Key == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	switch res.Result {
+	case "clean":
+	case "infected":
+		if err := quarantineAttachment(res.Key, strings.Join(res.Findings, ", ")); err != nil {
+			log.Printf("Failed to quarantine %s: %v", res.Key, err)
+			http.Error(w, "Failed to quarantine attachment", http.StatusInternalServerError)
+			return
+		}
+	case "error":
+		log.Printf("Scanner could not scan %s", res.Key)
+	default:
+		http.Error(w, "Unknown scan result", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Move an infected upload under the quarantine prefix, unlink it from its
+// ticket and tell the uploader and admins
+func quarantineAttachment(key, findings string) error {
+	if !strings.HasPrefix(key, "attachments/") {
+		return fmt.Errorf("not an attachment key: %s", key)
+	}
+	if s3Client == nil {
+		return errors.New("S3 not configured")
+	}
+
+	var ticketID sql.NullInt64
+	var uploadedBy string
+	var onMessage bool
+	err := db.QueryRow("SELECT ticket_id, uploaded_by, message_id IS NOT NULL FROM attachments WHERE s3_key = $1", key).
+		Scan(&ticketID, &uploadedBy, &onMessage)
+	if err == sql.ErrNoRows {
+		// Scanned before the upload was recorded; keys are
+		// attachments/{email}-{unix time}-{id}{ext}
+		name := strings.TrimPrefix(key, "attachments/")
+		if i := strings.LastIndex(name, "-"); i > 0 {
+			if j := strings.LastIndex(name[:i], "-"); j > 0 {
+				uploadedBy = name[:j]
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	qKey := quarantinePrefix + strings.TrimPrefix(key, "attachments/")
+	if err := moveObject(key, qKey); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO quarantined_attachments (s3_key, quarantine_key, ticket_id, uploaded_by, findings)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (s3_key) DO UPDATE SET findings = EXCLUDED.findings
+	`, key, qKey, ticketID, uploadedBy, findings)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE attachments SET s3_key = $1 WHERE s3_key = $2", qKey, key); err != nil {
+		return err
+	}
+	// attachment_url may link to it; replies' files never are
+	if ticketID.Valid && !onMessage {
+		if _, err := tx.Exec("UPDATE tickets SET attachment_url = NULL WHERE id = $1", ticketID.Int64); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("✓ Attachment %s quarantined (%s)", key, findings)
+	notifyQuarantine(key, uploadedBy, ticketID, findings)
+	return nil
+}
+
+// Copy an object to a new key and remove the original
+func moveObject(from, to string) error {
+	client, bucket := storageFor(from)
+	if client == nil {
+		return fmt.Errorf("storage location of %s is not configured", from)
+	}
+	_, err := client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(to),
+		CopySource: aws.String(bucket + "/" + url.PathEscape(from)),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(from),
+	})
+	return err
+}
+
+func notifyQuarantine(key, uploadedBy string, ticketID sql.NullInt64, findings string) {
+	name := key[strings.LastIndex(key, "/")+1:]
+	ticketNote := ""
+	if ticketID.Valid {
+		ticketNote = fmt.Sprintf(" attached to ticket #%d", ticketID.Int64)
+	}
+
+	if uploadedBy != "" {
+		sendMailAsync(uploadedBy, "An attachment you uploaded was blocked",
+			fmt.Sprintf("The file %s%s was flagged by our virus scanner and has been quarantined. "+
+				"It can no longer be downloaded.\n\nIf you believe this is a mistake, reply to your ticket or contact support.\n",
+				name, ticketNote))
+	}
+
+	rows, err := db.Query(`
+		SELECT u.email FROM users u JOIN roles r ON r.name = u.user_type
+		WHERE $1 = ANY(r.permissions)
+	`, permUsersManage)
+	if err != nil {
+		log.Printf("Error finding admins to notify: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var email string
+		if rows.Scan(&email) == nil {
+			sendMailAsync(email, "Attachment quarantined: "+name,
+				fmt.Sprintf("%s%s, uploaded by %s, was flagged by the virus scanner: %s\n\n"+
+					"Release or delete it from /admin/quarantine.\n", key, ticketNote, uploadedBy, findings))
+		}
+	}
+}
+
+// Whether an uploaded key was quarantined
+func isQuarantined(key string) bool {
+	var exists bool
+	db.QueryRow("SELECT EXISTS (SELECT 1 FROM quarantined_attachments WHERE s3_key = $1)", key).Scan(&exists)
+	return exists
+}
+
+// Admin: GET /admin/quarantine, POST /admin/quarantine/{id}/release,
+// DELETE /admin/quarantine/{id}
+func handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/quarantine"), "/")
+
+	switch {
+	case idPart == "" && r.Method == "GET":
+		rows, err := db.Query(`
+			SELECT id, s3_key, quarantine_key, ticket_id, uploaded_by, findings, quarantined_at
+			FROM quarantined_attachments ORDER BY quarantined_at DESC
+		`)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		items := []QuarantinedAttachment{}
+		for rows.Next() {
+			var q QuarantinedAttachment
+			var ticketID sql.NullInt64
+			if err := rows.Scan(&q.ID, &q.Key, &q.QuarantineKey, &ticketID, &q.UploadedBy, &q.Findings, &q.QuarantinedAt); err != nil {
+				continue
+			}
+			if ticketID.Valid {
+				id := int(ticketID.Int64)
+				q.TicketID = &id
+			}
+			items = append(items, q)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+
+	case strings.HasSuffix(idPart, "/release") && r.Method == "POST":
+		id, err := strconv.Atoi(strings.TrimSuffix(idPart, "/release"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		if err := releaseQuarantined(id); err != nil {
+			writeQuarantineError(w, err, "Failed to release attachment")
+			return
+		}
+		log.Printf("✓ Quarantined attachment %d released by %s", id, user.Email)
+		w.WriteHeader(http.StatusNoContent)
+
+	case idPart != "" && r.Method == "DELETE":
+		id, err := strconv.Atoi(idPart)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		if err := deleteQuarantined(id); err != nil {
+			writeQuarantineError(w, err, "Failed to delete attachment")
+			return
+		}
+		log.Printf("✓ Quarantined attachment %d deleted by %s", id, user.Email)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeQuarantineError(w http.ResponseWriter, err error, fallback string) {
+	if err == sql.ErrNoRows {
+		http.Error(w, "Quarantined attachment not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("%s: %v", fallback, err)
+	http.Error(w, fallback, http.StatusInternalServerError)
+}
+
+// Move a false positive back and relink it to its ticket
+func releaseQuarantined(id int) error {
+	var key, qKey string
+	var ticketID sql.NullInt64
+	err := db.QueryRow("SELECT s3_key, quarantine_key, ticket_id FROM quarantined_attachments WHERE id = $1", id).
+		Scan(&key, &qKey, &ticketID)
+	if err != nil {
+		return err
+	}
+
+	if err := moveObject(qKey, key); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE attachments SET s3_key = $1 WHERE s3_key = $2", key, qKey); err != nil {
+		return err
+	}
+	// A reply's file doesn't go back into the ticket's attachment_url
+	if ticketID.Valid {
+		urlStr, err := presignAttachment(key)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			UPDATE tickets SET attachment_url = $1 
+			WHERE id = $2 AND NOT EXISTS (SELECT 1 FROM attachments WHERE s3_key = $3 AND message_id IS NOT NULL)
+		`, urlStr, ticketID.Int64, key)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM quarantined_attachments WHERE id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Permanently remove a quarantined file
+func deleteQuarantined(id int) error {
+	var qKey string
+	if err := db.QueryRow("SELECT quarantine_key FROM quarantined_attachments WHERE id = $1", id).Scan(&qKey); err != nil {
+		return err
+	}
+
+	client, bucket := storageFor(qKey)
+	if client == nil {
+		return fmt.Errorf("storage location of %s is not configured", qKey)
+	}
+	_, err := client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(qKey),
+	})
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM attachments WHERE s3_key = $1", qKey); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM quarantined_attachments WHERE id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
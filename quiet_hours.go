@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	// Container images often ship without zoneinfo
+	_ "time/tzdata"
+)
+
+// Working hours and do-not-disturb settings. Non-urgent notification
+// emails generated outside working hours or during DND are held until
+// the user's next working period.
+type NotificationPreferences struct {
+	Timezone  string     `json:"timezone"`
+	WorkDays  []string   `json:"work_days"`
+	WorkStart string     `json:"work_start"`
+	WorkEnd   string     `json:"work_end"`
+	DNDUntil  *time.Time `json:"dnd_until,omitempty"`
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Create notification preferences and held email tables
+func createNotificationPreferencesTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS notification_preferences (
+			user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+			work_days VARCHAR(30) NOT NULL DEFAULT 'mon,tue,wed,thu,fri',
+			work_start VARCHAR(5) NOT NULL DEFAULT '09:00',
+			work_end VARCHAR(5) NOT NULL DEFAULT '17:00',
+			dnd_until TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS held_emails (
+			id SERIAL PRIMARY KEY,
+			recipient VARCHAR(255) NOT NULL,
+			subject TEXT NOT NULL,
+			body TEXT NOT NULL,
+			message_id INTEGER,
+			deliver_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS held_emails_deliver_idx ON held_emails (deliver_at)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create notification preferences tables:", err)
+	}
+}
+
+// Parse "HH:MM" into minutes after midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Check preferences before saving them
+func (p *NotificationPreferences) validate() error {
+	if p.Timezone == "" {
+		p.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", p.Timezone)
+	}
+	for i, d := range p.WorkDays {
+		p.WorkDays[i] = strings.ToLower(d)
+		if !containsString(weekdayNames, p.WorkDays[i]) {
+			return fmt.Errorf("unknown work day %q", d)
+		}
+	}
+	if len(p.WorkDays) == 0 {
+		return fmt.Errorf("at least one work day is required")
+	}
+	start, err := parseClock(p.WorkStart)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(p.WorkEnd)
+	if err != nil {
+		return err
+	}
+	if start >= end {
+		return fmt.Errorf("work_start must be before work_end")
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Earliest time at or after now when the user wants to be notified
+func (p NotificationPreferences) nextDeliveryTime(now time.Time) time.Time {
+	if p.DNDUntil != nil && p.DNDUntil.After(now) {
+		now = *p.DNDUntil
+	}
+
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return now
+	}
+	start, err1 := parseClock(p.WorkStart)
+	end, err2 := parseClock(p.WorkEnd)
+	if err1 != nil || err2 != nil {
+		return now
+	}
+
+	local := now.In(loc)
+	for i := 0; i < 8; i++ {
+		y, m, d := local.Year(), local.Month(), local.Day()+i
+		opens := time.Date(y, m, d, start/60, start%60, 0, 0, loc)
+		closes := time.Date(y, m, d, end/60, end%60, 0, 0, loc)
+		if !containsString(p.WorkDays, weekdayNames[opens.Weekday()]) {
+			continue
+		}
+		if local.Before(opens) {
+			return opens.UTC()
+		}
+		if local.Before(closes) {
+			return now
+		}
+	}
+	return now
+}
+
+// Preferences for the user with email; ok is false if they have none
+func preferencesForEmail(email string) (NotificationPreferences, bool) {
+	var p NotificationPreferences
+	var days string
+	var dnd sql.NullTime
+	err := db.QueryRow(`
+		SELECT p.timezone, p.work_days, p.work_start, p.work_end, p.dnd_until 
+		FROM notification_preferences p 
+		JOIN users u ON u.id = p.user_id 
+		WHERE lower(u.email) = lower($1)
+	`, email).Scan(&p.Timezone, &days, &p.WorkStart, &p.WorkEnd, &dnd)
+	if err != nil {
+		return p, false
+	}
+	p.WorkDays = strings.Split(days, ",")
+	if dnd.Valid {
+		p.DNDUntil = &dnd.Time
+	}
+	return p, true
+}
+
+// Send a non-urgent notification email, holding it until the
+// recipient's next working period if they're off-hours or in DND
+func sendNotification(to, subject, body string, messageID int) {
+	if fullFeatured() && mailer != nil {
+		if p, ok := preferencesForEmail(to); ok {
+			now := time.Now().UTC()
+			if at := p.nextDeliveryTime(now); at.After(now) {
+				holdEmail(to, subject, body, messageID, at)
+				return
+			}
+		}
+	}
+	sendMailTracked(to, subject, body, messageID)
+}
+
+func holdEmail(to, subject, body string, messageID int, at time.Time) {
+	_, err := db.Exec(`
+		INSERT INTO held_emails (recipient, subject, body, message_id, deliver_at) 
+		VALUES ($1, $2, $3, NULLIF($4, 0), $5)
+	`, to, subject, body, messageID, at)
+	if err != nil {
+		log.Printf("Failed to hold email for %s, sending now: %v", to, err)
+		sendMailTracked(to, subject, body, messageID)
+		return
+	}
+	log.Printf("Email to %s held until %s", to, at.Format(time.RFC3339))
+}
+
+// Job: send held emails whose delivery time has come
+func sendHeldEmails() error {
+	rows, err := db.Query(`
+		DELETE FROM held_emails WHERE deliver_at <= CURRENT_TIMESTAMP 
+		RETURNING recipient, subject, body, COALESCE(message_id, 0)
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	sent := 0
+	for rows.Next() {
+		var to, subject, body string
+		var messageID int
+		if err := rows.Scan(&to, &subject, &body, &messageID); err != nil {
+			return err
+		}
+		sendMailTracked(to, subject, body, messageID)
+		sent++
+	}
+	if sent > 0 {
+		log.Printf("✓ Released %d held notification emails", sent)
+	}
+	return rows.Err()
+}
+
+// GET/PUT/DELETE /me/notification_preferences. Without preferences,
+// notifications are sent immediately.
+func handleNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	switch r.Method {
+	case "GET":
+		p, ok := preferencesForEmail(user.Email)
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "preferences": p})
+
+	case "PUT":
+		var p NotificationPreferences
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := p.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO notification_preferences (user_id, timezone, work_days, work_start, work_end, dnd_until) 
+			VALUES ($1, $2, $3, $4, $5, $6) 
+			ON CONFLICT (user_id) DO UPDATE SET timezone = EXCLUDED.timezone, work_days = EXCLUDED.work_days, 
+				work_start = EXCLUDED.work_start, work_end = EXCLUDED.work_end, dnd_until = EXCLUDED.dnd_until
+		`, user.ID, p.Timezone, strings.Join(p.WorkDays, ","), p.WorkStart, p.WorkEnd, p.DNDUntil)
+		if err != nil {
+			http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ Notification preferences updated for %s", user.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "preferences": p})
+
+	case "DELETE":
+		if _, err := db.Exec("DELETE FROM notification_preferences WHERE user_id = $1", user.ID); err != nil {
+			http.Error(w, "Failed to clear preferences", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quota dimensions
+const (
+	quotaOpenTickets     = "open_tickets"
+	quotaAttachmentBytes = "attachment_bytes"
+	quotaAPICalls        = "api_calls_per_day"
+)
+
+// Organizations are warned once usage reaches this share of a quota
+const quotaWarnRatio = 0.8
+
+// Per-organization limits; nil means unlimited
+type OrgQuotas struct {
+	MaxOpenTickets     *int64 `json:"max_open_tickets"`
+	MaxAttachmentBytes *int64 `json:"max_attachment_bytes"`
+	MaxAPICallsPerDay  *int64 `json:"max_api_calls_per_day"`
+}
+
+type OrgUsage struct {
+	OpenTickets     int64 `json:"open_tickets"`
+	AttachmentBytes int64 `json:"attachment_bytes"`
+	APICallsToday   int64 `json:"api_calls_today"`
+}
+
+// Create quota tables and track attachment sizes
+func createQuotaTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS organization_quotas (
+			org_id INTEGER PRIMARY KEY REFERENCES organizations(id) ON DELETE CASCADE,
+			max_open_tickets BIGINT,
+			max_attachment_bytes BIGINT,
+			max_api_calls_per_day BIGINT
+		);
+		CREATE TABLE IF NOT EXISTS organization_api_usage (
+			org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			day DATE NOT NULL,
+			calls BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (org_id, day)
+		);
+		CREATE TABLE IF NOT EXISTS organization_quota_warnings (
+			org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			quota VARCHAR(30) NOT NULL,
+			period VARCHAR(10) NOT NULL,
+			warned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (org_id, quota, period)
+		);
+		ALTER TABLE attachments ADD COLUMN IF NOT EXISTS size_bytes BIGINT NOT NULL DEFAULT 0
+	`)
+	if err != nil {
+		log.Fatal("Failed to create quota tables:", err)
+	}
+}
+
+// Quotas are read on every API call, so cache them briefly
+var quotaCache = newContextCache(time.Minute)
+
+func orgQuotas(orgID int64) OrgQuotas {
+	key := strconv.FormatInt(orgID, 10)
+	if v, ok := quotaCache.get(key); ok {
+		return v.(OrgQuotas)
+	}
+
+	var q OrgQuotas
+	var tickets, bytes, calls sql.NullInt64
+	err := db.QueryRow(`
+		SELECT max_open_tickets, max_attachment_bytes, max_api_calls_per_day
+		FROM organization_quotas WHERE org_id = $1
+	`, orgID).Scan(&tickets, &bytes, &calls)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading quotas for organization %d: %v", orgID, err)
+		return q
+	}
+	q.MaxOpenTickets = nullableInt(tickets)
+	q.MaxAttachmentBytes = nullableInt(bytes)
+	q.MaxAPICallsPerDay = nullableInt(calls)
+
+	quotaCache.set(key, q)
+	return q
+}
+
+func nullableInt(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// Current usage for every quota dimension
+func orgUsage(orgID int64) (OrgUsage, error) {
+	var u OrgUsage
+	err := db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM tickets WHERE org_id = $1 AND status <> 'closed'),
+			(SELECT COALESCE(SUM(calls), 0) FROM organization_api_usage WHERE org_id = $1 AND day = CURRENT_DATE)
+	`, orgID).Scan(&u.OpenTickets, &u.APICallsToday)
+	if err != nil {
+		return u, err
+	}
+	u.AttachmentBytes, err = orgAttachmentBytes(orgID)
+	u.APICallsToday += apiUsage.pendingFor(orgID)
+	return u, err
+}
+
+// Attachment storage, hot and archived, uploaded by the organization's users
+func orgAttachmentBytes(orgID int64) (int64, error) {
+	var n int64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(a.size_bytes), 0) FROM (
+			SELECT uploaded_by, size_bytes FROM attachments
+			UNION ALL
+			SELECT uploaded_by, size_bytes FROM archived_attachments
+		) a
+		JOIN organizations o ON o.domain = lower(split_part(a.uploaded_by, '@', 2))
+		WHERE o.id = $1
+	`, orgID).Scan(&n)
+	return n, err
+}
+
+// Compare usage after adding n against a quota: warn the organization's
+// admins when it crosses the warning threshold, refuse when it would
+// exceed the limit
+func checkQuota(orgID int64, quota string, limit *int64, used, n int64) error {
+	if limit == nil {
+		return nil
+	}
+
+	if *limit > 0 && float64(used+n) >= quotaWarnRatio*float64(*limit) {
+		warnQuota(orgID, quota, used+n, *limit)
+	} else if quota != quotaAPICalls {
+		// Usage dropped back, so warn again next time it climbs
+		recentQuotaWarnings.delete(fmt.Sprintf("%d:%s:%s", orgID, quota, quotaPeriod(quota)))
+		db.Exec("DELETE FROM organization_quota_warnings WHERE org_id = $1 AND quota = $2", orgID, quota)
+	}
+
+	if used+n <= *limit {
+		return nil
+	}
+
+	log.Printf("Organization %d over %s quota (%d of %d)", orgID, quota, used+n, *limit)
+	switch quota {
+	case quotaAPICalls:
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return &serviceError{
+			kind:       errRateLimited,
+			message:    fmt.Sprintf("Your organization has used its %d API calls for today", *limit),
+			retryAfter: int(midnight.Sub(now).Seconds()) + 1,
+		}
+	case quotaOpenTickets:
+		return newServiceError(errForbidden, fmt.Sprintf("Your organization has reached its limit of %d open tickets. Close resolved tickets or contact support to raise it.", *limit))
+	default:
+		return newServiceError(errForbidden, "Your organization has used its attachment storage quota")
+	}
+}
+
+// Warning periods: daily quotas warn once a day, the others once each
+// time usage crosses the threshold
+func quotaPeriod(quota string) string {
+	if quota == quotaAPICalls {
+		return time.Now().UTC().Format("2006-01-02")
+	}
+	return "current"
+}
+
+// Warnings already recorded, so metered calls past the threshold don't
+// each write to the database
+var recentQuotaWarnings = newContextCache(10 * time.Minute)
+
+// Email the organization's admins the first time a quota nears its limit
+func warnQuota(orgID int64, quota string, used, limit int64) {
+	period := quotaPeriod(quota)
+	key := fmt.Sprintf("%d:%s:%s", orgID, quota, period)
+	if _, ok := recentQuotaWarnings.get(key); ok {
+		return
+	}
+	recentQuotaWarnings.set(key, true)
+
+	res, err := db.Exec(`
+		INSERT INTO organization_quota_warnings (org_id, quota, period)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`, orgID, quota, period)
+	if err != nil {
+		log.Printf("Error recording quota warning: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+
+	log.Printf("Organization %d at %d of %d %s", orgID, used, limit, quota)
+
+	rows, err := db.Query(`
+		SELECT u.email FROM users u 
+		JOIN organizations o ON o.domain = lower(split_part(u.email, '@', 2))
+		JOIN roles ro ON ro.name = u.user_type
+		WHERE o.id = $1 AND u.active AND $2 = ANY(ro.permissions)
+	`, orgID, permTicketsReadOrg)
+	if err != nil {
+		log.Printf("Error finding admins for organization %d: %v", orgID, err)
+		return
+	}
+	defer rows.Close()
+
+	subject := "Your support quota is almost used"
+	body := fmt.Sprintf("Your organization has used %d of its %d %s (%d%%).\n\n"+
+		"Requests beyond the limit will be refused. Contact support to raise it.\n",
+		used, limit, strings.ReplaceAll(quota, "_", " "), used*100/limit)
+	for rows.Next() {
+		var email string
+		if rows.Scan(&email) == nil {
+			go sendNotification(email, subject, body, 0)
+		}
+	}
+}
+
+// Refuse a new ticket when the requester's organization is at its limit
+func checkOpenTicketQuota(email string) error {
+	orgID := orgIDForEmail(email)
+	if !orgID.Valid {
+		return nil
+	}
+	q := orgQuotas(orgID.Int64)
+	if q.MaxOpenTickets == nil {
+		return nil
+	}
+
+	var open int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM tickets WHERE org_id = $1 AND status <> 'closed'", orgID.Int64).Scan(&open); err != nil {
+		// Don't block ticket creation on a failed quota check
+		return nil
+	}
+	return checkQuota(orgID.Int64, quotaOpenTickets, q.MaxOpenTickets, open, 1)
+}
+
+// Refuse an upload that would take the organization over its storage quota
+func checkStorageQuota(email string, size int64) error {
+	orgID := orgIDForEmail(email)
+	if !orgID.Valid {
+		return nil
+	}
+	q := orgQuotas(orgID.Int64)
+	if q.MaxAttachmentBytes == nil {
+		return nil
+	}
+
+	used, err := orgAttachmentBytes(orgID.Int64)
+	if err != nil {
+		return nil
+	}
+	return checkQuota(orgID.Int64, quotaAttachmentBytes, q.MaxAttachmentBytes, used, size)
+}
+
+// Record an upload's uploader, size and storage location before it is
+// linked to a ticket, so storage counts from the moment the object exists
+// and only the uploader can attach it
+func recordUpload(key, email, location string, size int64) error {
+	if err := store.Tickets().RecordUpload(key, email, size, location); err != nil {
+		return err
+	}
+	rememberKeyLocation(key, location)
+	return nil
+}
+
+// API calls counted in memory and flushed to organization_api_usage
+// periodically, so metering doesn't add a write to every request. Other
+// replicas' unflushed calls can let an organization overshoot slightly.
+type apiUsageCounter struct {
+	sync.Mutex
+	pending map[int64]int64
+	today   map[int64]int64 // flushed totals as of the last refresh
+}
+
+var apiUsage = &apiUsageCounter{pending: map[int64]int64{}, today: map[int64]int64{}}
+
+func (u *apiUsageCounter) pendingFor(orgID int64) int64 {
+	u.Lock()
+	defer u.Unlock()
+	return u.pending[orgID]
+}
+
+// Organization of a requester, cached so metering doesn't look it up on
+// every call
+var orgByEmail = newContextCache(5 * time.Minute)
+
+func cachedOrgIDForEmail(email string) sql.NullInt64 {
+	if v, ok := orgByEmail.get(email); ok {
+		return v.(sql.NullInt64)
+	}
+	id := orgIDForEmail(email)
+	orgByEmail.set(email, id)
+	return id
+}
+
+// Count and limit API calls made by organization members. Staff aren't
+// metered.
+func meterAPICalls(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if canSeeInternal(user) {
+			next(w, r)
+			return
+		}
+		orgID := cachedOrgIDForEmail(user.Email)
+		if !orgID.Valid {
+			next(w, r)
+			return
+		}
+
+		q := orgQuotas(orgID.Int64)
+		apiUsage.Lock()
+		apiUsage.pending[orgID.Int64]++
+		used := apiUsage.today[orgID.Int64] + apiUsage.pending[orgID.Int64]
+		apiUsage.Unlock()
+
+		if err := checkQuota(orgID.Int64, quotaAPICalls, q.MaxAPICallsPerDay, used-1, 1); err != nil {
+			writeServiceError(w, err, "Quota exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Flush metered calls every 30 seconds and refresh today's totals
+func startAPIUsageFlusher() {
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			flushAPIUsage()
+		}
+	}()
+}
+
+func flushAPIUsage() {
+	apiUsage.Lock()
+	pending := apiUsage.pending
+	apiUsage.pending = map[int64]int64{}
+	apiUsage.Unlock()
+
+	for orgID, n := range pending {
+		_, err := db.Exec(`
+			INSERT INTO organization_api_usage (org_id, day, calls) VALUES ($1, CURRENT_DATE, $2)
+			ON CONFLICT (org_id, day) DO UPDATE SET calls = organization_api_usage.calls + EXCLUDED.calls
+		`, orgID, n)
+		if err != nil {
+			log.Printf("Error flushing API usage for organization %d: %v", orgID, err)
+			apiUsage.Lock()
+			apiUsage.pending[orgID] += n
+			apiUsage.Unlock()
+		}
+	}
+
+	rows, err := db.Query("SELECT org_id, calls FROM organization_api_usage WHERE day = CURRENT_DATE")
+	if err != nil {
+		log.Printf("Error loading API usage: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	today := map[int64]int64{}
+	for rows.Next() {
+		var orgID, calls int64
+		if rows.Scan(&orgID, &calls) == nil {
+			today[orgID] = calls
+		}
+	}
+	apiUsage.Lock()
+	apiUsage.today = today
+	apiUsage.Unlock()
+}
+
+// GET/PUT/DELETE /admin/organizations/{id}/quotas, and the organization's
+// storage location at /admin/organizations/{id}/storage
+func handleOrganizationQuotas(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/organizations/"), "/"), "/")
+	if len(parts) != 2 || (parts[1] != "quotas" && parts[1] != "storage") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	orgID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	db.QueryRow("SELECT EXISTS (SELECT 1 FROM organizations WHERE id = $1)", orgID).Scan(&exists)
+	if !exists {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+	if parts[1] == "storage" {
+		handleOrganizationStorage(w, r, orgID)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		// Reported below
+
+	case "PUT":
+		var q OrgQuotas
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		for _, v := range []*int64{q.MaxOpenTickets, q.MaxAttachmentBytes, q.MaxAPICallsPerDay} {
+			if v != nil && *v < 0 {
+				http.Error(w, "Quotas must not be negative", http.StatusBadRequest)
+				return
+			}
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO organization_quotas (org_id, max_open_tickets, max_attachment_bytes, max_api_calls_per_day)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (org_id) DO UPDATE SET
+				max_open_tickets = EXCLUDED.max_open_tickets,
+				max_attachment_bytes = EXCLUDED.max_attachment_bytes,
+				max_api_calls_per_day = EXCLUDED.max_api_calls_per_day
+		`, orgID, q.MaxOpenTickets, q.MaxAttachmentBytes, q.MaxAPICallsPerDay)
+		if err != nil {
+			http.Error(w, "Failed to save quotas", http.StatusInternalServerError)
+			return
+		}
+		quotaCache.delete(strconv.FormatInt(orgID, 10))
+		log.Printf("✓ Quotas for organization %d updated by %s", orgID, currentUser(r).Email)
+
+	case "DELETE":
+		if _, err := db.Exec("DELETE FROM organization_quotas WHERE org_id = $1", orgID); err != nil {
+			http.Error(w, "Failed to remove quotas", http.StatusInternalServerError)
+			return
+		}
+		quotaCache.delete(strconv.FormatInt(orgID, 10))
+		log.Printf("✓ Quotas for organization %d removed by %s", orgID, currentUser(r).Email)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usage, err := orgUsage(orgID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"quotas": orgQuotas(orgID),
+		"usage":  usage,
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+)
+
+const defaultTicketRateLimit = 20
+
+// Maximum tickets a requester may create per hour (0 disables the limit)
+func ticketRateLimit() int {
+	if v := os.Getenv("TICKET_RATE_LIMIT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return defaultTicketRateLimit
+}
+
+// Reject ticket creation once a requester hits the hourly limit.
+// Counts come from the tickets table so the limit holds across replicas.
+func checkTicketRateLimit(email string) error {
+	limit := ticketRateLimit()
+	if limit == 0 {
+		return nil
+	}
+
+	var count int
+	var retryAfter float64
+	err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(EXTRACT(EPOCH FROM MIN(created_at) + INTERVAL '1 hour' - CURRENT_TIMESTAMP), 0)
+		FROM tickets 
+		WHERE email = $1 AND created_at > CURRENT_TIMESTAMP - INTERVAL '1 hour'
+	`, email).Scan(&count, &retryAfter)
+	if err != nil {
+		// Don't block ticket creation on a failed limit check
+		return nil
+	}
+
+	if count < limit {
+		return nil
+	}
+
+	log.Printf("Ticket rate limit hit by %s", email)
+
+	return &serviceError{
+		kind:       errRateLimited,
+		message:    fmt.Sprintf("Ticket limit reached: at most %d tickets per hour. Add details to an existing ticket or try again later.", limit),
+		retryAfter: int(math.Max(1, math.Ceil(retryAfter))),
+	}
+}
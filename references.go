@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Prefix for human-friendly ticket references, e.g. STS-2024-00123
+func ticketRefPrefix() string {
+	if prefix := os.Getenv("TICKET_REF_PREFIX"); prefix != "" {
+		return prefix
+	}
+	return "STS"
+}
+
+// Each organization's tickets are numbered on their own, and carry the
+// organization's ID after the prefix (STS-12-2024-00123) so references
+// stay unique. Tickets outside any organization share org_id 0 and keep
+// the short form (STS-2024-00123).
+func formatTicketReference(prefix string, orgID, year, n int) string {
+	if orgID > 0 {
+		return fmt.Sprintf("%s-%d-%d-%05d", prefix, orgID, year, n)
+	}
+	return fmt.Sprintf("%s-%d-%05d", prefix, year, n)
+}
+
+// Allocate the next ticket reference of an organization inside the ticket
+// creation transaction. The counter row stays locked until the transaction
+// ends, and a rollback returns the number, so references are gap-free.
+func nextTicketReference(tx *sql.Tx, orgID int) (string, error) {
+	prefix := ticketRefPrefix()
+	year := time.Now().UTC().Year()
+
+	var n int
+	err := tx.QueryRow(`
+		INSERT INTO ticket_sequences (prefix, org_id, year, last_value)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (prefix, org_id, year) DO UPDATE SET last_value = ticket_sequences.last_value + 1
+		RETURNING last_value
+	`, prefix, orgID, year).Scan(&n)
+	if err != nil {
+		return "", err
+	}
+
+	return formatTicketReference(prefix, orgID, year, n), nil
+}
+
+// Assign references to tickets created before references existed,
+// numbering them per creation year in ID order. Those tickets predate
+// organizations, so they all count under org_id 0.
+func migrateTicketReferences() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ticket_sequences (
+			prefix VARCHAR(20) NOT NULL,
+			org_id INTEGER NOT NULL DEFAULT 0,
+			year INTEGER NOT NULL,
+			last_value INTEGER NOT NULL
+		);
+		-- Counters were once kept per prefix and year only
+		ALTER TABLE ticket_sequences ADD COLUMN IF NOT EXISTS org_id INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE ticket_sequences DROP CONSTRAINT IF EXISTS ticket_sequences_pkey;
+		CREATE UNIQUE INDEX IF NOT EXISTS ticket_sequences_key_idx ON ticket_sequences (prefix, org_id, year);
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS reference VARCHAR(40);
+		CREATE UNIQUE INDEX IF NOT EXISTS tickets_reference_idx ON tickets (reference)
+	`)
+	if err != nil {
+		log.Fatal("Failed to migrate ticket references:", err)
+	}
+
+	_, err = runExclusive("migrate-ticket-references", func(conn *sql.Conn) error {
+		res, err := conn.ExecContext(context.Background(), `
+			WITH numbered AS (
+				SELECT t.id, EXTRACT(YEAR FROM t.created_at)::int AS yr,
+					COALESCE(s.last_value, 0) + ROW_NUMBER() OVER (
+						PARTITION BY EXTRACT(YEAR FROM t.created_at) ORDER BY t.id
+					) AS n
+				FROM tickets t
+				LEFT JOIN ticket_sequences s ON s.prefix = $1 AND s.org_id = 0 AND s.year = EXTRACT(YEAR FROM t.created_at)::int
+				WHERE t.reference IS NULL
+			), updated AS (
+				UPDATE tickets SET reference = $1 || '-' || numbered.yr || '-' ||
+					repeat('0', GREATEST(0, 5 - length(numbered.n::text))) || numbered.n
+				FROM numbered
+				WHERE tickets.id = numbered.id
+				RETURNING numbered.yr, numbered.n
+			)
+			INSERT INTO ticket_sequences (prefix, org_id, year, last_value)
+			SELECT $1, 0, yr, MAX(n) FROM updated GROUP BY yr
+			ON CONFLICT (prefix, org_id, year) DO UPDATE SET last_value = EXCLUDED.last_value
+		`, ticketRefPrefix())
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Println("✓ Ticket references backfilled")
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal("Failed to backfill ticket references:", err)
+	}
+}
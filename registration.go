@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// Self-service sign-up for client accounts, when ALLOW_REGISTRATION=true.
+// POST /register keeps the request pending and emails a link; the account
+// is only created when GET /verify?token= is opened, so nobody can claim
+// an address they can't read.
+const registrationTTL = 24 * time.Hour
+
+// Sign-up emails per hour, to an address and from a client IP, so
+// POST /register can't be used to flood someone's inbox
+const (
+	registrationsPerAddress = 3
+	registrationsPerIP      = 10
+)
+
+func registrationEnabled() bool {
+	return os.Getenv("ALLOW_REGISTRATION") == "true" && !proxyAuthEnabled() && !ldapAuthEnabled()
+}
+
+// Create pending registrations table
+func createRegistrationsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS registrations (
+			id SERIAL PRIMARY KEY,
+			email VARCHAR(255) NOT NULL,
+			password_hash VARCHAR(255) NOT NULL,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			verified_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS registrations_email_idx ON registrations (email);
+		-- Sign-ups are rate limited from login_attempts instead
+		ALTER TABLE registrations DROP COLUMN IF EXISTS ip
+	`)
+	if err != nil {
+		log.Fatal("Failed to create registrations table:", err)
+	}
+}
+
+// Plain address (no display name), lowercased, or "" if it isn't one
+func normalizeEmail(s string) string {
+	addr, err := mail.ParseAddress(strings.TrimSpace(s))
+	if err != nil || addr.Name != "" || len(addr.Address) > 255 || addr.Address != strings.TrimSpace(s) {
+		return ""
+	}
+	if at := strings.LastIndex(addr.Address, "@"); at < 1 || !strings.Contains(addr.Address[at+1:], ".") {
+		return ""
+	}
+	return strings.ToLower(addr.Address)
+}
+
+// POST /register: start sign-up with email and password. The answer is
+// the same whether or not the address already has an account.
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !registrationEnabled() {
+		http.Error(w, "Registration is not available", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	email := normalizeEmail(req.Email)
+	if email == "" {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	if err := checkPasswordStrength(req.Password, email); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := checkRegistrationRateLimit(email, clientIP(r)); err != nil {
+		recordLoginAttempt(r, email, 0, "register", loginFailure, loginReasonRateLimited)
+		writeServiceError(w, err, "Failed to register")
+		return
+	}
+	recordLoginAttempt(r, email, 0, "register", loginSuccess, "")
+
+	accepted := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Check your email for a link to finish signing up"})
+	}
+
+	if _, err := store.Users().IDByEmail(email); err == nil {
+		// Hash anyway, so the response takes as long as a real sign-up
+		hashPassword(req.Password)
+		sendMailAsync(email, "You already have a support account", `Someone tried to sign up for a support account with this address, but you
+already have one. Sign in with your existing password, or ask us to reset it.
+
+If this wasn't you, you can ignore this email.
+`)
+		accepted()
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	// A new request for the same address replaces any earlier one
+	_, err = db.Exec("DELETE FROM registrations WHERE email = $1 AND verified_at IS NULL", email)
+	if err == nil {
+		_, err = db.Exec(`
+			INSERT INTO registrations (email, password_hash, token_hash, expires_at)
+			VALUES ($1, $2, $3, $4)
+		`, email, hash, hashToken(token), time.Now().Add(registrationTTL).UTC())
+	}
+	if err != nil {
+		log.Printf("Error saving registration for %s: %v", email, err)
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+
+	sendMailAsync(email, "Confirm your support account", fmt.Sprintf(`To finish creating your support account, open this link within 24 hours:
+
+%s/verify?token=%s
+
+If you didn't sign up, you can ignore this email.
+`, publicBaseURL(), token))
+
+	log.Printf("✓ Registration started for %s from %s", email, clientIP(r))
+	accepted()
+}
+
+// Reject a sign-up once its address or client IP hits the hourly limit.
+// Sign-ups are counted from login_attempts, where each one is recorded.
+// Unlike other limits this fails closed: every sign-up sends an email.
+func checkRegistrationRateLimit(email, ip string) error {
+	var byAddress, byIP int
+	var retryAfter float64
+	err := db.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE email = $1), COUNT(*) FILTER (WHERE ip = $2),
+			COALESCE(EXTRACT(EPOCH FROM MIN(created_at) + INTERVAL '1 hour' - CURRENT_TIMESTAMP), 0)
+		FROM login_attempts
+		WHERE method = 'register' AND outcome = $3 AND (email = $1 OR ip = $2)
+			AND created_at > CURRENT_TIMESTAMP - INTERVAL '1 hour'
+	`, email, ip, loginSuccess).Scan(&byAddress, &byIP, &retryAfter)
+	if err != nil {
+		return err
+	}
+	if byAddress < registrationsPerAddress && byIP < registrationsPerIP {
+		return nil
+	}
+
+	log.Printf("Registration rate limit hit for %s from %s", email, ip)
+
+	return &serviceError{
+		kind:       errRateLimited,
+		message:    "Too many sign-up requests. Try again later.",
+		retryAfter: int(math.Max(1, math.Ceil(retryAfter))),
+	}
+}
+
+// GET /verify?token=: create the account for a pending registration
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !registrationEnabled() {
+		http.Error(w, "Registration is not available", http.StatusNotFound)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	var email, hash string
+	err := db.QueryRow(`
+		UPDATE registrations SET verified_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND verified_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING email, password_hash
+	`, hashToken(token)).Scan(&email, &hash)
+	if err == sql.ErrNoRows {
+		http.Error(w, "This link has expired or was already used", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	user, created, err := store.Users().Provision(email, hash, "client")
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error creating account for %s: %v", email, err)
+		// Let the link be used again rather than burn it on our failure
+		if _, err := db.Exec("UPDATE registrations SET verified_at = NULL WHERE token_hash = $1", hashToken(token)); err != nil {
+			log.Printf("Error reopening registration for %s: %v", email, err)
+		}
+		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+	if !created {
+		// Created some other way since the request
+		http.Error(w, "This email address already has an account", http.StatusConflict)
+		return
+	}
+
+	log.Printf("✓ Account created for %s by registration", user.Email)
+	recordAudit(user.Email, "user.registered", 0, map[string]interface{}{"user_id": user.ID})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account created; you can sign in now", "email": user.Email})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Sections a scheduled report email can include
+var reportSections = map[string]bool{"volume": true, "sla": true, "csat": true}
+
+type ReportSchedule struct {
+	ID         int        `json:"id"`
+	Recipient  string     `json:"recipient"`
+	Frequency  string     `json:"frequency"`
+	Sections   []string   `json:"sections"`
+	CreatedBy  string     `json:"created_by"`
+	LastSentAt *time.Time `json:"last_sent_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Create report schedules table
+func createReportSchedulesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS report_schedules (
+			id SERIAL PRIMARY KEY,
+			recipient VARCHAR(255) NOT NULL,
+			frequency VARCHAR(20) NOT NULL CHECK (frequency IN ('weekly', 'monthly')),
+			sections TEXT[] NOT NULL,
+			created_by VARCHAR(255) NOT NULL,
+			last_sent_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create report_schedules table:", err)
+	}
+}
+
+// Most recently completed reporting period [start, end)
+func reportPeriod(frequency string, now time.Time) (start, end time.Time) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if frequency == "monthly" {
+		end = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return end.AddDate(0, -1, 0), end
+	}
+	// Weeks start on Monday
+	end = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	return end.AddDate(0, 0, -7), end
+}
+
+// Send every schedule that hasn't been sent for the period that just ended
+func sendDueReportEmails() error {
+	if mailer == nil {
+		return nil
+	}
+
+	rows, err := db.Query(`
+		SELECT id, recipient, frequency, sections, last_sent_at 
+		FROM report_schedules
+	`)
+	if err != nil {
+		return err
+	}
+
+	var due []ReportSchedule
+	now := time.Now().UTC()
+	for rows.Next() {
+		var s ReportSchedule
+		if err := rows.Scan(&s.ID, &s.Recipient, &s.Frequency, pq.Array(&s.Sections), &s.LastSentAt); err != nil {
+			continue
+		}
+		_, end := reportPeriod(s.Frequency, now)
+		if s.LastSentAt == nil || s.LastSentAt.Before(end) {
+			due = append(due, s)
+		}
+	}
+	rows.Close()
+
+	for _, s := range due {
+		start, end := reportPeriod(s.Frequency, now)
+		body, err := renderReportEmail(s.Sections, start, end)
+		if err != nil {
+			notifyLog.Errorf("Error rendering report %d: %v", s.ID, err)
+			continue
+		}
+
+		subject := fmt.Sprintf("Support %s report: %s – %s", s.Frequency,
+			start.Format("Jan 2"), end.AddDate(0, 0, -1).Format("Jan 2, 2006"))
+		if isSuppressed(s.Recipient) {
+			notifyLog.Printf("Not sending report %d: %s is suppressed", s.ID, s.Recipient)
+			continue
+		}
+		if _, err := mailer.Send(s.Recipient, subject, body); err != nil {
+			notifyLog.Errorf("Error sending report %d to %s: %v", s.ID, s.Recipient, err)
+			continue
+		}
+
+		db.Exec("UPDATE report_schedules SET last_sent_at = CURRENT_TIMESTAMP WHERE id = $1", s.ID)
+		notifyLog.Printf("✓ Report %d sent to %s", s.ID, s.Recipient)
+	}
+
+	return nil
+}
+
+// Plain-text report body built from the reporting queries
+func renderReportEmail(sections []string, start, end time.Time) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Support report for %s to %s\n", start.Format("2006-01-02"), end.AddDate(0, 0, -1).Format("2006-01-02"))
+
+	for _, section := range sections {
+		b.WriteString("\n")
+		switch section {
+		case "volume":
+			report, err := buildVolumeReport("", nil, &start, &end)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "VOLUME\nTickets created: %d\n", report.Total)
+			writeCounts(&b, "By status", report.ByStatus)
+			writeCounts(&b, "By channel", report.ByChannel)
+
+		case "sla":
+			var total, met int
+			err := db.QueryRow(`
+				SELECT COUNT(*), COUNT(*) FILTER (WHERE first_reply.at <= t.created_at + $3 * INTERVAL '1 second')
+				FROM tickets t 
+				LEFT JOIN LATERAL (
+					SELECT MIN(m.created_at) AS at FROM messages m 
+					WHERE m.ticket_id = t.id AND m.sender_email <> t.email AND NOT m.is_description
+				) first_reply ON TRUE
+				WHERE t.created_at >= $1 AND t.created_at < $2
+			`, start, end, slaFirstResponseTarget().Seconds()).Scan(&total, &met)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "SLA COMPLIANCE\nFirst response within %s: %d of %d tickets", slaFirstResponseTarget(), met, total)
+			if total > 0 {
+				fmt.Fprintf(&b, " (%.1f%%)", float64(met)*100/float64(total))
+			}
+			b.WriteString("\n")
+
+		case "csat":
+			var count int
+			var avg *float64
+			err := db.QueryRow(`
+				SELECT COUNT(csat_score), AVG(csat_score)::float FROM tickets 
+				WHERE closed_at >= $1 AND closed_at < $2
+			`, start, end).Scan(&count, &avg)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString("CUSTOMER SATISFACTION\n")
+			if avg == nil {
+				b.WriteString("No ratings this period\n")
+			} else {
+				fmt.Fprintf(&b, "Average rating: %.2f / 5 from %d ratings\n", *avg, count)
+			}
+		}
+	}
+
+	return b.String(), nil
+}
+
+func writeCounts(b *strings.Builder, title string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(b, "%s:\n", title)
+	for _, k := range keys {
+		fmt.Fprintf(b, "  %-20s %d\n", k, counts[k])
+	}
+}
+
+// Admin: /admin/report_schedules and /admin/report_schedules/{id}
+func handleReportSchedules(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/report_schedules"), "/")
+
+	switch {
+	case idPart == "" && r.Method == "GET":
+		rows, err := db.Query(`
+			SELECT id, recipient, frequency, sections, created_by, last_sent_at, created_at 
+			FROM report_schedules ORDER BY id
+		`)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		schedules := []ReportSchedule{}
+		for rows.Next() {
+			var s ReportSchedule
+			if err := rows.Scan(&s.ID, &s.Recipient, &s.Frequency, pq.Array(&s.Sections), &s.CreatedBy, &s.LastSentAt, &s.CreatedAt); err != nil {
+				continue
+			}
+			schedules = append(schedules, s)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(schedules)
+
+	case idPart == "" && r.Method == "POST":
+		var s ReportSchedule
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if s.Recipient == "" || (s.Frequency != "weekly" && s.Frequency != "monthly") {
+			http.Error(w, "Recipient and frequency (weekly or monthly) are required", http.StatusBadRequest)
+			return
+		}
+		if len(s.Sections) == 0 {
+			s.Sections = []string{"volume", "sla", "csat"}
+		}
+		for _, section := range s.Sections {
+			if !reportSections[section] {
+				http.Error(w, "Invalid section: "+section, http.StatusBadRequest)
+				return
+			}
+		}
+
+		s.CreatedBy = user.Email
+		err := db.QueryRow(`
+			INSERT INTO report_schedules (recipient, frequency, sections, created_by) 
+			VALUES ($1, $2, $3, $4) 
+			RETURNING id, created_at
+		`, s.Recipient, s.Frequency, pq.Array(s.Sections), s.CreatedBy).Scan(&s.ID, &s.CreatedAt)
+		if err != nil {
+			http.Error(w, "Failed to create schedule", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ %s report for %s scheduled by %s", s.Frequency, s.Recipient, user.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+
+	case idPart != "" && r.Method == "DELETE":
+		id, err := strconv.Atoi(idPart)
+		if err != nil {
+			http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec("DELETE FROM report_schedules WHERE id = $1", id)
+		if err != nil {
+			http.Error(w, "Failed to delete schedule", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Schedule deleted"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Ticket volume report
+type VolumeReport struct {
+	From      *time.Time     `json:"from,omitempty"`
+	To        *time.Time     `json:"to,omitempty"`
+	Total     int            `json:"total"`
+	ByStatus  map[string]int `json:"by_status"`
+	ByChannel map[string]int `json:"by_channel"`
+}
+
+// Parse optional from/to query parameters (RFC 3339 or YYYY-MM-DD)
+func parseReportRange(r *http.Request) (from, to *time.Time, err error) {
+	parse := func(v string) (*time.Time, error) {
+		if v == "" {
+			return nil, nil
+		}
+		for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return &t, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid date %q", v)
+	}
+
+	if from, err = parse(r.URL.Query().Get("from")); err != nil {
+		return
+	}
+	to, err = parse(r.URL.Query().Get("to"))
+	return
+}
+
+// Ticket counts by status and channel for tickets matching predicate
+// (an " AND ..." fragment whose placeholders are in args)
+func buildVolumeReport(predicate string, args []interface{}, from, to *time.Time) (VolumeReport, error) {
+	where := "WHERE TRUE" + predicate
+	if from != nil {
+		args = append(args, *from)
+		where += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if to != nil {
+		args = append(args, *to)
+		where += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+
+	report := VolumeReport{From: from, To: to, ByStatus: map[string]int{}, ByChannel: map[string]int{}}
+
+	rows, err := db.Query("SELECT status, channel, COUNT(*) FROM tickets "+where+" GROUP BY status, channel", args...)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status, channel string
+		var n int
+		if err := rows.Scan(&status, &channel, &n); err != nil {
+			continue
+		}
+		report.Total += n
+		report.ByStatus[status] += n
+		report.ByChannel[channel] += n
+	}
+	return report, rows.Err()
+}
+
+// GET /reports/volume: ticket counts by status and channel
+func handleVolumeReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permReportsView, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	from, to, err := parseReportRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args []interface{}
+	predicate, args := ticketAccessPredicate(user, args)
+
+	report, err := buildVolumeReport(predicate, args, from, to)
+	if err != nil {
+		log.Printf("Error building volume report: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Time-series report metrics: the timestamp column each one counts
+var timeseriesMetrics = map[string]string{
+	"created":  "t.created_at",
+	"closed":   "t.closed_at",
+	"messages": "m.created_at",
+}
+
+var timeseriesIntervals = map[string]bool{"hour": true, "day": true, "week": true, "month": true}
+
+var timeseriesGroups = map[string]string{
+	"":         "''",
+	"category": "COALESCE(t.category, '')",
+	"channel":  "t.channel",
+	"status":   "t.status",
+	"org":      "COALESCE(t.org_id::text, '')",
+}
+
+type TimeseriesPoint struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+type TimeseriesSeries struct {
+	Group  string            `json:"group"`
+	Points []TimeseriesPoint `json:"points"`
+}
+
+type TimeseriesReport struct {
+	Metric   string             `json:"metric"`
+	Interval string             `json:"interval"`
+	GroupBy  string             `json:"group_by,omitempty"`
+	From     time.Time          `json:"from"`
+	To       time.Time          `json:"to"`
+	Series   []TimeseriesSeries `json:"series"`
+}
+
+// GET /reports/timeseries?metric=created&interval=day&group_by=category
+// Counts are bucketed server-side and every series has a point for every
+// bucket in range, zero-filled.
+func handleTimeseriesReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permReportsView, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	report := TimeseriesReport{Metric: q.Get("metric"), Interval: q.Get("interval"), GroupBy: q.Get("group_by")}
+	if report.Metric == "" {
+		report.Metric = "created"
+	}
+	if report.Interval == "" {
+		report.Interval = "day"
+	}
+
+	column, ok := timeseriesMetrics[report.Metric]
+	if !ok {
+		http.Error(w, "Invalid metric: use created, closed or messages", http.StatusBadRequest)
+		return
+	}
+	if !timeseriesIntervals[report.Interval] {
+		http.Error(w, "Invalid interval: use hour, day, week or month", http.StatusBadRequest)
+		return
+	}
+	group, ok := timeseriesGroups[report.GroupBy]
+	if !ok {
+		http.Error(w, "Invalid group_by: use category, channel, status or org", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseReportRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.To = time.Now().UTC()
+	if to != nil {
+		report.To = *to
+	}
+	report.From = report.To.AddDate(0, 0, -30)
+	if from != nil {
+		report.From = *from
+	}
+	if !report.From.Before(report.To) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	// Bucket starts covering the range
+	var buckets []time.Time
+	rows, err := db.Query(`
+		SELECT generate_series(date_trunc($1, $2::timestamp), $3::timestamp, ('1 ' || $1)::interval)
+	`, report.Interval, report.From, report.To)
+	if err != nil {
+		log.Printf("Error building timeseries buckets: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var b time.Time
+		if rows.Scan(&b) == nil {
+			buckets = append(buckets, b)
+		}
+	}
+	rows.Close()
+
+	if len(buckets) > 2000 {
+		http.Error(w, "Range too large for interval", http.StatusBadRequest)
+		return
+	}
+
+	args := []interface{}{report.Interval, report.From, report.To}
+	predicate, args := ticketAccessPredicate(user, args)
+
+	source := "tickets t"
+	if report.Metric == "messages" {
+		source = "messages m JOIN tickets t ON t.id = m.ticket_id"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT date_trunc($1, %[1]s) AS bucket, %[2]s AS grp, COUNT(*) 
+		FROM %[3]s 
+		WHERE %[1]s >= $2 AND %[1]s < $3%[4]s 
+		GROUP BY bucket, grp
+	`, column, group, source, predicate)
+
+	rows, err = db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error building timeseries report: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	counts := map[string]map[time.Time]int{}
+	var groups []string
+	for rows.Next() {
+		var bucket time.Time
+		var grp string
+		var n int
+		if err := rows.Scan(&bucket, &grp, &n); err != nil {
+			continue
+		}
+		if counts[grp] == nil {
+			counts[grp] = map[time.Time]int{}
+			groups = append(groups, grp)
+		}
+		counts[grp][bucket.UTC()] = n
+	}
+	if len(groups) == 0 && report.GroupBy == "" {
+		groups = []string{""}
+	}
+	sort.Strings(groups)
+
+	report.Series = []TimeseriesSeries{}
+	for _, grp := range groups {
+		series := TimeseriesSeries{Group: grp, Points: make([]TimeseriesPoint, 0, len(buckets))}
+		for _, b := range buckets {
+			series.Points = append(series.Points, TimeseriesPoint{Start: b, Count: counts[grp][b.UTC()]})
+		}
+		report.Series = append(report.Series, series)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+type AgentReportRow struct {
+	Email                   string   `json:"email"`
+	OpenTickets             int      `json:"open_tickets"`
+	ClosedThisWeek          int      `json:"closed_this_week"`
+	AvgFirstResponseSeconds *float64 `json:"avg_first_response_seconds"`
+	CSATAverage             *float64 `json:"csat_average"`
+	MinutesLoggedThisWeek   int      `json:"minutes_logged_this_week"`
+}
+
+// GET /reports/agents: workload and performance per agent
+func handleAgentReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authorize(currentUser(r), permReportsView, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT u.email,
+			(SELECT COUNT(*) FROM tickets t 
+				WHERE t.assigned_to = u.email AND t.status <> 'closed'),
+			(SELECT COUNT(*) FROM tickets t 
+				WHERE t.closed_by = u.email AND t.closed_at >= date_trunc('week', CURRENT_TIMESTAMP)),
+			(SELECT AVG(EXTRACT(EPOCH FROM first_reply.at - t.created_at)) 
+				FROM tickets t 
+				JOIN LATERAL (
+					SELECT MIN(m.created_at) AS at FROM messages m 
+					WHERE m.ticket_id = t.id AND m.sender_email = u.email AND NOT m.is_description
+				) first_reply ON first_reply.at IS NOT NULL),
+			(SELECT AVG(t.csat_score)::float FROM tickets t 
+				WHERE COALESCE(t.assigned_to, t.closed_by) = u.email AND t.csat_score IS NOT NULL),
+			(SELECT COALESCE(SUM(e.minutes), 0) FROM time_entries e 
+				WHERE e.agent_email = u.email AND e.created_at >= date_trunc('week', CURRENT_TIMESTAMP))
+		FROM users u 
+		JOIN roles ro ON ro.name = u.user_type 
+		WHERE $1 = ANY(ro.permissions) 
+		ORDER BY u.email
+	`, permTicketsReplyAll)
+	if err != nil {
+		log.Printf("Error building agent report: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	report := []AgentReportRow{}
+	for rows.Next() {
+		var a AgentReportRow
+		if err := rows.Scan(&a.Email, &a.OpenTickets, &a.ClosedThisWeek, &a.AvgFirstResponseSeconds,
+			&a.CSATAverage, &a.MinutesLoggedThisWeek); err != nil {
+			log.Printf("Error scanning agent report: %v", err)
+			continue
+		}
+		report = append(report, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Tickets belong to the requester's account (requester_id). The email is
+// kept alongside for display and for mail, and decides ownership only for
+// tickets filed before their requester had an account.
+
+// Add the requester column to tickets and link existing tickets to their
+// requesters' accounts
+func migrateTicketRequester() {
+	_, err := db.Exec(`
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS requester_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+		CREATE INDEX IF NOT EXISTS tickets_requester_idx ON tickets (requester_id);
+		UPDATE tickets t SET requester_id = u.id FROM users u
+		WHERE t.requester_id IS NULL AND u.email = t.email
+	`)
+	if err != nil {
+		log.Fatal("Failed to migrate ticket requesters:", err)
+	}
+}
+
+// Whether the user is the ticket's requester
+func ownsTicket(user User, ticket Ticket) bool {
+	if ticket.RequesterID != 0 {
+		return ticket.RequesterID == user.ID
+	}
+	return ticket.Email == user.Email
+}
+
+// POST /tickets/{id}/requester: move the ticket to another requester,
+// e.g. one filed from the wrong account. The new requester sees it and
+// gets its notifications from then on; the old one loses access.
+func changeRequester(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsAssign, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if strings.EqualFold(email, ticket.Email) {
+		http.Error(w, "Ticket already belongs to "+ticket.Email, http.StatusBadRequest)
+		return
+	}
+
+	// Only someone who can see their own tickets can be a requester
+	role, err := store.Users().RoleOf(email)
+	if err != nil {
+		http.Error(w, "No user with that email", http.StatusBadRequest)
+		return
+	}
+	perms := rolePermissions(role)
+	if !perms[permTicketsReadOwn] && !perms[permTicketsReadOrg] && !perms[permTicketsReadAll] {
+		http.Error(w, "That user can't have tickets", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.Tickets().SetRequester(ticketID, email); err != nil {
+		log.Printf("Error changing requester of ticket #%d: %v", ticketID, err)
+		http.Error(w, "Failed to change requester", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Ticket #%d moved from %s to %s by %s", ticketID, ticket.Email, email, user.Email)
+	publish(Event{Type: eventTicketRequesterChanged, Actor: user.Email, TicketID: ticketID,
+		Data: map[string]interface{}{"from": ticket.Email, "to": email}})
+
+	ticket.Email = email
+	body := fmt.Sprintf("Ticket \"%s\" was moved to your account by our support team. You'll get updates about it from now on.", ticket.Subject)
+	sendNotification(email, fmt.Sprintf("[%s] A ticket was moved to your account", ticket.Reference),
+		appendSignature(body, user.Email, ticket)+"\n", 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Requester changed", "email": email})
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// A canned reply staff can send on any ticket. Besides the signature
+// placeholders, the body uses the template's own variables, which have
+// to be filled in with values of the right type to send it.
+type ResponseTemplate struct {
+	ID        int                `json:"id"`
+	Name      string             `json:"name"`
+	Body      string             `json:"body"`
+	Variables []TemplateVariable `json:"variables"`
+	UpdatedBy string             `json:"updated_by,omitempty"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+type TemplateVariable struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Label string `json:"label,omitempty"`
+}
+
+var templateVariableTypes = []string{"text", "date", "link", "number"}
+
+var templateVariableName = regexp.MustCompile(`^[a-z_]{1,40}$`)
+
+const (
+	maxTemplateName      = 100
+	maxTemplateBody      = 10000
+	maxTemplateVariables = 20
+	maxTemplateValue     = 500
+)
+
+// Create response templates table
+func createResponseTemplatesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS response_templates (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(100) UNIQUE NOT NULL,
+			body TEXT NOT NULL,
+			variables JSONB NOT NULL DEFAULT '[]',
+			updated_by VARCHAR(255) NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create response_templates table:", err)
+	}
+}
+
+func (rt *ResponseTemplate) validate() error {
+	rt.Name = normalizeText(strings.TrimSpace(rt.Name))
+	rt.Body = normalizeText(rt.Body)
+	switch {
+	case rt.Name == "" || utf8.RuneCountInString(rt.Name) > maxTemplateName:
+		return newServiceError(errInvalid, "name must be 1-100 characters")
+	case strings.TrimSpace(rt.Body) == "":
+		return newServiceError(errInvalid, "Body is required")
+	case len(rt.Body) > maxTemplateBody:
+		return newServiceError(errInvalid, "Body is too long")
+	case len(rt.Variables) > maxTemplateVariables:
+		return newServiceError(errInvalid, "Too many variables")
+	}
+
+	declared := map[string]bool{}
+	for _, v := range rt.Variables {
+		switch {
+		case !templateVariableName.MatchString(v.Name):
+			return newServiceError(errInvalid, "Variable names are lowercase letters and underscores: "+v.Name)
+		case signaturePlaceholders[v.Name] != nil:
+			return newServiceError(errInvalid, "{"+v.Name+"} is filled in automatically and can't be a variable")
+		case declared[v.Name]:
+			return newServiceError(errInvalid, "Variable "+v.Name+" is declared twice")
+		case !containsString(templateVariableTypes, v.Type):
+			return newServiceError(errInvalid, "Variable "+v.Name+" must be text, date, link or number")
+		}
+		declared[v.Name] = true
+	}
+
+	used := map[string]bool{}
+	for _, m := range placeholderPattern.FindAllStringSubmatch(rt.Body, -1) {
+		if !declared[m[1]] && signaturePlaceholders[m[1]] == nil {
+			return newServiceError(errInvalid, "Unknown placeholder {"+m[1]+"}")
+		}
+		used[m[1]] = true
+	}
+	for _, v := range rt.Variables {
+		if !used[v.Name] {
+			return newServiceError(errInvalid, "Variable "+v.Name+" isn't used in the body")
+		}
+	}
+	return nil
+}
+
+// Check a value against its variable's type and format it for the reply
+func (v TemplateVariable) format(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", newServiceError(errInvalid, "Missing value for "+v.Name)
+	}
+	if len(value) > maxTemplateValue {
+		return "", newServiceError(errInvalid, "Value for "+v.Name+" is too long")
+	}
+	// Values are filled in before the signature placeholders, so they
+	// mustn't bring any of their own
+	if placeholderPattern.MatchString(value) {
+		return "", newServiceError(errInvalid, "Value for "+v.Name+" can't contain placeholders")
+	}
+
+	switch v.Type {
+	case "date":
+		d, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return "", newServiceError(errInvalid, v.Name+" must be a date (YYYY-MM-DD)")
+		}
+		return d.Format("2 January 2006"), nil
+	case "link":
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", newServiceError(errInvalid, v.Name+" must be an http(s) link")
+		}
+		return u.String(), nil
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "", newServiceError(errInvalid, v.Name+" must be a number")
+		}
+	}
+	return value, nil
+}
+
+// Body with every variable filled in. All variables are required and
+// values for undeclared ones are refused, so a reply never goes out with
+// a gap or a stray placeholder.
+func (rt ResponseTemplate) fill(values map[string]string) (string, error) {
+	var missing []string
+	for _, v := range rt.Variables {
+		if strings.TrimSpace(values[v.Name]) == "" {
+			missing = append(missing, v.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", newServiceError(errInvalid, "Missing values for "+strings.Join(missing, ", "))
+	}
+
+	formatted := map[string]string{}
+	for _, v := range rt.Variables {
+		value, err := v.format(values[v.Name])
+		if err != nil {
+			return "", err
+		}
+		formatted[v.Name] = value
+	}
+	var unknown []string
+	for name := range values {
+		if _, ok := formatted[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return "", newServiceError(errInvalid, "Template has no variables named "+strings.Join(unknown, ", "))
+	}
+
+	return placeholderPattern.ReplaceAllStringFunc(rt.Body, func(p string) string {
+		if value, ok := formatted[p[1:len(p)-1]]; ok {
+			return value
+		}
+		return p
+	}), nil
+}
+
+const responseTemplateColumns = "id, name, body, variables, updated_by, updated_at"
+
+func scanResponseTemplate(row interface{ Scan(...interface{}) error }) (ResponseTemplate, error) {
+	var rt ResponseTemplate
+	var variables []byte
+	if err := row.Scan(&rt.ID, &rt.Name, &rt.Body, &variables, &rt.UpdatedBy, &rt.UpdatedAt); err != nil {
+		return rt, err
+	}
+	err := json.Unmarshal(variables, &rt.Variables)
+	return rt, err
+}
+
+// Reply text from a template, for staff replying or previewing
+func templateReply(user User, templateID int, values map[string]string) (string, error) {
+	if !fullFeatured() {
+		return "", newServiceError(errUnavailable, "Response templates require PostgreSQL")
+	}
+	if !canSeeInternal(user) {
+		return "", errPermissionDenied
+	}
+	rt, err := scanResponseTemplate(db.QueryRow("SELECT "+responseTemplateColumns+" FROM response_templates WHERE id = $1", templateID))
+	if err != nil {
+		return "", newServiceError(errNotFound, "Template not found")
+	}
+	return rt.fill(values)
+}
+
+// GET /response_templates: templates for agents to pick from
+func handleResponseTemplateList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	listResponseTemplates(w)
+}
+
+func listResponseTemplates(w http.ResponseWriter) {
+	rows, err := db.Query("SELECT " + responseTemplateColumns + " FROM response_templates ORDER BY name")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	templates := []ResponseTemplate{}
+	for rows.Next() {
+		rt, err := scanResponseTemplate(rows)
+		if err != nil {
+			continue
+		}
+		templates = append(templates, rt)
+	}
+	sortCollated(templates, func(i int) string { return templates[i].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// GET/POST /admin/response_templates, GET/PUT/DELETE
+// /admin/response_templates/{id}
+func handleResponseTemplates(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/response_templates"), "/")
+
+	if idPart == "" {
+		switch r.Method {
+		case "GET":
+			listResponseTemplates(w)
+		case "POST":
+			saveResponseTemplate(w, r, user, 0)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(idPart)
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		rt, err := scanResponseTemplate(db.QueryRow("SELECT "+responseTemplateColumns+" FROM response_templates WHERE id = $1", id))
+		if err != nil {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rt)
+
+	case "PUT":
+		saveResponseTemplate(w, r, user, id)
+
+	case "DELETE":
+		res, err := db.Exec("DELETE FROM response_templates WHERE id = $1", id)
+		if err != nil {
+			http.Error(w, "Failed to delete template", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("✓ Response template #%d deleted by %s", id, user.Email)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Create (id 0) or update a template
+func saveResponseTemplate(w http.ResponseWriter, r *http.Request, user User, id int) {
+	var rt ResponseTemplate
+	if err := json.NewDecoder(r.Body).Decode(&rt); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if rt.Variables == nil {
+		rt.Variables = []TemplateVariable{}
+	}
+	if err := rt.validate(); err != nil {
+		writeServiceError(w, err, "Invalid template")
+		return
+	}
+	variables, _ := json.Marshal(rt.Variables)
+
+	var saved ResponseTemplate
+	var err error
+	if id == 0 {
+		saved, err = scanResponseTemplate(db.QueryRow(`
+			INSERT INTO response_templates (name, body, variables, updated_by) VALUES ($1, $2, $3, $4)
+			RETURNING `+responseTemplateColumns, rt.Name, rt.Body, string(variables), user.Email))
+	} else {
+		saved, err = scanResponseTemplate(db.QueryRow(`
+			UPDATE response_templates SET name = $2, body = $3, variables = $4, updated_by = $5, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+			RETURNING `+responseTemplateColumns, id, rt.Name, rt.Body, string(variables), user.Email))
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "A template with this name already exists", http.StatusConflict)
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to save template", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Response template %q saved by %s", saved.Name, user.Email)
+	w.Header().Set("Content-Type", "application/json")
+	if id == 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(saved)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Every permission a role can grant
+var knownPermissions = []string{
+	permTicketsCreate,
+	permTicketsReadAll, permTicketsReadOrg, permTicketsReadOwn,
+	permTicketsReplyAll, permTicketsReplyOrg, permTicketsReplyOwn,
+	permTicketsCloseAll, permTicketsCloseOwn,
+	permTicketsAssign,
+	permUsersManage,
+	permReportsView,
+}
+
+var roleName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// A role and what it grants
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	Users       int      `json:"users"`
+	BuiltIn     bool     `json:"built_in"`
+}
+
+// Drop cached role permissions so a change applies to the next request
+func invalidateRoleCache() {
+	roleCache.Lock()
+	roleCache.perms = nil
+	roleCache.Unlock()
+}
+
+// Whether some active user can still manage users and roles. Checked
+// before committing a change, so admins can't lock everyone out.
+func usersManageable(tx *sql.Tx) (bool, error) {
+	var ok bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM users u JOIN roles ro ON ro.name = u.user_type
+			WHERE u.active AND $1 = ANY(ro.permissions)
+		)
+	`, permUsersManage).Scan(&ok)
+	return ok, err
+}
+
+// Admin: GET /admin/roles lists roles; PUT /admin/roles/{name} creates
+// or replaces one; DELETE /admin/roles/{name} removes one no user has
+func handleRoles(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/roles"), "/")
+
+	switch {
+	case r.Method == "GET" && name == "":
+		listRoles(w)
+	case r.Method == "PUT" && name != "":
+		putRole(w, r, name)
+	case r.Method == "DELETE" && name != "":
+		deleteRole(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listRoles(w http.ResponseWriter) {
+	rows, err := db.Query(`
+		SELECT ro.name, ro.permissions, COUNT(u.id)
+		FROM roles ro LEFT JOIN users u ON u.user_type = ro.name AND u.active
+		GROUP BY ro.name, ro.permissions
+		ORDER BY ro.name
+	`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name, pq.Array(&role.Permissions), &role.Users); err != nil {
+			continue
+		}
+		sort.Strings(role.Permissions)
+		_, role.BuiltIn = defaultRoles[role.Name]
+		roles = append(roles, role)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+func putRole(w http.ResponseWriter, r *http.Request, name string) {
+	if !roleName.MatchString(name) {
+		http.Error(w, "Role names are lowercase letters, digits and _", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	perms := []string{}
+	seen := map[string]bool{}
+	for _, p := range req.Permissions {
+		if !containsString(knownPermissions, p) {
+			http.Error(w, "Unknown permission: "+p, http.StatusBadRequest)
+			return
+		}
+		if !seen[p] {
+			seen[p] = true
+			perms = append(perms, p)
+		}
+	}
+	sort.Strings(perms)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var created bool
+	err = tx.QueryRow(`
+		INSERT INTO roles (name, permissions) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET permissions = EXCLUDED.permissions
+		RETURNING xmax = 0
+	`, name, pq.Array(perms)).Scan(&created)
+	if err != nil {
+		http.Error(w, "Failed to save role", http.StatusInternalServerError)
+		return
+	}
+	if ok, err := usersManageable(tx); err != nil || !ok {
+		http.Error(w, "No active user would be left with "+permUsersManage, http.StatusConflict)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to save role", http.StatusInternalServerError)
+		return
+	}
+	invalidateRoleCache()
+
+	actor := currentUser(r).Email
+	log.Printf("✓ Role %s saved by %s: %s", name, actor, strings.Join(perms, ", "))
+	recordAudit(actor, "role.updated", 0, map[string]interface{}{"role": name, "permissions": perms, "created": created})
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	_, builtIn := defaultRoles[name]
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Role{Name: name, Permissions: perms, BuiltIn: builtIn})
+}
+
+func deleteRole(w http.ResponseWriter, r *http.Request, name string) {
+	// Sign-in and provisioning fall back to these
+	if _, builtIn := defaultRoles[name]; builtIn {
+		http.Error(w, "Built-in roles can be edited but not deleted", http.StatusConflict)
+		return
+	}
+
+	var users int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE user_type = $1", name).Scan(&users); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if users > 0 {
+		http.Error(w, "Role is still assigned to users", http.StatusConflict)
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM roles WHERE name = $1", name)
+	if err != nil {
+		http.Error(w, "Failed to delete role", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+	invalidateRoleCache()
+
+	actor := currentUser(r).Email
+	log.Printf("✓ Role %s deleted by %s", name, actor)
+	recordAudit(actor, "role.deleted", 0, map[string]interface{}{"role": name})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// How a route identifies its caller
+const (
+	accessPublic  = "public"  // anyone
+	accessSession = "session" // bearer session or proxy identity, via authenticate
+	accessHandler = "handler" // the handler checks its own token or signature
+)
+
+// Features a route depends on
+const (
+	requiresPostgres    = "postgres"
+	requiresAttachments = "attachments"
+)
+
+// Route and its security metadata. The router builds each handler's
+// middleware from these fields, so the policy dump is what is enforced
+// rather than a description that can drift from it.
+type route struct {
+	Pattern    string   `json:"pattern"`
+	Methods    []string `json:"methods"`
+	Access     string   `json:"access"`
+	Permission string   `json:"permission,omitempty"`
+	Scope      string   `json:"scope,omitempty"`
+	CSRF       bool     `json:"csrf"`
+	CORS       bool     `json:"cors"`
+	Requires   string   `json:"requires,omitempty"`
+	Enabled    bool     `json:"enabled"`
+
+	handler http.HandlerFunc
+	// Served instead when Requires isn't met
+	fallback http.HandlerFunc
+}
+
+// Every HTTP route. Permission is checked by the router before the
+// handler runs; Scope describes the finer-grained checks the handler
+// makes itself (per ticket, own records, signatures).
+func apiRoutes() []route {
+	get := []string{"GET"}
+	post := []string{"POST"}
+
+	return []route{
+		{Pattern: "/health", Methods: get, Access: accessPublic, handler: handleHealth},
+		{Pattern: "/login", Methods: post, Access: accessPublic, Scope: "password", CORS: true, handler: handleLogin},
+		{Pattern: "/register", Methods: post, Access: accessPublic, Scope: "ALLOW_REGISTRATION", CORS: true, Requires: requiresPostgres, handler: handleRegister},
+		{Pattern: "/verify", Methods: get, Access: accessHandler, Scope: "registration token", Requires: requiresPostgres, handler: handleVerify},
+		{Pattern: "/login/proxy", Methods: post, Access: accessPublic, Scope: "signed proxy identity header", CORS: true, handler: handleProxyLogin},
+		{Pattern: "/csrf", Methods: get, Access: accessPublic, CORS: true, handler: handleCSRF},
+		{Pattern: "/capabilities", Methods: get, Access: accessPublic, CORS: true, handler: handleCapabilities},
+		{Pattern: "/logout", Methods: post, Access: accessSession, Scope: "own session", CSRF: true, CORS: true, handler: handleLogout},
+		{Pattern: "/me/sessions", Methods: []string{"GET", "DELETE"}, Access: accessSession, Scope: "own sessions", CSRF: true, CORS: true, handler: handleSessions},
+		{Pattern: "/me/sessions/", Methods: []string{"DELETE"}, Access: accessSession, Scope: "own sessions", CSRF: true, CORS: true, handler: handleSessions},
+		{Pattern: "/token/refresh", Methods: post, Access: accessHandler, Scope: "session token", CORS: true, handler: handleTokenRefresh},
+		{Pattern: "/me/password", Methods: post, Access: accessSession, Scope: "own password", CSRF: true, CORS: true, handler: handleChangePassword},
+		{Pattern: "/me/email", Methods: []string{"POST", "DELETE"}, Access: accessSession, Scope: "own email", CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleEmailChange},
+		{Pattern: "/me/security_events", Methods: get, Access: accessSession, Scope: "own events", CORS: true, handler: handleSecurityEvents},
+		{Pattern: "/hooks/", Methods: post, Access: accessHandler, Scope: "per-provider signature", handler: handleHook},
+		{Pattern: "/upload", Methods: post, Access: accessSession, Scope: "any user", CSRF: true, CORS: true, Requires: requiresAttachments,
+			handler: handleUpload, fallback: attachmentsDisabled},
+		{Pattern: "/tickets", Methods: []string{"GET", "POST"}, Access: accessSession, Scope: "tickets.create to file; list filtered by tickets.read_*", CSRF: true, CORS: true, handler: handleTickets},
+		{Pattern: "/ws", Methods: get, Access: accessSession, Scope: "per-ticket tickets.read on subscribe; same-origin or CORS_CREDENTIAL_ORIGINS", handler: handleWebSocket},
+		{Pattern: "/search", Methods: get, Access: accessSession, Scope: "results filtered by tickets.read_*", CORS: true, Requires: requiresPostgres, handler: handleSearch},
+		{Pattern: "/preview", Methods: post, Access: accessSession, Scope: "tickets.reply on the ticket, if given", CSRF: true, CORS: true, handler: handlePreview},
+		{Pattern: "/tickets/", Methods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"}, Access: accessSession, Scope: "per-ticket tickets.read/reply/close", CSRF: true, CORS: true, handler: handleTicketActions},
+
+		{Pattern: "/assets", Methods: []string{"GET", "POST"}, Access: accessSession, Scope: "staff manage; clients list their own", CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleAssets},
+		{Pattern: "/assets/", Methods: []string{"GET", "PUT", "DELETE"}, Access: accessSession, Scope: "staff manage; owners view theirs", CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleAssets},
+
+		{Pattern: "/response_templates", Methods: get, Access: accessSession, Permission: permTicketsReplyAll, CORS: true, Requires: requiresPostgres, handler: handleResponseTemplateList},
+		{Pattern: "/changes", Methods: get, Access: accessSession, Permission: permTicketsReplyAll, CORS: true, Requires: requiresPostgres, handler: handleChangeCalendar},
+
+		{Pattern: "/admin/organizations", Methods: []string{"GET", "POST"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleOrganizations},
+		{Pattern: "/admin/organizations/", Methods: []string{"GET", "PUT", "DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleOrganizationQuotas},
+		{Pattern: "/admin/contracts", Methods: []string{"GET", "POST"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleContracts},
+		{Pattern: "/admin/contracts/", Methods: []string{"GET", "PUT", "DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleContracts},
+		{Pattern: "/admin/users/", Methods: []string{"GET", "PUT"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleAdminUsers},
+		{Pattern: "/admin/roles", Methods: get, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleRoles},
+		{Pattern: "/admin/roles/", Methods: []string{"PUT", "DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleRoles},
+		{Pattern: "/admin/custom_fields", Methods: []string{"GET", "POST"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleCustomFields},
+		{Pattern: "/admin/tags", Methods: []string{"GET", "POST"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleTags},
+		{Pattern: "/admin/report_schedules", Methods: []string{"GET", "POST"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleReportSchedules},
+		{Pattern: "/admin/report_schedules/", Methods: []string{"DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleReportSchedules},
+		{Pattern: "/admin/announcements", Methods: []string{"GET", "POST"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleAnnouncements},
+		{Pattern: "/admin/announcements/", Methods: []string{"PUT", "DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleAnnouncements},
+		{Pattern: "/admin/suppressions", Methods: get, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleSuppressions},
+		{Pattern: "/admin/suppressions/", Methods: []string{"DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleSuppressions},
+		{Pattern: "/admin/import", Methods: post, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleImport},
+		{Pattern: "/admin/import/", Methods: get, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleImport},
+		{Pattern: "/admin/billing_links", Methods: get, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleBillingLinks},
+		{Pattern: "/admin/billing_links/", Methods: []string{"PUT", "DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleBillingLinks},
+		{Pattern: "/admin/quarantine", Methods: get, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleQuarantine},
+		{Pattern: "/admin/quarantine/", Methods: []string{"POST", "DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleQuarantine},
+		{Pattern: "/admin/auto_responses", Methods: get, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleAutoResponses},
+		{Pattern: "/admin/auto_responses/", Methods: []string{"PUT", "DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleAutoResponses},
+		{Pattern: "/admin/response_templates", Methods: []string{"GET", "POST"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleResponseTemplates},
+		{Pattern: "/admin/response_templates/", Methods: []string{"GET", "PUT", "DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleResponseTemplates},
+		{Pattern: "/admin/response_times", Methods: get, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleResponseTimes},
+		{Pattern: "/admin/response_times/", Methods: []string{"PUT", "DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleResponseTimes},
+		{Pattern: "/admin/shifts", Methods: []string{"GET", "POST"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleShifts},
+		{Pattern: "/admin/shifts/", Methods: []string{"DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleShifts},
+		{Pattern: "/admin/on_call", Methods: []string{"GET", "PUT", "DELETE"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleOnCall},
+		{Pattern: "/admin/security/logins", Methods: get, Access: accessSession, Permission: permUsersManage, CORS: true, Requires: requiresPostgres, handler: handleLoginAttempts},
+		{Pattern: "/admin/usage", Methods: get, Access: accessSession, Permission: permUsersManage, CORS: true, Requires: requiresPostgres, handler: handleUsage},
+		{Pattern: "/admin/jobs", Methods: get, Access: accessSession, Permission: permUsersManage, CORS: true, Requires: requiresPostgres, handler: handleFailedJobs},
+		{Pattern: "/admin/jobs/", Methods: post, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleFailedJobs},
+		{Pattern: "/admin/log_levels", Methods: []string{"GET", "PUT"}, Access: accessSession, Permission: permUsersManage, CSRF: true, CORS: true, handler: handleLogLevels},
+		{Pattern: "/admin/policy", Methods: get, Access: accessSession, Permission: permUsersManage, CORS: true, handler: handlePolicy},
+		{Pattern: "/reports/volume", Methods: get, Access: accessSession, Permission: permReportsView, CORS: true, Requires: requiresPostgres, handler: handleVolumeReport},
+		{Pattern: "/reports/timeseries", Methods: get, Access: accessSession, Permission: permReportsView, CORS: true, Requires: requiresPostgres, handler: handleTimeseriesReport},
+		{Pattern: "/reports/agents", Methods: get, Access: accessSession, Permission: permReportsView, CORS: true, Requires: requiresPostgres, handler: handleAgentReport},
+		{Pattern: "/reports/tickets", Methods: get, Access: accessSession, Permission: permReportsView, Scope: "rows filtered by tickets.read_*", CORS: true, Requires: requiresPostgres, handler: handleTicketExport},
+		{Pattern: "/reports/billing", Methods: get, Access: accessSession, Permission: permReportsView, CORS: true, Requires: requiresPostgres, handler: handleBillingReport},
+		{Pattern: "/reports/wallboard", Methods: get, Access: accessHandler, Scope: "WALLBOARD_API_KEY or session with reports.view", CORS: true, Requires: requiresPostgres, handler: handleWallboard},
+		{Pattern: "/me/calendar_token", Methods: post, Access: accessSession, Permission: permTicketsReplyAll, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleCalendarToken},
+		{Pattern: "/me/calendar.ics", Methods: get, Access: accessHandler, Scope: "calendar feed token", Requires: requiresPostgres, handler: handleCalendarFeed},
+		{Pattern: "/scim/v2/", Methods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"}, Access: accessHandler, Scope: "SCIM_TOKEN bearer token", Requires: requiresPostgres, handler: handleSCIM},
+		{Pattern: "/email_change/", Methods: get, Access: accessHandler, Scope: "email change confirmation token", Requires: requiresPostgres, handler: handleEmailChangeConfirm},
+		{Pattern: "/shared/", Methods: get, Access: accessHandler, Scope: "share link token", Requires: requiresPostgres, handler: handleSharedTicket},
+		{Pattern: "/announcements", Methods: get, Access: accessPublic, CORS: true, Requires: requiresPostgres, handler: handlePublicAnnouncements},
+		{Pattern: "/announcements.atom", Methods: get, Access: accessPublic, Requires: requiresPostgres, handler: handleAnnouncementsFeed},
+		{Pattern: "/webhooks/ses", Methods: post, Access: accessHandler, Scope: "SES_WEBHOOK_TOKEN and SNS signature", Requires: requiresPostgres, handler: handleSESWebhook},
+		{Pattern: "/me/saved_searches", Methods: []string{"GET", "POST"}, Access: accessSession, Permission: permTicketsReplyAll, Scope: "own saved searches", CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleSavedSearches},
+		{Pattern: "/me/saved_searches/", Methods: []string{"PUT", "DELETE"}, Access: accessSession, Permission: permTicketsReplyAll, Scope: "own saved searches", CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleSavedSearches},
+		{Pattern: "/me/signature", Methods: []string{"GET", "PUT", "DELETE"}, Access: accessSession, Permission: permTicketsReplyAll, CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleSignature},
+		{Pattern: "/me/notifications", Methods: get, Access: accessSession, Scope: "own notifications", CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleNotifications},
+		{Pattern: "/me/notifications/", Methods: post, Access: accessSession, Scope: "own notifications", CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleNotifications},
+		{Pattern: "/me/notification_preferences", Methods: []string{"GET", "PUT", "DELETE"}, Access: accessSession, Scope: "own preferences", CSRF: true, CORS: true, Requires: requiresPostgres, handler: handleNotificationPreferences},
+	}
+}
+
+// Whether this deployment has what the route needs
+func (rt route) available() bool {
+	switch rt.Requires {
+	case requiresPostgres:
+		return fullFeatured()
+	case requiresAttachments:
+		return attachmentsEnabled
+	}
+	return true
+}
+
+// Handler with the middleware the route's metadata calls for
+func (rt route) build() http.HandlerFunc {
+	h := rt.handler
+	if rt.Permission != "" {
+		h = requirePermission(rt.Permission, h)
+	}
+	if rt.Access == accessSession {
+		// Metering needs the caller, so it runs inside authenticate
+		if fullFeatured() {
+			h = meterAPICalls(h)
+		}
+		h = authenticate(h)
+	}
+	if rt.CSRF {
+		h = csrfProtect(h)
+	}
+	h = allowMethods(rt.Methods, h)
+	if faultInjectionEnabled() {
+		h = injectFaults(h)
+	}
+	if rt.CORS {
+		h = cors(h)
+	}
+	return recoverPanics(logRequests(h))
+}
+
+// Reject methods the route doesn't declare, before anything else is
+// checked; HEAD goes wherever GET does
+func allowMethods(methods []string, next http.HandlerFunc) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		method := r.Method
+		if method == "HEAD" {
+			method = "GET"
+		}
+		if !containsString(methods, method) {
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Reject callers without perm before the handler runs
+func requirePermission(perm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(currentUser(r), perm, nil) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Register every available route on the default mux
+func registerRoutes() {
+	for _, rt := range apiRoutes() {
+		switch {
+		case rt.available():
+			http.HandleFunc(rt.Pattern, rt.build())
+		case rt.fallback != nil:
+			http.HandleFunc(rt.Pattern, recoverPanics(cors(rt.fallback)))
+		}
+	}
+}
+
+// Route table with availability filled in, sorted by pattern
+func routePolicy() []route {
+	routes := apiRoutes()
+	for i := range routes {
+		routes[i].Enabled = routes[i].available()
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Pattern < routes[j].Pattern })
+	return routes
+}
+
+// Problems with the route table a security review would flag
+func lintRoutes(routes []route) []string {
+	known := map[string]bool{}
+	for _, perms := range defaultRoles {
+		for _, p := range perms {
+			known[p] = true
+		}
+	}
+
+	var findings []string
+	seen := map[string]bool{}
+	for _, rt := range routes {
+		if seen[rt.Pattern] {
+			findings = append(findings, fmt.Sprintf("%s: registered twice", rt.Pattern))
+		}
+		seen[rt.Pattern] = true
+
+		switch rt.Access {
+		case accessPublic:
+			if rt.Permission != "" {
+				findings = append(findings, fmt.Sprintf("%s: public route declares permission %s", rt.Pattern, rt.Permission))
+			}
+			if strings.HasPrefix(rt.Pattern, "/admin/") || strings.HasPrefix(rt.Pattern, "/me/") {
+				findings = append(findings, fmt.Sprintf("%s: public route under a protected prefix", rt.Pattern))
+			}
+		case accessSession:
+			if rt.Permission == "" && rt.Scope == "" {
+				findings = append(findings, fmt.Sprintf("%s: open to any signed-in user; set a permission or document the scope", rt.Pattern))
+			}
+			if !rt.CSRF {
+				for _, m := range rt.Methods {
+					if m != "GET" && m != "HEAD" {
+						findings = append(findings, fmt.Sprintf("%s: %s without CSRF protection", rt.Pattern, m))
+					}
+				}
+			}
+		case accessHandler:
+			if rt.Scope == "" {
+				findings = append(findings, fmt.Sprintf("%s: handler-checked route doesn't say what it checks", rt.Pattern))
+			}
+		default:
+			findings = append(findings, fmt.Sprintf("%s: unknown access %q", rt.Pattern, rt.Access))
+		}
+
+		if rt.Permission != "" && !known[rt.Permission] {
+			findings = append(findings, fmt.Sprintf("%s: permission %s is not granted by any built-in role", rt.Pattern, rt.Permission))
+		}
+		if strings.HasPrefix(rt.Pattern, "/admin/") && rt.Permission == "" {
+			findings = append(findings, fmt.Sprintf("%s: admin route without a router-enforced permission", rt.Pattern))
+		}
+		if len(rt.Methods) == 0 {
+			findings = append(findings, fmt.Sprintf("%s: no methods listed", rt.Pattern))
+		}
+	}
+	return findings
+}
+
+// GET /admin/policy
+func handlePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	routes := routePolicy()
+	findings := lintRoutes(routes)
+	if findings == nil {
+		findings = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"routes":   routes,
+		"findings": findings,
+	})
+}
+
+// `sts policy` prints the route table; `sts policy lint` exits non-zero
+// if the table has findings
+func runPolicy(args []string) error {
+	routes := routePolicy()
+
+	if len(args) > 0 && args[0] == "lint" {
+		findings := lintRoutes(routes)
+		for _, f := range findings {
+			fmt.Println(f)
+		}
+		if len(findings) > 0 {
+			return fmt.Errorf("%d policy findings", len(findings))
+		}
+		fmt.Printf("%d routes, no findings\n", len(routes))
+		return nil
+	}
+	if len(args) > 0 {
+		return errors.New("usage: sts policy [lint]")
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATTERN\tMETHODS\tACCESS\tPERMISSION\tSCOPE\tCSRF\tENABLED")
+	for _, rt := range routes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%t\t%t\n", rt.Pattern, strings.Join(rt.Methods, ","),
+			rt.Access, dashIfEmpty(rt.Permission), dashIfEmpty(rt.Scope), rt.CSRF, rt.Enabled)
+	}
+	return tw.Flush()
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var allMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// Every route's generated middleware enforces what its metadata declares:
+// methods, authentication, CSRF and permission
+func TestRouteMiddleware(t *testing.T) {
+	tokens := map[string]string{
+		"client": testSession(t, "client@demo.com"),
+		"agent":  testSession(t, "agent@demo.com"),
+	}
+	roles := builtinRoles()
+
+	for _, rt := range apiRoutes() {
+		rt := rt
+		t.Run(rt.Pattern, func(t *testing.T) {
+			if len(rt.Methods) == 0 {
+				t.Fatal("route declares no methods")
+			}
+			rt.handler = func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			h := rt.build()
+			serve := func(method string, prepare func(r *http.Request)) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(method, rt.Pattern, nil)
+				if prepare != nil {
+					prepare(r)
+				}
+				w := httptest.NewRecorder()
+				h(w, r)
+				return w
+			}
+
+			for _, method := range allMethods {
+				if containsString(rt.Methods, method) {
+					continue
+				}
+				w := serve(method, nil)
+				if w.Code != http.StatusMethodNotAllowed {
+					t.Errorf("%s: got %d, want 405", method, w.Code)
+				}
+				if w.Header().Get("Allow") == "" {
+					t.Errorf("%s: 405 without an Allow header", method)
+				}
+			}
+
+			for _, method := range rt.Methods {
+				want := http.StatusNoContent
+				if rt.Access == accessSession {
+					want = http.StatusUnauthorized
+				}
+				if w := serve(method, nil); w.Code != want {
+					t.Errorf("%s without credentials: got %d, want %d", method, w.Code, want)
+				}
+				if rt.Access != accessSession {
+					continue
+				}
+
+				for role, token := range tokens {
+					want := http.StatusNoContent
+					if rt.Permission != "" && !roles[role][rt.Permission] {
+						want = http.StatusForbidden
+					}
+					w := serve(method, func(r *http.Request) {
+						r.Header.Set("Authorization", "Bearer "+token)
+					})
+					if w.Code != want {
+						t.Errorf("%s as %s: got %d, want %d", method, role, w.Code, want)
+					}
+				}
+
+				// Cookie sessions need the CSRF token on unsafe methods
+				if method == "GET" {
+					continue
+				}
+				cookie := &http.Cookie{Name: sessionCookieName, Value: tokens["agent"]}
+				want = http.StatusNoContent
+				if rt.Permission != "" && !roles["agent"][rt.Permission] {
+					want = http.StatusForbidden
+				}
+				if w := serve(method, func(r *http.Request) {
+					r.AddCookie(cookie)
+					r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "csrf-token"})
+					r.Header.Set(csrfHeaderName, "csrf-token")
+				}); w.Code != want {
+					t.Errorf("%s with a cookie and CSRF token: got %d, want %d", method, w.Code, want)
+				}
+				if !rt.CSRF {
+					t.Errorf("%s: session route without CSRF protection", method)
+					continue
+				}
+				if w := serve(method, func(r *http.Request) { r.AddCookie(cookie) }); w.Code != http.StatusForbidden {
+					t.Errorf("%s with a cookie but no CSRF token: got %d, want 403", method, w.Code)
+				}
+			}
+		})
+	}
+}
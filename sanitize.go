@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// User input reaches email headers, S3 keys and log lines. A line break
+// there can add a header or forge a log entry, and bidi controls can make
+// text read differently from what it is, so those characters are
+// removed or escaped on the way out.
+
+// Controls (CR, LF, NUL, NEL...), Unicode line and paragraph separators,
+// and bidi embedding, override and isolate characters
+func isUnsafeRune(r rune) bool {
+	switch {
+	case unicode.IsControl(r):
+		return true
+	case r == '\u2028', r == '\u2029':
+		return true
+	case r == '\u061c', r == '\u200e', r == '\u200f':
+		return true
+	case r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+		return true
+	}
+	return false
+}
+
+// Text safe for a single header or line: unsafe characters become spaces
+func singleLine(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if isUnsafeRune(r) {
+			return ' '
+		}
+		return r
+	}, s))
+}
+
+var errUnsafeAddress = errors.New("address contains control characters")
+
+// Mail transport that keeps subjects to one line and refuses recipients
+// that would break out of the To header
+type headerSafeTransport struct {
+	mailTransport
+}
+
+func (t headerSafeTransport) Send(to, subject, body string) (string, error) {
+	if strings.IndexFunc(to, isUnsafeRune) >= 0 {
+		return "", errUnsafeAddress
+	}
+	return t.mailTransport.Send(to, singleLine(subject), body)
+}
+
+// Log output with control and bidi characters escaped, so input that
+// ends up in a message can't start a fake log line
+type logSanitizer struct {
+	w io.Writer
+}
+
+func (l logSanitizer) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	if strings.IndexFunc(line, func(r rune) bool { return r != '\t' && isUnsafeRune(r) }) < 0 {
+		return l.w.Write(p)
+	}
+
+	var b strings.Builder
+	for _, r := range line {
+		if r != '\t' && isUnsafeRune(r) {
+			q := strconv.QuoteRuneToASCII(r)
+			b.WriteString(q[1 : len(q)-1])
+			continue
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\n')
+	if _, err := l.w.Write([]byte(b.String())); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9@._+-]`)
+
+var safeExtension = regexp.MustCompile(`^\.[A-Za-z0-9]{1,10}$`)
+
+// Email as it appears in S3 keys, to tell whose uploads are whose when
+// browsing a bucket. Ownership is checked against the recorded uploader,
+// never the key. Anything but plain address characters becomes _.
+func keyEmail(email string) string {
+	return unsafeKeyChars.ReplaceAllString(email, "_")
+}
+
+// File extension for an upload's key, or "" if it's anything unusual
+func keyExtension(filename string) string {
+	i := strings.LastIndex(filename, ".")
+	if i < 0 || !safeExtension.MatchString(filename[i:]) {
+		return ""
+	}
+	return strings.ToLower(filename[i:])
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Agents save /search queries (e.g. "error 500 billing") by name. When a
+// new ticket's subject or description matches a saved search with notify
+// on, its owner gets an in-app notification. All saved searches are
+// checked against the ticket in one query as it's created.
+
+const maxSavedSearches = 20
+
+type SavedSearch struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Query  string `json:"query"`
+	Notify bool   `json:"notify"`
+}
+
+// Create saved searches table
+func createSavedSearchesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS saved_searches (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name VARCHAR(100) NOT NULL,
+			query VARCHAR(200) NOT NULL,
+			notify BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (user_id, name)
+		);
+		CREATE INDEX IF NOT EXISTS saved_searches_notify_idx ON saved_searches (user_id) WHERE notify
+	`)
+	if err != nil {
+		log.Fatal("Failed to create saved_searches table:", err)
+	}
+}
+
+// Check and normalize a saved search's name and query
+func (s *SavedSearch) validate() error {
+	s.Name = strings.TrimSpace(s.Name)
+	s.Query = strings.TrimSpace(normalizeText(s.Query))
+	if s.Name == "" || utf8.RuneCountInString(s.Name) > 100 {
+		return newServiceError(errInvalid, "Name is required and at most 100 characters")
+	}
+	if s.Query == "" || utf8.RuneCountInString(s.Query) > maxSearchQueryLength {
+		return newServiceError(errInvalid, fmt.Sprintf("Query is required and at most %d characters", maxSearchQueryLength))
+	}
+	// A query of only stop words ("the", "and") would never match
+	var nodes int
+	if err := db.QueryRow(fmt.Sprintf("SELECT numnode(websearch_to_tsquery('%s', $1))", searchConfig), s.Query).Scan(&nodes); err != nil {
+		return err
+	}
+	if nodes == 0 {
+		return newServiceError(errInvalid, "Query has no searchable words")
+	}
+	return nil
+}
+
+// Notify owners of saved searches the new ticket matches. Several
+// matching searches of one agent make one notification.
+func subscribeSavedSearches() {
+	subscribe(eventTicketCreated, func(ev Event) {
+		rows, err := db.Query(fmt.Sprintf(`
+			SELECT u.email, s.name
+			FROM saved_searches s
+			JOIN users u ON u.id = s.user_id
+			JOIN tickets t ON t.id = $1
+			WHERE s.notify AND u.active AND t.search_vector @@ websearch_to_tsquery('%s', s.query)
+			ORDER BY u.email, s.name
+		`, searchConfig), ev.TicketID)
+		if err != nil {
+			notifyLog.Errorf("Error matching ticket #%d against saved searches: %v", ev.TicketID, err)
+			return
+		}
+		var emails []string
+		names := map[string][]string{}
+		for rows.Next() {
+			var email, name string
+			if rows.Scan(&email, &name) != nil {
+				continue
+			}
+			if names[email] == nil {
+				emails = append(emails, email)
+			}
+			names[email] = append(names[email], name)
+		}
+		rows.Close()
+		if len(emails) == 0 {
+			return
+		}
+
+		ticket, err := ticketForNotification(ev.TicketID)
+		if err != nil {
+			return
+		}
+		for _, email := range emails {
+			if strings.EqualFold(email, ev.Actor) {
+				continue
+			}
+			summary := fmt.Sprintf("%s matches your saved search %q", ticket.Reference, names[email][0])
+			if len(names[email]) > 1 {
+				summary = fmt.Sprintf("%s matches your saved searches %s", ticket.Reference, quoteList(names[email]))
+			}
+			// notifyUser skips agents who can't read the ticket
+			notifyUser(email, notificationSavedSearch, ticket, ev.Actor, summary)
+		}
+	})
+}
+
+func quoteList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, s := range items {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// GET/POST /me/saved_searches, PUT/DELETE /me/saved_searches/{id}
+func handleSavedSearches(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/saved_searches"), "/")
+
+	// Body of POST and PUT; notify defaults to true
+	var req struct {
+		Name   string `json:"name"`
+		Query  string `json:"query"`
+		Notify *bool  `json:"notify"`
+	}
+	decode := func() (SavedSearch, error) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return SavedSearch{}, newServiceError(errInvalid, "Invalid request")
+		}
+		s := SavedSearch{Name: req.Name, Query: req.Query, Notify: req.Notify == nil || *req.Notify}
+		return s, s.validate()
+	}
+
+	switch {
+	case idPart == "" && r.Method == "GET":
+		rows, err := db.Query("SELECT id, name, query, notify FROM saved_searches WHERE user_id = $1 ORDER BY name", user.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		list := []SavedSearch{}
+		for rows.Next() {
+			var s SavedSearch
+			if err := rows.Scan(&s.ID, &s.Name, &s.Query, &s.Notify); err != nil {
+				continue
+			}
+			list = append(list, s)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case idPart == "" && r.Method == "POST":
+		s, err := decode()
+		if err != nil {
+			writeServiceError(w, err, "Failed to save search")
+			return
+		}
+
+		// The limit is checked by the insert itself
+		err = db.QueryRow(`
+			INSERT INTO saved_searches (user_id, name, query, notify)
+			SELECT $1, $2, $3, $4
+			WHERE (SELECT COUNT(*) FROM saved_searches WHERE user_id = $1) < $5
+			RETURNING id
+		`, user.ID, s.Name, s.Query, s.Notify, maxSavedSearches).Scan(&s.ID)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("At most %d saved searches", maxSavedSearches), http.StatusConflict)
+			return
+		}
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			http.Error(w, "A saved search with that name already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to save search", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ Saved search #%d created by %s", s.ID, user.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+
+	case idPart != "" && r.Method == "PUT":
+		id, err := strconv.Atoi(idPart)
+		if err != nil {
+			http.Error(w, "Invalid saved search ID", http.StatusBadRequest)
+			return
+		}
+		s, err := decode()
+		if err != nil {
+			writeServiceError(w, err, "Failed to update saved search")
+			return
+		}
+		s.ID = id
+
+		res, err := db.Exec("UPDATE saved_searches SET name = $1, query = $2, notify = $3 WHERE id = $4 AND user_id = $5",
+			s.Name, s.Query, s.Notify, id, user.ID)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			http.Error(w, "A saved search with that name already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to update saved search", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Saved search not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+
+	case idPart != "" && r.Method == "DELETE":
+		id, err := strconv.Atoi(idPart)
+		if err != nil {
+			http.Error(w, "Invalid saved search ID", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec("DELETE FROM saved_searches WHERE id = $1 AND user_id = $2", id, user.ID)
+		if err != nil {
+			http.Error(w, "Failed to delete saved search", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Saved search not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Saved search deleted"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
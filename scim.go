@@ -0,0 +1,755 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// SCIM 2.0 provisioning (RFC 7643/7644) for enterprise identity
+// providers, authenticated with SCIM_TOKEN as a bearer token. Users map
+// to sts users by email (userName); groups are the roles, so adding a
+// user to a group sets their role. Deleting a user deactivates it, since
+// tickets and audit history refer to it.
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfig      = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+)
+
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Active      bool        `json:"active"`
+	Emails      []scimValue `json:"emails"`
+	Groups      []scimValue `json:"groups"`
+	Meta        scimMeta    `json:"meta"`
+}
+
+type scimGroup struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	DisplayName string      `json:"displayName"`
+	Members     []scimValue `json:"members"`
+	Meta        scimMeta    `json:"meta"`
+}
+
+type scimValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+// Attributes accepted on user create, replace and patch
+type scimUserInput struct {
+	ExternalID  *string     `json:"externalId"`
+	UserName    *string     `json:"userName"`
+	DisplayName *string     `json:"displayName"`
+	Active      interface{} `json:"active"`
+	Emails      []scimValue `json:"emails"`
+}
+
+type scimPatch struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+const (
+	scimDefaultCount = 100
+	scimMaxCount     = 200
+)
+
+var scimFilterPattern = regexp.MustCompile(`^(?i)(userName|externalId|displayName) eq "([^"]*)"$`)
+
+// Members removed from a group by a filtered path, e.g. members[value eq "12"]
+var scimMemberPath = regexp.MustCompile(`^(?i)members\[value eq "([^"]*)"\]$`)
+
+// Create SCIM tables. Deactivated users can't sign in and their sessions
+// are revoked.
+func createSCIMTables() {
+	_, err := db.Exec(`
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+		CREATE TABLE IF NOT EXISTS scim_users (
+			user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			external_id VARCHAR(255) NOT NULL DEFAULT '',
+			display_name VARCHAR(255) NOT NULL DEFAULT ''
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create SCIM tables:", err)
+	}
+}
+
+// Role given to users the identity provider creates or removes from
+// their last group (SCIM_DEFAULT_ROLE, client by default)
+func scimDefaultRole() string {
+	if role := os.Getenv("SCIM_DEFAULT_ROLE"); role != "" {
+		return role
+	}
+	return "client"
+}
+
+func scimTokenValid(r *http.Request) bool {
+	want := os.Getenv("SCIM_TOKEN")
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return want != "" && got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// Errors are reported in the SCIM format identity providers expect
+func scimError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]interface{}{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(status), "detail": detail}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// /scim/v2/...: ServiceProviderConfig, Users[/{id}] and Groups[/{id}]
+func handleSCIM(w http.ResponseWriter, r *http.Request) {
+	if !scimTokenValid(r) {
+		scimError(w, http.StatusUnauthorized, "", "Invalid or missing SCIM token")
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/scim/v2"), "/")
+	resource, id, _ := strings.Cut(path, "/")
+
+	switch resource {
+	case "ServiceProviderConfig":
+		writeSCIM(w, http.StatusOK, map[string]interface{}{
+			"schemas":        []string{scimConfig},
+			"patch":          map[string]bool{"supported": true},
+			"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxCount},
+			"changePassword": map[string]bool{"supported": false},
+			"sort":           map[string]bool{"supported": false},
+			"etag":           map[string]bool{"supported": false},
+			"authenticationSchemes": []map[string]string{
+				{"type": "oauthbearertoken", "name": "Bearer token", "description": "SCIM_TOKEN"},
+			},
+		})
+	case "Users":
+		handleSCIMUsers(w, r, id)
+	case "Groups":
+		handleSCIMGroups(w, r, id)
+	default:
+		scimError(w, http.StatusNotFound, "", "Unknown resource")
+	}
+}
+
+const scimUserQuery = `
+	SELECT u.id, u.email, u.user_type, u.active, COALESCE(s.external_id, ''), COALESCE(s.display_name, '')
+	FROM users u LEFT JOIN scim_users s ON s.user_id = u.id`
+
+func scanSCIMUser(row interface{ Scan(...interface{}) error }) (scimUser, error) {
+	var u scimUser
+	var id int
+	var role string
+	if err := row.Scan(&id, &u.UserName, &role, &u.Active, &u.ExternalID, &u.DisplayName); err != nil {
+		return u, err
+	}
+	u.Schemas = []string{scimUserSchema}
+	u.ID = strconv.Itoa(id)
+	u.Emails = []scimValue{{Value: u.UserName, Primary: true}}
+	u.Groups = []scimValue{{Value: role, Display: role}}
+	u.Meta = scimMeta{ResourceType: "User", Location: publicBaseURL() + "/scim/v2/Users/" + u.ID}
+	return u, nil
+}
+
+func loadSCIMUser(id int) (scimUser, error) {
+	return scanSCIMUser(db.QueryRow(scimUserQuery+" WHERE u.id = $1", id))
+}
+
+// startIndex and count paging parameters, 1-based
+func scimPage(r *http.Request) (offset, count int) {
+	offset, count = 0, scimDefaultCount
+	if n, err := strconv.Atoi(r.URL.Query().Get("startIndex")); err == nil && n > 1 {
+		offset = n - 1
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && n >= 0 {
+		count = min(n, scimMaxCount)
+	}
+	return offset, count
+}
+
+func handleSCIMUsers(w http.ResponseWriter, r *http.Request, idPart string) {
+	if idPart == "" {
+		switch r.Method {
+		case "GET":
+			listSCIMUsers(w, r)
+		case "POST":
+			createSCIMUser(w, r)
+		default:
+			scimError(w, http.StatusMethodNotAllowed, "", "Method not allowed")
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(idPart)
+	if err != nil {
+		scimError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+	current, err := loadSCIMUser(id)
+	if err != nil {
+		scimError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeSCIM(w, http.StatusOK, current)
+
+	case "PUT":
+		var in scimUserInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			scimError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request")
+			return
+		}
+		// Replacing leaves out what isn't sent; active defaults to true
+		if in.ExternalID == nil {
+			in.ExternalID = new(string)
+		}
+		if in.DisplayName == nil {
+			in.DisplayName = new(string)
+		}
+		if in.Active == nil {
+			in.Active = true
+		}
+		updateSCIMUser(w, current, in)
+
+	case "PATCH":
+		var patch scimPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			scimError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request")
+			return
+		}
+		var in scimUserInput
+		for _, op := range patch.Operations {
+			if !strings.EqualFold(op.Op, "replace") && !strings.EqualFold(op.Op, "add") {
+				scimError(w, http.StatusBadRequest, "invalidValue", "Unsupported operation "+op.Op)
+				return
+			}
+			// Without a path the value holds the attributes to set, as
+			// Azure AD sends them
+			value := op.Value
+			if op.Path != "" {
+				value, _ = json.Marshal(map[string]json.RawMessage{op.Path: op.Value})
+			}
+			if err := json.Unmarshal(value, &in); err != nil {
+				scimError(w, http.StatusBadRequest, "invalidValue", "Invalid value for "+op.Path)
+				return
+			}
+		}
+		updateSCIMUser(w, current, in)
+
+	case "DELETE":
+		if _, ok := setSCIMUserActive(w, id, false); ok {
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		scimError(w, http.StatusMethodNotAllowed, "", "Method not allowed")
+	}
+}
+
+func listSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	where := ""
+	var args []interface{}
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		m := scimFilterPattern.FindStringSubmatch(filter)
+		if m == nil {
+			scimError(w, http.StatusBadRequest, "invalidFilter", "Only userName, externalId and displayName eq filters are supported")
+			return
+		}
+		args = append(args, m[2])
+		switch strings.ToLower(m[1]) {
+		case "username":
+			where = " WHERE lower(u.email) = lower($1)"
+		case "externalid":
+			where = " WHERE s.external_id = $1"
+		default:
+			where = " WHERE s.display_name = $1"
+		}
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users u LEFT JOIN scim_users s ON s.user_id = u.id"+where, args...).Scan(&total); err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Database error")
+		return
+	}
+
+	offset, count := scimPage(r)
+	args = append(args, count, offset)
+	rows, err := db.Query(fmt.Sprintf("%s%s ORDER BY u.id LIMIT $%d OFFSET $%d", scimUserQuery, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	users := []scimUser{}
+	for rows.Next() {
+		u, err := scanSCIMUser(rows)
+		if err != nil {
+			continue
+		}
+		users = append(users, u)
+	}
+
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   offset + 1,
+		"itemsPerPage": len(users),
+		"Resources":    users,
+	})
+}
+
+// userName, falling back to the primary email
+func (in scimUserInput) email() string {
+	if in.UserName != nil {
+		return strings.ToLower(strings.TrimSpace(*in.UserName))
+	}
+	for _, e := range in.Emails {
+		if e.Primary || len(in.Emails) == 1 {
+			return strings.ToLower(strings.TrimSpace(e.Value))
+		}
+	}
+	return ""
+}
+
+// active as sent: identity providers send both booleans and strings
+func (in scimUserInput) active() (value, ok bool) {
+	switch v := in.Active.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return false, false
+}
+
+// POST /scim/v2/Users. A user who already signed up is linked rather
+// than refused, unless the identity provider already manages them.
+func createSCIMUser(w http.ResponseWriter, r *http.Request) {
+	var in scimUserInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		scimError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request")
+		return
+	}
+	email := in.email()
+	if strings.LastIndex(email, "@") < 1 || len(email) > 255 {
+		scimError(w, http.StatusBadRequest, "invalidValue", "userName must be an email address")
+		return
+	}
+	active, ok := in.active()
+	if in.Active == nil {
+		active = true
+	} else if !ok {
+		scimError(w, http.StatusBadRequest, "invalidValue", "active must be true or false")
+		return
+	}
+
+	// Provisioned users can't log in with a password, only through SSO
+	password, err := randomPasswordHash()
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Failed to create user")
+		return
+	}
+	user, created, err := store.Users().Provision(email, password, scimDefaultRole())
+	if err == sql.ErrNoRows {
+		// Deactivated, so already managed by the identity provider
+		scimError(w, http.StatusConflict, "uniqueness", "User already exists")
+		return
+	}
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Failed to create user")
+		return
+	}
+
+	var externalID, displayName string
+	if in.ExternalID != nil {
+		externalID = *in.ExternalID
+	}
+	if in.DisplayName != nil {
+		displayName = *in.DisplayName
+	}
+	res, err := db.Exec(`
+		INSERT INTO scim_users (user_id, external_id, display_name) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO NOTHING
+	`, user.ID, externalID, displayName)
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Failed to create user")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		scimError(w, http.StatusConflict, "uniqueness", "User already exists")
+		return
+	}
+
+	if _, ok := setSCIMUserActive(w, user.ID, active); !ok {
+		return
+	}
+	if created {
+		log.Printf("✓ Provisioned %s (%s) over SCIM", user.Email, user.UserType)
+	} else {
+		log.Printf("✓ Linked existing user %s to the identity provider", user.Email)
+	}
+	recordAudit("scim", "user.provisioned", 0, map[string]interface{}{"user_id": user.ID, "email": user.Email, "created": created})
+
+	u, err := loadSCIMUser(user.ID)
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Database error")
+		return
+	}
+	writeSCIM(w, http.StatusCreated, u)
+}
+
+// Apply the attributes set in in to a user and return the result
+func updateSCIMUser(w http.ResponseWriter, current scimUser, in scimUserInput) {
+	id, _ := strconv.Atoi(current.ID)
+
+	if email := in.email(); email != "" && email != strings.ToLower(current.UserName) {
+		if strings.LastIndex(email, "@") < 1 || len(email) > 255 {
+			scimError(w, http.StatusBadRequest, "invalidValue", "userName must be an email address")
+			return
+		}
+		_, err := db.Exec("UPDATE users SET email = $1 WHERE id = $2", email, id)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			scimError(w, http.StatusConflict, "uniqueness", "Another user has this userName")
+			return
+		}
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", "Failed to update user")
+			return
+		}
+		log.Printf("✓ User %d renamed from %s to %s over SCIM", id, current.UserName, email)
+	}
+
+	externalID, displayName := current.ExternalID, current.DisplayName
+	if in.ExternalID != nil {
+		externalID = *in.ExternalID
+	}
+	if in.DisplayName != nil {
+		displayName = *in.DisplayName
+	}
+	_, err := db.Exec(`
+		INSERT INTO scim_users (user_id, external_id, display_name) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET external_id = EXCLUDED.external_id, display_name = EXCLUDED.display_name
+	`, id, externalID, displayName)
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Failed to update user")
+		return
+	}
+
+	if in.Active != nil {
+		active, ok := in.active()
+		if !ok {
+			scimError(w, http.StatusBadRequest, "invalidValue", "active must be true or false")
+			return
+		}
+		if _, ok := setSCIMUserActive(w, id, active); !ok {
+			return
+		}
+	}
+
+	u, err := loadSCIMUser(id)
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Database error")
+		return
+	}
+	writeSCIM(w, http.StatusOK, u)
+}
+
+// Activate or deactivate a user; deactivating signs them out everywhere.
+// Reports errors itself; false means it did.
+func setSCIMUserActive(w http.ResponseWriter, id int, active bool) (changed, ok bool) {
+	res, err := db.Exec("UPDATE users SET active = $1 WHERE id = $2 AND active <> $1", active, id)
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Failed to update user")
+		return false, false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, true
+	}
+
+	if active {
+		log.Printf("✓ User %d reactivated over SCIM", id)
+		recordAudit("scim", "user.reactivated", 0, map[string]interface{}{"user_id": id})
+		return true, true
+	}
+
+	revoked, err := store.Users().RevokeAllSessions(id)
+	if err != nil {
+		log.Printf("Error revoking sessions of deactivated user %d: %v", id, err)
+	}
+	if _, err := db.Exec("DELETE FROM calendar_feeds WHERE user_id = $1", id); err != nil {
+		log.Printf("Error revoking calendar feed of deactivated user %d: %v", id, err)
+	}
+	log.Printf("✓ User %d deactivated over SCIM (%d sessions revoked)", id, revoked)
+	recordAudit("scim", "user.deactivated", 0, map[string]interface{}{"user_id": id, "sessions_revoked": revoked})
+	return true, true
+}
+
+func loadSCIMGroup(role string) (scimGroup, error) {
+	g := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          role,
+		DisplayName: role,
+		Members:     []scimValue{},
+		Meta:        scimMeta{ResourceType: "Group", Location: publicBaseURL() + "/scim/v2/Groups/" + role},
+	}
+
+	rows, err := db.Query("SELECT id, email FROM users WHERE user_type = $1 AND active ORDER BY id", role)
+	if err != nil {
+		return g, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			return g, err
+		}
+		g.Members = append(g.Members, scimValue{Value: strconv.Itoa(id), Display: email})
+	}
+	return g, rows.Err()
+}
+
+// Groups are the configured roles; identity providers can change their
+// members but not create or delete them
+func handleSCIMGroups(w http.ResponseWriter, r *http.Request, role string) {
+	if role == "" {
+		if r.Method != "GET" {
+			scimError(w, http.StatusNotImplemented, "", "Groups are sts roles; manage them in sts")
+			return
+		}
+		listSCIMGroups(w, r)
+		return
+	}
+
+	if rolePermissions(role) == nil {
+		scimError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		g, err := loadSCIMGroup(role)
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", "Database error")
+			return
+		}
+		writeSCIM(w, http.StatusOK, g)
+
+	case "PUT":
+		var in struct {
+			Members []scimValue `json:"members"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			scimError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request")
+			return
+		}
+		updateSCIMGroup(w, role, in.Members, nil, true)
+
+	case "PATCH":
+		var patch scimPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			scimError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request")
+			return
+		}
+		var add, remove []scimValue
+		replace := false
+		for _, op := range patch.Operations {
+			var members []scimValue
+			switch {
+			case scimMemberPath.MatchString(op.Path):
+				members = []scimValue{{Value: scimMemberPath.FindStringSubmatch(op.Path)[1]}}
+			case strings.EqualFold(op.Path, "members"):
+				if len(op.Value) > 0 && json.Unmarshal(op.Value, &members) != nil {
+					scimError(w, http.StatusBadRequest, "invalidValue", "members must be a list")
+					return
+				}
+			case op.Path == "":
+				var value struct {
+					Members []scimValue `json:"members"`
+				}
+				if json.Unmarshal(op.Value, &value) != nil {
+					scimError(w, http.StatusBadRequest, "invalidValue", "Invalid value")
+					return
+				}
+				members = value.Members
+			default:
+				// displayName and the like can't change: they're the role
+				scimError(w, http.StatusBadRequest, "mutability", "Only members can be changed")
+				return
+			}
+
+			switch strings.ToLower(op.Op) {
+			case "add":
+				add = append(add, members...)
+			case "remove":
+				if strings.EqualFold(op.Path, "members") && len(members) == 0 {
+					replace, add = true, nil
+				}
+				remove = append(remove, members...)
+			case "replace":
+				replace, add = true, members
+			default:
+				scimError(w, http.StatusBadRequest, "invalidValue", "Unsupported operation "+op.Op)
+				return
+			}
+		}
+		updateSCIMGroup(w, role, add, remove, replace)
+
+	default:
+		scimError(w, http.StatusNotImplemented, "", "Groups are sts roles; manage them in sts")
+	}
+}
+
+func listSCIMGroups(w http.ResponseWriter, r *http.Request) {
+	roles, err := store.Users().Roles()
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Database error")
+		return
+	}
+
+	names := []string{}
+	for name := range roles {
+		names = append(names, name)
+	}
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		m := scimFilterPattern.FindStringSubmatch(filter)
+		if m == nil || !strings.EqualFold(m[1], "displayName") {
+			scimError(w, http.StatusBadRequest, "invalidFilter", "Only displayName eq filters are supported")
+			return
+		}
+		names = []string{}
+		if roles[m[2]] != nil {
+			names = append(names, m[2])
+		}
+	}
+	sort.Strings(names)
+
+	groups := []scimGroup{}
+	for _, name := range names {
+		g, err := loadSCIMGroup(name)
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", "Database error")
+			return
+		}
+		groups = append(groups, g)
+	}
+
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(groups),
+		"startIndex":   1,
+		"itemsPerPage": len(groups),
+		"Resources":    groups,
+	})
+}
+
+// Move users into or out of a role. With replace, current members not in
+// add are removed. Removed users fall back to the default role.
+func updateSCIMGroup(w http.ResponseWriter, role string, add, remove []scimValue, replace bool) {
+	ids := func(members []scimValue) ([]int, bool) {
+		out := []int{}
+		for _, m := range members {
+			id, err := strconv.Atoi(m.Value)
+			if err != nil {
+				return nil, false
+			}
+			out = append(out, id)
+		}
+		return out, true
+	}
+	addIDs, ok1 := ids(add)
+	removeIDs, ok2 := ids(remove)
+	if !ok1 || !ok2 {
+		scimError(w, http.StatusBadRequest, "invalidValue", "Member values must be user IDs")
+		return
+	}
+
+	fallback := scimDefaultRole()
+	if role == fallback && (replace || len(removeIDs) > 0) {
+		scimError(w, http.StatusBadRequest, "mutability", "Members can't be removed from the default group")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	if replace {
+		_, err = tx.Exec("UPDATE users SET user_type = $1 WHERE user_type = $2 AND id <> ALL($3)", fallback, role, pq.Array(addIDs))
+	} else if len(removeIDs) > 0 {
+		_, err = tx.Exec("UPDATE users SET user_type = $1 WHERE user_type = $2 AND id = ANY($3)", fallback, role, pq.Array(removeIDs))
+	}
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Failed to update group")
+		return
+	}
+	if len(addIDs) > 0 {
+		res, err := tx.Exec("UPDATE users SET user_type = $1 WHERE id = ANY($2)", role, pq.Array(addIDs))
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", "Failed to update group")
+			return
+		}
+		if n, _ := res.RowsAffected(); int(n) != len(addIDs) {
+			scimError(w, http.StatusBadRequest, "invalidValue", "Unknown user in members")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Failed to update group")
+		return
+	}
+
+	log.Printf("✓ Group %s updated over SCIM (%d added, %d removed, replace=%t)", role, len(addIDs), len(removeIDs), replace)
+	recordAudit("scim", "role.members_updated", 0, map[string]interface{}{
+		"role": role, "added": addIDs, "removed": removeIDs, "replace": replace})
+
+	g, err := loadSCIMGroup(role)
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", "Database error")
+		return
+	}
+	writeSCIM(w, http.StatusOK, g)
+}
@@ -0,0 +1,56 @@
+#!/bin/sh
+# Performance regression gate for the hot paths: ticket listing, message
+# fetch and the auth middleware (Benchmark* in main_test.go, run against
+# the in-memory store, so no database is needed).
+#
+# Runs the benchmarks on a base revision and on the working tree, compares
+# them with benchstat and fails if time or allocations per operation got
+# significantly worse by more than THRESHOLD percent.
+#
+#   go install golang.org/x/perf/cmd/benchstat@latest
+#   scripts/bench-gate.sh [base-ref]        # base defaults to main
+#
+# Environment: THRESHOLD (default 10), COUNT runs per benchmark (default
+# 10, which benchstat needs to call a difference significant), BENCH
+# (default ., every benchmark).
+set -eu
+
+base=${1:-main}
+threshold=${THRESHOLD:-10}
+count=${COUNT:-10}
+bench=${BENCH:-.}
+
+command -v benchstat >/dev/null || {
+	echo "benchstat not found: go install golang.org/x/perf/cmd/benchstat@latest" >&2
+	exit 2
+}
+
+root=$(git rev-parse --show-toplevel)
+work=$(mktemp -d)
+trap 'git -C "$root" worktree remove --force "$work/base" >/dev/null 2>&1; rm -rf "$work"' EXIT
+
+git -C "$root" worktree add --detach "$work/base" "$base" >/dev/null
+(cd "$work/base" && go test -run '^$' -bench "$bench" -benchmem -count "$count" .) > "$work/base.txt"
+(cd "$root" && go test -run '^$' -bench "$bench" -benchmem -count "$count" .) > "$work/head.txt"
+
+benchstat "$work/base.txt" "$work/head.txt"
+echo
+
+# In CSV, each unit's table starts with a ",sec/op,CI,sec/op,CI,vs base,P"
+# row; "vs base" is ~ unless the change is significant
+benchstat -format csv "$work/base.txt" "$work/head.txt" | awk -F, -v limit="$threshold" '
+	$6 == "vs base" { unit = $2; next }
+	unit != "sec/op" && unit != "allocs/op" { next }
+	$1 == "geomean" || $6 !~ /^\+[0-9.]+%$/ { next }
+	{
+		pct = substr($6, 2) + 0
+		if (pct > limit) {
+			printf "%s: %s up %s (limit %s%%)\n", $1, unit, $6, limit
+			failed = 1
+		}
+	}
+	END {
+		if (failed) exit 1
+		print "No regressions over " limit "%"
+	}
+'
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Text search configuration for ticket and message search vectors
+const searchConfig = "english"
+
+const maxSearchQueryLength = 200
+
+// Add generated search vectors with GIN indexes to tickets (subject
+// weighted over description) and messages. Adding them rewrites both
+// tables once. Runs after messages are partitioned, so the partitioned
+// table gets the generated column rather than a copy of its values.
+func migrateSearch() {
+	_, err := db.Exec(fmt.Sprintf(`
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+			setweight(to_tsvector('%[1]s', COALESCE(subject, '')), 'A') ||
+			setweight(to_tsvector('%[1]s', COALESCE(description, '')), 'B')
+		) STORED;
+		CREATE INDEX IF NOT EXISTS tickets_search_idx ON tickets USING GIN (search_vector);
+		ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+			to_tsvector('%[1]s', message)
+		) STORED;
+		CREATE INDEX IF NOT EXISTS messages_search_idx ON messages USING GIN (search_vector)
+	`, searchConfig))
+	if err != nil {
+		log.Fatal("Failed to migrate search:", err)
+	}
+}
+
+type SearchResult struct {
+	Ticket Ticket  `json:"ticket"`
+	Rank   float64 `json:"rank"`
+	// Best matching passage of the ticket or one of its replies, with
+	// matched words in **bold**
+	Snippet string `json:"snippet"`
+}
+
+// GET /search?q=: tickets whose subject, description or replies match,
+// best matches first, limited to tickets the caller can see
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	q := strings.TrimSpace(normalizeText(r.URL.Query().Get("q")))
+	if q == "" || utf8.RuneCountInString(q) > maxSearchQueryLength {
+		http.Error(w, fmt.Sprintf("q is required and at most %d characters", maxSearchQueryLength), http.StatusBadRequest)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	args := []interface{}{q}
+	predicate, args := ticketAccessPredicate(user, args)
+	args = append(args, page.Limit, page.Offset)
+
+	// The description is also the thread's first message, so only
+	// replies are searched in messages
+	rows, err := db.Query(fmt.Sprintf(`
+		WITH q AS (
+			SELECT websearch_to_tsquery('%[1]s', $1) AS query
+		), hits AS (
+			SELECT t.id AS ticket_id, ts_rank(t.search_vector, q.query) AS rank, NULL::text AS body
+			FROM tickets t, q WHERE t.search_vector @@ q.query
+			UNION ALL
+			SELECT m.ticket_id, ts_rank(m.search_vector, q.query), m.message
+			FROM messages m, q WHERE m.search_vector @@ q.query AND NOT m.is_description
+		), best AS (
+			SELECT DISTINCT ON (ticket_id) ticket_id, rank, body FROM hits ORDER BY ticket_id, rank DESC
+		)
+		SELECT %[2]s, best.rank,
+			ts_headline('%[1]s', COALESCE(best.body, subject || E'\n' || description), q.query,
+				'StartSel=**, StopSel=**, MaxFragments=2, MaxWords=25, MinWords=8'),
+			COUNT(*) OVER ()
+		FROM best JOIN tickets ON tickets.id = best.ticket_id, q
+		WHERE TRUE%[3]s
+		ORDER BY best.rank DESC, created_at DESC, id DESC
+		LIMIT $%[4]d OFFSET $%[5]d
+	`, searchConfig, ticketColumns, predicate, len(args)-1, len(args)), args...)
+	if err != nil {
+		log.Printf("Error searching tickets: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	tickets := []Ticket{}
+	total := 0
+	for rows.Next() {
+		var res SearchResult
+		t, err := scanTicket(rows, &res.Rank, &res.Snippet, &total)
+		if err != nil {
+			log.Printf("Error reading search result: %v", err)
+			continue
+		}
+		res.Ticket = t
+		results = append(results, res)
+		tickets = append(tickets, t)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	presentTickets(user, tickets)
+	for i := range results {
+		results[i].Ticket = tickets[i]
+	}
+
+	setPageHeaders(w, r, page, total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Security event types
+const (
+	securityEventLogin                = "login"
+	securityEventNewDeviceLogin       = "new_device_login"
+	securityEventLoginFailed          = "login_failed"
+	securityEventPasswordChanged      = "password_changed"
+	securityEventSessionsRevoked      = "sessions_revoked"
+	securityEventEmailChangeRequested = "email_change_requested"
+	securityEventEmailChanged         = "email_changed"
+)
+
+type SecurityEvent struct {
+	ID        int       `json:"id"`
+	EventType string    `json:"event_type"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Details   string    `json:"details,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Create security events table
+func createSecurityEventsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS security_events (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			event_type VARCHAR(50) NOT NULL,
+			ip VARCHAR(45) NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			details TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS security_events_user_idx ON security_events (user_id, created_at DESC)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create security_events table:", err)
+	}
+}
+
+// Record a security event for a user
+func recordSecurityEvent(userID int, eventType string, r *http.Request, details string) {
+	if err := store.Users().RecordSecurityEvent(userID, eventType, clientIP(r), r.UserAgent(), details); err != nil {
+		log.Printf("Failed to record security event %s for user %d: %v", eventType, userID, err)
+	}
+}
+
+// Whether the user has logged in from this user agent before
+func isKnownDevice(userID int, r *http.Request) bool {
+	known, err := store.Users().HasUsedDevice(userID, r.UserAgent())
+	return err != nil || known
+}
+
+// Email the user about a security-relevant change on their account
+func notifySecurityEvent(email, eventType string, r *http.Request) {
+	var subject, what string
+	switch eventType {
+	case securityEventNewDeviceLogin:
+		subject = "New sign-in to your support account"
+		what = "Your account was signed in to from a new device."
+	case securityEventPasswordChanged:
+		subject = "Your support account password was changed"
+		what = "The password for your account was changed."
+	default:
+		return
+	}
+
+	body := fmt.Sprintf(`%s
+
+Device: %s
+IP address: %s
+Time: %s
+
+If this was you, no action is needed. If not, change your password and
+sign out of all sessions right away.
+`, what, describeDevice(r.UserAgent()), clientIP(r), time.Now().UTC().Format(time.RFC1123))
+
+	sendMailAsync(email, subject, body)
+}
+
+// List the current user's security events
+func handleSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	events, err := store.Users().SecurityEvents(currentUser(r).ID, 100)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
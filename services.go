@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Kinds of business-rule failures, independent of the transport
+type errorKind int
+
+const (
+	errInvalid errorKind = iota
+	errNotFound
+	errForbidden
+	errConflict
+	errRateLimited
+	errUnavailable
+)
+
+// Failure returned by services; message is safe to show to the caller
+type serviceError struct {
+	kind       errorKind
+	message    string
+	retryAfter int
+}
+
+func (e *serviceError) Error() string { return e.message }
+
+func newServiceError(kind errorKind, message string) *serviceError {
+	return &serviceError{kind: kind, message: message}
+}
+
+var (
+	errTicketNotFound   = newServiceError(errNotFound, "Ticket not found")
+	errPermissionDenied = newServiceError(errForbidden, "Permission denied")
+)
+
+// Write a service error as an HTTP response. Errors that aren't service
+// errors are internal and reported with fallback.
+func writeServiceError(w http.ResponseWriter, err error, fallback string) {
+	se, ok := err.(*serviceError)
+	if !ok {
+		if err == errUnknownField {
+			http.Error(w, "Unknown custom field", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fallback, http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusBadRequest
+	switch se.kind {
+	case errNotFound:
+		status = http.StatusNotFound
+	case errForbidden:
+		status = http.StatusForbidden
+	case errConflict:
+		status = http.StatusConflict
+	case errUnavailable:
+		status = http.StatusServiceUnavailable
+	case errRateLimited:
+		status = http.StatusTooManyRequests
+		w.Header().Set("Retry-After", strconv.Itoa(se.retryAfter))
+	}
+	http.Error(w, se.message, status)
+}
+
+// Ticket business rules shared by the REST API, CLI and email gateway
+type TicketService struct {
+	store Store
+}
+
+var ticketService TicketService
+
+// Open a ticket on behalf of user
+func (s TicketService) Create(user User, ticket *Ticket) error {
+	if !authorize(user, permTicketsCreate, nil) {
+		return errPermissionDenied
+	}
+
+	ticket.Email = user.Email
+	ticket.Tags = nil
+
+	// Subjects go into email headers; long ones (mostly from email) are
+	// cut to fit rather than refused
+	ticket.Subject = truncateText(normalizeText(singleLine(ticket.Subject)), maxSubjectLength)
+	ticket.Description = normalizeText(ticket.Description)
+	if ticket.Subject == "" || ticket.Description == "" {
+		return newServiceError(errInvalid, "Missing required fields")
+	}
+
+	if ticket.Channel == "" {
+		ticket.Channel = defaultTicketChannel
+	}
+	if !ticketChannels[ticket.Channel] {
+		return newServiceError(errInvalid, "Invalid channel")
+	}
+	if ticket.Priority == "" {
+		ticket.Priority = defaultTicketPriority
+	}
+	if !validPriority(ticket.Priority) {
+		return newServiceError(errInvalid, "Priority must be low, normal, high or urgent")
+	}
+
+	if err := checkTicketRateLimit(user.Email); err != nil {
+		return err
+	}
+	if fullFeatured() {
+		if err := checkOpenTicketQuota(user.Email); err != nil {
+			return err
+		}
+	}
+
+	// attachment_key is the older, single-file form of attachment_keys
+	keys := ticket.AttachmentKeys
+	if ticket.AttachmentKey != "" {
+		keys = append([]string{ticket.AttachmentKey}, keys...)
+	}
+	ticket.Attachments = nil
+	for _, key := range keys {
+		ticket.Attachments = append(ticket.Attachments, Attachment{Key: key})
+	}
+	if err := checkAttachments(user, ticket.Attachments); err != nil {
+		return err
+	}
+	if err := checkAttachmentLocations(storageOrgID(ticket.Email), ticket.Attachments); err != nil {
+		return err
+	}
+	if len(ticket.Attachments) > 0 {
+		urlStr, err := presignAttachment(ticket.Attachments[0].Key)
+		if err != nil {
+			return fmt.Errorf("presign attachment: %w", err)
+		}
+		ticket.AttachmentURL = urlStr
+	}
+
+	if err := s.store.Tickets().Create(ticket, user); err != nil {
+		// A file already linked elsewhere isn't this request's to remove
+		if err == errAttachmentLinked {
+			return newServiceError(errConflict, "Attachment is already linked to a ticket or message")
+		}
+		discardUploads(ticket.Attachments)
+		return err
+	}
+
+	ticket.Status = "open"
+	log.Printf("✓ Ticket #%d (%s) created by %s", ticket.ID, ticket.Reference, ticket.Email)
+
+	if fullFeatured() {
+		if e, err := recordEntitlement(ticket.ID, ticket.Email); err != nil {
+			log.Printf("Error checking entitlement for ticket #%d: %v", ticket.ID, err)
+		} else {
+			ticket.Entitlement = &e
+			if e.Warning != "" {
+				log.Printf("Ticket #%d: %s", ticket.ID, e.Warning)
+			}
+		}
+	}
+	created := *ticket
+	publish(Event{Type: eventTicketCreated, Actor: user.Email, TicketID: ticket.ID, Ticket: &created,
+		Data: map[string]interface{}{"channel": ticket.Channel}})
+
+	return nil
+}
+
+// Load a ticket user is allowed to see
+func (s TicketService) Get(user User, ticketID int) (Ticket, error) {
+	ticket, err := s.store.Tickets().Find(user, ticketID)
+	if err != nil {
+		// Tickets the caller can't see are reported as missing
+		return ticket, errTicketNotFound
+	}
+	return ticket, nil
+}
+
+// Close a ticket
+func (s TicketService) Close(user User, ticketID int) (Ticket, error) {
+	ticket, err := s.Get(user, ticketID)
+	if err != nil {
+		return ticket, err
+	}
+
+	if !authorize(user, actionTicketClose, &ticket) {
+		return ticket, errPermissionDenied
+	}
+	if ticket.Status == "closed" {
+		return ticket, newServiceError(errConflict, "Ticket is already closed")
+	}
+	if !canTransition(ticket.Status, "closed") {
+		return ticket, newServiceError(errConflict, fmt.Sprintf("Ticket can't be closed while %s", ticket.Status))
+	}
+
+	if err := s.store.Tickets().SetStatus(ticketID, ticket.Status, "closed", user.Email); err != nil {
+		if err == errStatusChanged {
+			return ticket, newServiceError(errConflict, "Ticket status changed meanwhile")
+		}
+		return ticket, err
+	}
+	ticket.Status = "closed"
+	ticket.ClosedBy = user.Email
+
+	log.Printf("✓ Ticket #%d closed by %s", ticketID, user.Email)
+	closed := ticket
+	publish(Event{Type: eventTicketClosed, Actor: user.Email, TicketID: ticketID, Ticket: &closed})
+
+	return ticket, nil
+}
+
+// Move a ticket to another status the workflow allows. Closing goes
+// through Close, so it's authorized and announced the same way.
+func (s TicketService) SetStatus(user User, ticketID int, status string) (Ticket, error) {
+	if !validStatus(status) {
+		return Ticket{}, newServiceError(errInvalid, "Unknown status")
+	}
+	if status == "closed" {
+		return s.Close(user, ticketID)
+	}
+
+	ticket, err := s.Get(user, ticketID)
+	if err != nil {
+		return ticket, err
+	}
+
+	if !authorize(user, permTicketsAssign, nil) {
+		return ticket, errPermissionDenied
+	}
+	if ticket.Status == status {
+		return ticket, newServiceError(errConflict, fmt.Sprintf("Ticket is already %s", status))
+	}
+	if !canTransition(ticket.Status, status) {
+		return ticket, newServiceError(errConflict, fmt.Sprintf("Ticket can't move from %s to %s", ticket.Status, status))
+	}
+
+	from := ticket.Status
+	if err := s.store.Tickets().SetStatus(ticketID, from, status, user.Email); err != nil {
+		if err == errStatusChanged {
+			return ticket, newServiceError(errConflict, "Ticket status changed meanwhile")
+		}
+		return ticket, err
+	}
+	ticket.Status = status
+	ticket.ClosedBy = ""
+
+	log.Printf("✓ Ticket #%d moved from %s to %s by %s", ticketID, from, status, user.Email)
+	publish(Event{Type: eventTicketStatusChanged, Actor: user.Email, TicketID: ticketID,
+		Data: map[string]interface{}{"from": from, "to": status}})
+
+	return ticket, nil
+}
+
+// Add a reply to a ticket's thread. Staff replies have placeholders
+// filled in and carry the agent's signature unless withSignature is false.
+func (s TicketService) Reply(user User, ticketID int, body string, withSignature bool, attachments []Attachment) (Message, error) {
+	body = normalizeText(body)
+	msg := Message{TicketID: ticketID, SenderEmail: user.Email, Message: body, Attachments: attachments}
+
+	ticket, err := s.Get(user, ticketID)
+	if err != nil {
+		return msg, err
+	}
+
+	if !authorize(user, actionTicketReply, &ticket) {
+		return msg, errPermissionDenied
+	}
+	if body == "" {
+		return msg, newServiceError(errInvalid, "Message cannot be empty")
+	}
+	if err := checkAttachments(user, attachments); err != nil {
+		return msg, err
+	}
+	if err := checkAttachmentLocations(ticket.OrgID, attachments); err != nil {
+		return msg, err
+	}
+	msg.Message = composeReply(user, ticket, body, withSignature)
+
+	if err := s.store.Messages().Create(&msg); err != nil {
+		if err == errAttachmentLinked {
+			return msg, newServiceError(errConflict, "Attachment is already linked to a ticket or message")
+		}
+		return msg, err
+	}
+
+	log.Printf("✓ Message added to ticket #%d by %s", ticketID, user.Email)
+
+	created := msg
+	publish(Event{Type: eventMessageCreated, Actor: user.Email, TicketID: ticketID, Ticket: &ticket, Message: &created})
+
+	return msg, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+}
+
+// Create sessions table
+func createSessionsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id VARCHAR(36) PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			user_agent TEXT NOT NULL DEFAULT '',
+			ip VARCHAR(45) NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			revoked_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id) WHERE revoked_at IS NULL
+	`)
+	if err != nil {
+		log.Fatal("Failed to create sessions table:", err)
+	}
+}
+
+// Only a hash of the token is stored, so a leaked table can't be replayed
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Persist a new session for user and return its bearer token and ID
+func createSession(user User, r *http.Request) (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	id := uuid.New().String()
+	err := store.Users().CreateSession(id, user.ID, hashToken(token), r.UserAgent(), clientIP(r))
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, id, nil
+}
+
+// Browser clients can keep the session in an HttpOnly cookie instead of
+// holding the bearer token, so script injected into the page can't read
+// it. Requests authenticated by cookie need a CSRF token to change
+// anything (see csrfProtect).
+func setSessionCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Session or access token from the Authorization header (a "Bearer "
+// prefix is optional), or else the session cookie
+func sessionToken(r *http.Request) string {
+	if token := r.Header.Get("Authorization"); token != "" {
+		return strings.TrimPrefix(token, "Bearer ")
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// Resolve a bearer token to its user and session ID
+func lookupSession(token string, r *http.Request) (User, string, error) {
+	user, sessionID, err := store.Users().SessionUser(hashToken(token))
+	if err != nil {
+		return user, "", err
+	}
+
+	store.Users().TouchSession(sessionID, clientIP(r))
+
+	return user, sessionID, nil
+}
+
+// Log out the current session
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := currentSessionID(r)
+	if _, err := store.Users().RevokeSession(sessionID, 0); err != nil {
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	clearSessionCookie(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
+
+// Handle /me/sessions and /me/sessions/{id}
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/me/sessions"), "/")
+
+	switch {
+	case sessionID == "" && r.Method == "GET":
+		listSessions(w, r)
+	case sessionID == "" && r.Method == "DELETE":
+		revokeAllSessions(w, r)
+	case sessionID != "" && r.Method == "DELETE":
+		revokeSession(w, r, sessionID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// List active sessions for the current user
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	currentID := currentSessionID(r)
+
+	sessions, err := store.Users().ListSessions(currentUser(r).ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Device = describeDevice(sessions[i].UserAgent)
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// Revoke one of the current user's sessions
+func revokeSession(w http.ResponseWriter, r *http.Request, sessionID string) {
+	user := currentUser(r)
+
+	revoked, err := store.Users().RevokeSession(sessionID, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("✓ Session %s revoked by %s", sessionID, user.Email)
+	recordSecurityEvent(user.ID, securityEventSessionsRevoked, r, sessionID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked"})
+}
+
+// Log out everywhere
+func revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	n, err := store.Users().RevokeAllSessions(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ %d sessions revoked by %s", n, user.Email)
+	recordSecurityEvent(user.ID, securityEventSessionsRevoked, r, "all")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Logged out everywhere", "revoked": n})
+}
+
+// Short human-readable device description from a User-Agent
+func describeDevice(ua string) string {
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(ua, "curl/"):
+		browser = "curl"
+	}
+
+	platform := "unknown OS"
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		platform = "iOS"
+	case strings.Contains(ua, "Android"):
+		platform = "Android"
+	case strings.Contains(ua, "Windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(ua, "Linux"):
+		platform = "Linux"
+	}
+
+	return browser + " on " + platform
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A read-only link to a ticket's thread, for showing it to someone
+// without an account. Like calendar feeds, only a hash of the token is
+// kept; the URL is shown once, when the link is created.
+type TicketShare struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// What a share link shows: the ticket's public state and its thread
+type SharedTicket struct {
+	Reference string          `json:"reference"`
+	Subject   string          `json:"subject"`
+	Status    string          `json:"status"`
+	CreatedAt time.Time       `json:"created_at"`
+	Messages  []SharedMessage `json:"messages"`
+}
+
+type SharedMessage struct {
+	SenderEmail string    `json:"sender_email"`
+	HTML        string    `json:"html"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+const (
+	defaultShareDays   = 30
+	maxShareDays       = 90
+	maxSharesPerTicket = 20
+)
+
+// Create ticket shares table. Links stop working once a ticket is
+// archived, since the rows go with it.
+func createTicketSharesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ticket_shares (
+			id SERIAL PRIMARY KEY,
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			created_by VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS ticket_shares_ticket_idx ON ticket_shares (ticket_id)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create ticket_shares table:", err)
+	}
+}
+
+// GET/POST /tickets/{id}/share, DELETE /tickets/{id}/share/{shareID}.
+// Anyone who can read the ticket can share it; POST takes an optional
+// expires_in_days (30 by default, at most 90).
+func handleTicketShare(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if !fullFeatured() {
+		http.Error(w, "Share links require PostgreSQL", http.StatusNotImplemented)
+		return
+	}
+
+	user := currentUser(r)
+	ticket, err := findAccessibleTicket(r, ticketID)
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+	if !authorize(user, actionTicketRead, &ticket) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	idPart := ""
+	if len(parts) > 3 {
+		idPart = parts[3]
+	}
+
+	if idPart == "" {
+		switch r.Method {
+		case "GET":
+			rows, err := db.Query(`
+				SELECT id, created_by, created_at, expires_at FROM ticket_shares
+				WHERE ticket_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+				ORDER BY created_at
+			`, ticketID)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			shares := []TicketShare{}
+			for rows.Next() {
+				var s TicketShare
+				if err := rows.Scan(&s.ID, &s.CreatedBy, &s.CreatedAt, &s.ExpiresAt); err != nil {
+					continue
+				}
+				shares = append(shares, s)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(shares)
+
+		case "POST":
+			var req struct {
+				ExpiresInDays int `json:"expires_in_days"`
+			}
+			// An empty body takes the defaults
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					http.Error(w, "Invalid request", http.StatusBadRequest)
+					return
+				}
+			}
+			if req.ExpiresInDays == 0 {
+				req.ExpiresInDays = defaultShareDays
+			}
+			if req.ExpiresInDays < 1 || req.ExpiresInDays > maxShareDays {
+				http.Error(w, "expires_in_days must be 1-90", http.StatusBadRequest)
+				return
+			}
+
+			var active int
+			db.QueryRow(`
+				SELECT COUNT(*) FROM ticket_shares
+				WHERE ticket_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+			`, ticketID).Scan(&active)
+			if active >= maxSharesPerTicket {
+				http.Error(w, "Too many share links; revoke some first", http.StatusBadRequest)
+				return
+			}
+
+			buf := make([]byte, 32)
+			if _, err := rand.Read(buf); err != nil {
+				http.Error(w, "Failed to create link", http.StatusInternalServerError)
+				return
+			}
+			token := base64.RawURLEncoding.EncodeToString(buf)
+
+			s := TicketShare{CreatedBy: user.Email, URL: publicBaseURL() + "/shared/" + token}
+			err := db.QueryRow(`
+				INSERT INTO ticket_shares (ticket_id, token_hash, created_by, expires_at)
+				VALUES ($1, $2, $3, CURRENT_TIMESTAMP + make_interval(days => $4))
+				RETURNING id, created_at, expires_at
+			`, ticketID, hashToken(token), user.Email, req.ExpiresInDays).Scan(&s.ID, &s.CreatedAt, &s.ExpiresAt)
+			if err != nil {
+				http.Error(w, "Failed to create link", http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("✓ Share link #%d for ticket #%d created by %s", s.ID, ticketID, user.Email)
+			recordAudit(user.Email, "ticket.shared", ticketID, map[string]interface{}{"share_id": s.ID, "expires_at": s.ExpiresAt})
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(s)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	shareID, err := strconv.Atoi(idPart)
+	if err != nil {
+		http.Error(w, "Invalid share ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := db.Exec(`
+		UPDATE ticket_shares SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND ticket_id = $2 AND revoked_at IS NULL
+	`, shareID, ticketID)
+	if err != nil {
+		http.Error(w, "Failed to revoke link", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("✓ Share link #%d for ticket #%d revoked by %s", shareID, ticketID, user.Email)
+	recordAudit(user.Email, "ticket.share_revoked", ticketID, map[string]interface{}{"share_id": shareID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /shared/{token}: the ticket behind a share link, without internal
+// fields or delivery details
+func handleSharedTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/shared/")
+	if token == "" || strings.Contains(token, "/") {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+
+	var ticketID int
+	var t SharedTicket
+	err := db.QueryRow(`
+		SELECT t.id, COALESCE(t.reference, ''), t.subject, t.status, t.created_at
+		FROM ticket_shares s JOIN tickets t ON t.id = s.ticket_id
+		WHERE s.token_hash = $1 AND s.revoked_at IS NULL AND s.expires_at > CURRENT_TIMESTAMP
+	`, hashToken(token)).Scan(&ticketID, &t.Reference, &t.Subject, &t.Status, &t.CreatedAt)
+	if err != nil {
+		// Expired, revoked and made-up links look the same
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+
+	messages, err := store.Messages().List(ticketID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	t.Messages = []SharedMessage{}
+	for _, m := range messages {
+		t.Messages = append(t.Messages, SharedMessage{SenderEmail: m.SenderEmail, HTML: renderMarkdown(m.Message), CreatedAt: m.CreatedAt})
+	}
+
+	// Links are bearer credentials; keep them out of caches and referrers
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A weekly shift an agent works. A shift ending at or before its start
+// runs past midnight into the next day, e.g. 22:00-06:00.
+type Shift struct {
+	ID       int      `json:"id"`
+	Email    string   `json:"email"`
+	Timezone string   `json:"timezone"`
+	Days     []string `json:"days"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+}
+
+// Agents who take urgent tickets when nobody is on shift, each for
+// PeriodHours in turn starting at StartsAt. Tickets in UrgentCategories
+// are urgent.
+type OnCallRotation struct {
+	Agents           []string   `json:"agents"`
+	StartsAt         time.Time  `json:"starts_at"`
+	PeriodHours      int        `json:"period_hours"`
+	UrgentCategories []string   `json:"urgent_categories"`
+	Current          string     `json:"current,omitempty"`
+	NextHandover     *time.Time `json:"next_handover,omitempty"`
+}
+
+// Create shift and on-call tables
+func createShiftTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS agent_shifts (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+			days VARCHAR(30) NOT NULL,
+			start_time VARCHAR(5) NOT NULL,
+			end_time VARCHAR(5) NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS agent_shifts_user_idx ON agent_shifts (user_id);
+		CREATE TABLE IF NOT EXISTS on_call_rotation (
+			id INTEGER PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+			agents TEXT[] NOT NULL,
+			starts_at TIMESTAMP NOT NULL,
+			period_hours INTEGER NOT NULL,
+			urgent_categories TEXT[] NOT NULL DEFAULT '{}',
+			updated_by VARCHAR(255) NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create shift tables:", err)
+	}
+}
+
+// Check a shift before saving it
+func (s *Shift) validate() error {
+	if s.Timezone == "" {
+		s.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", s.Timezone)
+	}
+	if len(s.Days) == 0 {
+		return fmt.Errorf("at least one day is required")
+	}
+	for i, d := range s.Days {
+		s.Days[i] = strings.ToLower(d)
+		if !containsString(weekdayNames, s.Days[i]) {
+			return fmt.Errorf("unknown day %q", d)
+		}
+	}
+	start, err := parseClock(s.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(s.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("start and end must differ")
+	}
+	return nil
+}
+
+// Whether the shift is being worked at t
+func (s Shift) covers(t time.Time) bool {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return false
+	}
+	start, err1 := parseClock(s.Start)
+	end, err2 := parseClock(s.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	today := weekdayNames[local.Weekday()]
+	yesterday := weekdayNames[(local.Weekday()+6)%7]
+
+	if start < end {
+		return containsString(s.Days, today) && minute >= start && minute < end
+	}
+	return (containsString(s.Days, today) && minute >= start) ||
+		(containsString(s.Days, yesterday) && minute < end)
+}
+
+// All shifts, by agent email
+func listShifts() ([]Shift, error) {
+	rows, err := db.Query(`
+		SELECT s.id, u.email, s.timezone, s.days, s.start_time, s.end_time
+		FROM agent_shifts s JOIN users u ON u.id = s.user_id
+		ORDER BY u.email, s.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shifts := []Shift{}
+	for rows.Next() {
+		var s Shift
+		var days string
+		if err := rows.Scan(&s.ID, &s.Email, &s.Timezone, &days, &s.Start, &s.End); err != nil {
+			return nil, err
+		}
+		s.Days = strings.Split(days, ",")
+		shifts = append(shifts, s)
+	}
+	return shifts, rows.Err()
+}
+
+// Emails of agents on shift at t. scheduled is false when no shifts are
+// defined, in which case every agent counts as on shift.
+func onShiftAgents(t time.Time) (onShift map[string]bool, scheduled bool, err error) {
+	shifts, err := listShifts()
+	if err != nil {
+		return nil, false, err
+	}
+	onShift = map[string]bool{}
+	for _, s := range shifts {
+		if s.covers(t) {
+			onShift[strings.ToLower(s.Email)] = true
+		}
+	}
+	return onShift, len(shifts) > 0, nil
+}
+
+// The on-call rotation; ok is false if none is configured
+func onCallRotation() (OnCallRotation, bool, error) {
+	var rot OnCallRotation
+	err := db.QueryRow(`
+		SELECT agents, starts_at, period_hours, urgent_categories FROM on_call_rotation WHERE id = 1
+	`).Scan(pq.Array(&rot.Agents), &rot.StartsAt, &rot.PeriodHours, pq.Array(&rot.UrgentCategories))
+	if err == sql.ErrNoRows {
+		return rot, false, nil
+	}
+	return rot, err == nil, err
+}
+
+// Agent on call at t and when the next one takes over
+func (rot OnCallRotation) onCall(t time.Time) (string, time.Time) {
+	period := time.Duration(rot.PeriodHours) * time.Hour
+	if len(rot.Agents) == 0 || period <= 0 {
+		return "", time.Time{}
+	}
+	if t.Before(rot.StartsAt) {
+		return rot.Agents[0], rot.StartsAt.Add(period)
+	}
+	n := int64(t.Sub(rot.StartsAt) / period)
+	return rot.Agents[n%int64(len(rot.Agents))], rot.StartsAt.Add(time.Duration(n+1) * period)
+}
+
+func (rot OnCallRotation) urgent(t Ticket) bool {
+	return t.Category != "" && containsString(rot.UrgentCategories, t.Category)
+}
+
+// On-call agent for an urgent ticket arriving while nobody is on shift,
+// or "" if the ticket should wait for the next shift
+func afterHoursAssignee(t Ticket, now time.Time) (string, error) {
+	rot, ok, err := onCallRotation()
+	if err != nil || !ok || !rot.urgent(t) {
+		return "", err
+	}
+	onShift, scheduled, err := onShiftAgents(now)
+	if err != nil || !scheduled || len(onShift) > 0 {
+		return "", err
+	}
+	agent, _ := rot.onCall(now)
+	if agent == "" || !isAgent(agent) {
+		return "", nil
+	}
+	return agent, nil
+}
+
+// GET/POST /admin/shifts, DELETE /admin/shifts/{id}
+func handleShifts(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/shifts"), "/")
+
+	switch {
+	case idPart == "" && r.Method == "GET":
+		shifts, err := listShifts()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		onShift, _, _ := onShiftAgents(time.Now())
+		on := []string{}
+		for email := range onShift {
+			on = append(on, email)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"shifts": shifts, "on_shift": on})
+
+	case idPart == "" && r.Method == "POST":
+		var s Shift
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := s.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !isAgent(s.Email) {
+			http.Error(w, "Shifts are for agents", http.StatusBadRequest)
+			return
+		}
+		userID, err := store.Users().IDByEmail(s.Email)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusBadRequest)
+			return
+		}
+
+		err = db.QueryRow(`
+			INSERT INTO agent_shifts (user_id, timezone, days, start_time, end_time)
+			VALUES ($1, $2, $3, $4, $5) RETURNING id
+		`, userID, s.Timezone, strings.Join(s.Days, ","), s.Start, s.End).Scan(&s.ID)
+		if err != nil {
+			http.Error(w, "Failed to save shift", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ Shift #%d added for %s by %s", s.ID, s.Email, user.Email)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+
+	case idPart != "" && r.Method == "DELETE":
+		id, err := strconv.Atoi(idPart)
+		if err != nil {
+			http.Error(w, "Invalid shift ID", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec("DELETE FROM agent_shifts WHERE id = $1", id)
+		if err != nil {
+			http.Error(w, "Failed to remove shift", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Shift not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET/PUT/DELETE /admin/on_call
+func handleOnCall(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		rot, ok, err := onCallRotation()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+			return
+		}
+		rot.withCurrent(time.Now())
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "rotation": rot})
+
+	case "PUT":
+		var rot OnCallRotation
+		if err := json.NewDecoder(r.Body).Decode(&rot); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if len(rot.Agents) == 0 {
+			http.Error(w, "At least one agent is required", http.StatusBadRequest)
+			return
+		}
+		for _, a := range rot.Agents {
+			if !isAgent(a) {
+				http.Error(w, a+" is not an agent", http.StatusBadRequest)
+				return
+			}
+		}
+		if rot.PeriodHours <= 0 {
+			http.Error(w, "period_hours must be positive", http.StatusBadRequest)
+			return
+		}
+		if rot.StartsAt.IsZero() {
+			rot.StartsAt = time.Now().UTC().Truncate(time.Hour)
+		}
+		if rot.UrgentCategories == nil {
+			rot.UrgentCategories = []string{}
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO on_call_rotation (id, agents, starts_at, period_hours, urgent_categories, updated_by)
+			VALUES (1, $1, $2, $3, $4, $5)
+			ON CONFLICT (id) DO UPDATE SET agents = EXCLUDED.agents, starts_at = EXCLUDED.starts_at,
+				period_hours = EXCLUDED.period_hours, urgent_categories = EXCLUDED.urgent_categories,
+				updated_by = EXCLUDED.updated_by, updated_at = CURRENT_TIMESTAMP
+		`, pq.Array(rot.Agents), rot.StartsAt.UTC(), rot.PeriodHours, pq.Array(rot.UrgentCategories), user.Email)
+		if err != nil {
+			http.Error(w, "Failed to save rotation", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ On-call rotation of %d agents set by %s", len(rot.Agents), user.Email)
+		rot.withCurrent(time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "rotation": rot})
+
+	case "DELETE":
+		if _, err := db.Exec("DELETE FROM on_call_rotation"); err != nil {
+			http.Error(w, "Failed to remove rotation", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (rot *OnCallRotation) withCurrent(now time.Time) {
+	current, next := rot.onCall(now)
+	rot.Current = current
+	if !next.IsZero() {
+		rot.NextHandover = &next
+	}
+}
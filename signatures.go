@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Reply signature, appended to an agent's replies and to the emails
+// sent when they act on a ticket
+type Signature struct {
+	Body    string `json:"body"`
+	Enabled bool   `json:"enabled"`
+	Preview string `json:"preview,omitempty"`
+}
+
+const maxSignatureLength = 2000
+
+// Placeholders staff may use in signatures and replies
+var signaturePlaceholders = map[string]func(agent string, t Ticket) string{
+	"agent_email":      func(agent string, t Ticket) string { return agent },
+	"ticket_reference": func(agent string, t Ticket) string { return t.Reference },
+	"ticket_subject":   func(agent string, t Ticket) string { return t.Subject },
+	"customer_email":   func(agent string, t Ticket) string { return t.Email },
+	"date":             func(agent string, t Ticket) string { return time.Now().UTC().Format("2 January 2006") },
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// Create signatures table
+func createSignaturesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS agent_signatures (
+			user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			body TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create agent_signatures table:", err)
+	}
+}
+
+func (s Signature) validate() error {
+	if len(s.Body) > maxSignatureLength {
+		return newServiceError(errInvalid, "Signature is too long")
+	}
+	for _, m := range placeholderPattern.FindAllStringSubmatch(s.Body, -1) {
+		if signaturePlaceholders[m[1]] == nil {
+			return newServiceError(errInvalid, "Unknown placeholder {"+m[1]+"}")
+		}
+	}
+	return nil
+}
+
+// Fill in placeholders for a ticket
+func (s Signature) render(agent string, t Ticket) string {
+	return expandPlaceholders(s.Body, agent, t)
+}
+
+// Replace known placeholders in text; anything else in braces is left as is
+func expandPlaceholders(text, agent string, t Ticket) string {
+	return placeholderPattern.ReplaceAllStringFunc(text, func(p string) string {
+		if fn := signaturePlaceholders[p[1:len(p)-1]]; fn != nil {
+			return fn(agent, t)
+		}
+		return p
+	})
+}
+
+// Enabled signature of the agent with this email, rendered for t
+func signatureFor(email string, t Ticket) (string, bool) {
+	if !fullFeatured() {
+		return "", false
+	}
+	var s Signature
+	err := db.QueryRow(`
+		SELECT s.body, s.enabled FROM agent_signatures s JOIN users u ON u.id = s.user_id
+		WHERE lower(u.email) = lower($1)
+	`, email).Scan(&s.Body, &s.Enabled)
+	if err != nil || !s.Enabled || strings.TrimSpace(s.Body) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(s.render(email, t)), true
+}
+
+// Append the agent's signature to text, separated the usual way
+func appendSignature(text, agent string, t Ticket) string {
+	if sig, ok := signatureFor(agent, t); ok {
+		return text + "\n\n-- \n" + sig
+	}
+	return text
+}
+
+// GET/PUT/DELETE /me/signature
+func handleSignature(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	switch r.Method {
+	case "GET":
+		var s Signature
+		err := db.QueryRow("SELECT body, enabled FROM agent_signatures WHERE user_id = $1", user.ID).Scan(&s.Body, &s.Enabled)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		s.Preview = s.render(user.Email, sampleTicket)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+
+	case "PUT":
+		var s Signature
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := s.validate(); err != nil {
+			writeServiceError(w, err, "Invalid signature")
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO agent_signatures (user_id, body, enabled) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id) DO UPDATE SET body = EXCLUDED.body, enabled = EXCLUDED.enabled, updated_at = CURRENT_TIMESTAMP
+		`, user.ID, s.Body, s.Enabled)
+		if err != nil {
+			http.Error(w, "Failed to save signature", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ Signature updated by %s", user.Email)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+
+	case "DELETE":
+		if _, err := db.Exec("DELETE FROM agent_signatures WHERE user_id = $1", user.ID); err != nil {
+			http.Error(w, "Failed to remove signature", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
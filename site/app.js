@@ -5,6 +5,8 @@ const $ = sel => document.querySelector(sel);
 
 let currentUser = null;
 let currentTicketId = null;
+let capabilities = {};
+let notificationsTimer = null;
 
 const loginScreen = $('#login-screen');
 const appScreen = $('#app-screen');
@@ -25,6 +27,30 @@ const savedUser = sessionStorage.getItem('user');
 if (savedUser) {
   currentUser = JSON.parse(savedUser);
   showApp();
+} else {
+  trySSOLogin();
+}
+
+// Behind an SSO proxy the user is already signed in; trade that for a session
+async function trySSOLogin() {
+  try {
+    const caps = await fetch(`${API_BASE}/capabilities`).then(res => res.json());
+    if (!(caps.sso_providers || []).includes('proxy')) return;
+    loginForm.style.display = 'none';
+
+    const res = await fetch(`${API_BASE}/login/proxy`, {
+      method: 'POST',
+      credentials: 'include',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ cookie: true })
+    });
+    if (!res.ok) throw new Error('your SSO session was not accepted');
+    currentUser = await res.json();
+    sessionStorage.setItem('user', JSON.stringify(currentUser));
+    showApp();
+  } catch (err) {
+    showLoginMsg('Sign-in failed: ' + err.message, true);
+  }
 }
 
 loginForm.addEventListener('submit', async (e) => {
@@ -35,8 +61,9 @@ loginForm.addEventListener('submit', async (e) => {
   try {
     const res = await fetch(`${API_BASE}/login`, {
       method: 'POST',
+      credentials: 'include',
       headers: { 'Content-Type': 'application/json' },
-      body: JSON.stringify({ email, password })
+      body: JSON.stringify({ email, password, cookie: true })
     });
 
     if (!res.ok) throw new Error('Invalid credentials');
@@ -51,31 +78,82 @@ loginForm.addEventListener('submit', async (e) => {
   }
 });
 
+// API call with the session cookie. The page never sees the session
+// token; changes carry the CSRF token that goes with the cookie.
+async function api(path, options = {}) {
+  const headers = { ...(options.headers || {}) };
+  const method = (options.method || 'GET').toUpperCase();
+  if (method !== 'GET' && method !== 'HEAD') {
+    headers['X-CSRF-Token'] = await csrfToken();
+  }
+  return fetch(`${API_BASE}${path}`, { ...options, headers, credentials: 'include' });
+}
+
+let csrfTokenRequest = null;
+
+function csrfToken() {
+  if (!csrfTokenRequest) {
+    csrfTokenRequest = fetch(`${API_BASE}/csrf`, { credentials: 'include' })
+      .then(res => res.json())
+      .then(data => data.csrf_token)
+      .catch(err => {
+        csrfTokenRequest = null;
+        throw err;
+      });
+  }
+  return csrfTokenRequest;
+}
+
 $('#logout-btn').addEventListener('click', () => {
+  api(`/logout`, { method: 'POST' }).catch(() => {});
   currentUser = null;
   sessionStorage.removeItem('user');
+  clearInterval(notificationsTimer);
+  $('#notifications-bell').style.display = 'none';
   loginScreen.style.display = 'flex';
   appScreen.style.display = 'none';
   loginForm.reset();
+  if ((capabilities.sso_providers || []).includes('proxy')) {
+    showLoginMsg('Signed out. Reload the page to sign in again.', false);
+  }
 });
 
+function can(permission) {
+  return (currentUser.permissions || []).includes(permission);
+}
+
 function showApp() {
   loginScreen.style.display = 'none';
   appScreen.style.display = 'block';
   
   userInfo.textContent = `Logged in as ${currentUser.user_type}: ${currentUser.email}`;
   
-  if (currentUser.user_type === 'agent') {
-    submitSection.style.display = 'none';
-    ticketsTitle.textContent = 'All Tickets';
-  } else {
-    submitSection.style.display = 'block';
-    ticketsTitle.textContent = 'Your Tickets';
-  }
+  submitSection.style.display = can('tickets.create') ? 'block' : 'none';
+  ticketsTitle.textContent = can('tickets.read_all') ? 'All Tickets'
+    : can('tickets.read_org') ? 'Your Organization\'s Tickets' : 'Your Tickets';
   
+  loadCapabilities();
   loadTickets();
 }
 
+// Hide features this deployment doesn't have
+async function loadCapabilities() {
+  try {
+    const res = await fetch(`${API_BASE}/capabilities`);
+    if (!res.ok) return;
+    capabilities = await res.json();
+    $('#attachment-group').style.display = capabilities.attachments ? 'block' : 'none';
+    if (capabilities.notifications) {
+      $('#notifications-bell').style.display = 'block';
+      loadNotifications();
+      clearInterval(notificationsTimer);
+      notificationsTimer = setInterval(loadNotifications, 60000);
+    }
+  } catch (err) {
+    console.error('Failed to load capabilities:', err);
+  }
+}
+
 ticketForm.addEventListener('submit', async (e) => {
   e.preventDefault();
   
@@ -96,40 +174,36 @@ ticketForm.addEventListener('submit', async (e) => {
   showFormMsg('Submitting...');
   
   try {
-    let attachmentUrl = null;
+    let attachmentKey = null;
     
     if (attachmentFile) {
       const formData = new FormData();
       formData.append('file', attachmentFile);
       
-      const uploadRes = await fetch(`${API_BASE}/upload`, {
+      const uploadRes = await api(`/upload`, {
         method: 'POST',
-        headers: { 'Authorization': currentUser.token },
         body: formData
       });
       
       if (!uploadRes.ok) throw new Error('Failed to upload attachment');
       const uploadData = await uploadRes.json();
-      attachmentUrl = uploadData.url;
+      attachmentKey = uploadData.key;
     }
 
-    const res = await fetch(`${API_BASE}/tickets`, {
+    const res = await api(`/tickets`, {
       method: 'POST',
-      headers: { 
-        'Content-Type': 'application/json',
-        'Authorization': currentUser.token
-      },
+      headers: { 'Content-Type': 'application/json' },
       body: JSON.stringify({
         subject,
         description,
-        attachment_url: attachmentUrl
+        attachment_key: attachmentKey
       })
     });
     
     if (!res.ok) throw new Error(await res.text());
     
     const data = await res.json();
-    showFormMsg('Ticket created! #' + data.id, false);
+    showFormMsg('Ticket created! ' + data.reference, false);
     ticketForm.reset();
     loadTickets();
   } catch (err) {
@@ -137,35 +211,44 @@ ticketForm.addEventListener('submit', async (e) => {
   }
 });
 
-async function loadTickets() {
-  ticketsList.innerHTML = 'Loading...';
+// Path of the next page named in a paged response's Link header
+function nextPage(res) {
+  const match = /<([^>]+)>;\s*rel="next"/.exec(res.headers.get('Link') || '');
+  return match ? match[1] : null;
+}
+
+async function loadTickets(path = '/tickets') {
+  const more = path !== '/tickets';
+  if (!more) ticketsList.innerHTML = 'Loading...';
   
   try {
-    const res = await fetch(`${API_BASE}/tickets`, {
-      headers: { 'Authorization': currentUser.token }
-    });
+    const res = await api(path);
     
     if (!res.ok) throw new Error('Failed to load tickets');
     
     const tickets = await res.json();
     
-    if (!tickets || tickets.length === 0) {
+    if (!more && (!tickets || tickets.length === 0)) {
       ticketsList.innerHTML = '<p style="color:#6b7280">No tickets found.</p>';
       return;
     }
     
-    ticketsList.innerHTML = '';
-    tickets.reverse().forEach(ticket => {
+    if (more) {
+      ticketsList.querySelector('.load-more')?.remove();
+    } else {
+      ticketsList.innerHTML = '';
+    }
+    tickets.forEach(ticket => {
       const div = document.createElement('div');
       div.className = 'ticket';
       div.onclick = () => openTicketModal(ticket.id);
       
-      const statusClass = ticket.status === 'open' ? 'status-open' : 'status-closed';
+      const statusClass = ticket.status === 'closed' ? 'status-closed' : 'status-open';
       
       div.innerHTML = `
         <div class="ticket-header">
-          <strong>#${ticket.id} — ${escape(ticket.subject)}</strong>
-          <span class="ticket-status ${statusClass}">${ticket.status}</span>
+          <strong>${escape(ticket.reference)} — ${escape(ticket.subject)}</strong>
+          <span class="ticket-status ${statusClass}">${escape(ticket.status.replace(/_/g, ' '))}</span>
         </div>
         <div class="ticket-meta">
           ${escape(ticket.email)} • ${new Date(ticket.created_at).toLocaleString()}
@@ -176,6 +259,15 @@ async function loadTickets() {
       
       ticketsList.appendChild(div);
     });
+    
+    const next = nextPage(res);
+    if (next) {
+      const btn = document.createElement('button');
+      btn.className = 'btn-secondary load-more';
+      btn.textContent = 'Load more';
+      btn.onclick = () => loadTickets(next);
+      ticketsList.appendChild(btn);
+    }
   } catch (err) {
     ticketsList.innerHTML = `<p style="color:#dc2626">Error: ${err.message}</p>`;
   }
@@ -186,14 +278,12 @@ async function openTicketModal(ticketId) {
   
   try {
 
-    const res = await fetch(`${API_BASE}/tickets/${ticketId}`, {
-      headers: { 'Authorization': currentUser.token }
-    });
+    const res = await api(`/tickets/${ticketId}`);
     
     if (!res.ok) throw new Error('Failed to load ticket');
     const ticket = await res.json();
     
-    $('#modal-title').textContent = `Ticket #${ticket.id}`;
+    $('#modal-title').textContent = `Ticket ${ticket.reference}`;
     $('#ticket-details').innerHTML = `
       <div class="detail-row">
         <div class="detail-label">Subject</div>
@@ -202,8 +292,8 @@ async function openTicketModal(ticketId) {
       <div class="detail-row">
         <div class="detail-label">Status</div>
         <div class="detail-value">
-          <span class="ticket-status ${ticket.status === 'open' ? 'status-open' : 'status-closed'}">
-            ${ticket.status}
+          <span class="ticket-status ${ticket.status === 'closed' ? 'status-closed' : 'status-open'}">
+            ${escape(ticket.status.replace(/_/g, ' '))}
           </span>
         </div>
       </div>
@@ -215,6 +305,21 @@ async function openTicketModal(ticketId) {
         <div class="detail-label">Created At</div>
         <div class="detail-value">${new Date(ticket.created_at).toLocaleString()}</div>
       </div>
+      ${ticket.entitlement ? `
+        <div class="detail-row">
+          <div class="detail-label">Contract</div>
+          <div class="detail-value">
+            ${ticket.entitlement.tier ? escape(ticket.entitlement.tier) + ' • ' : ''}${escape(ticket.entitlement.status)}
+            ${ticket.entitlement.warning ? `<div class="entitlement-warning">⚠ ${escape(ticket.entitlement.warning)}</div>` : ''}
+          </div>
+        </div>
+      ` : ''}
+      ${ticket.tasks ? `
+        <div class="detail-row">
+          <div class="detail-label">Tasks</div>
+          <div class="detail-value">${ticket.tasks.done} of ${ticket.tasks.total} done</div>
+        </div>
+      ` : ''}
       ${ticket.closed_by ? `
         <div class="detail-row">
           <div class="detail-label">Closed By</div>
@@ -235,8 +340,19 @@ async function openTicketModal(ticketId) {
           </div>
         </div>
       ` : ''}
+      <div class="detail-row">
+        <div class="detail-label">Export</div>
+        <div class="detail-value">
+          <a href="#" id="export-pdf-link" class="attachment-link">📄 Download PDF</a>
+        </div>
+      </div>
     `;
+    $('#export-pdf-link').addEventListener('click', (e) => {
+      e.preventDefault();
+      downloadTicketPDF(ticket);
+    });
     
+    if ((capabilities.context_providers || []).length > 0 && can('tickets.read_all')) loadTicketContext(ticketId);
     loadMessages(ticketId);
     
     if (ticket.status === 'closed') {
@@ -245,6 +361,8 @@ async function openTicketModal(ticketId) {
     } else {
       closeTicketBtn.style.display = 'block';
       replyForm.style.display = 'block';
+      $('#reply-signature-group').style.display = can('tickets.reply_all') && capabilities.database === 'postgres' ? 'block' : 'none';
+      $('#reply-signature').checked = true;
     }
     
     ticketModal.style.display = 'flex';
@@ -253,14 +371,79 @@ async function openTicketModal(ticketId) {
   }
 }
 
-async function loadMessages(ticketId) {
+// Agent-only panels with external context about the requester
+// (billing, CRM, ...), one row per provider
+async function loadTicketContext(ticketId) {
   try {
-    const res = await fetch(`${API_BASE}/tickets/${ticketId}/messages`, {
-      headers: { 'Authorization': currentUser.token }
+    const res = await api(`/tickets/${ticketId}/context`);
+    if (!res.ok || ticketId !== currentTicketId) return;
+    const data = await res.json();
+
+    data.providers.forEach(name => {
+      let html;
+      if (data.errors[name]) {
+        html = `<span class="muted">${escape(name)} is ${escape(data.errors[name])}</span>`;
+      } else if (!data.context[name]) {
+        html = '<span class="muted">No record for this requester</span>';
+      } else if (name === 'billing') {
+        html = renderBillingContext(data.context[name]);
+      } else {
+        html = Object.entries(data.context[name])
+          .filter(([, v]) => v === null || typeof v !== 'object')
+          .map(([k, v]) => `<div><span class="muted">${escape(k)}:</span> ${escape(String(v))}</div>`)
+          .join('');
+      }
+
+      const row = document.createElement('div');
+      row.className = 'detail-row context-panel';
+      row.innerHTML = `<div class="detail-label">${escape(name.charAt(0).toUpperCase() + name.slice(1))}</div>
+        <div class="detail-value">${html}</div>`;
+      $('#ticket-details').appendChild(row);
     });
-    
-    if (!res.ok) throw new Error('Failed to load messages');
-    const messages = await res.json();
+  } catch (err) {
+    console.error('Failed to load ticket context:', err);
+  }
+}
+
+function renderBillingContext(b) {
+  const inv = b.last_invoice;
+  return `
+    <div><strong>${escape(b.plan || 'No subscription')}</strong>
+      ${b.subscription_status ? `(${escape(b.subscription_status)})` : ''}
+      ${b.delinquent ? '<span class="billing-delinquent">Delinquent</span>' : ''}
+    </div>
+    ${inv ? `<div>Last invoice ${escape(inv.number)}: ${escape(inv.status)},
+      ${(inv.amount_due / 100).toFixed(2)} ${escape(inv.currency.toUpperCase())}</div>` : ''}
+    <a href="${b.dashboard_url}" target="_blank" class="attachment-link">Open in Stripe</a>
+  `;
+}
+
+// The export needs the session, so fetch it and hand the browser a blob
+async function downloadTicketPDF(ticket) {
+  try {
+    const res = await api(`/tickets/${ticket.id}/export.pdf`);
+    if (!res.ok) throw new Error('Failed to export ticket');
+
+    const url = URL.createObjectURL(await res.blob());
+    const link = document.createElement('a');
+    link.href = url;
+    link.download = `${ticket.reference}.pdf`;
+    link.click();
+    URL.revokeObjectURL(url);
+  } catch (err) {
+    alert('Error: ' + err.message);
+  }
+}
+
+async function loadMessages(ticketId) {
+  try {
+    let messages = [];
+    for (let path = `/tickets/${ticketId}/messages`; path; ) {
+      const res = await api(path);
+      if (!res.ok) throw new Error('Failed to load messages');
+      messages = messages.concat(await res.json());
+      path = nextPage(res);
+    }
     
     const messagesList = $('#messages-list');
     
@@ -278,7 +461,10 @@ async function loadMessages(ticketId) {
           <span class="message-sender">${escape(msg.sender_email)}</span>
           <span class="message-time">${new Date(msg.created_at).toLocaleString()}</span>
         </div>
-        <div class="message-text">${escape(msg.message)}</div>
+        ${['bounced', 'complained', 'failed', 'suppressed'].includes(msg.delivery_status) ? `
+          <div class="message-delivery-failed">⚠ Email notification not delivered (${escape(msg.delivery_status)})</div>
+        ` : ''}
+        <div class="message-text">${msg.html || escape(msg.message)}</div>
       `;
       messagesList.appendChild(div);
     });
@@ -296,32 +482,48 @@ replyForm.addEventListener('submit', async (e) => {
   if (!message) return;
   
   try {
-    const res = await fetch(`${API_BASE}/tickets/${currentTicketId}/messages`, {
+    const res = await api(`/tickets/${currentTicketId}/messages`, {
       method: 'POST',
-      headers: { 
-        'Content-Type': 'application/json',
-        'Authorization': currentUser.token
-      },
-      body: JSON.stringify({ message })
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ message, signature: $('#reply-signature').checked })
     });
     
     if (!res.ok) throw new Error('Failed to send message');
     
     $('#reply-message').value = '';
+    $('#reply-preview').style.display = 'none';
     loadMessages(currentTicketId);
   } catch (err) {
     alert('Error: ' + err.message);
   }
 });
 
+// Show the draft as it will be stored and displayed, signature included
+$('#reply-preview-btn').addEventListener('click', async () => {
+  const message = $('#reply-message').value.trim();
+  if (!message) return;
+
+  try {
+    const res = await api(`/preview`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ ticket_id: currentTicketId, message, signature: $('#reply-signature').checked })
+    });
+    if (!res.ok) throw new Error('Failed to render preview');
+    const preview = await res.json();
+    const box = $('#reply-preview');
+    box.innerHTML = `<div class="message-text">${preview.html}</div>`;
+    box.style.display = 'block';
+  } catch (err) {
+    alert('Error: ' + err.message);
+  }
+});
+
 closeTicketBtn.addEventListener('click', async () => {
   if (!confirm('Are you sure you want to close this ticket?')) return;
   
   try {
-    const res = await fetch(`${API_BASE}/tickets/${currentTicketId}/close`, {
-      method: 'POST',
-      headers: { 'Authorization': currentUser.token }
-    });
+    const res = await api(`/tickets/${currentTicketId}/close`, { method: 'POST' });
     
     if (!res.ok) throw new Error('Failed to close ticket');
     
@@ -343,7 +545,54 @@ ticketModal.addEventListener('click', (e) => {
   }
 });
 
-$('#refresh').addEventListener('click', loadTickets);
+$('#refresh').addEventListener('click', () => loadTickets());
+
+// In-app notification inbox
+async function loadNotifications() {
+  if (!currentUser) return;
+  try {
+    const res = await api(`/me/notifications`);
+    if (!res.ok) return;
+    const data = await res.json();
+
+    const count = $('#bell-count');
+    count.textContent = data.unread_count > 0 ? data.unread_count : '';
+    count.style.display = data.unread_count > 0 ? 'inline-block' : 'none';
+
+    const list = $('#notifications-list');
+    if (data.notifications.length === 0) {
+      list.innerHTML = '<p class="notifications-empty">No notifications</p>';
+      return;
+    }
+    list.innerHTML = data.notifications.map(n => `
+      <div class="notification ${n.read_at ? '' : 'notification-unread'}" data-id="${n.id}" data-ticket="${n.ticket_id}">
+        <div>${escape(n.summary)}</div>
+        <small>${new Date(n.created_at).toLocaleString()}</small>
+      </div>
+    `).join('');
+
+    list.querySelectorAll('.notification').forEach(el => {
+      el.addEventListener('click', async () => {
+        await api(`/me/notifications/${el.dataset.id}/read`, { method: 'POST' }).catch(() => {});
+        $('#notifications-panel').style.display = 'none';
+        loadNotifications();
+        if (el.dataset.ticket !== '0') openTicketModal(Number(el.dataset.ticket));
+      });
+    });
+  } catch (err) {
+    console.error('Failed to load notifications:', err);
+  }
+}
+
+$('#bell-btn').addEventListener('click', () => {
+  const panel = $('#notifications-panel');
+  panel.style.display = panel.style.display === 'none' ? 'block' : 'none';
+});
+
+$('#notifications-read-all').addEventListener('click', async () => {
+  await api(`/me/notifications/read_all`, { method: 'POST' }).catch(() => {});
+  loadNotifications();
+});
 
 function showLoginMsg(text, isError) {
   loginMsg.textContent = text;
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Response-time targets, configured in hours
+func slaTarget(env string, defaultHours int) time.Duration {
+	hours := defaultHours
+	if v, err := strconv.Atoi(os.Getenv(env)); err == nil && v > 0 {
+		hours = v
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// Time allowed before the first staff reply
+func slaFirstResponseTarget() time.Duration {
+	return slaTarget("SLA_FIRST_RESPONSE_HOURS", 24)
+}
+
+// Time allowed before a ticket is closed
+func slaResolutionTarget() time.Duration {
+	return slaTarget("SLA_RESOLUTION_HOURS", 72)
+}
+
+// Fill in when each ticket's first response and resolution are due, and
+// when it first got a response, so clients needn't repeat the math
+func setResponseTargets(tickets []Ticket) {
+	ids := make([]int, len(tickets))
+	for i := range tickets {
+		ids[i] = tickets[i].ID
+	}
+	responses, err := store.Messages().FirstResponses(ids)
+	if err != nil {
+		dbLog.Errorf("Error loading first responses: %v", err)
+	}
+
+	for i := range tickets {
+		t := &tickets[i]
+		firstDue := t.CreatedAt.Add(slaFirstResponseTarget())
+		resolutionDue := t.CreatedAt.Add(slaResolutionTarget())
+		t.FirstResponseDueAt, t.ResolutionDueAt = &firstDue, &resolutionDue
+		if at, ok := responses[t.ID]; ok {
+			t.FirstRespondedAt = &at
+		}
+	}
+}
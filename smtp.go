@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTP transport for deployments without SES. Connections are kept in a
+// small pool and reused across messages.
+type smtpTransport struct {
+	addr     string
+	host     string
+	from     string
+	auth     smtp.Auth
+	startTLS bool
+	dkim     *dkimSigner
+	pool     chan *smtp.Client
+}
+
+// Build an SMTP transport from SMTP_HOST, SMTP_PORT, SMTP_USERNAME,
+// SMTP_PASSWORD, SMTP_STARTTLS and SMTP_POOL_SIZE, signing with DKIM when
+// a key is configured
+func newSMTPTransport(from string) (*smtpTransport, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, fmt.Errorf("SMTP_HOST not set")
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	poolSize := 4
+	if v, err := strconv.Atoi(os.Getenv("SMTP_POOL_SIZE")); err == nil && v > 0 {
+		poolSize = v
+	}
+
+	t := &smtpTransport{
+		addr:     net.JoinHostPort(host, port),
+		host:     host,
+		from:     from,
+		startTLS: os.Getenv("SMTP_STARTTLS") != "false",
+		pool:     make(chan *smtp.Client, poolSize),
+	}
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		t.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	dkim, err := loadDKIMSigner()
+	if err != nil {
+		return nil, fmt.Errorf("DKIM: %w", err)
+	}
+	t.dkim = dkim
+	return t, nil
+}
+
+// Take an idle connection from the pool, or dial a new one
+func (t *smtpTransport) conn() (*smtp.Client, error) {
+	for {
+		select {
+		case c := <-t.pool:
+			// Drop connections the server has closed while idle
+			if c.Reset() == nil {
+				return c, nil
+			}
+			notifyLog.Debugf("Dropping closed SMTP connection to %s", t.addr)
+			c.Close()
+		default:
+			return t.dial()
+		}
+	}
+}
+
+func (t *smtpTransport) dial() (*smtp.Client, error) {
+	notifyLog.Debugf("Dialing SMTP server %s (STARTTLS %t)", t.addr, t.startTLS)
+	nc, err := net.DialTimeout("tcp", t.addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c, err := smtp.NewClient(nc, t.host)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	if t.startTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("%s does not support STARTTLS", t.addr)
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: t.host}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if t.auth != nil {
+		if err := c.Auth(t.auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Return a healthy connection to the pool, closing it if the pool is full
+func (t *smtpTransport) release(c *smtp.Client) {
+	select {
+	case t.pool <- c:
+	default:
+		c.Quit()
+	}
+}
+
+func (t *smtpTransport) Send(to, subject, body string) (string, error) {
+	messageID := newMessageID(t.from)
+	msg := buildMessage(t.from, to, subject, body, messageID)
+	if t.dkim != nil {
+		signed, err := t.dkim.Sign(msg)
+		if err != nil {
+			return "", err
+		}
+		msg = signed
+	}
+
+	c, err := t.conn()
+	if err != nil {
+		return "", err
+	}
+	if err := t.deliver(c, to, msg); err != nil {
+		c.Close()
+		return "", err
+	}
+	t.release(c)
+	notifyLog.Debugf("SMTP server %s accepted <%s> for %s", t.addr, messageID, to)
+
+	return messageID, nil
+}
+
+func (t *smtpTransport) deliver(c *smtp.Client, to string, msg []byte) error {
+	if err := c.Mail(addressOf(t.from)); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Plain-text RFC 5322 message with CRLF line endings
+func buildMessage(from, to, subject, body, messageID string) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("Message-ID: <" + messageID + ">\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Unique Message-ID in the sender's domain
+func newMessageID(from string) string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	domain := "localhost"
+	if at := strings.LastIndex(addressOf(from), "@"); at >= 0 {
+		domain = addressOf(from)[at+1:]
+	}
+	return hex.EncodeToString(buf) + "@" + domain
+}
+
+// Bare address from "Name <addr>" or "addr"
+func addressOf(from string) string {
+	if i := strings.Index(from, "<"); i >= 0 {
+		return strings.TrimSuffix(from[i+1:], ">")
+	}
+	return from
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	startupRetryBase = time.Second
+	startupRetryMax  = 30 * time.Second
+)
+
+// Number of attempts for each startup dependency (STARTUP_RETRY_ATTEMPTS)
+func startupRetryAttempts() int {
+	if n, err := strconv.Atoi(os.Getenv("STARTUP_RETRY_ATTEMPTS")); err == nil && n > 0 {
+		return n
+	}
+	return 10
+}
+
+// Retry fn with exponential backoff so the service can start before its
+// dependencies (docker-compose, ECS) instead of exiting on the first failure
+func retryStartup(name string, fn func() error) error {
+	attempts := startupRetryAttempts()
+	delay := startupRetryBase
+
+	var err error
+	for i := 1; i <= attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if i == attempts {
+			break
+		}
+		log.Printf("Waiting for %s (attempt %d/%d): %v; retrying in %s", name, i, attempts, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > startupRetryMax {
+			delay = startupRetryMax
+		}
+	}
+	return fmt.Errorf("%s unavailable after %d attempts: %w", name, attempts, err)
+}
+
+// Verify the S3 credentials and bucket are usable. S3 is only needed for
+// attachments and exports, so a failure disables attachments rather than
+// stopping the service.
+func checkS3() {
+	bucket := os.Getenv("S3_BUCKET_NAME")
+	if s3Client == nil || bucket == "" {
+		storageLog.Warnf("S3 not configured, attachments disabled")
+		return
+	}
+
+	err := retryStartup("S3", func() error {
+		_, err := s3Client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+		return err
+	})
+	if err != nil {
+		storageLog.Warnf("%v; attachments disabled", err)
+		return
+	}
+	attachmentsEnabled = true
+	storageLog.Printf("✓ S3 bucket reachable")
+	checkStorageLocations()
+}
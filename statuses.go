@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Statuses a ticket moves through, and where each may go next. Tickets
+// start open; closed is what CSAT, archival and the open-ticket counts
+// key on, so every workflow has both. TICKET_WORKFLOW replaces this with
+// a JSON object of the same shape.
+var defaultTicketWorkflow = map[string][]string{
+	"open":                {"in_progress", "waiting_on_customer", "resolved", "closed"},
+	"in_progress":         {"open", "waiting_on_customer", "resolved", "closed"},
+	"waiting_on_customer": {"in_progress", "resolved", "closed"},
+	"resolved":            {"in_progress", "closed"},
+	"closed":              {},
+}
+
+var ticketWorkflow = defaultTicketWorkflow
+
+var statusNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// Load TICKET_WORKFLOW, if set
+func loadTicketWorkflow() {
+	raw := os.Getenv("TICKET_WORKFLOW")
+	if raw == "" {
+		return
+	}
+
+	var workflow map[string][]string
+	if err := json.Unmarshal([]byte(raw), &workflow); err != nil {
+		log.Fatal("TICKET_WORKFLOW is not a JSON object of status lists:", err)
+	}
+	for _, required := range []string{"open", "closed"} {
+		if _, ok := workflow[required]; !ok {
+			log.Fatalf("TICKET_WORKFLOW must include the %s status", required)
+		}
+	}
+	for from, next := range workflow {
+		if !statusNamePattern.MatchString(from) {
+			log.Fatalf("TICKET_WORKFLOW status %q must be lowercase letters, digits and underscores", from)
+		}
+		for _, to := range next {
+			if _, ok := workflow[to]; !ok {
+				log.Fatalf("TICKET_WORKFLOW lets %s move to %q, which isn't a status", from, to)
+			}
+		}
+	}
+
+	ticketWorkflow = workflow
+	log.Printf("✓ Ticket workflow with %d statuses loaded", len(workflow))
+}
+
+func validStatus(status string) bool {
+	_, ok := ticketWorkflow[status]
+	return ok
+}
+
+func canTransition(from, to string) bool {
+	return containsString(ticketWorkflow[from], to)
+}
+
+// Status change recorded in a ticket's history
+type StatusChange struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	ChangedBy string    `json:"changed_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Returned by the store when the ticket left the expected status meanwhile
+var errStatusChanged = errors.New("ticket status changed")
+
+// Create the status history table
+func createStatusHistoryTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ticket_status_history (
+			id SERIAL PRIMARY KEY,
+			ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+			from_status VARCHAR(50) NOT NULL,
+			to_status VARCHAR(50) NOT NULL,
+			changed_by VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS ticket_status_history_ticket_idx ON ticket_status_history (ticket_id, created_at)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create ticket_status_history table:", err)
+	}
+}
+
+// GET /tickets/{id}/status: current status, where it may go next and
+// its history. PATCH: move the ticket to another status.
+func handleTicketStatus(w http.ResponseWriter, r *http.Request, ticketID int) {
+	user := currentUser(r)
+
+	switch r.Method {
+	case "GET":
+		ticket, err := ticketService.Get(user, ticketID)
+		if err != nil {
+			writeServiceError(w, err, "Database error")
+			return
+		}
+		history, err := store.Tickets().StatusHistory(ticketID)
+		if err != nil {
+			log.Printf("Error loading status history of ticket #%d: %v", ticketID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		next := []string{}
+		for _, to := range ticketWorkflow[ticket.Status] {
+			if to == "closed" && !authorize(user, actionTicketClose, &ticket) {
+				continue
+			}
+			if to != "closed" && !authorize(user, permTicketsAssign, nil) {
+				continue
+			}
+			next = append(next, to)
+		}
+		sort.Strings(next)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":      ticket.Status,
+			"transitions": next,
+			"history":     history,
+		})
+
+	case "PATCH":
+		var req struct {
+			Status string `json:"status"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		ticket, err := ticketService.SetStatus(user, ticketID, req.Status)
+		if err != nil {
+			if _, ok := err.(*serviceError); !ok {
+				log.Printf("Error changing status of ticket #%d: %v", ticketID, err)
+			}
+			writeServiceError(w, err, "Failed to change status")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Status updated", "status": ticket.Status})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Data residency: an organization's attachments can be kept in a bucket of
+// their own, e.g. in the EU for European customers. Locations are named in
+// S3_LOCATIONS as name=bucket@region pairs:
+//
+//	S3_LOCATIONS=eu=sts-eu-files@eu-west-1,us=sts-us-files@us-east-1
+//
+// New uploads go to the uploader's organization's location (a reply's files
+// to the ticket's), everything else to S3_BUCKET_NAME. Each attachment row
+// records where its object was written, so moving an organization only
+// affects new uploads and older files are still found. Files are never
+// linked to a ticket stored elsewhere.
+
+// Attachments kept in the default bucket are recorded without a location
+const defaultStorageLocation = ""
+
+type storageLocation struct {
+	Bucket string
+	Region string
+	client *s3.S3
+}
+
+var storageLocations = map[string]*storageLocation{}
+
+// Location of each object key, as recorded in attachments; keys don't
+// change location, so entries never go stale
+var keyLocations = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+const maxKeyLocations = 10000
+
+// Parse S3_LOCATIONS and create a client for each region
+func loadStorageLocations() {
+	spec := strings.TrimSpace(os.Getenv("S3_LOCATIONS"))
+	if spec == "" {
+		return
+	}
+	clients := map[string]*s3.S3{}
+	for _, entry := range strings.Split(spec, ",") {
+		name, target, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		bucket, region, _ := strings.Cut(target, "@")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || bucket == "" || region == "" {
+			log.Fatalf("Invalid S3_LOCATIONS entry %q: want name=bucket@region", entry)
+		}
+		if storageLocations[name] != nil {
+			log.Fatalf("Storage location %q given twice in S3_LOCATIONS", name)
+		}
+		if clients[region] == nil {
+			sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+			if err != nil {
+				log.Fatalf("Failed to create AWS session for %s: %v", region, err)
+			}
+			clients[region] = newS3Client(sess)
+		}
+		storageLocations[name] = &storageLocation{Bucket: bucket, Region: region, client: clients[region]}
+	}
+	storageLog.Printf("✓ Storage locations: %s", strings.Join(storageLocationNames(), ", "))
+}
+
+func newS3Client(sess *session.Session) *s3.S3 {
+	client := s3.New(sess)
+	if faultInjectionEnabled() {
+		addS3FaultHandler(&client.Handlers)
+	}
+	addS3LogHandler(&client.Handlers)
+	return client
+}
+
+func storageLocationNames() []string {
+	names := make([]string, 0, len(storageLocations))
+	for name := range storageLocations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check each location's bucket once at startup. An unreachable one only
+// fails uploads routed to it; they never fall back to the default bucket.
+func checkStorageLocations() {
+	for _, name := range storageLocationNames() {
+		loc := storageLocations[name]
+		_, err := loc.client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(loc.Bucket)})
+		if err != nil {
+			storageLog.Warnf("S3 bucket %s for storage location %s unreachable: %v", loc.Bucket, name, err)
+			continue
+		}
+		storageLog.Printf("✓ S3 bucket for storage location %s reachable", name)
+	}
+}
+
+// Record which location attachment objects and organizations use
+func createStorageLocationColumns() {
+	_, err := db.Exec(`
+		ALTER TABLE organizations ADD COLUMN IF NOT EXISTS storage_location VARCHAR(50);
+		ALTER TABLE attachments ADD COLUMN IF NOT EXISTS storage_location VARCHAR(50)
+	`)
+	if err != nil {
+		log.Fatal("Failed to add storage location columns:", err)
+	}
+}
+
+// Client and bucket of a location; unknown names have neither
+func locationStorage(name string) (*s3.S3, string) {
+	if name == defaultStorageLocation {
+		return s3Client, os.Getenv("S3_BUCKET_NAME")
+	}
+	if loc := storageLocations[name]; loc != nil {
+		return loc.client, loc.Bucket
+	}
+	return nil, ""
+}
+
+// Location new uploads of an organization go to
+func orgStorageLocation(orgID int) string {
+	if len(storageLocations) == 0 || orgID == 0 || !fullFeatured() {
+		return defaultStorageLocation
+	}
+	var name sql.NullString
+	db.QueryRow("SELECT storage_location FROM organizations WHERE id = $1", orgID).Scan(&name)
+	return name.String
+}
+
+// Organization whose storage location an address's uploads and tickets use
+func storageOrgID(email string) int {
+	if len(storageLocations) == 0 || !fullFeatured() {
+		return 0
+	}
+	return int(orgIDForEmail(email).Int64)
+}
+
+// Location an attachment object was written to
+func keyLocation(key string) string {
+	if len(storageLocations) == 0 || !fullFeatured() {
+		return defaultStorageLocation
+	}
+	keyLocations.Lock()
+	name, ok := keyLocations.m[key]
+	keyLocations.Unlock()
+	if ok {
+		return name
+	}
+
+	var loc sql.NullString
+	err := db.QueryRow("SELECT storage_location FROM attachments WHERE s3_key = $1", key).Scan(&loc)
+	if err != nil && err != sql.ErrNoRows {
+		storageLog.Errorf("Error looking up storage location of %s: %v", key, err)
+		return defaultStorageLocation
+	}
+	// Unrecorded keys may be recorded by the upload still in progress
+	if err == nil {
+		rememberKeyLocation(key, loc.String)
+	}
+	return loc.String
+}
+
+func rememberKeyLocation(key, name string) {
+	keyLocations.Lock()
+	defer keyLocations.Unlock()
+	if len(keyLocations.m) >= maxKeyLocations {
+		keyLocations.m = map[string]string{}
+	}
+	keyLocations.m[key] = name
+}
+
+// Client and bucket holding an attachment object
+func storageFor(key string) (*s3.S3, string) {
+	return locationStorage(keyLocation(key))
+}
+
+// Refuse files stored outside the location of the organization a ticket
+// belongs to
+func checkAttachmentLocations(orgID int, attachments []Attachment) error {
+	if len(storageLocations) == 0 || len(attachments) == 0 {
+		return nil
+	}
+	want := orgStorageLocation(orgID)
+	for _, a := range attachments {
+		if keyLocation(a.Key) != want {
+			return newServiceError(errInvalid, "Attachment is stored outside the organization's storage location")
+		}
+	}
+	return nil
+}
+
+// GET/PUT /admin/organizations/{id}/storage
+func handleOrganizationStorage(w http.ResponseWriter, r *http.Request, orgID int64) {
+	switch r.Method {
+	case "GET":
+		// Reported below
+
+	case "PUT":
+		var req struct {
+			StorageLocation string `json:"storage_location"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		name := strings.ToLower(strings.TrimSpace(req.StorageLocation))
+		if name != defaultStorageLocation && storageLocations[name] == nil {
+			http.Error(w, fmt.Sprintf("Unknown storage location %q", req.StorageLocation), http.StatusBadRequest)
+			return
+		}
+		if _, err := db.Exec("UPDATE organizations SET storage_location = NULLIF($1, '') WHERE id = $2", name, orgID); err != nil {
+			http.Error(w, "Failed to save storage location", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("✓ Storage location of organization %d set to %q by %s", orgID, name, currentUser(r).Email)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"storage_location": orgStorageLocation(int(orgID)),
+		"available":        storageLocationNames(),
+	})
+}
+
+// Storage location of each attachment in a backup's attachments table
+func backupKeyLocations(table []byte) (map[string]string, error) {
+	locations := map[string]string{}
+	dec := json.NewDecoder(strings.NewReader(string(table)))
+	for dec.More() {
+		var row struct {
+			S3Key           string  `json:"s3_key"`
+			StorageLocation *string `json:"storage_location"`
+		}
+		if err := dec.Decode(&row); err != nil {
+			return nil, err
+		}
+		if row.StorageLocation != nil {
+			locations[row.S3Key] = *row.StorageLocation
+		}
+	}
+	return locations, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"time"
+)
+
+// Storage for the core ticket workflow: tickets, their messages, and
+// users with their sessions. Only these go through repositories, so the
+// workflow runs on every driver. Postgres is the full implementation;
+// SQLite lets single-node installs run without a database server.
+// Everything else (organizations, registrations, shares, SCIM, reports
+// and so on) queries db directly and needs Postgres: their routes are
+// marked requiresPostgres, or they check fullFeatured().
+type Store interface {
+	// Create or migrate the schema
+	Migrate() error
+
+	Tickets() TicketRepo
+	Messages() MessageRepo
+	Users() UserRepo
+}
+
+// Tickets, limited to those the given user may see
+type TicketRepo interface {
+	// Tickets matching filter, one page of them if filter.Page is set,
+	// and how many match in all
+	List(user User, filter TicketFilter) ([]Ticket, int, error)
+	Find(user User, id int) (Ticket, error)
+	IDByReference(ref string) (int, error)
+	Create(ticket *Ticket, user User) error
+	// Move the ticket from one status to another, recording who did it;
+	// errStatusChanged if it's no longer in from
+	SetStatus(id int, from, to, changedBy string) error
+	StatusHistory(id int) ([]StatusChange, error)
+	Assign(id int, assignee string) error
+	// Assign the ticket only if nobody has it; errAlreadyAssigned if
+	// someone does
+	Claim(id int, assignee string) error
+	// Move the ticket to another requester's account
+	SetRequester(id int, email string) error
+	SetPriority(id int, priority string) error
+	Rate(id int, score int, comment string) error
+	// Files attached to tickets themselves, not to their messages
+	Attachments(ids []int) (map[int][]Attachment, error)
+	// Record an uploaded file before it's linked to a ticket or message;
+	// size and location are only kept where storage quotas are
+	RecordUpload(key, email string, size int64, location string) error
+	// Who uploaded a file; sql.ErrNoRows if it was never recorded
+	Uploader(key string) (string, error)
+}
+
+// Ticket conversation threads
+type MessageRepo interface {
+	List(ticketID int) ([]Message, error)
+	// One page of the thread, and how many messages it has in all
+	ListPage(ticketID int, page Page) ([]Message, int, error)
+	Create(msg *Message) error
+	// When each ticket first got a message from someone other than its
+	// requester, not counting its description, which stays with whoever
+	// first requested it; tickets without one are left out
+	FirstResponses(ticketIDs []int) (map[int]time.Time, error)
+}
+
+// Users, their sessions and security history
+type UserRepo interface {
+	// Active user with email and their stored password, a bcrypt hash
+	// or, for rows from before hashing, the password itself
+	PasswordHash(email string) (User, string, error)
+	SetPasswordHash(userID int, hash string) error
+	// Users whose password is still stored as plaintext
+	PlaintextPasswords() (map[int]string, error)
+	// Set the hash unless the stored password changed from old meanwhile
+	ReplacePassword(userID int, old, hash string) error
+	// Existing user with email, or a new one with the given role and
+	// password; created reports which. Deactivated users aren't returned
+	// (sql.ErrNoRows).
+	Provision(email, password, userType string) (user User, created bool, err error)
+	IDByEmail(email string) (int, error)
+	// Role of an active user
+	RoleOf(email string) (string, error)
+	// Active users with one of the roles, by ID
+	WithRoles(roles []string) ([]User, error)
+	SetRole(userID int, role string) error
+	Roles() (map[string]map[string]bool, error)
+
+	CreateSession(id string, userID int, tokenHash, userAgent, ip string) error
+	SessionUser(tokenHash string) (User, string, error)
+	TouchSession(id, ip string) error
+	ListSessions(userID int) ([]Session, error)
+	// Revoke one session (userID 0 skips the ownership check)
+	RevokeSession(id string, userID int) (bool, error)
+	RevokeAllSessions(userID int) (int64, error)
+	// Revoke every session but one, e.g. the caller's own
+	RevokeOtherSessions(userID int, keepID string) (int64, error)
+	HasUsedDevice(userID int, userAgent string) (bool, error)
+
+	RecordSecurityEvent(userID int, eventType, ip, userAgent, details string) error
+	SecurityEvents(userID int, limit int) ([]SecurityEvent, error)
+}
+
+// Optional filters for TicketRepo.List
+type TicketFilter struct {
+	Reference string
+	Channel   string
+	// Text the subject contains, ignoring case and how accents were
+	// typed. Matched after the query so it follows Unicode case rules
+	// whatever the database's locale.
+	Query string
+	// Only tickets with this priority
+	Priority string
+	Status   string
+	// Requester email, ignoring case
+	Email string
+	// Created at or after From and before To; zero for no bound
+	From, To time.Time
+	// Only tickets with (true) or without (false) an attachment
+	HasAttachment *bool
+	// Order of the list; nil for newest first
+	Sort []TicketSort
+	// Zero Limit returns every match
+	Page Page
+}
+
+// One key of a ticket list's order (see ticket_sort.go)
+type TicketSort struct {
+	// priority, created_at, updated_at or sla_due
+	Field string
+	Desc  bool
+}
+
+var store Store
+
+// Database driver selected with DB_DRIVER (postgres, sqlite or memory)
+func dbDriver() string {
+	if driver := os.Getenv("DB_DRIVER"); driver != "" {
+		return driver
+	}
+	return "postgres"
+}
+
+// Features beyond the core workflow (organizations, custom fields,
+// reports, exports, backups) rely on Postgres
+func fullFeatured() bool {
+	return dbDriver() == "postgres"
+}
+
+// Open the configured database and its store
+func connectStore() {
+	switch dbDriver() {
+	case "postgres":
+		connectDB()
+		store = pgStore{db}
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "sts.db"
+		}
+
+		var err error
+		db, err = sql.Open(sqlDriverName("sqlite3"), path+"?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL")
+		if err != nil {
+			log.Fatal("Database connection error:", err)
+		}
+		// SQLite allows a single writer; serialize through one connection
+		db.SetMaxOpenConns(1)
+
+		if err = db.Ping(); err != nil {
+			log.Fatal("Database open error:", err)
+		}
+		store = sqliteStore{db}
+		dbLog.Printf("✓ Opened SQLite database %s", path)
+	case "memory":
+		// Tables outside the store (audit events, queued writes) go to a
+		// throwaway SQLite database
+		var err error
+		db, err = sql.Open(sqlDriverName("sqlite3"), "file::memory:?cache=shared&_foreign_keys=on")
+		if err != nil {
+			log.Fatal("Database open error:", err)
+		}
+		db.SetMaxOpenConns(1)
+		if err := (sqliteStore{db}).Migrate(); err != nil {
+			log.Fatal("Failed to migrate database:", err)
+		}
+		store = newMemoryStore()
+		dbLog.Warnf("DB_DRIVER=memory keeps everything in memory; data is lost on exit")
+	default:
+		log.Fatalf("Unknown DB_DRIVER %q (expected postgres, sqlite or memory)", dbDriver())
+	}
+}
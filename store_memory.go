@@ -0,0 +1,637 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-memory store (DB_DRIVER=memory) for benchmarks and throwaway demos.
+// It keeps the core ticket workflow in process memory, so handler and
+// middleware costs can be measured without a database in the way.
+// Behaves like the SQLite store: built-in roles, no organizations.
+type memoryStore struct {
+	*memoryData
+}
+
+type memoryData struct {
+	mu sync.RWMutex
+
+	users        map[int]*memoryUser
+	userByEmail  map[string]int
+	sessions     map[string]*memorySession
+	sessionByTok map[string]string
+	secEvents    []memorySecurityEvent
+
+	// Indexed by ID - 1, so in creation order
+	tickets     []*memoryTicket
+	ticketByRef map[string]int
+	sequences   map[int]int
+	messages    map[int][]Message
+	history     map[int][]StatusChange
+	// Keys of files attached to tickets and messages
+	attachments map[string]bool
+	// Who uploaded each file, by key
+	uploads map[string]string
+
+	lastUserID, lastMessageID, lastEventID, lastAttachmentID int
+}
+
+type memoryUser struct {
+	User
+	password string
+}
+
+type memorySession struct {
+	Session
+	userID    int
+	tokenHash string
+	revoked   bool
+}
+
+type memorySecurityEvent struct {
+	SecurityEvent
+	userID int
+}
+
+type memoryTicket struct {
+	Ticket
+	csatScore   int
+	csatComment string
+}
+
+func newMemoryStore() memoryStore {
+	return memoryStore{&memoryData{
+		users:        map[int]*memoryUser{},
+		userByEmail:  map[string]int{},
+		sessions:     map[string]*memorySession{},
+		sessionByTok: map[string]string{},
+		ticketByRef:  map[string]int{},
+		sequences:    map[int]int{},
+		messages:     map[int][]Message{},
+		history:      map[int][]StatusChange{},
+		attachments:  map[string]bool{},
+		uploads:      map[string]string{},
+	}}
+}
+
+// Seed the demo users, like the SQLite store
+func (s memoryStore) Migrate() error {
+	users := s.Users()
+	for _, u := range []struct{ email, role string }{{"client@demo.com", "client"}, {"agent@demo.com", "agent"}} {
+		if _, _, err := users.Provision(u.email, "password123", u.role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s memoryStore) Tickets() TicketRepo   { return memoryTicketRepo{s.memoryData} }
+func (s memoryStore) Messages() MessageRepo { return memoryMessageRepo{s.memoryData} }
+func (s memoryStore) Users() UserRepo       { return memoryUserRepo{s.memoryData} }
+
+type memoryUserRepo struct {
+	d *memoryData
+}
+
+func (s memoryUserRepo) PasswordHash(email string) (User, string, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	u, ok := s.d.users[s.d.userByEmail[email]]
+	if !ok {
+		return User{}, "", sql.ErrNoRows
+	}
+	return u.User, u.password, nil
+}
+
+func (s memoryUserRepo) SetPasswordHash(userID int, hash string) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if u, ok := s.d.users[userID]; ok {
+		u.password = hash
+	}
+	return nil
+}
+
+func (s memoryUserRepo) PlaintextPasswords() (map[int]string, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	passwords := map[int]string{}
+	for id, u := range s.d.users {
+		if !(len(u.password) > 3 && strings.HasPrefix(u.password, "$2") && u.password[3] == '$') {
+			passwords[id] = u.password
+		}
+	}
+	return passwords, nil
+}
+
+func (s memoryUserRepo) ReplacePassword(userID int, old, hash string) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if u, ok := s.d.users[userID]; ok && u.password == old {
+		u.password = hash
+	}
+	return nil
+}
+
+func (s memoryUserRepo) Provision(email, password, userType string) (User, bool, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if id, ok := s.d.userByEmail[email]; ok {
+		return s.d.users[id].User, false, nil
+	}
+	s.d.lastUserID++
+	u := &memoryUser{User: User{ID: s.d.lastUserID, Email: email, UserType: userType}, password: password}
+	s.d.users[u.ID] = u
+	s.d.userByEmail[email] = u.ID
+	return u.User, true, nil
+}
+
+func (s memoryUserRepo) IDByEmail(email string) (int, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	id, ok := s.d.userByEmail[email]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return id, nil
+}
+
+func (s memoryUserRepo) RoleOf(email string) (string, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	u, ok := s.d.users[s.d.userByEmail[email]]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return u.UserType, nil
+}
+
+func (s memoryUserRepo) WithRoles(roles []string) ([]User, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	users := []User{}
+	for _, u := range s.d.users {
+		if containsString(roles, u.UserType) {
+			users = append(users, u.User)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s memoryUserRepo) SetRole(userID int, role string) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if u, ok := s.d.users[userID]; ok {
+		u.UserType = role
+	}
+	return nil
+}
+
+// Roles are fixed to the built-in set
+func (s memoryUserRepo) Roles() (map[string]map[string]bool, error) {
+	return builtinRoles(), nil
+}
+
+func (s memoryUserRepo) CreateSession(id string, userID int, tokenHash, userAgent, ip string) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if _, ok := s.d.users[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	if _, ok := s.d.sessionByTok[tokenHash]; ok {
+		return fmt.Errorf("session token already in use")
+	}
+	now := time.Now().UTC()
+	s.d.sessions[id] = &memorySession{
+		Session:   Session{ID: id, UserAgent: userAgent, IP: ip, CreatedAt: now, LastUsedAt: now},
+		userID:    userID,
+		tokenHash: tokenHash,
+	}
+	s.d.sessionByTok[tokenHash] = id
+	return nil
+}
+
+func (s memoryUserRepo) SessionUser(tokenHash string) (User, string, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	sess, ok := s.d.sessions[s.d.sessionByTok[tokenHash]]
+	if !ok || sess.revoked {
+		return User{}, "", sql.ErrNoRows
+	}
+	return s.d.users[sess.userID].User, sess.ID, nil
+}
+
+func (s memoryUserRepo) TouchSession(id, ip string) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if sess, ok := s.d.sessions[id]; ok && time.Since(sess.LastUsedAt) > time.Minute {
+		sess.LastUsedAt = time.Now().UTC()
+		sess.IP = ip
+	}
+	return nil
+}
+
+func (s memoryUserRepo) ListSessions(userID int) ([]Session, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	sessions := []Session{}
+	for _, sess := range s.d.sessions {
+		if sess.userID == userID && !sess.revoked {
+			sessions = append(sessions, sess.Session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+func (s memoryUserRepo) RevokeSession(id string, userID int) (bool, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	sess, ok := s.d.sessions[id]
+	if !ok || sess.revoked || (userID != 0 && sess.userID != userID) {
+		return false, nil
+	}
+	sess.revoked = true
+	return true, nil
+}
+
+func (s memoryUserRepo) RevokeAllSessions(userID int) (int64, error) {
+	return s.revokeSessions(userID, "")
+}
+
+func (s memoryUserRepo) RevokeOtherSessions(userID int, keepID string) (int64, error) {
+	return s.revokeSessions(userID, keepID)
+}
+
+func (s memoryUserRepo) revokeSessions(userID int, keepID string) (int64, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	var n int64
+	for _, sess := range s.d.sessions {
+		if sess.userID == userID && sess.ID != keepID && !sess.revoked {
+			sess.revoked = true
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s memoryUserRepo) HasUsedDevice(userID int, userAgent string) (bool, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	for _, sess := range s.d.sessions {
+		if sess.userID == userID && sess.UserAgent == userAgent {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s memoryUserRepo) RecordSecurityEvent(userID int, eventType, ip, userAgent, details string) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	s.d.lastEventID++
+	s.d.secEvents = append(s.d.secEvents, memorySecurityEvent{
+		SecurityEvent: SecurityEvent{ID: s.d.lastEventID, EventType: eventType, IP: ip, UserAgent: userAgent,
+			Details: details, CreatedAt: time.Now().UTC()},
+		userID: userID,
+	})
+	return nil
+}
+
+func (s memoryUserRepo) SecurityEvents(userID int, limit int) ([]SecurityEvent, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	events := []SecurityEvent{}
+	for i := len(s.d.secEvents) - 1; i >= 0 && len(events) < limit; i-- {
+		if e := s.d.secEvents[i]; e.userID == userID {
+			events = append(events, e.SecurityEvent)
+		}
+	}
+	return events, nil
+}
+
+type memoryTicketRepo struct {
+	d *memoryData
+}
+
+// Whether user may see t without tickets.read_all
+func ownsMemoryTicket(user User, t *memoryTicket) bool {
+	return t.RequesterID == user.ID || (t.RequesterID == 0 && t.Email == user.Email)
+}
+
+// Position of a priority in priorityOrder
+func priorityRank(p string) int {
+	for i, v := range ticketPriorities {
+		if v == p {
+			return len(ticketPriorities) - 1 - i
+		}
+	}
+	return len(ticketPriorities) - 1
+}
+
+func (s memoryTicketRepo) List(user User, filter TicketFilter) ([]Ticket, int, error) {
+	readAll := authorize(user, permTicketsReadAll, nil)
+
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	tickets := []Ticket{}
+	for i := len(s.d.tickets) - 1; i >= 0; i-- {
+		t := s.d.tickets[i]
+		if !readAll && !ownsMemoryTicket(user, t) {
+			continue
+		}
+		if (filter.Reference != "" && t.Reference != filter.Reference) ||
+			(filter.Channel != "" && t.Channel != filter.Channel) ||
+			(filter.Priority != "" && t.Priority != filter.Priority) ||
+			(filter.Status != "" && t.Status != filter.Status) ||
+			(filter.Email != "" && !strings.EqualFold(t.Email, filter.Email)) {
+			continue
+		}
+		if (!filter.From.IsZero() && t.CreatedAt.Before(filter.From)) ||
+			(!filter.To.IsZero() && !t.CreatedAt.Before(filter.To)) {
+			continue
+		}
+		if filter.HasAttachment != nil && *filter.HasAttachment != (len(t.Attachments) > 0) {
+			continue
+		}
+		if filter.Query != "" && !containsText(t.Subject, filter.Query) {
+			continue
+		}
+		tickets = append(tickets, t.Ticket)
+	}
+
+	sortTickets(tickets, filter.Sort)
+	total := len(tickets)
+	if filter.Page.Limit > 0 {
+		tickets = pageSlice(tickets, filter.Page)
+	}
+	return tickets, total, nil
+}
+
+func (s memoryTicketRepo) Find(user User, id int) (Ticket, error) {
+	readAll := authorize(user, permTicketsReadAll, nil)
+
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	if id < 1 || id > len(s.d.tickets) {
+		return Ticket{}, sql.ErrNoRows
+	}
+	t := s.d.tickets[id-1]
+	if !readAll && !ownsMemoryTicket(user, t) {
+		return Ticket{}, sql.ErrNoRows
+	}
+	return t.Ticket, nil
+}
+
+func (s memoryTicketRepo) IDByReference(ref string) (int, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	id, ok := s.d.ticketByRef[ref]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return id, nil
+}
+
+func (s memoryTicketRepo) Create(ticket *Ticket, user User) error {
+	if len(ticket.CustomFields) > 0 {
+		return errUnknownField
+	}
+
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	for _, a := range ticket.Attachments {
+		if s.d.attachments[a.Key] {
+			return errAttachmentLinked
+		}
+	}
+	for i := range ticket.Attachments {
+		s.d.lastAttachmentID++
+		ticket.Attachments[i].ID = s.d.lastAttachmentID
+		s.d.attachments[ticket.Attachments[i].Key] = true
+	}
+
+	ticket.CreatedAt = time.Now().UTC()
+	ticket.UpdatedAt = ticket.CreatedAt
+	year := ticket.CreatedAt.Year()
+	s.d.sequences[year]++
+	ticket.Reference = formatTicketReference(ticketRefPrefix(), 0, year, s.d.sequences[year])
+	ticket.ID = len(s.d.tickets) + 1
+	ticket.RequesterID = s.d.userByEmail[ticket.Email]
+	ticket.Status = "open"
+
+	stored := &memoryTicket{Ticket: *ticket}
+	stored.AttachmentKey, stored.AttachmentKeys = "", nil
+	stored.Attachments = append([]Attachment{}, ticket.Attachments...)
+	s.d.tickets = append(s.d.tickets, stored)
+	s.d.ticketByRef[ticket.Reference] = ticket.ID
+
+	s.d.lastMessageID++
+	s.d.messages[ticket.ID] = append(s.d.messages[ticket.ID], Message{ID: s.d.lastMessageID, TicketID: ticket.ID,
+		SenderEmail: ticket.Email, Message: ticket.Description, IsDescription: true, CreatedAt: ticket.CreatedAt})
+	return nil
+}
+
+// Run fn on a ticket under the write lock, marking it updated if fn
+// succeeds
+func (s memoryTicketRepo) update(id int, fn func(t *memoryTicket) error) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if id < 1 || id > len(s.d.tickets) {
+		return sql.ErrNoRows
+	}
+	t := s.d.tickets[id-1]
+	if err := fn(t); err != nil {
+		return err
+	}
+	t.UpdatedAt = time.Now().UTC()
+	return nil
+}
+
+func (s memoryTicketRepo) SetStatus(id int, from, to, changedBy string) error {
+	return s.update(id, func(t *memoryTicket) error {
+		if t.Status != from {
+			return errStatusChanged
+		}
+		t.Status = to
+		t.ClosedBy = ""
+		if to == "closed" {
+			t.ClosedBy = changedBy
+		}
+		s.d.history[id] = append(s.d.history[id], StatusChange{From: from, To: to, ChangedBy: changedBy, CreatedAt: time.Now().UTC()})
+		return nil
+	})
+}
+
+func (s memoryTicketRepo) StatusHistory(id int) ([]StatusChange, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	return append([]StatusChange{}, s.d.history[id]...), nil
+}
+
+func (s memoryTicketRepo) Assign(id int, assignee string) error {
+	return s.update(id, func(t *memoryTicket) error {
+		t.AssignedTo = assignee
+		return nil
+	})
+}
+
+func (s memoryTicketRepo) Claim(id int, assignee string) error {
+	return s.update(id, func(t *memoryTicket) error {
+		if t.AssignedTo != "" {
+			return errAlreadyAssigned
+		}
+		t.AssignedTo = assignee
+		return nil
+	})
+}
+
+func (s memoryTicketRepo) SetRequester(id int, email string) error {
+	return s.update(id, func(t *memoryTicket) error {
+		t.Email = email
+		t.RequesterID = s.d.userByEmail[email]
+		return nil
+	})
+}
+
+func (s memoryTicketRepo) SetPriority(id int, priority string) error {
+	return s.update(id, func(t *memoryTicket) error {
+		t.Priority = priority
+		return nil
+	})
+}
+
+func (s memoryTicketRepo) Rate(id int, score int, comment string) error {
+	return s.update(id, func(t *memoryTicket) error {
+		t.csatScore, t.csatComment = score, comment
+		return nil
+	})
+}
+
+func (s memoryTicketRepo) Attachments(ids []int) (map[int][]Attachment, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	attachments := map[int][]Attachment{}
+	for _, id := range ids {
+		if id >= 1 && id <= len(s.d.tickets) && len(s.d.tickets[id-1].Attachments) > 0 {
+			attachments[id] = append([]Attachment{}, s.d.tickets[id-1].Attachments...)
+		}
+	}
+	return attachments, nil
+}
+
+func (s memoryTicketRepo) RecordUpload(key, email string, size int64, location string) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if _, ok := s.d.uploads[key]; !ok {
+		s.d.uploads[key] = email
+	}
+	return nil
+}
+
+func (s memoryTicketRepo) Uploader(key string) (string, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+	email, ok := s.d.uploads[key]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return email, nil
+}
+
+type memoryMessageRepo struct {
+	d *memoryData
+}
+
+func (s memoryMessageRepo) List(ticketID int) ([]Message, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	return append([]Message{}, s.d.messages[ticketID]...), nil
+}
+
+func (s memoryMessageRepo) ListPage(ticketID int, page Page) ([]Message, int, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	messages := s.d.messages[ticketID]
+	return append([]Message{}, pageSlice(messages, page)...), len(messages), nil
+}
+
+func (s memoryMessageRepo) FirstResponses(ticketIDs []int) (map[int]time.Time, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	responses := map[int]time.Time{}
+	for _, id := range ticketIDs {
+		if id < 1 || id > len(s.d.tickets) {
+			continue
+		}
+		requester := s.d.tickets[id-1].Email
+		for _, m := range s.d.messages[id] {
+			if m.SenderEmail != requester && !m.IsDescription {
+				responses[id] = m.CreatedAt
+				break
+			}
+		}
+	}
+	return responses, nil
+}
+
+func (s memoryMessageRepo) Create(msg *Message) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if msg.TicketID < 1 || msg.TicketID > len(s.d.tickets) {
+		return sql.ErrNoRows
+	}
+	for _, a := range msg.Attachments {
+		if s.d.attachments[a.Key] {
+			return errAttachmentLinked
+		}
+	}
+	s.d.lastMessageID++
+	msg.ID = s.d.lastMessageID
+	msg.CreatedAt = time.Now().UTC()
+	for i := range msg.Attachments {
+		s.d.lastAttachmentID++
+		msg.Attachments[i].ID = s.d.lastAttachmentID
+		s.d.attachments[msg.Attachments[i].Key] = true
+	}
+	stored := *msg
+	stored.Attachments = append([]Attachment{}, msg.Attachments...)
+	s.d.messages[msg.TicketID] = append(s.d.messages[msg.TicketID], stored)
+	s.d.tickets[msg.TicketID-1].UpdatedAt = msg.CreatedAt
+	return nil
+}
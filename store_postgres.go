@@ -0,0 +1,692 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Postgres store
+type pgStore struct {
+	db *sql.DB
+}
+
+func (s pgStore) Migrate() error {
+	createTables()
+	return nil
+}
+
+func (s pgStore) Tickets() TicketRepo   { return pgTicketRepo{s.db} }
+func (s pgStore) Messages() MessageRepo { return pgMessageRepo{s.db} }
+func (s pgStore) Users() UserRepo       { return pgUserRepo{s.db} }
+
+type pgUserRepo struct {
+	db *sql.DB
+}
+
+func (s pgUserRepo) PasswordHash(email string) (User, string, error) {
+	var user User
+	var hash string
+	err := s.db.QueryRow(`
+		SELECT id, email, user_type, password 
+		FROM users 
+		WHERE email = $1 AND active
+	`, email).Scan(&user.ID, &user.Email, &user.UserType, &hash)
+	return user, hash, err
+}
+
+func (s pgUserRepo) SetPasswordHash(userID int, hash string) error {
+	_, err := s.db.Exec("UPDATE users SET password = $1 WHERE id = $2", hash, userID)
+	return err
+}
+
+func (s pgUserRepo) PlaintextPasswords() (map[int]string, error) {
+	rows, err := s.db.Query("SELECT id, password FROM users WHERE password NOT LIKE '$2_$%'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passwords := map[int]string{}
+	for rows.Next() {
+		var id int
+		var password string
+		if err := rows.Scan(&id, &password); err != nil {
+			return nil, err
+		}
+		passwords[id] = password
+	}
+	return passwords, rows.Err()
+}
+
+func (s pgUserRepo) ReplacePassword(userID int, old, hash string) error {
+	_, err := s.db.Exec("UPDATE users SET password = $1 WHERE id = $2 AND password = $3", hash, userID, old)
+	return err
+}
+
+func (s pgUserRepo) Provision(email, password, userType string) (User, bool, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO users (email, password, user_type) 
+		VALUES ($1, $2, $3) 
+		ON CONFLICT (email) DO NOTHING
+	`, email, password, userType)
+	if err != nil {
+		return User{}, false, err
+	}
+	created, _ := res.RowsAffected()
+
+	var user User
+	err = s.db.QueryRow("SELECT id, email, user_type FROM users WHERE email = $1 AND active", email).
+		Scan(&user.ID, &user.Email, &user.UserType)
+	return user, created > 0, err
+}
+
+func (s pgUserRepo) IDByEmail(email string) (int, error) {
+	var id int
+	err := s.db.QueryRow("SELECT id FROM users WHERE email = $1", email).Scan(&id)
+	return id, err
+}
+
+func (s pgUserRepo) Roles() (map[string]map[string]bool, error) {
+	rows, err := s.db.Query("SELECT name, permissions FROM roles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make(map[string]map[string]bool)
+	for rows.Next() {
+		var name string
+		var perms []string
+		if err := rows.Scan(&name, pq.Array(&perms)); err != nil {
+			return nil, err
+		}
+		set := make(map[string]bool, len(perms))
+		for _, p := range perms {
+			set[p] = true
+		}
+		roles[name] = set
+	}
+	return roles, rows.Err()
+}
+
+func (s pgUserRepo) CreateSession(id string, userID int, tokenHash, userAgent, ip string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sessions (id, user_id, token_hash, user_agent, ip) 
+		VALUES ($1, $2, $3, $4, $5)
+	`, id, userID, tokenHash, userAgent, ip)
+	return err
+}
+
+func (s pgUserRepo) SessionUser(tokenHash string) (User, string, error) {
+	var user User
+	var sessionID string
+	err := s.db.QueryRow(`
+		SELECT s.id, u.id, u.email, u.user_type 
+		FROM sessions s 
+		JOIN users u ON u.id = s.user_id 
+		WHERE s.token_hash = $1 AND s.revoked_at IS NULL AND u.active
+	`, tokenHash).Scan(&sessionID, &user.ID, &user.Email, &user.UserType)
+	return user, sessionID, err
+}
+
+// Track activity at minute granularity to keep writes cheap
+func (s pgUserRepo) TouchSession(id, ip string) error {
+	_, err := s.db.Exec(`
+		UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP, ip = $2 
+		WHERE id = $1 AND last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute'
+	`, id, ip)
+	return err
+}
+
+func (s pgUserRepo) RoleOf(email string) (string, error) {
+	var role string
+	err := s.db.QueryRow("SELECT user_type FROM users WHERE email = $1 AND active", email).Scan(&role)
+	return role, err
+}
+
+func (s pgUserRepo) WithRoles(roles []string) ([]User, error) {
+	rows, err := s.db.Query("SELECT id, email, user_type FROM users WHERE user_type = ANY($1) AND active ORDER BY id", pq.Array(roles))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Email, &u.UserType); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s pgUserRepo) SetRole(userID int, role string) error {
+	_, err := s.db.Exec("UPDATE users SET user_type = $1 WHERE id = $2", role, userID)
+	return err
+}
+
+func (s pgUserRepo) ListSessions(userID int) ([]Session, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_agent, ip, created_at, last_used_at 
+		FROM sessions 
+		WHERE user_id = $1 AND revoked_at IS NULL 
+		ORDER BY last_used_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func (s pgUserRepo) RevokeSession(id string, userID int) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP 
+		WHERE id = $1 AND ($2 = 0 OR user_id = $2) AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s pgUserRepo) RevokeAllSessions(userID int) (int64, error) {
+	res, err := s.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP 
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s pgUserRepo) RevokeOtherSessions(userID int, keepID string) (int64, error) {
+	res, err := s.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP 
+		WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL
+	`, userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s pgUserRepo) HasUsedDevice(userID int, userAgent string) (bool, error) {
+	var known bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM sessions WHERE user_id = $1 AND user_agent = $2)
+	`, userID, userAgent).Scan(&known)
+	return known, err
+}
+
+func (s pgUserRepo) RecordSecurityEvent(userID int, eventType, ip, userAgent, details string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO security_events (user_id, event_type, ip, user_agent, details) 
+		VALUES ($1, $2, $3, $4, $5)
+	`, userID, eventType, ip, userAgent, details)
+	return err
+}
+
+func (s pgUserRepo) SecurityEvents(userID int, limit int) ([]SecurityEvent, error) {
+	rows, err := s.db.Query(`
+		SELECT id, event_type, ip, user_agent, details, created_at 
+		FROM security_events 
+		WHERE user_id = $1 
+		ORDER BY created_at DESC 
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []SecurityEvent{}
+	for rows.Next() {
+		var e SecurityEvent
+		if err := rows.Scan(&e.ID, &e.EventType, &e.IP, &e.UserAgent, &e.Details, &e.CreatedAt); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+type pgTicketRepo struct {
+	db *sql.DB
+}
+
+func (s pgTicketRepo) List(user User, filter TicketFilter) ([]Ticket, int, error) {
+	where := " WHERE TRUE"
+
+	var args []interface{}
+	predicate, args := ticketAccessPredicate(user, args)
+	where += predicate
+
+	if filter.Reference != "" {
+		args = append(args, filter.Reference)
+		where += fmt.Sprintf(" AND reference = $%d", len(args))
+	}
+
+	if filter.Channel != "" {
+		args = append(args, filter.Channel)
+		where += fmt.Sprintf(" AND channel = $%d", len(args))
+	}
+
+	if filter.Priority != "" {
+		args = append(args, filter.Priority)
+		where += fmt.Sprintf(" AND priority = $%d", len(args))
+	}
+
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		where += fmt.Sprintf(" AND status = $%d", len(args))
+	}
+
+	if filter.Email != "" {
+		args = append(args, filter.Email)
+		where += fmt.Sprintf(" AND LOWER(email) = $%d", len(args))
+	}
+
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		where += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		where += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+
+	if filter.HasAttachment != nil {
+		if *filter.HasAttachment {
+			where += " AND " + hasAttachmentsSQL
+		} else {
+			where += " AND NOT " + hasAttachmentsSQL
+		}
+	}
+
+	// Subject matches are found in Go, so those are paged after scanning
+	paged := filter.Page.Limit > 0 && filter.Query == ""
+	var total int
+	if paged {
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM tickets"+where, args...).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	query := "SELECT " + ticketColumns + " FROM tickets" + where
+
+	query += ticketOrderBy(filter.Sort)
+	if paged {
+		args = append(args, filter.Page.Limit, filter.Page.Offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	tickets := []Ticket{}
+	for rows.Next() {
+		t, err := scanTicket(rows)
+		if err != nil {
+			continue
+		}
+		if filter.Query != "" && !containsText(t.Subject, filter.Query) {
+			continue
+		}
+		tickets = append(tickets, t)
+	}
+	if !paged {
+		total = len(tickets)
+		if filter.Page.Limit > 0 {
+			tickets = pageSlice(tickets, filter.Page)
+		}
+	}
+	return tickets, total, rows.Err()
+}
+
+func (s pgTicketRepo) Find(user User, id int) (Ticket, error) {
+	args := []interface{}{id}
+	predicate, args := ticketAccessPredicate(user, args)
+	return scanTicket(s.db.QueryRow("SELECT "+ticketColumns+" FROM tickets WHERE id = $1"+predicate, args...))
+}
+
+func (s pgTicketRepo) IDByReference(ref string) (int, error) {
+	var id int
+	err := s.db.QueryRow("SELECT id FROM tickets WHERE reference = $1", ref).Scan(&id)
+	return id, err
+}
+
+// Insert ticket, its attachment record, custom fields and first message atomically
+func (s pgTicketRepo) Create(ticket *Ticket, user User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	orgID := orgIDForEmail(ticket.Email)
+	ticket.OrgID = int(orgID.Int64)
+
+	ticket.Reference, err = nextTicketReference(tx, ticket.OrgID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO tickets (reference, email, requester_id, subject, description, status, channel, attachment_url, org_id, category, priority) 
+		VALUES ($1, $2, (SELECT id FROM users WHERE email = $2), $3, $4, 'open', $5, $6, $7, $8, $9) 
+		RETURNING id, COALESCE(requester_id, 0), created_at, updated_at
+	`, ticket.Reference, ticket.Email, ticket.Subject, ticket.Description, ticket.Channel,
+		sql.NullString{String: ticket.AttachmentURL, Valid: ticket.AttachmentURL != ""},
+		orgID, sql.NullString{String: ticket.Category, Valid: ticket.Category != ""}, ticket.Priority).Scan(&ticket.ID, &ticket.RequesterID, &ticket.CreatedAt, &ticket.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	for i, a := range ticket.Attachments {
+		// Uploads are recorded unlinked for storage quotas; claim that row
+		err := tx.QueryRow(`
+			INSERT INTO attachments (ticket_id, s3_key, uploaded_by) 
+			VALUES ($1, $2, $3)
+			ON CONFLICT (s3_key) DO UPDATE SET ticket_id = EXCLUDED.ticket_id
+			WHERE attachments.ticket_id IS NULL
+			RETURNING id
+		`, ticket.ID, a.Key, ticket.Email).Scan(&ticket.Attachments[i].ID)
+		if err == sql.ErrNoRows {
+			return errAttachmentLinked
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := saveCustomFields(tx, user, ticket.ID, ticket.CustomFields); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO messages (ticket_id, sender_email, message, is_description, created_at) 
+		VALUES ($1, $2, $3, TRUE, $4)
+	`, ticket.ID, ticket.Email, ticket.Description, ticket.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s pgTicketRepo) SetStatus(id int, from, to, changedBy string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only closed tickets carry who closed them and when
+	res, err := tx.Exec(`
+		UPDATE tickets SET status = $1, 
+			closed_by = CASE WHEN $1 = 'closed' THEN $2 END, 
+			closed_at = CASE WHEN $1 = 'closed' THEN CURRENT_TIMESTAMP END, 
+			updated_at = CURRENT_TIMESTAMP 
+		WHERE id = $3 AND status = $4
+	`, to, changedBy, id, from)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errStatusChanged
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO ticket_status_history (ticket_id, from_status, to_status, changed_by) 
+		VALUES ($1, $2, $3, $4)
+	`, id, from, to, changedBy)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s pgTicketRepo) StatusHistory(id int) ([]StatusChange, error) {
+	rows, err := s.db.Query(`
+		SELECT from_status, to_status, changed_by, created_at 
+		FROM ticket_status_history 
+		WHERE ticket_id = $1 
+		ORDER BY created_at, id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []StatusChange{}
+	for rows.Next() {
+		var c StatusChange
+		if err := rows.Scan(&c.From, &c.To, &c.ChangedBy, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+func (s pgTicketRepo) Assign(id int, assignee string) error {
+	_, err := s.db.Exec("UPDATE tickets SET assigned_to = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		sql.NullString{String: assignee, Valid: assignee != ""}, id)
+	return err
+}
+
+func (s pgTicketRepo) Claim(id int, assignee string) error {
+	res, err := s.db.Exec("UPDATE tickets SET assigned_to = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2 AND COALESCE(assigned_to, '') = ''",
+		assignee, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errAlreadyAssigned
+	}
+	return nil
+}
+
+func (s pgTicketRepo) SetRequester(id int, email string) error {
+	// The organization follows the requester, so org admins see it too
+	_, err := s.db.Exec(`
+		UPDATE tickets SET email = $1, requester_id = (SELECT id FROM users WHERE email = $1), org_id = $2, 
+			updated_at = CURRENT_TIMESTAMP 
+		WHERE id = $3
+	`, email, orgIDForEmail(email), id)
+	return err
+}
+
+func (s pgTicketRepo) SetPriority(id int, priority string) error {
+	_, err := s.db.Exec("UPDATE tickets SET priority = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", priority, id)
+	return err
+}
+
+func (s pgTicketRepo) Rate(id int, score int, comment string) error {
+	_, err := s.db.Exec("UPDATE tickets SET csat_score = $1, csat_comment = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3", score, comment, id)
+	return err
+}
+
+func (s pgTicketRepo) Attachments(ids []int) (map[int][]Attachment, error) {
+	rows, err := s.db.Query(`
+		SELECT id, ticket_id, s3_key, filename FROM attachments 
+		WHERE ticket_id = ANY($1) AND message_id IS NULL 
+		ORDER BY id
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	return scanAttachments(rows)
+}
+
+func (s pgTicketRepo) RecordUpload(key, email string, size int64, location string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO attachments (s3_key, uploaded_by, size_bytes, storage_location) VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (s3_key) DO UPDATE SET size_bytes = EXCLUDED.size_bytes, storage_location = EXCLUDED.storage_location
+	`, key, email, size, location)
+	return err
+}
+
+func (s pgTicketRepo) Uploader(key string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT uploaded_by FROM attachments WHERE s3_key = $1", key).Scan(&email)
+	return email, err
+}
+
+type pgMessageRepo struct {
+	db *sql.DB
+}
+
+func (s pgMessageRepo) List(ticketID int) ([]Message, error) {
+	return s.list(ticketID, Page{})
+}
+
+func (s pgMessageRepo) ListPage(ticketID int, page Page) ([]Message, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM messages WHERE ticket_id = $1", ticketID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	messages, err := s.list(ticketID, page)
+	return messages, total, err
+}
+
+// Messages of a thread, description first; zero page.Limit for all
+func (s pgMessageRepo) list(ticketID int, page Page) ([]Message, error) {
+	limit := sql.NullInt64{Int64: int64(page.Limit), Valid: page.Limit > 0}
+
+	// Latest delivery status of the notification email for each message
+	rows, err := s.db.Query(`
+		SELECT m.id, m.ticket_id, m.sender_email, m.message, m.is_description, 
+			COALESCE(d.status, ''), m.created_at 
+		FROM messages m 
+		LEFT JOIN LATERAL (
+			SELECT status FROM email_deliveries 
+			WHERE message_id = m.id ORDER BY updated_at DESC LIMIT 1
+		) d ON TRUE 
+		WHERE m.ticket_id = $1 
+		ORDER BY m.is_description DESC, m.created_at ASC, m.id ASC 
+		LIMIT $2 OFFSET $3
+	`, ticketID, limit, page.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.TicketID, &m.SenderEmail, &m.Message, &m.IsDescription, &m.DeliveryStatus, &m.CreatedAt); err != nil {
+			continue
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil || len(messages) == 0 {
+		return messages, err
+	}
+
+	rows, err = s.db.Query(`
+		SELECT id, message_id, s3_key, filename FROM attachments 
+		WHERE ticket_id = $1 AND message_id IS NOT NULL 
+		ORDER BY id
+	`, ticketID)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := scanAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].ID]
+	}
+	return messages, nil
+}
+
+func (s pgMessageRepo) FirstResponses(ticketIDs []int) (map[int]time.Time, error) {
+	rows, err := s.db.Query(`
+		SELECT m.ticket_id, MIN(m.created_at) 
+		FROM messages m 
+		JOIN tickets t ON t.id = m.ticket_id 
+		WHERE m.ticket_id = ANY($1) AND m.sender_email <> t.email AND NOT m.is_description 
+		GROUP BY m.ticket_id
+	`, pq.Array(ticketIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	responses := map[int]time.Time{}
+	for rows.Next() {
+		var id int
+		var at time.Time
+		if err := rows.Scan(&id, &at); err != nil {
+			return nil, err
+		}
+		responses[id] = at
+	}
+	return responses, rows.Err()
+}
+
+// A new message also marks its ticket updated, and claims its attachments
+func (s pgMessageRepo) Create(msg *Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		WITH m AS (
+			INSERT INTO messages (ticket_id, sender_email, message) 
+			VALUES ($1, $2, $3) 
+			RETURNING id, ticket_id, created_at
+		), touched AS (
+			UPDATE tickets SET updated_at = m.created_at FROM m WHERE tickets.id = m.ticket_id
+		)
+		SELECT id, created_at FROM m
+	`, msg.TicketID, msg.SenderEmail, msg.Message).Scan(&msg.ID, &msg.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for i, a := range msg.Attachments {
+		// Uploads are recorded unlinked for storage quotas; claim that row
+		err := tx.QueryRow(`
+			INSERT INTO attachments (ticket_id, message_id, s3_key, filename, uploaded_by) 
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (s3_key) DO UPDATE SET ticket_id = EXCLUDED.ticket_id, 
+				message_id = EXCLUDED.message_id, filename = EXCLUDED.filename
+			WHERE attachments.ticket_id IS NULL
+			RETURNING id
+		`, msg.TicketID, msg.ID, a.Key, sql.NullString{String: a.Filename, Valid: a.Filename != ""}, msg.SenderEmail).Scan(&msg.Attachments[i].ID)
+		if err == sql.ErrNoRows {
+			return errAttachmentLinked
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
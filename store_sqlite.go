@@ -0,0 +1,850 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite store for single-node installs. Covers the core ticket workflow;
+// roles are the built-in ones and there are no agent scopes, custom
+// fields or organizations.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func (s sqliteStore) Migrate() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email TEXT UNIQUE NOT NULL,
+			password TEXT NOT NULL,
+			user_type TEXT NOT NULL
+		);
+		INSERT OR IGNORE INTO users (email, password, user_type) 
+		VALUES 
+			('client@demo.com', 'password123', 'client'),
+			('agent@demo.com', 'password123', 'agent');
+
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash TEXT UNIQUE NOT NULL,
+			user_agent TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			revoked_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id);
+
+		CREATE TABLE IF NOT EXISTS security_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			event_type TEXT NOT NULL,
+			ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			details TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS security_events_user_idx ON security_events (user_id, created_at);
+
+		CREATE TABLE IF NOT EXISTS ticket_sequences (
+			prefix TEXT NOT NULL,
+			org_id INTEGER NOT NULL DEFAULT 0,
+			year INTEGER NOT NULL,
+			last_value INTEGER NOT NULL,
+			PRIMARY KEY (prefix, org_id, year)
+		);
+
+		CREATE TABLE IF NOT EXISTS tickets (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			reference TEXT UNIQUE,
+			email TEXT NOT NULL,
+			requester_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			subject TEXT NOT NULL,
+			description TEXT NOT NULL,
+			status TEXT DEFAULT 'open',
+			channel TEXT NOT NULL DEFAULT 'web',
+			attachment_url TEXT,
+			closed_by TEXT,
+			closed_at TIMESTAMP,
+			assigned_to TEXT,
+			org_id INTEGER,
+			category TEXT,
+			priority TEXT NOT NULL DEFAULT 'normal' CHECK (priority IN ('low', 'normal', 'high', 'urgent')),
+			csat_score INTEGER CHECK (csat_score BETWEEN 1 AND 5),
+			csat_comment TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			sender_email TEXT NOT NULL,
+			message TEXT NOT NULL,
+			is_description BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS messages_ticket_idx ON messages (ticket_id);
+
+		CREATE TABLE IF NOT EXISTS ticket_status_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+			from_status TEXT NOT NULL,
+			to_status TEXT NOT NULL,
+			changed_by TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS ticket_status_history_ticket_idx ON ticket_status_history (ticket_id, created_at);
+
+		CREATE TABLE IF NOT EXISTS attachments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			message_id INTEGER REFERENCES messages(id) ON DELETE CASCADE,
+			s3_key TEXT UNIQUE NOT NULL,
+			filename TEXT,
+			uploaded_by TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			actor_email TEXT NOT NULL,
+			action TEXT NOT NULL,
+			ticket_id INTEGER,
+			details TEXT NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS audit_events_ticket_idx ON audit_events (ticket_id, created_at)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Databases from before requester_id; SQLite can't ADD COLUMN IF NOT EXISTS
+	_, err = s.db.Exec("ALTER TABLE tickets ADD COLUMN requester_id INTEGER REFERENCES users(id) ON DELETE SET NULL")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return err
+	}
+	_, err = s.db.Exec(`
+		CREATE INDEX IF NOT EXISTS tickets_requester_idx ON tickets (requester_id);
+		UPDATE tickets SET requester_id = (SELECT id FROM users WHERE users.email = tickets.email)
+		WHERE requester_id IS NULL
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Databases from before per-organization reference counters; without
+	// organizations every counter stays at org_id 0
+	_, err = s.db.Exec("ALTER TABLE ticket_sequences ADD COLUMN org_id INTEGER NOT NULL DEFAULT 0")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return err
+	}
+	_, err = s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS ticket_sequences_key_idx ON ticket_sequences (prefix, org_id, year)")
+	if err != nil {
+		return err
+	}
+
+	// Databases from before priority
+	_, err = s.db.Exec(`ALTER TABLE tickets ADD COLUMN priority TEXT NOT NULL DEFAULT 'normal' CHECK (priority IN ('low', 'normal', 'high', 'urgent'))`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return err
+	}
+	_, err = s.db.Exec("CREATE INDEX IF NOT EXISTS tickets_priority_idx ON tickets (priority)")
+	if err != nil {
+		return err
+	}
+
+	// Databases from before updated_at, and the indexes behind each sort
+	// key (see ticket_sort.go)
+	_, err = s.db.Exec("ALTER TABLE tickets ADD COLUMN updated_at TIMESTAMP")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return err
+	}
+	_, err = s.db.Exec(`
+		UPDATE tickets SET updated_at = COALESCE(
+			(SELECT MAX(m.created_at) FROM messages m WHERE m.ticket_id = tickets.id), created_at)
+		WHERE updated_at IS NULL;
+		CREATE INDEX IF NOT EXISTS tickets_created_idx ON tickets (created_at, id);
+		CREATE INDEX IF NOT EXISTS tickets_updated_idx ON tickets (updated_at, id);
+		CREATE INDEX IF NOT EXISTS tickets_priority_order_idx ON tickets ((` + priorityOrder + `), created_at DESC, id DESC);
+		CREATE INDEX IF NOT EXISTS tickets_sla_due_idx ON tickets ((status = 'closed'), created_at, id)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Databases from before message attachments
+	for _, column := range []string{
+		"message_id INTEGER REFERENCES messages(id) ON DELETE CASCADE",
+		"filename TEXT",
+	} {
+		_, err = s.db.Exec("ALTER TABLE attachments ADD COLUMN " + column)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return err
+		}
+	}
+	_, err = s.db.Exec(`
+		CREATE INDEX IF NOT EXISTS attachments_message_idx ON attachments (message_id) WHERE message_id IS NOT NULL;
+		CREATE INDEX IF NOT EXISTS attachments_ticket_idx ON attachments (ticket_id) WHERE message_id IS NULL
+	`)
+	return err
+}
+
+func (s sqliteStore) Tickets() TicketRepo   { return sqliteTicketRepo{s.db} }
+func (s sqliteStore) Messages() MessageRepo { return sqliteMessageRepo{s.db} }
+func (s sqliteStore) Users() UserRepo       { return sqliteUserRepo{s.db} }
+
+type sqliteUserRepo struct {
+	db *sql.DB
+}
+
+func (s sqliteUserRepo) PasswordHash(email string) (User, string, error) {
+	var user User
+	var hash string
+	err := s.db.QueryRow("SELECT id, email, user_type, password FROM users WHERE email = ?", email).
+		Scan(&user.ID, &user.Email, &user.UserType, &hash)
+	return user, hash, err
+}
+
+func (s sqliteUserRepo) SetPasswordHash(userID int, hash string) error {
+	_, err := s.db.Exec("UPDATE users SET password = ? WHERE id = ?", hash, userID)
+	return err
+}
+
+func (s sqliteUserRepo) PlaintextPasswords() (map[int]string, error) {
+	rows, err := s.db.Query("SELECT id, password FROM users WHERE password NOT LIKE '$2_$%'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passwords := map[int]string{}
+	for rows.Next() {
+		var id int
+		var password string
+		if err := rows.Scan(&id, &password); err != nil {
+			return nil, err
+		}
+		passwords[id] = password
+	}
+	return passwords, rows.Err()
+}
+
+func (s sqliteUserRepo) ReplacePassword(userID int, old, hash string) error {
+	_, err := s.db.Exec("UPDATE users SET password = ? WHERE id = ? AND password = ?", hash, userID, old)
+	return err
+}
+
+func (s sqliteUserRepo) Provision(email, password, userType string) (User, bool, error) {
+	res, err := s.db.Exec("INSERT OR IGNORE INTO users (email, password, user_type) VALUES (?, ?, ?)", email, password, userType)
+	if err != nil {
+		return User{}, false, err
+	}
+	created, _ := res.RowsAffected()
+
+	var user User
+	err = s.db.QueryRow("SELECT id, email, user_type FROM users WHERE email = ?", email).
+		Scan(&user.ID, &user.Email, &user.UserType)
+	return user, created > 0, err
+}
+
+func (s sqliteUserRepo) IDByEmail(email string) (int, error) {
+	var id int
+	err := s.db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&id)
+	return id, err
+}
+
+// Roles are fixed to the built-in set
+func (s sqliteUserRepo) Roles() (map[string]map[string]bool, error) {
+	return builtinRoles(), nil
+}
+
+func (s sqliteUserRepo) CreateSession(id string, userID int, tokenHash, userAgent, ip string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sessions (id, user_id, token_hash, user_agent, ip) 
+		VALUES (?, ?, ?, ?, ?)
+	`, id, userID, tokenHash, userAgent, ip)
+	return err
+}
+
+func (s sqliteUserRepo) SessionUser(tokenHash string) (User, string, error) {
+	var user User
+	var sessionID string
+	err := s.db.QueryRow(`
+		SELECT s.id, u.id, u.email, u.user_type 
+		FROM sessions s 
+		JOIN users u ON u.id = s.user_id 
+		WHERE s.token_hash = ? AND s.revoked_at IS NULL
+	`, tokenHash).Scan(&sessionID, &user.ID, &user.Email, &user.UserType)
+	return user, sessionID, err
+}
+
+func (s sqliteUserRepo) TouchSession(id, ip string) error {
+	_, err := s.db.Exec(`
+		UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP, ip = ? 
+		WHERE id = ? AND last_used_at < datetime('now', '-1 minute')
+	`, ip, id)
+	return err
+}
+
+func (s sqliteUserRepo) RoleOf(email string) (string, error) {
+	var role string
+	err := s.db.QueryRow("SELECT user_type FROM users WHERE email = ?", email).Scan(&role)
+	return role, err
+}
+
+func (s sqliteUserRepo) WithRoles(roles []string) ([]User, error) {
+	users := []User{}
+	if len(roles) == 0 {
+		return users, nil
+	}
+	args := make([]interface{}, len(roles))
+	for i, role := range roles {
+		args[i] = role
+	}
+	rows, err := s.db.Query("SELECT id, email, user_type FROM users WHERE user_type IN (?"+strings.Repeat(", ?", len(roles)-1)+") ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Email, &u.UserType); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s sqliteUserRepo) SetRole(userID int, role string) error {
+	_, err := s.db.Exec("UPDATE users SET user_type = ? WHERE id = ?", role, userID)
+	return err
+}
+
+func (s sqliteUserRepo) ListSessions(userID int) ([]Session, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_agent, ip, created_at, last_used_at 
+		FROM sessions 
+		WHERE user_id = ? AND revoked_at IS NULL 
+		ORDER BY last_used_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func (s sqliteUserRepo) RevokeSession(id string, userID int) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP 
+		WHERE id = ? AND (? = 0 OR user_id = ?) AND revoked_at IS NULL
+	`, id, userID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s sqliteUserRepo) RevokeAllSessions(userID int) (int64, error) {
+	res, err := s.db.Exec("UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND revoked_at IS NULL", userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s sqliteUserRepo) RevokeOtherSessions(userID int, keepID string) (int64, error) {
+	res, err := s.db.Exec("UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s sqliteUserRepo) HasUsedDevice(userID int, userAgent string) (bool, error) {
+	var known bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM sessions WHERE user_id = ? AND user_agent = ?)", userID, userAgent).Scan(&known)
+	return known, err
+}
+
+func (s sqliteUserRepo) RecordSecurityEvent(userID int, eventType, ip, userAgent, details string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO security_events (user_id, event_type, ip, user_agent, details) 
+		VALUES (?, ?, ?, ?, ?)
+	`, userID, eventType, ip, userAgent, details)
+	return err
+}
+
+func (s sqliteUserRepo) SecurityEvents(userID int, limit int) ([]SecurityEvent, error) {
+	rows, err := s.db.Query(`
+		SELECT id, event_type, ip, user_agent, details, created_at 
+		FROM security_events 
+		WHERE user_id = ? 
+		ORDER BY created_at DESC, id DESC 
+		LIMIT ?
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []SecurityEvent{}
+	for rows.Next() {
+		var e SecurityEvent
+		if err := rows.Scan(&e.ID, &e.EventType, &e.IP, &e.UserAgent, &e.Details, &e.CreatedAt); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+type sqliteTicketRepo struct {
+	db *sql.DB
+}
+
+func (s sqliteTicketRepo) List(user User, filter TicketFilter) ([]Ticket, int, error) {
+	where := " WHERE 1 = 1"
+	var args []interface{}
+
+	if !authorize(user, permTicketsReadAll, nil) {
+		where += " AND (requester_id = ? OR (requester_id IS NULL AND email = ?))"
+		args = append(args, user.ID, user.Email)
+	}
+	if filter.Reference != "" {
+		where += " AND reference = ?"
+		args = append(args, filter.Reference)
+	}
+	if filter.Channel != "" {
+		where += " AND channel = ?"
+		args = append(args, filter.Channel)
+	}
+	if filter.Priority != "" {
+		where += " AND priority = ?"
+		args = append(args, filter.Priority)
+	}
+	if filter.Status != "" {
+		where += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	if filter.Email != "" {
+		where += " AND LOWER(email) = ?"
+		args = append(args, filter.Email)
+	}
+	if !filter.From.IsZero() {
+		where += " AND created_at >= ?"
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		where += " AND created_at < ?"
+		args = append(args, filter.To)
+	}
+	if filter.HasAttachment != nil {
+		if *filter.HasAttachment {
+			where += " AND " + hasAttachmentsSQL
+		} else {
+			where += " AND NOT " + hasAttachmentsSQL
+		}
+	}
+
+	// Subject matches are found in Go, so those are paged after scanning
+	paged := filter.Page.Limit > 0 && filter.Query == ""
+	var total int
+	if paged {
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM tickets"+where, args...).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	query := "SELECT " + ticketColumns + " FROM tickets" + where
+	query += ticketOrderBy(filter.Sort)
+	if paged {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Page.Limit, filter.Page.Offset)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	tickets := []Ticket{}
+	for rows.Next() {
+		t, err := scanTicket(rows)
+		if err != nil {
+			continue
+		}
+		if filter.Query != "" && !containsText(t.Subject, filter.Query) {
+			continue
+		}
+		tickets = append(tickets, t)
+	}
+	if !paged {
+		total = len(tickets)
+		if filter.Page.Limit > 0 {
+			tickets = pageSlice(tickets, filter.Page)
+		}
+	}
+	return tickets, total, rows.Err()
+}
+
+func (s sqliteTicketRepo) Find(user User, id int) (Ticket, error) {
+	query := "SELECT " + ticketColumns + " FROM tickets WHERE id = ?"
+	args := []interface{}{id}
+	if !authorize(user, permTicketsReadAll, nil) {
+		query += " AND (requester_id = ? OR (requester_id IS NULL AND email = ?))"
+		args = append(args, user.ID, user.Email)
+	}
+	return scanTicket(s.db.QueryRow(query, args...))
+}
+
+func (s sqliteTicketRepo) IDByReference(ref string) (int, error) {
+	var id int
+	err := s.db.QueryRow("SELECT id FROM tickets WHERE reference = ?", ref).Scan(&id)
+	return id, err
+}
+
+func (s sqliteTicketRepo) Create(ticket *Ticket, user User) error {
+	if len(ticket.CustomFields) > 0 {
+		return errUnknownField
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ticket.Reference, err = nextTicketReference(tx, 0)
+	if err != nil {
+		return err
+	}
+
+	ticket.CreatedAt = time.Now().UTC()
+	ticket.UpdatedAt = ticket.CreatedAt
+	res, err := tx.Exec(`
+		INSERT INTO tickets (reference, email, requester_id, subject, description, status, channel, attachment_url, category, priority, created_at, updated_at) 
+		VALUES (?, ?, (SELECT id FROM users WHERE email = ?), ?, ?, 'open', ?, ?, ?, ?, ?, ?)
+	`, ticket.Reference, ticket.Email, ticket.Email, ticket.Subject, ticket.Description, ticket.Channel,
+		sql.NullString{String: ticket.AttachmentURL, Valid: ticket.AttachmentURL != ""},
+		sql.NullString{String: ticket.Category, Valid: ticket.Category != ""}, ticket.Priority, ticket.CreatedAt, ticket.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	ticket.ID = int(id)
+	tx.QueryRow("SELECT COALESCE(requester_id, 0) FROM tickets WHERE id = ?", id).Scan(&ticket.RequesterID)
+
+	for i, a := range ticket.Attachments {
+		// Uploads are recorded unlinked; claim that row
+		err := tx.QueryRow(`
+			INSERT INTO attachments (ticket_id, s3_key, uploaded_by) VALUES (?, ?, ?)
+			ON CONFLICT (s3_key) DO UPDATE SET ticket_id = excluded.ticket_id
+			WHERE attachments.ticket_id IS NULL
+			RETURNING id
+		`, ticket.ID, a.Key, ticket.Email).Scan(&ticket.Attachments[i].ID)
+		if err == sql.ErrNoRows {
+			return errAttachmentLinked
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO messages (ticket_id, sender_email, message, is_description, created_at) 
+		VALUES (?, ?, ?, TRUE, ?)
+	`, ticket.ID, ticket.Email, ticket.Description, ticket.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s sqliteTicketRepo) SetStatus(id int, from, to, changedBy string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE tickets SET status = ?1, 
+			closed_by = CASE WHEN ?1 = 'closed' THEN ?2 END, 
+			closed_at = CASE WHEN ?1 = 'closed' THEN CURRENT_TIMESTAMP END, 
+			updated_at = ?5 
+		WHERE id = ?3 AND status = ?4
+	`, to, changedBy, id, from, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errStatusChanged
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO ticket_status_history (ticket_id, from_status, to_status, changed_by) 
+		VALUES (?, ?, ?, ?)
+	`, id, from, to, changedBy)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s sqliteTicketRepo) StatusHistory(id int) ([]StatusChange, error) {
+	rows, err := s.db.Query(`
+		SELECT from_status, to_status, changed_by, created_at 
+		FROM ticket_status_history 
+		WHERE ticket_id = ? 
+		ORDER BY created_at, id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []StatusChange{}
+	for rows.Next() {
+		var c StatusChange
+		if err := rows.Scan(&c.From, &c.To, &c.ChangedBy, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+func (s sqliteTicketRepo) Assign(id int, assignee string) error {
+	_, err := s.db.Exec("UPDATE tickets SET assigned_to = ?, updated_at = ? WHERE id = ?",
+		sql.NullString{String: assignee, Valid: assignee != ""}, time.Now().UTC(), id)
+	return err
+}
+
+func (s sqliteTicketRepo) Claim(id int, assignee string) error {
+	res, err := s.db.Exec("UPDATE tickets SET assigned_to = ?, updated_at = ? WHERE id = ? AND COALESCE(assigned_to, '') = ''",
+		assignee, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errAlreadyAssigned
+	}
+	return nil
+}
+
+func (s sqliteTicketRepo) SetRequester(id int, email string) error {
+	_, err := s.db.Exec("UPDATE tickets SET email = ?1, requester_id = (SELECT id FROM users WHERE email = ?1), updated_at = ?3 WHERE id = ?2",
+		email, id, time.Now().UTC())
+	return err
+}
+
+func (s sqliteTicketRepo) SetPriority(id int, priority string) error {
+	_, err := s.db.Exec("UPDATE tickets SET priority = ?, updated_at = ? WHERE id = ?", priority, time.Now().UTC(), id)
+	return err
+}
+
+func (s sqliteTicketRepo) Rate(id int, score int, comment string) error {
+	_, err := s.db.Exec("UPDATE tickets SET csat_score = ?, csat_comment = ?, updated_at = ? WHERE id = ?",
+		score, comment, time.Now().UTC(), id)
+	return err
+}
+
+func (s sqliteTicketRepo) Attachments(ids []int) (map[int][]Attachment, error) {
+	if len(ids) == 0 {
+		return map[int][]Attachment{}, nil
+	}
+	in, args := sqliteInList(ids)
+	rows, err := s.db.Query(`
+		SELECT id, ticket_id, s3_key, filename FROM attachments 
+		WHERE ticket_id IN `+in+` AND message_id IS NULL 
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAttachments(rows)
+}
+
+func (s sqliteTicketRepo) RecordUpload(key, email string, size int64, location string) error {
+	_, err := s.db.Exec("INSERT INTO attachments (s3_key, uploaded_by) VALUES (?, ?) ON CONFLICT (s3_key) DO NOTHING", key, email)
+	return err
+}
+
+func (s sqliteTicketRepo) Uploader(key string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT uploaded_by FROM attachments WHERE s3_key = ?", key).Scan(&email)
+	return email, err
+}
+
+// Placeholders and arguments for "IN (...)" over ids, which mustn't be
+// empty
+func sqliteInList(ids []int) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return "(?" + strings.Repeat(", ?", len(ids)-1) + ")", args
+}
+
+type sqliteMessageRepo struct {
+	db *sql.DB
+}
+
+func (s sqliteMessageRepo) List(ticketID int) ([]Message, error) {
+	return s.list(ticketID, Page{})
+}
+
+func (s sqliteMessageRepo) ListPage(ticketID int, page Page) ([]Message, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM messages WHERE ticket_id = ?", ticketID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	messages, err := s.list(ticketID, page)
+	return messages, total, err
+}
+
+// Messages of a thread, description first; zero page.Limit for all
+func (s sqliteMessageRepo) list(ticketID int, page Page) ([]Message, error) {
+	limit := -1
+	if page.Limit > 0 {
+		limit = page.Limit
+	}
+	rows, err := s.db.Query(`
+		SELECT id, ticket_id, sender_email, message, is_description, created_at 
+		FROM messages 
+		WHERE ticket_id = ? 
+		ORDER BY is_description DESC, created_at ASC, id ASC 
+		LIMIT ? OFFSET ?
+	`, ticketID, limit, page.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.TicketID, &m.SenderEmail, &m.Message, &m.IsDescription, &m.CreatedAt); err != nil {
+			continue
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil || len(messages) == 0 {
+		return messages, err
+	}
+
+	rows, err = s.db.Query(`
+		SELECT id, message_id, s3_key, filename FROM attachments 
+		WHERE ticket_id = ? AND message_id IS NOT NULL 
+		ORDER BY id
+	`, ticketID)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := scanAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].ID]
+	}
+	return messages, nil
+}
+
+func (s sqliteMessageRepo) FirstResponses(ticketIDs []int) (map[int]time.Time, error) {
+	responses := map[int]time.Time{}
+	if len(ticketIDs) == 0 {
+		return responses, nil
+	}
+	in, args := sqliteInList(ticketIDs)
+	// MIN() would come back as text, so the earliest is picked here
+	rows, err := s.db.Query(`
+		SELECT m.ticket_id, m.created_at 
+		FROM messages m 
+		JOIN tickets t ON t.id = m.ticket_id 
+		WHERE m.ticket_id IN `+in+` AND m.sender_email <> t.email AND NOT m.is_description
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var at time.Time
+		if err := rows.Scan(&id, &at); err != nil {
+			return nil, err
+		}
+		if first, ok := responses[id]; !ok || at.Before(first) {
+			responses[id] = at
+		}
+	}
+	return responses, rows.Err()
+}
+
+// A new message also marks its ticket updated, and links its attachments
+func (s sqliteMessageRepo) Create(msg *Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	msg.CreatedAt = time.Now().UTC()
+	res, err := tx.Exec("INSERT INTO messages (ticket_id, sender_email, message, created_at) VALUES (?, ?, ?, ?)",
+		msg.TicketID, msg.SenderEmail, msg.Message, msg.CreatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	msg.ID = int(id)
+	if _, err := tx.Exec("UPDATE tickets SET updated_at = ? WHERE id = ?", msg.CreatedAt, msg.TicketID); err != nil {
+		return err
+	}
+	for i, a := range msg.Attachments {
+		// Uploads are recorded unlinked; claim that row
+		err := tx.QueryRow(`
+			INSERT INTO attachments (ticket_id, message_id, s3_key, filename, uploaded_by) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (s3_key) DO UPDATE SET ticket_id = excluded.ticket_id,
+				message_id = excluded.message_id, filename = excluded.filename
+			WHERE attachments.ticket_id IS NULL
+			RETURNING id
+		`, msg.TicketID, msg.ID, a.Key, sql.NullString{String: a.Filename, Valid: a.Filename != ""}, msg.SenderEmail).Scan(&msg.Attachments[i].ID)
+		if err == sql.ErrNoRows {
+			return errAttachmentLinked
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
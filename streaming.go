@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Large exports are written as rows come off the database cursor rather
+// than built up in memory first. Each write goes to the connection, so a
+// client reading slowly holds the cursor back instead of rows piling up
+// in the server; a client that stops reading altogether runs into the
+// write deadline, and one that disconnects cancels the request context
+// and with it the query.
+
+const (
+	streamFlushRows     = 500
+	streamFlushInterval = 2 * time.Second
+	// How long a single flush may wait on the client
+	streamWriteTimeout = 30 * time.Second
+)
+
+// Buffered writer over a response. Callers write rows in batches and
+// flush once streamFlushRows are pending or streamFlushInterval has
+// passed, whichever comes first.
+type streamWriter struct {
+	rc        *http.ResponseController
+	buf       *bufio.Writer
+	lastFlush time.Time
+}
+
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	return &streamWriter{
+		rc:        http.NewResponseController(w),
+		buf:       bufio.NewWriterSize(w, 64*1024),
+		lastFlush: time.Now(),
+	}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.deadline()
+	return s.buf.Write(p)
+}
+
+// Whether pending rows should be written out and flushed now
+func (s *streamWriter) Due(pending int) bool {
+	return pending >= streamFlushRows || time.Since(s.lastFlush) >= streamFlushInterval
+}
+
+// Send everything buffered so far to the client
+func (s *streamWriter) Flush() error {
+	s.deadline()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	s.lastFlush = time.Now()
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// Push the write deadline out before each write that may reach the
+// connection; ignored where the connection doesn't support deadlines
+func (s *streamWriter) deadline() {
+	s.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+}
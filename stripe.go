@@ -0,0 +1,338 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Billing summary for a requester, shown to agents next to the ticket
+type BillingContext struct {
+	CustomerID         string       `json:"customer_id"`
+	Name               string       `json:"name,omitempty"`
+	Delinquent         bool         `json:"delinquent"`
+	Plan               string       `json:"plan,omitempty"`
+	SubscriptionStatus string       `json:"subscription_status,omitempty"`
+	CurrentPeriodEnd   *time.Time   `json:"current_period_end,omitempty"`
+	LastInvoice        *InvoiceInfo `json:"last_invoice,omitempty"`
+	DashboardURL       string       `json:"dashboard_url"`
+}
+
+type InvoiceInfo struct {
+	Number    string    `json:"number"`
+	Status    string    `json:"status"`
+	AmountDue int64     `json:"amount_due"`
+	Currency  string    `json:"currency"`
+	Created   time.Time `json:"created"`
+	URL       string    `json:"url,omitempty"`
+}
+
+// Stripe lookups are cached briefly; webhooks invalidate on changes
+var billingCache = newContextCache(5 * time.Minute)
+
+func stripeEnabled() bool {
+	return os.Getenv("STRIPE_API_KEY") != ""
+}
+
+// Create table linking requester emails to Stripe customers
+func createStripeCustomersTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS stripe_customers (
+			email VARCHAR(255) PRIMARY KEY,
+			customer_id VARCHAR(255) NOT NULL,
+			linked_by VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create stripe_customers table:", err)
+	}
+}
+
+// GET a Stripe API resource into out
+func stripeGet(path string, params url.Values, out interface{}) error {
+	req, err := http.NewRequest("GET", "https://api.stripe.com/v1/"+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("STRIPE_API_KEY"))
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("stripe %s: %d %s", path, resp.StatusCode, e.Error.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Stripe customer for an email: an explicit link if one exists, otherwise
+// a customer with the same email address. Empty if there is none.
+func stripeCustomerFor(email string) (string, error) {
+	if fullFeatured() {
+		var id string
+		err := db.QueryRow("SELECT customer_id FROM stripe_customers WHERE lower(email) = lower($1)", email).Scan(&id)
+		if err == nil {
+			return id, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := stripeGet("customers", url.Values{"email": {email}, "limit": {"1"}}, &list); err != nil {
+		return "", err
+	}
+	if len(list.Data) == 0 {
+		return "", nil
+	}
+	return list.Data[0].ID, nil
+}
+
+// Billing context for an email, or nil if they aren't a Stripe customer
+func billingContextFor(email string) (*BillingContext, error) {
+	customerID, err := stripeCustomerFor(email)
+	if err != nil || customerID == "" {
+		return nil, err
+	}
+
+	if v, ok := billingCache.get(customerID); ok {
+		return v.(*BillingContext), nil
+	}
+
+	ctx, err := fetchBillingContext(customerID)
+	if err != nil {
+		return nil, err
+	}
+	billingCache.set(customerID, ctx)
+	return ctx, nil
+}
+
+// Billing section of the ticket context
+type stripeContextProvider struct{}
+
+func (stripeContextProvider) Name() string {
+	return "billing"
+}
+
+func (stripeContextProvider) Lookup(ticket Ticket) (interface{}, error) {
+	ctx, err := billingContextFor(ticket.Email)
+	if ctx == nil {
+		// Keep a typed nil out of the interface so JSON shows null
+		return nil, err
+	}
+	return ctx, err
+}
+
+func fetchBillingContext(customerID string) (*BillingContext, error) {
+	var customer struct {
+		Name       string `json:"name"`
+		Delinquent bool   `json:"delinquent"`
+	}
+	if err := stripeGet("customers/"+url.PathEscape(customerID), nil, &customer); err != nil {
+		return nil, err
+	}
+
+	ctx := &BillingContext{
+		CustomerID:   customerID,
+		Name:         customer.Name,
+		Delinquent:   customer.Delinquent,
+		DashboardURL: "https://dashboard.stripe.com/customers/" + customerID,
+	}
+
+	var subs struct {
+		Data []struct {
+			Status           string `json:"status"`
+			CurrentPeriodEnd int64  `json:"current_period_end"`
+			Items            struct {
+				Data []struct {
+					CurrentPeriodEnd int64 `json:"current_period_end"`
+					Price            struct {
+						ID       string `json:"id"`
+						Nickname string `json:"nickname"`
+					} `json:"price"`
+				} `json:"data"`
+			} `json:"items"`
+		} `json:"data"`
+	}
+	if err := stripeGet("subscriptions", url.Values{"customer": {customerID}, "status": {"all"}, "limit": {"1"}}, &subs); err != nil {
+		return nil, err
+	}
+	if len(subs.Data) > 0 {
+		sub := subs.Data[0]
+		ctx.SubscriptionStatus = sub.Status
+		periodEnd := sub.CurrentPeriodEnd
+		if len(sub.Items.Data) > 0 {
+			price := sub.Items.Data[0].Price
+			ctx.Plan = price.Nickname
+			if ctx.Plan == "" {
+				ctx.Plan = price.ID
+			}
+			// Newer API versions report the period per item
+			if periodEnd == 0 {
+				periodEnd = sub.Items.Data[0].CurrentPeriodEnd
+			}
+		}
+		if periodEnd > 0 {
+			t := time.Unix(periodEnd, 0).UTC()
+			ctx.CurrentPeriodEnd = &t
+		}
+	}
+
+	var invoices struct {
+		Data []struct {
+			Number           string `json:"number"`
+			Status           string `json:"status"`
+			AmountDue        int64  `json:"amount_due"`
+			Currency         string `json:"currency"`
+			Created          int64  `json:"created"`
+			HostedInvoiceURL string `json:"hosted_invoice_url"`
+		} `json:"data"`
+	}
+	if err := stripeGet("invoices", url.Values{"customer": {customerID}, "limit": {"1"}}, &invoices); err != nil {
+		return nil, err
+	}
+	if len(invoices.Data) > 0 {
+		inv := invoices.Data[0]
+		ctx.LastInvoice = &InvoiceInfo{
+			Number:    inv.Number,
+			Status:    inv.Status,
+			AmountDue: inv.AmountDue,
+			Currency:  inv.Currency,
+			Created:   time.Unix(inv.Created, 0).UTC(),
+			URL:       inv.HostedInvoiceURL,
+		}
+	}
+
+	return ctx, nil
+}
+
+// Verified Stripe events: drop cached billing context for the customer
+// so agents see plan and invoice changes right away
+func handleStripeHook(w http.ResponseWriter, r *http.Request, body []byte) {
+	var ev struct {
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID       string `json:"id"`
+				Object   string `json:"object"`
+				Customer string `json:"customer"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &ev); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	customerID := ev.Data.Object.Customer
+	if ev.Data.Object.Object == "customer" {
+		customerID = ev.Data.Object.ID
+	}
+	if customerID != "" {
+		billingCache.delete(customerID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Admin: GET /admin/billing_links, PUT/DELETE /admin/billing_links/{email}
+func handleBillingLinks(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	email, _ := url.PathUnescape(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/billing_links"), "/"))
+
+	switch {
+	case email == "" && r.Method == "GET":
+		rows, err := db.Query("SELECT email, customer_id, linked_by, created_at FROM stripe_customers ORDER BY email")
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		type link struct {
+			Email      string    `json:"email"`
+			CustomerID string    `json:"customer_id"`
+			LinkedBy   string    `json:"linked_by"`
+			CreatedAt  time.Time `json:"created_at"`
+		}
+		links := []link{}
+		for rows.Next() {
+			var l link
+			if err := rows.Scan(&l.Email, &l.CustomerID, &l.LinkedBy, &l.CreatedAt); err != nil {
+				continue
+			}
+			links = append(links, l)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(links)
+
+	case email != "" && r.Method == "PUT":
+		var req struct {
+			CustomerID string `json:"customer_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !strings.HasPrefix(req.CustomerID, "cus_") {
+			http.Error(w, "customer_id must be a Stripe customer ID (cus_...)", http.StatusBadRequest)
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO stripe_customers (email, customer_id, linked_by) 
+			VALUES (lower($1), $2, $3) 
+			ON CONFLICT (email) DO UPDATE SET customer_id = EXCLUDED.customer_id, linked_by = EXCLUDED.linked_by
+		`, email, req.CustomerID, user.Email)
+		if err != nil {
+			http.Error(w, "Failed to link customer", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✓ %s linked to Stripe customer %s by %s", email, req.CustomerID, user.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"email": email, "customer_id": req.CustomerID})
+
+	case email != "" && r.Method == "DELETE":
+		res, err := db.Exec("DELETE FROM stripe_customers WHERE email = lower($1)", email)
+		if err != nil {
+			http.Error(w, "Failed to unlink customer", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "No link for this email", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Link removed"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Suppression struct {
+	Email     string    `json:"email"`
+	Reason    string    `json:"reason"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Create suppression list table
+func createSuppressionsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS email_suppressions (
+			email VARCHAR(255) PRIMARY KEY,
+			reason VARCHAR(20) NOT NULL,
+			detail TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create email_suppressions table:", err)
+	}
+}
+
+// Stop sending to an address after a hard bounce or complaint
+func suppressAddress(email, reason, detail string) {
+	_, err := db.Exec(`
+		INSERT INTO email_suppressions (email, reason, detail) 
+		VALUES (lower($1), $2, $3) 
+		ON CONFLICT (email) DO UPDATE SET reason = EXCLUDED.reason, detail = EXCLUDED.detail
+	`, email, reason, detail)
+	if err != nil {
+		notifyLog.Errorf("Failed to suppress %s: %v", email, err)
+		return
+	}
+	notifyLog.Printf("✓ %s added to suppression list (%s)", email, reason)
+}
+
+// Whether mail to the address is blocked
+func isSuppressed(email string) bool {
+	if !fullFeatured() {
+		return false
+	}
+	var exists bool
+	db.QueryRow("SELECT EXISTS (SELECT 1 FROM email_suppressions WHERE email = lower($1))", email).Scan(&exists)
+	return exists
+}
+
+// Admin: GET /admin/suppressions, DELETE /admin/suppressions/{email}
+func handleSuppressions(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !authorize(user, permUsersManage, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	email, _ := url.PathUnescape(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/suppressions"), "/"))
+
+	switch {
+	case email == "" && r.Method == "GET":
+		rows, err := db.Query("SELECT email, reason, detail, created_at FROM email_suppressions ORDER BY created_at DESC")
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		list := []Suppression{}
+		for rows.Next() {
+			var s Suppression
+			if err := rows.Scan(&s.Email, &s.Reason, &s.Detail, &s.CreatedAt); err != nil {
+				continue
+			}
+			list = append(list, s)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case email != "" && r.Method == "DELETE":
+		res, err := db.Exec("DELETE FROM email_suppressions WHERE email = lower($1)", email)
+		if err != nil {
+			http.Error(w, "Failed to remove suppression", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Address not suppressed", http.StatusNotFound)
+			return
+		}
+
+		log.Printf("✓ %s removed from suppression list by %s", email, user.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Suppression removed"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
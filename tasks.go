@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A step in resolving a ticket. Staff only.
+type Task struct {
+	ID        int        `json:"id"`
+	TicketID  int        `json:"ticket_id"`
+	Text      string     `json:"text"`
+	Assignee  string     `json:"assignee,omitempty"`
+	Done      bool       `json:"done"`
+	DoneBy    string     `json:"done_by,omitempty"`
+	DoneAt    *time.Time `json:"done_at,omitempty"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Task completion shown on ticket detail
+type TaskProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+const (
+	maxTaskLength     = 500
+	maxTasksPerTicket = 100
+)
+
+// Create ticket tasks table
+func createTasksTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ticket_tasks (
+			id SERIAL PRIMARY KEY,
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			text TEXT NOT NULL,
+			assignee VARCHAR(255) NOT NULL DEFAULT '',
+			done BOOLEAN NOT NULL DEFAULT FALSE,
+			done_by VARCHAR(255) NOT NULL DEFAULT '',
+			done_at TIMESTAMP,
+			created_by VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS ticket_tasks_ticket_idx ON ticket_tasks (ticket_id)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create ticket_tasks table:", err)
+	}
+}
+
+// Done and total tasks for each of the given tickets that has any
+func ticketTaskProgress(ids []int) (map[int]*TaskProgress, error) {
+	rows, err := db.Query(`
+		SELECT ticket_id, COUNT(*) FILTER (WHERE done), COUNT(*)
+		FROM ticket_tasks WHERE ticket_id = ANY($1)
+		GROUP BY ticket_id
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	progress := map[int]*TaskProgress{}
+	for rows.Next() {
+		var id int
+		var p TaskProgress
+		if err := rows.Scan(&id, &p.Done, &p.Total); err != nil {
+			return nil, err
+		}
+		progress[id] = &p
+	}
+	return progress, rows.Err()
+}
+
+const taskColumns = "id, ticket_id, text, assignee, done, done_by, done_at, created_by, created_at"
+
+func scanTask(row interface{ Scan(...interface{}) error }) (Task, error) {
+	var t Task
+	var doneAt sql.NullTime
+	err := row.Scan(&t.ID, &t.TicketID, &t.Text, &t.Assignee, &t.Done, &t.DoneBy, &doneAt, &t.CreatedBy, &t.CreatedAt)
+	if doneAt.Valid {
+		t.DoneAt = &doneAt.Time
+	}
+	return t, err
+}
+
+func (t *Task) validate() error {
+	t.Text = strings.TrimSpace(t.Text)
+	t.Assignee = strings.TrimSpace(t.Assignee)
+	switch {
+	case t.Text == "":
+		return fmt.Errorf("task text is required")
+	case len(t.Text) > maxTaskLength:
+		return fmt.Errorf("task text is too long")
+	case t.Assignee != "" && !isAgent(t.Assignee):
+		return fmt.Errorf("assignee must be an agent")
+	}
+	return nil
+}
+
+// GET/POST /tickets/{id}/tasks, PUT/DELETE /tickets/{id}/tasks/{taskID}.
+// PUT updates any of text, assignee and done.
+func handleTasks(w http.ResponseWriter, r *http.Request, ticketID int) {
+	if !fullFeatured() {
+		http.Error(w, "Tasks require PostgreSQL", http.StatusNotImplemented)
+		return
+	}
+
+	user := currentUser(r)
+	if !authorize(user, permTicketsReplyAll, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	if _, err := findAccessibleTicket(r, ticketID); err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	idPart := ""
+	if len(parts) > 3 {
+		idPart = parts[3]
+	}
+
+	if idPart == "" {
+		switch r.Method {
+		case "GET":
+			rows, err := db.Query("SELECT "+taskColumns+" FROM ticket_tasks WHERE ticket_id = $1 ORDER BY id", ticketID)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			tasks := []Task{}
+			progress := TaskProgress{}
+			for rows.Next() {
+				t, err := scanTask(rows)
+				if err != nil {
+					continue
+				}
+				tasks = append(tasks, t)
+				progress.Total++
+				if t.Done {
+					progress.Done++
+				}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"tasks": tasks, "progress": progress})
+
+		case "POST":
+			var t Task
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if err := t.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var count int
+			db.QueryRow("SELECT COUNT(*) FROM ticket_tasks WHERE ticket_id = $1", ticketID).Scan(&count)
+			if count >= maxTasksPerTicket {
+				http.Error(w, "Too many tasks on this ticket", http.StatusBadRequest)
+				return
+			}
+
+			t, err := scanTask(db.QueryRow(`
+				INSERT INTO ticket_tasks (ticket_id, text, assignee, created_by) VALUES ($1, $2, $3, $4)
+				RETURNING `+taskColumns, ticketID, t.Text, t.Assignee, user.Email))
+			if err != nil {
+				http.Error(w, "Failed to add task", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(t)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	taskID, err := strconv.Atoi(idPart)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		current, err := scanTask(db.QueryRow("SELECT "+taskColumns+" FROM ticket_tasks WHERE id = $1 AND ticket_id = $2", taskID, ticketID))
+		if err != nil {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+
+		var req struct {
+			Text     *string `json:"text"`
+			Assignee *string `json:"assignee"`
+			Done     *bool   `json:"done"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		updated := current
+		if req.Text != nil {
+			updated.Text = *req.Text
+		}
+		if req.Assignee != nil {
+			updated.Assignee = *req.Assignee
+		}
+		if req.Done != nil {
+			updated.Done = *req.Done
+		}
+		if err := updated.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Completion records who ticked the task off; reopening clears it
+		t, err := scanTask(db.QueryRow(`
+			UPDATE ticket_tasks SET text = $2, assignee = $3, done = $4,
+				done_by = CASE WHEN $4 AND NOT done THEN $5 WHEN $4 THEN done_by ELSE '' END,
+				done_at = CASE WHEN $4 AND NOT done THEN CURRENT_TIMESTAMP WHEN $4 THEN done_at END
+			WHERE id = $1
+			RETURNING `+taskColumns, taskID, updated.Text, updated.Assignee, updated.Done, user.Email))
+		if err != nil {
+			http.Error(w, "Failed to update task", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+
+	case "DELETE":
+		res, err := db.Exec("DELETE FROM ticket_tasks WHERE id = $1 AND ticket_id = $2", taskID, ticketID)
+		if err != nil {
+			http.Error(w, "Failed to delete task", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
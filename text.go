@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Text is stored in Unicode NFC, so "é" typed as one character or as "e"
+// plus an accent is the same string to compare, search and count. Lengths
+// are in characters, as Postgres counts VARCHAR(n), and cuts never land
+// inside a character or an emoji sequence.
+
+// Longest ticket subject (tickets.subject is VARCHAR(200))
+const maxSubjectLength = 200
+
+// NFC form of s, with invalid UTF-8 replaced
+func normalizeText(s string) string {
+	return norm.NFC.String(strings.ToValidUTF8(s, "\ufffd"))
+}
+
+// Runes that attach to the one before: combining marks, zero-width
+// joiners, variation selectors and emoji skin tones
+func isExtendingRune(r rune) bool {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me):
+		return true
+	case r == '\u200d', r >= '\ufe00' && r <= '\ufe0f':
+		return true
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		return true
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// s cut to at most max characters, ending in "…" if anything was cut.
+// The cut backs up to the start of the character cluster it would split,
+// so a flag or a family emoji is dropped whole rather than in pieces.
+func truncateText(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	cut := max - 1
+	for cut > 0 && (isExtendingRune(runes[cut]) || runes[cut-1] == '\u200d') {
+		cut--
+	}
+	// Flags are pairs of regional indicators
+	if isRegionalIndicator(runes[cut]) {
+		n := 0
+		for i := cut - 1; i >= 0 && isRegionalIndicator(runes[i]); i-- {
+			n++
+		}
+		if n%2 == 1 {
+			cut--
+		}
+	}
+	return strings.TrimRightFunc(string(runes[:cut]), unicode.IsSpace) + "…"
+}
+
+// Whether text contains query, ignoring case and normalization
+func containsText(text, query string) bool {
+	fold := cases.Fold()
+	return strings.Contains(fold.String(normalizeText(text)), fold.String(normalizeText(query)))
+}
+
+// Collation for sorted lists: COLLATION as a BCP 47 tag (de, sv, ja...),
+// or the Unicode root order
+func collationTag() language.Tag {
+	tag, err := language.Parse(os.Getenv("COLLATION"))
+	if err != nil {
+		return language.Und
+	}
+	return tag
+}
+
+// Sort a slice by a text key in collation order, so accented and
+// non-Latin names sort where a reader expects rather than by code point
+func sortCollated(items interface{}, key func(i int) string) {
+	c := collate.New(collationTag(), collate.IgnoreCase)
+	sort.SliceStable(items, func(i, j int) bool {
+		return c.CompareString(key(i), key(j)) < 0
+	})
+}
+
+// Text for the PDF core fonts, which only have cp1252: composed first so
+// accented letters survive, and anything else (emoji, CJK) becomes one "?"
+// per character rather than a byte per rune
+func pdfText(s string) string {
+	var b strings.Builder
+	prevFlag := false
+	for _, r := range normalizeText(s) {
+		if isExtendingRune(r) {
+			continue
+		}
+		if isRegionalIndicator(r) {
+			if prevFlag {
+				prevFlag = false
+				continue
+			}
+			prevFlag = true
+		} else {
+			prevFlag = false
+		}
+		if c, ok := charmap.Windows1252.EncodeRune(r); ok {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Threading for the email channel: which ticket an inbound email belongs
+// to. It's off unless INBOUND_EMAIL=true says an inbound gateway delivers
+// mail here; the gateway calls threadTicket before opening a ticket and
+// recordEmailThread once the mail is on one.
+
+// Whether inbound email is delivered to this deployment (INBOUND_EMAIL)
+func inboundEmailEnabled() bool {
+	return os.Getenv("INBOUND_EMAIL") == "true"
+}
+
+// Headers of an inbound email that decide which ticket it belongs to.
+// The inbound gateway fills this in from the parsed message.
+type inboundEmail struct {
+	From       string
+	Subject    string
+	MessageID  string
+	InReplyTo  string
+	References string
+}
+
+// How far back a reply with a bare subject is matched against the
+// sender's open tickets
+const subjectThreadWindow = 14 * 24 * time.Hour
+
+var (
+	headerMessageID = regexp.MustCompile(`<([^<>\s]+)>`)
+	replyPrefix     = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|wg|sv|vs|antw|tr)(\[\d+\])?\s*:\s*)+`)
+	subjectSpaces   = regexp.MustCompile(`\s+`)
+)
+
+// Create the table mapping inbound Message-IDs to tickets, so replies
+// to a customer's own earlier mail (e.g. with others in Cc) thread too
+func createEmailThreadsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS email_threads (
+			message_id VARCHAR(998) PRIMARY KEY,
+			ticket_id INTEGER NOT NULL REFERENCES tickets(id) ON DELETE CASCADE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create email_threads table:", err)
+	}
+}
+
+// Remember an inbound email's Message-ID once it's on a ticket
+func recordEmailThread(messageID string, ticketID int) {
+	ids := messageIDs(messageID)
+	if !inboundEmailEnabled() || !fullFeatured() || len(ids) == 0 {
+		return
+	}
+	_, err := db.Exec(`
+		INSERT INTO email_threads (message_id, ticket_id) VALUES ($1, $2)
+		ON CONFLICT (message_id) DO NOTHING
+	`, ids[0], ticketID)
+	if err != nil {
+		log.Printf("Failed to record email thread for ticket #%d: %v", ticketID, err)
+	}
+}
+
+// Ticket an inbound email replies to, or ok=false when it should open a
+// new ticket, as every email does without INBOUND_EMAIL. In order:
+//  1. In-Reply-To, then References newest first, matched against the
+//     notifications we sent and inbound mail already on a ticket
+//  2. a [REF] token in the subject, if the sender is the requester or staff
+//  3. an open ticket from the same sender with the same subject once
+//     Re:/Fwd: prefixes are removed, so resends don't open duplicates
+func threadTicket(mail inboundEmail) (ticketID int, ok bool, err error) {
+	if !inboundEmailEnabled() {
+		return 0, false, nil
+	}
+	sender := strings.ToLower(addressOf(strings.TrimSpace(mail.From)))
+
+	if fullFeatured() {
+		refs := messageIDs(mail.References)
+		ids := messageIDs(mail.InReplyTo)
+		for i := len(refs) - 1; i >= 0; i-- {
+			ids = append(ids, refs[i])
+		}
+		for _, id := range ids {
+			ticketID, err := ticketByMessageID(id)
+			if err == nil {
+				return ticketID, true, nil
+			}
+			if err != sql.ErrNoRows {
+				return 0, false, err
+			}
+		}
+	}
+
+	if ref := subjectReference(mail.Subject); ref != "" {
+		ticketID, err := store.Tickets().IDByReference(ref)
+		switch {
+		case err == sql.ErrNoRows:
+			// Archived or mistyped; a new ticket is the safer outcome
+		case err != nil:
+			return 0, false, err
+		default:
+			if ok, err := mayReplyTo(sender, ticketID); err != nil || ok {
+				return ticketID, ok, err
+			}
+		}
+	}
+
+	if fullFeatured() {
+		ticketID, err := openTicketBySubject(sender, mail.Subject)
+		if err == nil {
+			return ticketID, true, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, false, err
+		}
+	}
+
+	return 0, false, nil
+}
+
+// Bracketed Message-IDs in a header, in order
+func messageIDs(header string) []string {
+	var ids []string
+	for _, m := range headerMessageID.FindAllStringSubmatch(header, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+// Ticket for a Message-ID we sent or received. SMTP delivery records keep
+// the full Message-ID; SES records its message ID, which SES uses as the
+// local part of the Message-ID it sets.
+func ticketByMessageID(id string) (int, error) {
+	local := id
+	if at := strings.LastIndex(id, "@"); at >= 0 {
+		local = id[:at]
+	}
+
+	var ticketID int
+	err := db.QueryRow(`
+		SELECT ticket_id FROM email_threads WHERE message_id = $1
+		UNION ALL
+		SELECT m.ticket_id FROM email_deliveries d JOIN messages m ON m.id = d.message_id
+		WHERE d.provider_id IN ($1, $2) AND d.provider_id <> ''
+		LIMIT 1
+	`, id, local).Scan(&ticketID)
+	return ticketID, err
+}
+
+// Ticket reference in a subject's [PREFIX-YYYY-NNNNN] or, for an
+// organization's ticket, [PREFIX-ORG-YYYY-NNNNN] token
+func subjectReference(subject string) string {
+	token := regexp.MustCompile(`\[(` + regexp.QuoteMeta(ticketRefPrefix()) + `(-\d+)?-\d{4}-\d{5,})\]`)
+	if m := token.FindStringSubmatch(subject); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// Anyone can type a reference into a subject, so only the requester and
+// staff are threaded by it
+func mayReplyTo(sender string, ticketID int) (bool, error) {
+	role, err := store.Users().RoleOf(sender)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if rolePermissions(role)[permTicketsReplyAll] {
+		return true, nil
+	}
+
+	// Senders without an account only match tickets filed by email
+	userID, _ := store.Users().IDByEmail(sender)
+	ticket, err := store.Tickets().Find(User{ID: userID, Email: sender, UserType: "client"}, ticketID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if ticket.RequesterID != 0 {
+		return ticket.RequesterID == userID, nil
+	}
+	return strings.EqualFold(ticket.Email, sender), nil
+}
+
+// Subject with reply/forward prefixes and ticket tokens removed, for
+// comparing a reply with the ticket it answers
+func normalizeSubject(subject string) string {
+	if ref := subjectReference(subject); ref != "" {
+		subject = strings.Replace(subject, "["+ref+"]", "", 1)
+	}
+	subject = replyPrefix.ReplaceAllString(strings.TrimSpace(subject), "")
+	return strings.ToLower(subjectSpaces.ReplaceAllString(strings.TrimSpace(subject), " "))
+}
+
+// Most recent open ticket from sender with the same normalized subject
+func openTicketBySubject(sender, subject string) (int, error) {
+	normalized := normalizeSubject(subject)
+	if normalized == "" || sender == "" {
+		return 0, sql.ErrNoRows
+	}
+
+	rows, err := db.Query(`
+		SELECT id, subject FROM tickets
+		WHERE lower(email) = $1 AND status <> 'closed' AND created_at > $2
+		ORDER BY created_at DESC
+	`, sender, time.Now().Add(-subjectThreadWindow))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var s string
+		if err := rows.Scan(&id, &s); err != nil {
+			return 0, err
+		}
+		if normalizeSubject(s) == normalized {
+			return id, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return 0, sql.ErrNoRows
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessageIDs(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", nil},
+		{"<a1@mail.example.com>", []string{"a1@mail.example.com"}},
+		{"<a1@x> <b2@y>\r\n\t<c3@z>", []string{"a1@x", "b2@y", "c3@z"}},
+		{"no brackets@x", nil},
+		{"<has space@x> <ok@y>", []string{"ok@y"}},
+	}
+	for _, tt := range tests {
+		if got := messageIDs(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestSubjectReference(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"Re: [STS-2024-00123] Printer on fire", "STS-2024-00123"},
+		{"[STS-12-2024-00123] Printer on fire", "STS-12-2024-00123"},
+		{"Printer on fire", ""},
+		{"STS-2024-00123 without brackets", ""},
+		{"[STS-2024-123] too short", ""},
+		{"[ABC-2024-00123] another prefix", ""},
+	}
+	for _, tt := range tests {
+		if got := subjectReference(tt.subject); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.subject, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"Printer on fire", "printer on fire"},
+		{"Re: Printer on fire", "printer on fire"},
+		{"RE: Fwd: re[2]:  Printer   on fire ", "printer on fire"},
+		{"AW: WG: Printer on fire", "printer on fire"},
+		{"Re: [STS-2024-00123] Printer on fire", "printer on fire"},
+		{"Printer on fire: re: again", "printer on fire: re: again"},
+		{"Re:", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeSubject(tt.subject); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.subject, got, tt.want)
+		}
+	}
+}
+
+// Without Postgres only the subject token threads, and only for the
+// requester and staff
+func TestThreadTicket(t *testing.T) {
+	user, ids := seedTickets(t, "threads@example.com", 1, 0)
+	ticket, err := store.Tickets().Find(user, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := "Re: [" + ticket.Reference + "] Ticket 1"
+
+	tests := []struct {
+		name    string
+		from    string
+		subject string
+		want    bool
+	}{
+		{"requester", "Threads <threads@example.com>", subject, true},
+		{"requester, other case", "THREADS@example.com", subject, true},
+		{"staff", "agent@demo.com", subject, true},
+		{"another client", "client@demo.com", subject, false},
+		{"stranger", "someone@elsewhere.com", subject, false},
+		{"unknown reference", "threads@example.com", "Re: [STS-1999-99999] Ticket 1", false},
+		{"no reference", "threads@example.com", "Re: Ticket 1", false},
+	}
+
+	t.Setenv("INBOUND_EMAIL", "true")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok, err := threadTicket(inboundEmail{From: tt.from, Subject: tt.subject})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.want || (ok && id != ticket.ID) {
+				t.Errorf("got ticket %d, %v, want %v", id, ok, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("INBOUND_EMAIL", "")
+	if _, ok, _ := threadTicket(inboundEmail{From: "threads@example.com", Subject: subject}); ok {
+		t.Error("threaded with inbound email disabled")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ticketExportColumns = []string{"id", "reference", "email", "subject", "description", "status", "channel",
+	"priority", "category", "org_id", "assigned_to", "closed_by", "created_at"}
+
+func ticketCSVRecord(t Ticket) []string {
+	orgID := ""
+	if t.OrgID != 0 {
+		orgID = strconv.Itoa(t.OrgID)
+	}
+	return []string{strconv.Itoa(t.ID), t.Reference, t.Email, t.Subject, t.Description, t.Status, t.Channel,
+		t.Priority, t.Category, orgID, t.AssignedTo, t.ClosedBy, t.CreatedAt.UTC().Format(time.RFC3339)}
+}
+
+// GET /reports/tickets?format=ndjson|csv[&status=][&from=YYYY-MM-DD][&to=YYYY-MM-DD]:
+// every ticket the caller can see, oldest first. Rows are streamed in
+// batches as they are read, so the export's size isn't bounded by memory.
+func handleTicketExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" {
+		http.Error(w, "Invalid format, expected ndjson or csv", http.StatusBadRequest)
+		return
+	}
+
+	var args []interface{}
+	where := ""
+	if status := query.Get("status"); status != "" {
+		if !validStatus(status) {
+			http.Error(w, "Invalid status", http.StatusBadRequest)
+			return
+		}
+		args = append(args, status)
+		where += fmt.Sprintf(" AND status = $%d", len(args))
+	}
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !from.IsZero() {
+		args = append(args, from)
+		where += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !to.IsZero() {
+		args = append(args, to)
+		where += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+	predicate, args := ticketAccessPredicate(user, args)
+
+	// The request context cancels the query if the client goes away
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(
+		"SELECT %s FROM tickets WHERE TRUE%s%s ORDER BY id", ticketColumns, where, predicate), args...)
+	if err != nil {
+		log.Printf("Error exporting tickets: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("tickets-%s.%s", time.Now().UTC().Format("2006-01-02"), format)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	sw := newStreamWriter(w)
+	enc := json.NewEncoder(sw)
+	cw := csv.NewWriter(sw)
+	if format == "csv" {
+		cw.Write(ticketExportColumns)
+	}
+
+	// Custom fields are looked up a batch at a time, then the batch is
+	// written and flushed before more rows are read
+	written := 0
+	batch := make([]Ticket, 0, streamFlushRows)
+	flush := func() error {
+		presentTickets(user, batch)
+		for _, t := range batch {
+			if format == "csv" {
+				cw.Write(ticketCSVRecord(t))
+			} else if err := enc.Encode(t); err != nil {
+				return err
+			}
+		}
+		written += len(batch)
+		batch = batch[:0]
+		if format == "csv" {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+		}
+		return sw.Flush()
+	}
+
+	for rows.Next() {
+		t, err := scanTicket(rows)
+		if err != nil {
+			log.Printf("Error reading ticket for export: %v", err)
+			continue
+		}
+		batch = append(batch, t)
+		if sw.Due(len(batch)) {
+			if err := flush(); err != nil {
+				// Headers are out; the client sees a truncated file
+				log.Printf("Ticket export stopped after %d rows: %v", written, err)
+				return
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Ticket export stopped after %d rows: %v", written, err)
+		if written == 0 {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := flush(); err != nil {
+		log.Printf("Ticket export stopped after %d rows: %v", written, err)
+	}
+}
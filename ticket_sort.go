@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Ticket lists take ?sort=key[,key...] with up to maxTicketSortKeys of
+// priority (most urgent first), created_at, updated_at (last change or
+// message) and sla_due (resolution deadline, soonest first, closed
+// tickets last). A leading "-" reverses a key. Each key's ascending order
+// has an index, so the leading key never needs a full sort.
+
+const maxTicketSortKeys = 3
+
+var ticketSortFields = []string{"priority", "created_at", "updated_at", "sla_due"}
+
+// Newest first, as lists have always been
+var defaultTicketSort = []TicketSort{{Field: "created_at", Desc: true}}
+
+// Parse the sort query parameter; empty gives defaultTicketSort
+func parseTicketSort(v string) ([]TicketSort, error) {
+	if v == "" {
+		return defaultTicketSort, nil
+	}
+	var keys []TicketSort
+	seen := map[string]bool{}
+	for _, part := range strings.Split(v, ",") {
+		key := TicketSort{Field: strings.TrimSpace(part)}
+		if strings.HasPrefix(key.Field, "-") {
+			key.Field, key.Desc = key.Field[1:], true
+		}
+		if !containsString(ticketSortFields, key.Field) {
+			return nil, fmt.Errorf("sort keys must be %s, optionally prefixed with -", strings.Join(ticketSortFields, ", "))
+		}
+		if seen[key.Field] {
+			return nil, fmt.Errorf("sort key %s given twice", key.Field)
+		}
+		seen[key.Field] = true
+		keys = append(keys, key)
+	}
+	if len(keys) > maxTicketSortKeys {
+		return nil, fmt.Errorf("at most %d sort keys", maxTicketSortKeys)
+	}
+	return keys, nil
+}
+
+// The full order for keys: ties on the keys fall back to newest first,
+// and finally to id in the direction of the last date key, so pages
+// don't shift between requests
+func ticketOrder(keys []TicketSort) []TicketSort {
+	order := append([]TicketSort{}, keys...)
+	idDesc, dated := true, false
+	for _, k := range keys {
+		if k.Field != "priority" {
+			idDesc, dated = k.Desc, true
+		}
+	}
+	if !dated {
+		order = append(order, TicketSort{Field: "created_at", Desc: true})
+	}
+	return append(order, TicketSort{Field: "id", Desc: idDesc})
+}
+
+// ORDER BY clause for a ticket list query
+func ticketOrderBy(keys []TicketSort) string {
+	var terms []string
+	for _, k := range ticketOrder(keys) {
+		dir := ""
+		if k.Desc {
+			dir = " DESC"
+		}
+		switch k.Field {
+		case "priority":
+			terms = append(terms, priorityOrder+dir)
+		case "sla_due":
+			terms = append(terms, "(status = 'closed')", "created_at"+dir)
+		default:
+			terms = append(terms, k.Field+dir)
+		}
+	}
+	return " ORDER BY " + strings.Join(terms, ", ")
+}
+
+// Sort tickets already in memory the way ticketOrderBy would
+func sortTickets(tickets []Ticket, keys []TicketSort) {
+	order := ticketOrder(keys)
+	sort.SliceStable(tickets, func(i, j int) bool {
+		a, b := tickets[i], tickets[j]
+		for _, k := range order {
+			var c int
+			switch k.Field {
+			case "priority":
+				c = priorityRank(a.Priority) - priorityRank(b.Priority)
+			case "sla_due":
+				if aClosed, bClosed := a.Status == "closed", b.Status == "closed"; aClosed != bClosed {
+					// Closed tickets are last either way
+					return bClosed
+				}
+				c = a.CreatedAt.Compare(b.CreatedAt)
+			case "created_at":
+				c = a.CreatedAt.Compare(b.CreatedAt)
+			case "updated_at":
+				c = a.UpdatedAt.Compare(b.UpdatedAt)
+			case "id":
+				c = a.ID - b.ID
+			}
+			if c != 0 {
+				return (c < 0) != k.Desc
+			}
+		}
+		return false
+	})
+}
+
+// Add updated_at to tickets, starting from each ticket's latest message,
+// and the indexes behind each sort key
+func migrateTicketSorting() {
+	_, err := db.Exec(`
+		ALTER TABLE tickets ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP;
+		UPDATE tickets t SET updated_at = GREATEST(t.created_at,
+			(SELECT MAX(m.created_at) FROM messages m WHERE m.ticket_id = t.id))
+		WHERE t.updated_at IS NULL;
+		ALTER TABLE tickets ALTER COLUMN updated_at SET DEFAULT CURRENT_TIMESTAMP,
+			ALTER COLUMN updated_at SET NOT NULL;
+		CREATE INDEX IF NOT EXISTS tickets_created_idx ON tickets (created_at, id);
+		CREATE INDEX IF NOT EXISTS tickets_updated_idx ON tickets (updated_at, id);
+		CREATE INDEX IF NOT EXISTS tickets_priority_order_idx ON tickets ((` + priorityOrder + `), created_at DESC, id DESC);
+		CREATE INDEX IF NOT EXISTS tickets_sla_due_idx ON tickets ((status = 'closed'), created_at, id)
+	`)
+	if err != nil {
+		log.Fatal("Failed to migrate ticket sorting:", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type TimeEntry struct {
+	ID         int       `json:"id"`
+	TicketID   int       `json:"ticket_id"`
+	AgentEmail string    `json:"agent_email"`
+	Minutes    int       `json:"minutes"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Create time entries table
+func createTimeEntriesTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS time_entries (
+			id SERIAL PRIMARY KEY,
+			ticket_id INTEGER REFERENCES tickets(id) ON DELETE CASCADE,
+			agent_email VARCHAR(255) NOT NULL,
+			minutes INTEGER NOT NULL CHECK (minutes > 0),
+			note TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS time_entries_agent_idx ON time_entries (agent_email, created_at)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create time_entries table:", err)
+	}
+}
+
+// GET/POST /tickets/{id}/time: list or log time spent on a ticket
+func handleTimeEntries(w http.ResponseWriter, r *http.Request, ticketID int) {
+	user := currentUser(r)
+	if !authorize(user, permTicketsReplyAll, nil) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	if _, err := findAccessibleTicket(r, ticketID); err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		rows, err := db.Query(`
+			SELECT id, ticket_id, agent_email, minutes, note, created_at 
+			FROM time_entries 
+			WHERE ticket_id = $1 
+			ORDER BY created_at ASC
+		`, ticketID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		entries := []TimeEntry{}
+		for rows.Next() {
+			var e TimeEntry
+			if err := rows.Scan(&e.ID, &e.TicketID, &e.AgentEmail, &e.Minutes, &e.Note, &e.CreatedAt); err != nil {
+				continue
+			}
+			entries = append(entries, e)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+
+	case "POST":
+		var e TimeEntry
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if e.Minutes <= 0 {
+			http.Error(w, "Minutes must be positive", http.StatusBadRequest)
+			return
+		}
+
+		e.TicketID = ticketID
+		e.AgentEmail = user.Email
+		err := db.QueryRow(`
+			INSERT INTO time_entries (ticket_id, agent_email, minutes, note) 
+			VALUES ($1, $2, $3, $4) 
+			RETURNING id, created_at
+		`, e.TicketID, e.AgentEmail, e.Minutes, e.Note).Scan(&e.ID, &e.CreatedAt)
+		if err != nil {
+			http.Error(w, "Failed to log time", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Billable usage for one organization in one month. Storage and seats
+// are the highest values sampled during the month.
+type UsageRecord struct {
+	OrgID          int    `json:"org_id"`
+	Organization   string `json:"organization"`
+	Domain         string `json:"domain"`
+	Month          string `json:"month"`
+	TicketsCreated int64  `json:"tickets_created"`
+	StorageBytes   int64  `json:"storage_bytes"`
+	AgentSeats     int64  `json:"agent_seats"`
+}
+
+// Create usage metering tables
+func createUsageTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS usage_records (
+			org_id INTEGER NOT NULL REFERENCES organizations(id),
+			month DATE NOT NULL,
+			tickets_created BIGINT NOT NULL DEFAULT 0,
+			storage_bytes BIGINT NOT NULL DEFAULT 0,
+			agent_seats BIGINT NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (org_id, month)
+		);
+		CREATE TABLE IF NOT EXISTS usage_exports (
+			month DATE PRIMARY KEY,
+			exported_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatal("Failed to create usage tables:", err)
+	}
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Sample every organization's usage for month. Tickets are counted
+// exactly, including archived ones; storage and seats keep their peak.
+// Seats are agents scoped to the organization; global agents aren't
+// attributed to any tenant.
+func meterUsage(month time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO usage_records (org_id, month, tickets_created, storage_bytes, agent_seats)
+		SELECT o.id, $1::date,
+			(SELECT COUNT(*) FROM (
+				SELECT id FROM tickets WHERE org_id = o.id AND created_at >= $1 AND created_at < $2
+				UNION ALL
+				SELECT id FROM archived_tickets WHERE org_id = o.id AND created_at >= $1 AND created_at < $2
+			) t),
+			(SELECT COALESCE(SUM(a.size_bytes), 0) FROM (
+				SELECT uploaded_by, size_bytes FROM attachments
+				UNION ALL
+				SELECT uploaded_by, size_bytes FROM archived_attachments
+			) a WHERE lower(split_part(a.uploaded_by, '@', 2)) = o.domain),
+			(SELECT COUNT(*) FROM agent_scopes s WHERE o.id = ANY(s.org_ids))
+		FROM organizations o
+		ON CONFLICT (org_id, month) DO UPDATE SET
+			tickets_created = EXCLUDED.tickets_created,
+			storage_bytes = GREATEST(usage_records.storage_bytes, EXCLUDED.storage_bytes),
+			agent_seats = GREATEST(usage_records.agent_seats, EXCLUDED.agent_seats),
+			updated_at = CURRENT_TIMESTAMP
+	`, month, month.AddDate(0, 1, 0))
+	return err
+}
+
+// Scheduled job: sample the current month; on the first run of a month
+// finalize the previous one and export it
+func recordUsage() error {
+	now := time.Now().UTC()
+	current := monthStart(now)
+	previous := current.AddDate(0, -1, 0)
+
+	var exported bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM usage_exports WHERE month = $1)", previous).Scan(&exported); err != nil {
+		return err
+	}
+	if !exported {
+		// Only the ticket count changes; storage and seats were sampled
+		// while the month was current
+		if err := meterUsage(previous); err != nil {
+			return fmt.Errorf("finalize %s: %w", previous.Format("2006-01"), err)
+		}
+		if err := exportUsage(previous); err != nil {
+			return fmt.Errorf("export %s: %w", previous.Format("2006-01"), err)
+		}
+	}
+
+	return meterUsage(current)
+}
+
+// Write a month's usage CSV to the export location, if configured
+func exportUsage(month time.Time) error {
+	bucket, prefix, ok := exportDestination()
+	if !ok {
+		return nil
+	}
+
+	records, err := usageRecords(month)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := writeUsageCSV(&buf, records); err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s/usage/month=%s/usage.csv", prefix, month.Format("2006-01"))
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("text/csv; charset=utf-8"),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("✓ Exported usage for %d organizations to s3://%s/%s", len(records), bucket, key)
+
+	_, err = db.Exec("INSERT INTO usage_exports (month) VALUES ($1) ON CONFLICT DO NOTHING", month)
+	return err
+}
+
+// Recorded usage for month, by organization name
+func usageRecords(month time.Time) ([]UsageRecord, error) {
+	rows, err := db.Query(`
+		SELECT o.id, o.name, o.domain, u.tickets_created, u.storage_bytes, u.agent_seats
+		FROM usage_records u JOIN organizations o ON o.id = u.org_id
+		WHERE u.month = $1
+		ORDER BY o.name
+	`, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []UsageRecord{}
+	for rows.Next() {
+		rec := UsageRecord{Month: month.Format("2006-01")}
+		if err := rows.Scan(&rec.OrgID, &rec.Organization, &rec.Domain,
+			&rec.TicketsCreated, &rec.StorageBytes, &rec.AgentSeats); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func writeUsageCSV(w io.Writer, records []UsageRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"month", "org_id", "organization", "domain", "tickets_created", "storage_bytes", "agent_seats"})
+	for _, rec := range records {
+		cw.Write([]string{rec.Month, strconv.Itoa(rec.OrgID), rec.Organization, rec.Domain,
+			strconv.FormatInt(rec.TicketsCreated, 10), strconv.FormatInt(rec.StorageBytes, 10),
+			strconv.FormatInt(rec.AgentSeats, 10)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// GET /admin/usage?month=YYYY-MM[&format=csv]
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	current := monthStart(time.Now())
+	month := current
+	if m := r.URL.Query().Get("month"); m != "" {
+		parsed, err := time.Parse("2006-01", m)
+		if err != nil {
+			http.Error(w, "Invalid month, expected YYYY-MM", http.StatusBadRequest)
+			return
+		}
+		month = parsed
+	}
+	if month.After(current) {
+		http.Error(w, "Month is in the future", http.StatusBadRequest)
+		return
+	}
+
+	// The current month is sampled now so the numbers are live
+	if month.Equal(current) {
+		if err := meterUsage(month); err != nil {
+			log.Printf("Error metering usage: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	records, err := usageRecords(month)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s.csv"`, month.Format("2006-01")))
+		writeUsageCSV(w, records)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Compact queue summary for TV dashboards
+type Wallboard struct {
+	Open              int       `json:"open"`
+	OldestWaitingSecs int64     `json:"oldest_waiting_seconds"`
+	OldestWaitingRef  string    `json:"oldest_waiting_reference,omitempty"`
+	SLABreaches       int       `json:"sla_breaches"`
+	AgentsOnline      int       `json:"agents_online"`
+	ClosedToday       int       `json:"closed_today"`
+	GeneratedAt       time.Time `json:"generated_at"`
+	RefreshAfterSecs  int       `json:"refresh_after_seconds"`
+}
+
+// Agents count as online if their session was used this recently
+const wallboardOnlineWindow = 15 * time.Minute
+
+// Many screens poll the same numbers, so results are cached briefly
+// (WALLBOARD_CACHE_SECONDS, default 30)
+func wallboardCacheTTL() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("WALLBOARD_CACHE_SECONDS")); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 30 * time.Second
+}
+
+var wallboardCache = struct {
+	sync.Mutex
+	board *Wallboard
+}{}
+
+// GET /reports/wallboard. Dashboards without a login can pass the
+// WALLBOARD_API_KEY as X-API-Key or ?key=; otherwise reports.view is
+// required. Figures cover the whole queue regardless of agent scope.
+func handleWallboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if wallboardKeyValid(r) {
+		serveWallboard(w, r)
+		return
+	}
+
+	authenticate(func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(currentUser(r), permReportsView, nil) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		serveWallboard(w, r)
+	})(w, r)
+}
+
+func wallboardKeyValid(r *http.Request) bool {
+	want := os.Getenv("WALLBOARD_API_KEY")
+	if want == "" {
+		return false
+	}
+	got := r.Header.Get("X-API-Key")
+	if got == "" {
+		got = r.URL.Query().Get("key")
+	}
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func serveWallboard(w http.ResponseWriter, r *http.Request) {
+	ttl := wallboardCacheTTL()
+
+	wallboardCache.Lock()
+	board := wallboardCache.board
+	if board == nil || time.Since(board.GeneratedAt) > ttl {
+		fresh, err := buildWallboard()
+		if err != nil {
+			wallboardCache.Unlock()
+			log.Printf("Error building wallboard: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		fresh.RefreshAfterSecs = int(ttl.Seconds())
+		wallboardCache.board = fresh
+		board = fresh
+	}
+	wallboardCache.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl.Seconds())))
+	json.NewEncoder(w).Encode(board)
+}
+
+func buildWallboard() (*Wallboard, error) {
+	b := &Wallboard{GeneratedAt: time.Now().UTC()}
+
+	// A ticket is waiting while its latest message is from the requester
+	var oldestRef *string
+	var oldestSecs *float64
+	err := db.QueryRow(`
+		WITH open_tickets AS (
+			SELECT t.id, t.reference, t.email, t.created_at, 
+				(SELECT m.sender_email FROM messages m WHERE m.ticket_id = t.id ORDER BY m.created_at DESC, m.id DESC LIMIT 1) AS last_sender, 
+				(SELECT MAX(m.created_at) FROM messages m WHERE m.ticket_id = t.id) AS last_at, 
+				EXISTS (SELECT 1 FROM messages m WHERE m.ticket_id = t.id AND m.sender_email <> t.email AND NOT m.is_description) AS responded 
+			FROM tickets t WHERE t.status <> 'closed'
+		), waiting AS (
+			SELECT reference, last_at FROM open_tickets 
+			WHERE last_sender = email ORDER BY last_at LIMIT 1
+		)
+		SELECT 
+			(SELECT COUNT(*) FROM open_tickets), 
+			(SELECT COUNT(*) FROM open_tickets 
+				WHERE (NOT responded AND created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second') 
+					OR created_at < CURRENT_TIMESTAMP - $2 * INTERVAL '1 second'), 
+			(SELECT reference FROM waiting), 
+			(SELECT EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - last_at) FROM waiting), 
+			(SELECT COUNT(*) FROM tickets WHERE closed_at >= date_trunc('day', CURRENT_TIMESTAMP))
+	`, slaFirstResponseTarget().Seconds(), slaResolutionTarget().Seconds()).
+		Scan(&b.Open, &b.SLABreaches, &oldestRef, &oldestSecs, &b.ClosedToday)
+	if err != nil {
+		return nil, err
+	}
+	if oldestRef != nil {
+		b.OldestWaitingRef = *oldestRef
+	}
+	if oldestSecs != nil {
+		b.OldestWaitingSecs = int64(*oldestSecs)
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT u.id, u.user_type 
+		FROM sessions s JOIN users u ON u.id = s.user_id 
+		WHERE s.revoked_at IS NULL AND s.last_used_at > CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+	`, wallboardOnlineWindow.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var role string
+		if rows.Scan(&id, &role) == nil && rolePermissions(role)[permTicketsReplyAll] {
+			b.AgentsOnline++
+		}
+	}
+
+	return b, rows.Err()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Writes that nobody waits on (audit events, in-app notifications, read
+// markers) are retried in the background when the database is briefly
+// unreachable, rather than failing the request that made them. The queue
+// is bounded (WRITE_QUEUE_SIZE, 1000 by default); once it's full, or a
+// write has waited longer than writeQueueMaxAge, writes are dropped and
+// logged. Queued writes carry their own timestamps, so they record when
+// something happened rather than when the database came back.
+
+const (
+	defaultWriteQueueSize = 1000
+	writeQueueMaxAge      = 10 * time.Minute
+	writeRetryMax         = 30 * time.Second
+)
+
+type queuedWrite struct {
+	what     string
+	query    string
+	args     []interface{}
+	queuedAt time.Time
+}
+
+var writeQueue struct {
+	once sync.Once
+	ch   chan queuedWrite
+	// Queued and not yet applied, including the one being retried
+	pending atomic.Int64
+	dropped atomic.Int64
+}
+
+func writeQueueSize() int {
+	if n, err := strconv.Atoi(os.Getenv("WRITE_QUEUE_SIZE")); err == nil && n > 0 {
+		return n
+	}
+	return defaultWriteQueueSize
+}
+
+// Whether err means the database couldn't be reached, as opposed to
+// rejecting the write
+func isTransientDBError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "57P01", "57P02", "57P03", "53300": // shutting down, starting up, too many connections
+			return true
+		}
+		return pqErr.Code.Class() == "08" // connection exception
+	}
+	return false
+}
+
+// Run a non-critical write now, or queue it if the database is down.
+// Writes already waiting go first, so later writes (a read marker) don't
+// overtake earlier ones (the notification it marks). Returns whether the
+// write was queued; err is only set if it failed for good.
+func execOrQueue(what, query string, args ...interface{}) (queued bool, err error) {
+	if writeQueue.pending.Load() == 0 {
+		_, err := db.Exec(query, args...)
+		if err == nil || !isTransientDBError(err) {
+			return false, err
+		}
+	}
+	if err := queueWrite(what, query, args...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+var errWriteQueueFull = errors.New("write queue full")
+
+// Queue a write for the background writer without trying it first
+func queueWrite(what, query string, args ...interface{}) error {
+	writeQueue.once.Do(func() {
+		writeQueue.ch = make(chan queuedWrite, writeQueueSize())
+		go drainWriteQueue()
+	})
+
+	writeQueue.pending.Add(1)
+	select {
+	case writeQueue.ch <- queuedWrite{what: what, query: query, args: args, queuedAt: time.Now()}:
+		dbLog.Debugf("Queued %s, %d writes pending", what, writeQueue.pending.Load())
+		return nil
+	default:
+		writeQueue.pending.Add(-1)
+		writeQueue.dropped.Add(1)
+		dbLog.Errorf("Write queue full, dropped %s", what)
+		return errWriteQueueFull
+	}
+}
+
+// Apply queued writes in order, backing off while the database is down
+func drainWriteQueue() {
+	backoff := time.Second
+	for w := range writeQueue.ch {
+		applyQueuedWrite(w, &backoff)
+		writeQueue.pending.Add(-1)
+	}
+}
+
+func applyQueuedWrite(w queuedWrite, backoff *time.Duration) {
+	for {
+		if time.Since(w.queuedAt) > writeQueueMaxAge {
+			writeQueue.dropped.Add(1)
+			dbLog.Errorf("Dropped %s queued %s ago", w.what, time.Since(w.queuedAt).Round(time.Second))
+			return
+		}
+		_, err := db.Exec(w.query, w.args...)
+		if err == nil {
+			if *backoff > time.Second {
+				dbLog.Printf("✓ Database reachable again, %d queued writes left", len(writeQueue.ch))
+			}
+			*backoff = time.Second
+			return
+		}
+		if !isTransientDBError(err) {
+			dbLog.Errorf("Failed to apply queued %s: %v", w.what, err)
+			return
+		}
+		dbLog.Debugf("Database unavailable for queued %s, retrying in %s: %v", w.what, *backoff, err)
+		time.Sleep(*backoff)
+		*backoff = min(*backoff*2, writeRetryMax)
+	}
+}
+
+// Queue depth and drops, for the health check
+func writeQueueStats() (pending, dropped int64) {
+	return writeQueue.pending.Load(), writeQueue.dropped.Load()
+}